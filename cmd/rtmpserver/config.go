@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"playground/pkg/rtmp"
+)
+
+// duration is a time.Duration read from json string like "10s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+type gopCacheConfig struct {
+	Num        int `json:"num"`
+	MaxPackets int `json:"max_packets"`
+	MaxBytes   int `json:"max_bytes"`
+}
+
+type hooksConfig struct {
+	OnConnect   []string `json:"on_connect"`
+	OnClose     []string `json:"on_close"`
+	OnPublish   []string `json:"on_publish"`
+	OnUnpublish []string `json:"on_unpublish"`
+	OnPlay      []string `json:"on_play"`
+	OnStop      []string `json:"on_stop"`
+	OnDvr       []string `json:"on_dvr"`
+	Timeout     duration `json:"timeout"`
+	FailOpen    bool     `json:"fail_open"`
+}
+
+type authConfig struct {
+	Secrets         map[string]string `json:"secrets"` // by "vhost/app", "vhost/*" or "*"
+	ReplayCacheSize int               `json:"replay_cache_size"`
+}
+
+type forwardConfig struct {
+	Rules      map[string][]string `json:"rules"` // target url templates by "vhost/app", "vhost/*" or "*"
+	MinBackoff duration            `json:"min_backoff"`
+	MaxBackoff duration            `json:"max_backoff"`
+}
+
+type edgeConfig struct {
+	Origins     []string `json:"origins"` // "host[:port]" of origins
+	IdleTimeout duration `json:"idle_timeout"`
+}
+
+type httpConfig struct {
+	Listen      string `json:"listen"` // http playback address, empty disables
+	AllowOrigin string `json:"allow_origin"`
+}
+
+type tlsConfig struct {
+	Listen   string                   `json:"listen"` // rtmps address, empty disables
+	CertFile string                   `json:"cert_file"`
+	KeyFile  string                   `json:"key_file"`
+	Certs    map[string]tlsCertConfig `json:"certs"` // by server name, "*.example.com" matches subdomains
+}
+
+type tlsCertConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+type hlsConfig struct {
+	SegmentDuration duration `json:"segment_duration"`
+	Window          int      `json:"window"` // segments in the playlist
+	Dir             string   `json:"dir"`    // empty keeps segments in memory
+}
+
+type llhlsConfig struct {
+	PartDuration    duration `json:"part_duration"`
+	SegmentDuration duration `json:"segment_duration"`
+	Window          int      `json:"window"`
+}
+
+type dashConfig struct {
+	SegmentDuration duration `json:"segment_duration"`
+	Window          int      `json:"window"` // segments in the manifest
+}
+
+type dvrConfig struct {
+	Rules    map[string]string `json:"rules"` // path template by "vhost/app", "vhost/*" or "*"
+	Dir      string            `json:"dir"`
+	Duration duration          `json:"duration"`
+	Size     int64             `json:"size"`
+}
+
+type aggregateConfig struct {
+	MaxMessages int      `json:"max_messages"`
+	MaxBytes    int      `json:"max_bytes"`
+	MaxDelay    duration `json:"max_delay"`
+}
+
+// serverConfig is the json config file of rtmpserver, zero value means default
+type serverConfig struct {
+	Listen          string   `json:"listen"`
+	APIListen       string   `json:"api_listen"`       // admin api address, empty disables
+	ShutdownTimeout duration `json:"shutdown_timeout"` // graceful shutdown deadline on SIGINT/SIGTERM
+
+	ChunkSize           uint32         `json:"chunk_size"`
+	WindowAckSize       uint32         `json:"window_ack_size"`
+	PeerBandwidth       uint32         `json:"peer_bandwidth"`
+	SubscriberQueueSize int            `json:"subscriber_queue_size"`
+	GopCache            gopCacheConfig `json:"gop_cache"`
+	HandshakeTimeout    duration       `json:"handshake_timeout"`
+	IdleTimeout         duration       `json:"idle_timeout"`
+	PingInterval        duration       `json:"ping_interval"`
+	MaxConns            int            `json:"max_conns"`
+
+	Hooks   *hooksConfig   `json:"hooks"`
+	Auth    *authConfig    `json:"auth"`
+	Forward *forwardConfig `json:"forward"`
+	Edge    *edgeConfig    `json:"edge"`
+	HTTP    *httpConfig    `json:"http"`
+	TLS     *tlsConfig     `json:"tls"`
+	HLS     *hlsConfig     `json:"hls"`
+	LLHLS   *llhlsConfig   `json:"llhls"`
+	DASH    *dashConfig    `json:"dash"`
+	DVR     *dvrConfig     `json:"dvr"`
+
+	Aggregate *aggregateConfig `json:"aggregate"`
+}
+
+func loadConfig(path string) (*serverConfig, error) {
+	cfg := &serverConfig{Listen: ":1935", ShutdownTimeout: duration(10 * time.Second)}
+	if path == "" {
+		return cfg, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *serverConfig) httpListen() string {
+	if cfg.HTTP == nil {
+		return ""
+	}
+	return cfg.HTTP.Listen
+}
+
+func (cfg *serverConfig) tlsListen() string {
+	if cfg.TLS == nil {
+		return ""
+	}
+	return cfg.TLS.Listen
+}
+
+func (cfg *serverConfig) rtmpConfig() *rtmp.Config {
+	config := &rtmp.Config{
+		ChunkSize:           cfg.ChunkSize,
+		WindowAckSize:       cfg.WindowAckSize,
+		PeerBandwidth:       cfg.PeerBandwidth,
+		SubscriberQueueSize: cfg.SubscriberQueueSize,
+		GopCacheNum:         cfg.GopCache.Num,
+		GopCacheMaxPackets:  cfg.GopCache.MaxPackets,
+		GopCacheMaxBytes:    cfg.GopCache.MaxBytes,
+		HandshakeTimeout:    time.Duration(cfg.HandshakeTimeout),
+		IdleTimeout:         time.Duration(cfg.IdleTimeout),
+		PingInterval:        time.Duration(cfg.PingInterval),
+		MaxConns:            cfg.MaxConns,
+	}
+
+	if h := cfg.Hooks; h != nil {
+		config.Hooks = &rtmp.HookConfig{
+			OnConnect:   h.OnConnect,
+			OnClose:     h.OnClose,
+			OnPublish:   h.OnPublish,
+			OnUnpublish: h.OnUnpublish,
+			OnPlay:      h.OnPlay,
+			OnStop:      h.OnStop,
+			OnDvr:       h.OnDvr,
+			Timeout:     time.Duration(h.Timeout),
+			FailOpen:    h.FailOpen,
+		}
+	}
+
+	if a := cfg.Auth; a != nil {
+		config.Auth = &rtmp.AuthConfig{
+			Secrets:         a.Secrets,
+			ReplayCacheSize: a.ReplayCacheSize,
+		}
+	}
+
+	if f := cfg.Forward; f != nil {
+		config.Forward = &rtmp.ForwardConfig{
+			Rules:      f.Rules,
+			MinBackoff: time.Duration(f.MinBackoff),
+			MaxBackoff: time.Duration(f.MaxBackoff),
+		}
+	}
+
+	if e := cfg.Edge; e != nil {
+		config.Edge = &rtmp.EdgeConfig{
+			Origins:     e.Origins,
+			IdleTimeout: time.Duration(e.IdleTimeout),
+		}
+	}
+
+	if h := cfg.HTTP; h != nil {
+		config.HTTP = &rtmp.HTTPConfig{
+			AllowOrigin: h.AllowOrigin,
+		}
+	}
+
+	if t := cfg.TLS; t != nil {
+		config.TLS = &rtmp.TLSConfig{
+			CertFile: t.CertFile,
+			KeyFile:  t.KeyFile,
+			Certs:    make(map[string]rtmp.TLSCert, len(t.Certs)),
+		}
+		for name, cert := range t.Certs {
+			config.TLS.Certs[name] = rtmp.TLSCert{CertFile: cert.CertFile, KeyFile: cert.KeyFile}
+		}
+	}
+
+	if h := cfg.HLS; h != nil {
+		config.HLS = &rtmp.HLSConfig{
+			SegmentDuration: time.Duration(h.SegmentDuration),
+			Window:          h.Window,
+			Dir:             h.Dir,
+		}
+	}
+
+	if l := cfg.LLHLS; l != nil {
+		config.LLHLS = &rtmp.LLHLSConfig{
+			PartDuration:    time.Duration(l.PartDuration),
+			SegmentDuration: time.Duration(l.SegmentDuration),
+			Window:          l.Window,
+		}
+	}
+
+	if d := cfg.DASH; d != nil {
+		config.DASH = &rtmp.DASHConfig{
+			SegmentDuration: time.Duration(d.SegmentDuration),
+			Window:          d.Window,
+		}
+	}
+
+	if d := cfg.DVR; d != nil {
+		config.DVR = &rtmp.DVRConfig{
+			Rules:    d.Rules,
+			Dir:      d.Dir,
+			Duration: time.Duration(d.Duration),
+			Size:     d.Size,
+		}
+	}
+
+	if a := cfg.Aggregate; a != nil {
+		config.Aggregate = &rtmp.AggregateConfig{
+			MaxMessages: a.MaxMessages,
+			MaxBytes:    a.MaxBytes,
+			MaxDelay:    time.Duration(a.MaxDelay),
+		}
+	}
+
+	return config
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,7 +18,52 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func initLogger(config *rtmp.Config) (*logrus.Logger, error) {
+var (
+	configFile = flag.String("c", "", "json config file, reloaded on SIGHUP")
+	loopFiles  = flag.Bool("loop", false, "loop the files of -file")
+	files      fileFlags
+)
+
+func init() {
+	flag.Var(&files, "file", "publish a flv file as a live stream, 'path=app/stream', repeatable")
+}
+
+// fileFlags are flv files to publish, path=app/stream
+type fileFlags []string
+
+func (ff *fileFlags) String() string {
+	return strings.Join(*ff, ",")
+}
+
+func (ff *fileFlags) Set(v string) error {
+	i := strings.LastIndex(v, "=")
+	if i <= 0 || !strings.Contains(v[i+1:], "/") {
+		return errors.New("want path=app/stream")
+	}
+	*ff = append(*ff, v)
+	return nil
+}
+
+// publishFiles publishes the files of -file to the server
+func publishFiles(srv *rtmp.Server, logger *logrus.Logger) {
+	for _, v := range files {
+		i := strings.LastIndex(v, "=")
+		path, key := v[:i], v[i+1:]
+		j := strings.LastIndex(key, "/")
+
+		fs, err := srv.PublishFile(path, "", key[:j], key[j+1:], *loopFiles)
+		if err != nil {
+			logger.WithField("event", "publish file").Fatal(err)
+		}
+		go func() {
+			if err := fs.Err(); err != nil && err != rtmp.ErrServerClosed {
+				logger.WithFields(logrus.Fields{"event": "publish file", "file": path}).Error(err)
+			}
+		}()
+	}
+}
+
+func initLogger() (*logrus.Logger, error) {
 	return (&logging.LogConfig{
 		LogPath:         "logs/error.log",
 		RotationTime:    24 * time.Hour,
@@ -27,25 +76,90 @@ func initLogger(config *rtmp.Config) (*logrus.Logger, error) {
 }
 
 func main() {
+	flag.Parse()
+
 	go func() {
 		_ = http.ListenAndServe(":6060", nil) //pprof
 	}()
 
-	go func() {
-		config := &rtmp.Config{} //TODO
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
-		logger, err := initLogger(config)
-		if err != nil {
-			panic(err)
-		}
-		config.Logger = logger
+	config := cfg.rtmpConfig()
+	logger, err := initLogger()
+	if err != nil {
+		panic(err)
+	}
+	config.Logger = logger
 
-		if err := rtmp.ListenAndServe("tcp", ":1935", config); err != nil {
-			logrus.Fatal(err)
+	srv := rtmp.NewServer(cfg.Listen, config)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != rtmp.ErrServerClosed {
+			logger.Fatal(err)
 		}
 	}()
 
+	publishFiles(srv, logger)
+
+	if addr := cfg.httpListen(); addr != "" {
+		go func() {
+			if err := srv.ListenAndServeHTTP(addr); err != nil && err != rtmp.ErrServerClosed {
+				logger.Fatal(err)
+			}
+		}()
+	}
+
+	if addr := cfg.APIListen; addr != "" {
+		go func() {
+			if err := srv.ListenAndServeAPI(addr); err != nil && err != rtmp.ErrServerClosed {
+				logger.Fatal(err)
+			}
+		}()
+	}
+
+	if addr := cfg.tlsListen(); addr != "" {
+		go func() {
+			if err := srv.ListenAndServeTLS(addr); err != nil && err != rtmp.ErrServerClosed {
+				logger.Fatal(err)
+			}
+		}()
+	}
+
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	<-ch
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.WithField("event", "shutdown").Error(err)
+			}
+			cancel()
+			return
+		}
+
+		newCfg, err := loadConfig(*configFile)
+		if err != nil {
+			logger.WithField("event", "reload config").Error(err)
+			continue
+		}
+		if newCfg.Listen != cfg.Listen {
+			logger.WithField("event", "reload config").Warnf("listen address change to '%s' needs restart", newCfg.Listen)
+		}
+		if newCfg.httpListen() != cfg.httpListen() {
+			logger.WithField("event", "reload config").Warnf("http listen address change to '%s' needs restart", newCfg.httpListen())
+		}
+		if newCfg.APIListen != cfg.APIListen {
+			logger.WithField("event", "reload config").Warnf("api listen address change to '%s' needs restart", newCfg.APIListen)
+		}
+		if newCfg.tlsListen() != cfg.tlsListen() {
+			logger.WithField("event", "reload config").Warnf("rtmps listen address change to '%s' needs restart", newCfg.tlsListen())
+		}
+
+		config := newCfg.rtmpConfig()
+		config.Logger = logger
+		srv.SetConfig(config) // applies to new connections
+		logger.WithField("event", "reload config").Info("success")
+	}
 }
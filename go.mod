@@ -9,7 +9,6 @@ require (
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/google/uuid v1.1.4
 	github.com/google/vectorio v0.0.0-20160107201919-f555dd215279
-	github.com/gwuhaolin/livego v0.0.0-20210119152854-12948dfb6782
 	github.com/lestrrat-go/file-rotatelogs v2.4.0+incompatible
 	github.com/lestrrat-go/strftime v1.0.4 // indirect
 	github.com/nats-io/nats.go v1.9.1
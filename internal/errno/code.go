@@ -17,5 +17,9 @@ var (
 	ErrUserPhone   = NewError(2010001, "用户手机号不合法")
 	ErrUserCaptcha = NewError(2010002, "用户验证码有误")
 
+	// 模块级错误码 - 直播模块(02)
+	ErrStreamNotFound = NewError(2020001, "流不存在")
+	ErrClientNotFound = NewError(2020002, "客户端不存在")
+
 	//...
 )
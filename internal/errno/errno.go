@@ -5,10 +5,10 @@ import "encoding/json"
 var _ Error = (*err)(nil)
 
 type Error interface {
-	// 设置成功时返回的数据
+	// 设置成功时返回的数据，返回副本，不修改包级错误码
 	WithData(data interface{}) Error
 
-	// 设置当前请求的唯一ID
+	// 设置当前请求的唯一ID，返回副本
 	WithID(id string) Error
 
 	// 返回JSON格式的错误详情
@@ -33,13 +33,15 @@ func NewError(errno int, errmsg string) Error {
 }
 
 func (e *err) WithData(data interface{}) Error {
-	e.Data = data
-	return e
+	ne := *e
+	ne.Data = data
+	return &ne
 }
 
 func (e *err) WithID(id string) Error {
-	e.ID = id
-	return e
+	ne := *e
+	ne.ID = id
+	return &ne
 }
 
 func (e *err) String() string {
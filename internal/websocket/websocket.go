@@ -0,0 +1,321 @@
+// Package websocket is a minimal server side implementation of RFC 6455,
+// enough for pushing binary messages to browsers.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// message types, the frame opcodes
+const (
+	ContinuationMessage = 0
+	TextMessage         = 1
+	BinaryMessage       = 2
+	CloseMessage        = 8
+	PingMessage         = 9
+	PongMessage         = 10
+)
+
+// close codes
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseMessageTooBig    = 1009
+	CloseNoStatusReceived = 1005
+)
+
+const (
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	maxControlPayload = 125
+	maxMessageSize    = 64 << 10 // max size of messages read
+)
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrTooLarge     = errors.New("websocket: message too large")
+)
+
+// CloseError is returned by ReadMessage once the peer sends a close frame
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+// IsUpgrade reports whether r asks for a websocket upgrade
+func IsUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// Conn is a server side websocket connection. One goroutine may read while others write,
+// writes are serialized.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// Upgrade hijacks the connection of r and finishes the opening handshake
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet || !IsUpgrade(r) || r.Header.Get("Sec-Websocket-Version") != "13" {
+		http.Error(w, "websocket: bad request", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "websocket: no key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket: hijack unsupported", http.StatusInternalServerError)
+		return nil, ErrBadHandshake
+	}
+
+	// headers set by the handler before, e.g. CORS, are kept
+	var sb strings.Builder
+	sb.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	sb.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n")
+	for k, vs := range w.Header() {
+		for _, v := range vs {
+			sb.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	sb.WriteString("\r\n")
+
+	netConn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := netConn.Write([]byte(sb.String())); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: netConn, br: brw.Reader}, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// WriteMessage writes data as one unfragmented frame, nothing is written after a close frame
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if isControl(messageType) && len(data) > maxControlPayload {
+		return errors.New("websocket: control frame too large")
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return errors.New("websocket: close sent")
+	}
+	if messageType == CloseMessage {
+		c.closeSent = true
+	}
+
+	return writeFrame(c.conn, messageType, data)
+}
+
+// WriteClose sends a close frame with code and text
+func (c *Conn) WriteClose(code int, text string) error {
+	return c.WriteMessage(CloseMessage, FormatCloseMessage(code, text))
+}
+
+// FormatCloseMessage returns the payload of a close frame
+func FormatCloseMessage(code int, text string) []byte {
+	if code == CloseNoStatusReceived {
+		return []byte{}
+	}
+	b := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	copy(b[2:], text)
+	return b
+}
+
+// ReadMessage reads the next data, ping or pong message. Pings are answered with pongs,
+// a close frame is answered and returned as *CloseError.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	fin, opcode, payload, err := c.readFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	switch opcode {
+	case PingMessage:
+		if err := c.WriteMessage(PongMessage, payload); err != nil {
+			return 0, nil, err
+		}
+		return opcode, payload, nil
+	case PongMessage:
+		return opcode, payload, nil
+	case CloseMessage:
+		ce := &CloseError{Code: CloseNoStatusReceived}
+		if len(payload) >= 2 {
+			ce.Code = int(binary.BigEndian.Uint16(payload))
+			ce.Text = string(payload[2:])
+		}
+		_ = c.WriteMessage(CloseMessage, FormatCloseMessage(ce.Code, ""))
+		return 0, nil, ce
+	case TextMessage, BinaryMessage:
+	default:
+		_ = c.WriteClose(CloseProtocolError, "")
+		return 0, nil, fmt.Errorf("websocket: unexpected opcode %d", opcode)
+	}
+
+	// a fragmented message ends with a fin continuation frame
+	for !fin {
+		var op int
+		var more []byte
+		if fin, op, more, err = c.readFrame(); err != nil {
+			return 0, nil, err
+		}
+		if op != ContinuationMessage {
+			_ = c.WriteClose(CloseProtocolError, "")
+			return 0, nil, fmt.Errorf("websocket: unexpected opcode %d in fragmented message", op)
+		}
+		if len(payload)+len(more) > maxMessageSize {
+			_ = c.WriteClose(CloseMessageTooBig, "")
+			return 0, nil, ErrTooLarge
+		}
+		payload = append(payload, more...)
+	}
+
+	return opcode, payload, nil
+}
+
+func (c *Conn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.br, h[:]); err != nil {
+		return
+	}
+
+	fin = h[0]&0x80 != 0
+	opcode = int(h[0] & 0x0f)
+	masked := h[1]&0x80 != 0
+	size := uint64(h[1] & 0x7f)
+
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	}
+
+	if isControl(opcode) && (size > maxControlPayload || !fin) {
+		err = errors.New("websocket: invalid control frame")
+		return
+	}
+	if size > maxMessageSize {
+		_ = c.WriteClose(CloseMessageTooBig, "")
+		err = ErrTooLarge
+		return
+	}
+	if !masked { // client frames must be masked
+		_ = c.WriteClose(CloseProtocolError, "")
+		err = errors.New("websocket: unmasked client frame")
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return
+}
+
+// writeFrame writes an unmasked frame as server
+func writeFrame(w io.Writer, opcode int, data []byte) error {
+	h := make([]byte, 2, 10)
+	h[0] = 0x80 | byte(opcode) // fin
+
+	n := len(data)
+	switch {
+	case n < 126:
+		h[1] = byte(n)
+	case n <= 0xffff:
+		h[1] = 126
+		h = append(h, byte(n>>8), byte(n))
+	default:
+		h[1] = 127
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		h = append(h, b[:]...)
+	}
+
+	bufs := net.Buffers{h, data}
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+func isControl(opcode int) bool {
+	return opcode >= CloseMessage
+}
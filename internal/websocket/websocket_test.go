@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// writeClientFrame writes a masked frame as a browser does
+func writeClientFrame(t *testing.T, c net.Conn, fin bool, opcode int, data []byte) {
+	h := []byte{byte(opcode), 0x80}
+	if fin {
+		h[0] |= 0x80
+	}
+	switch n := len(data); {
+	case n < 126:
+		h[1] |= byte(n)
+	default:
+		h[1] |= 126
+		h = append(h, byte(n>>8), byte(n))
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	h = append(h, mask...)
+	for i, b := range data {
+		h = append(h, b^mask[i%4])
+	}
+
+	if _, err := c.Write(h); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readServerFrame reads an unmasked frame
+func readServerFrame(t *testing.T, br *bufio.Reader) (int, []byte) {
+	var h [2]byte
+	readFull(t, br, h[:])
+	if h[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+
+	n := int(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		readFull(t, br, b[:])
+		n = int(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		readFull(t, br, b[:])
+		n = int(binary.BigEndian.Uint64(b[:]))
+	}
+
+	data := make([]byte, n)
+	readFull(t, br, data)
+	return int(h[0] & 0x0f), data
+}
+
+func readFull(t *testing.T, br *bufio.Reader, b []byte) {
+	for n := 0; n < len(b); {
+		m, err := br.Read(b[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+}
+
+func TestAcceptKey(t *testing.T) {
+	// example of RFC 6455 section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("acceptKey = %s", got)
+	}
+}
+
+func TestConn(t *testing.T) {
+	big := bytes.Repeat([]byte{0xab}, 70000)
+	received := make(chan string, 4)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		if err := c.WriteMessage(BinaryMessage, big); err != nil {
+			t.Error(err)
+			return
+		}
+
+		for {
+			mt, data, err := c.ReadMessage()
+			if err != nil {
+				if ce, ok := err.(*CloseError); ok {
+					received <- fmt.Sprintf("close %d", ce.Code)
+				}
+				return
+			}
+			received <- fmt.Sprintf("%d %s", mt, data)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := "GET /live/s.flv HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	if _, err := c.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-Websocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("bad handshake response: %s %v", resp.Status, resp.Header)
+	}
+
+	if op, data := readServerFrame(t, br); op != BinaryMessage || !bytes.Equal(data, big) {
+		t.Fatalf("got opcode %d, %d bytes", op, len(data))
+	}
+
+	writeClientFrame(t, c, true, PingMessage, []byte("hi"))
+	if op, data := readServerFrame(t, br); op != PongMessage || string(data) != "hi" {
+		t.Fatalf("want pong, got opcode %d %q", op, data)
+	}
+	if got := <-received; got != "9 hi" {
+		t.Fatalf("got %q", got)
+	}
+
+	writeClientFrame(t, c, false, TextMessage, []byte("hel"))
+	writeClientFrame(t, c, true, ContinuationMessage, []byte("lo"))
+	if got := <-received; got != "1 hello" {
+		t.Fatalf("got %q", got)
+	}
+
+	writeClientFrame(t, c, true, CloseMessage, FormatCloseMessage(CloseNormalClosure, "bye"))
+	if op, data := readServerFrame(t, br); op != CloseMessage || binary.BigEndian.Uint16(data) != CloseNormalClosure {
+		t.Fatalf("want close echo, got opcode %d % x", op, data)
+	}
+	if got := <-received; got != "close 1000" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,218 @@
+// Package amf encodes and decodes Action Message Format, AMF0 of rtmp commands and flv
+// metadata, and AMF3 of objectEncoding 3 clients which AMF0 switches to by the avmplus marker.
+//
+// Values are mapped to Go as
+//
+//	number, AMF3 double     float64
+//	AMF3 integer            int32
+//	boolean                 bool
+//	string, long string     string
+//	object                  Object, *TypedObject of a class, Externalizable
+//	ECMA array              ECMAArray
+//	strict array            Array, *MixedArray of AMF3 arrays with associative part
+//	date                    time.Time
+//	null                    nil
+//	undefined               Undefined
+//	unsupported             Unsupported
+//	XML document            XMLDocument, XML of AMF3 E4X
+//	byte array              []byte
+//	vector                  []int32, []uint32, []float64, *ObjectVector
+//	dictionary              *Dictionary
+//
+// References are resolved to the values referenced when decoding. When encoding, maps, pointers
+// and slices met again are written as references, so cyclic values can be encoded.
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Version of the encoding
+type Version uint8
+
+const (
+	AMF0 Version = 0
+	AMF3 Version = 3
+)
+
+// Object is an anonymous object
+type Object map[string]interface{}
+
+// ECMAArray is an AMF0 associative array, as onMetaData usually is
+type ECMAArray map[string]interface{}
+
+// Array is a strict array, or an AMF3 array of the dense part only
+type Array []interface{}
+
+// MixedArray is an AMF3 array with associative part, which AMF0 encodes as an ECMA array
+// with the dense part keyed by index
+type MixedArray struct {
+	Dense Array
+	Assoc Object
+}
+
+// TypedObject is an object of a class
+type TypedObject struct {
+	Type   string
+	Object Object
+}
+
+// Undefined is the undefined value
+type Undefined struct{}
+
+// Unsupported is the AMF0 unsupported value
+type Unsupported struct{}
+
+// XMLDocument is a flash.xml.XMLDocument
+type XMLDocument string
+
+// XML is an AMF3 E4X XML, AMF0 encodes it as an XML document
+type XML string
+
+// ObjectVector is an AMF3 Vector.<Type> of objects
+type ObjectVector struct {
+	Type  string // class of items, "*" or empty for any
+	Fixed bool
+	Items []interface{}
+}
+
+// Dictionary is an AMF3 flash.utils.Dictionary, whose keys are of any type
+type Dictionary struct {
+	WeakKeys bool
+	Entries  []DictionaryEntry
+}
+
+type DictionaryEntry struct {
+	Key, Value interface{}
+}
+
+// Externalizable is an AMF3 object of a class serializing itself, whose format is only known
+// by the class, see RegisterExternalizable
+type Externalizable interface {
+	ClassName() string
+	ReadExternal(d *Decoder) error
+	WriteExternal(e *Encoder) error
+}
+
+var (
+	ErrNestingTooDeep = errors.New("amf: nesting too deep")
+	ErrUnknownMarker  = errors.New("amf: unknown marker")
+	ErrInvalidRef     = errors.New("amf: invalid reference")
+)
+
+var externalizables = struct {
+	sync.RWMutex
+	m map[string]func() Externalizable
+}{m: make(map[string]func() Externalizable)}
+
+// RegisterExternalizable registers the class of externalizable AMF3 objects, whose values are
+// returned by newFn to be read. Objects of unregistered classes can't be decoded.
+func RegisterExternalizable(className string, newFn func() Externalizable) {
+	externalizables.Lock()
+	defer externalizables.Unlock()
+	externalizables.m[className] = newFn
+}
+
+func newExternalizable(className string) (Externalizable, error) {
+	externalizables.RLock()
+	defer externalizables.RUnlock()
+	newFn, ok := externalizables.m[className]
+	if !ok {
+		return nil, fmt.Errorf("amf: unregistered externalizable class '%s'", className)
+	}
+	return newFn(), nil
+}
+
+func init() {
+	RegisterExternalizable(classArrayCollection, func() Externalizable { return &ArrayCollection{} })
+	RegisterExternalizable(classObjectProxy, func() Externalizable { return &ObjectProxy{} })
+}
+
+const (
+	classArrayCollection = "flex.messaging.io.ArrayCollection"
+	classObjectProxy     = "flex.messaging.io.ObjectProxy"
+)
+
+// ArrayCollection is flex.messaging.io.ArrayCollection, which externalizes its source array
+type ArrayCollection struct {
+	Source interface{}
+}
+
+func (c *ArrayCollection) ClassName() string { return classArrayCollection }
+
+func (c *ArrayCollection) ReadExternal(d *Decoder) (err error) {
+	c.Source, err = d.DecodeAMF3()
+	return
+}
+
+func (c *ArrayCollection) WriteExternal(e *Encoder) error {
+	return e.EncodeAMF3(c.Source)
+}
+
+// ObjectProxy is flex.messaging.io.ObjectProxy, which externalizes the object proxied
+type ObjectProxy struct {
+	Object interface{}
+}
+
+func (p *ObjectProxy) ClassName() string { return classObjectProxy }
+
+func (p *ObjectProxy) ReadExternal(d *Decoder) (err error) {
+	p.Object, err = d.DecodeAMF3()
+	return
+}
+
+func (p *ObjectProxy) WriteExternal(e *Encoder) error {
+	return e.EncodeAMF3(p.Object)
+}
+
+// Number returns v as a float64 if it's a number of any Go type, AMF3 decodes integers as
+// int32 unlike AMF0
+func Number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// Marshal encodes vs one after another
+func Marshal(ver Version, vs ...interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	e := NewEncoder(&b, ver)
+	for _, v := range vs {
+		if err := e.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// Unmarshal decodes all values of b
+func Unmarshal(b []byte, ver Version) ([]interface{}, error) {
+	return NewDecoder(bytes.NewReader(b), ver).DecodeAll()
+}
@@ -0,0 +1,368 @@
+package amf
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// AMF0 markers
+const (
+	NumberMarker      = 0x00
+	BooleanMarker     = 0x01
+	StringMarker      = 0x02
+	ObjectMarker      = 0x03
+	MovieClipMarker   = 0x04 // reserved
+	NullMarker        = 0x05
+	UndefinedMarker   = 0x06
+	ReferenceMarker   = 0x07
+	ECMAArrayMarker   = 0x08
+	ObjectEndMarker   = 0x09
+	StrictArrayMarker = 0x0a
+	DateMarker        = 0x0b
+	LongStringMarker  = 0x0c
+	UnsupportedMarker = 0x0d
+	RecordSetMarker   = 0x0e // reserved
+	XMLDocumentMarker = 0x0f
+	TypedObjectMarker = 0x10
+	AVMPlusMarker     = 0x11 // switch to AMF3
+)
+
+const maxRef0 = 0xffff
+
+func (d *Decoder) decodeAMF0(marker byte) (interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	switch marker {
+	case NumberMarker:
+		return d.readDouble()
+	case BooleanMarker:
+		b, err := d.readByte()
+		return b != 0, err
+	case StringMarker:
+		return d.readString0()
+	case LongStringMarker:
+		return d.readLongString0()
+	case XMLDocumentMarker:
+		s, err := d.readLongString0()
+		return XMLDocument(s), err
+	case NullMarker:
+		return nil, nil
+	case UndefinedMarker:
+		return Undefined{}, nil
+	case UnsupportedMarker:
+		return Unsupported{}, nil
+	case ObjectMarker:
+		obj := make(Object)
+		d.objects0 = append(d.objects0, obj)
+		return obj, d.readProps0(obj)
+	case TypedObjectMarker:
+		className, err := d.readString0()
+		if err != nil {
+			return nil, err
+		}
+		obj := &TypedObject{Type: className, Object: make(Object)}
+		d.objects0 = append(d.objects0, obj)
+		return obj, d.readProps0(obj.Object)
+	case ECMAArrayMarker:
+		if _, err := d.readU32(); err != nil { // count, which may be wrong
+			return nil, err
+		}
+		arr := make(ECMAArray)
+		d.objects0 = append(d.objects0, arr)
+		return arr, d.readProps0(arr)
+	case StrictArrayMarker:
+		return d.readStrictArray0()
+	case DateMarker:
+		ms, err := d.readDouble()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := d.readU16(); err != nil { // time zone, should be 0
+			return nil, err
+		}
+		return msToTime(ms), nil
+	case ReferenceMarker:
+		i, err := d.readU16()
+		if err != nil {
+			return nil, err
+		}
+		if int(i) >= len(d.objects0) {
+			return nil, ErrInvalidRef
+		}
+		return d.objects0[i], nil
+	case AVMPlusMarker:
+		d.strings, d.objects, d.traits = nil, nil, nil
+		marker, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeAMF3(marker)
+	}
+	return nil, fmt.Errorf("%v 0x%02x of AMF0", ErrUnknownMarker, marker)
+}
+
+func (d *Decoder) readString0() (string, error) {
+	n, err := d.readU16()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.readBytes(int(n))
+	return string(b), err
+}
+
+func (d *Decoder) readLongString0() (string, error) {
+	n, err := d.readU32()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.readBytes(int(n))
+	return string(b), err
+}
+
+// readProps0 reads properties until the empty key and object end marker
+func (d *Decoder) readProps0(m map[string]interface{}) error {
+	for {
+		key, err := d.readString0()
+		if err != nil {
+			return err
+		}
+		marker, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		if key == "" && marker == ObjectEndMarker {
+			return nil
+		}
+
+		v, err := d.decodeAMF0(marker)
+		if err != nil {
+			return err
+		}
+		m[key] = v
+	}
+}
+
+func (d *Decoder) readStrictArray0() (interface{}, error) {
+	n, err := d.readU32()
+	if err != nil {
+		return nil, err
+	}
+	ref := len(d.objects0)
+	d.objects0 = append(d.objects0, nil) // set when complete
+
+	arr := make(Array, 0, prealloc(n))
+	for i := uint32(0); i < n; i++ {
+		marker, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decodeAMF0(marker)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	d.objects0[ref] = arr
+	return arr, nil
+}
+
+func (e *Encoder) encodeAMF0(v interface{}) error {
+	if err := e.enter(); err != nil {
+		return err
+	}
+	defer e.leave()
+
+	switch v := v.(type) {
+	case nil:
+		return e.writeByte(NullMarker)
+	case Undefined:
+		return e.writeByte(UndefinedMarker)
+	case Unsupported:
+		return e.writeByte(UnsupportedMarker)
+	case bool:
+		return e.write(BooleanMarker, boolByte(v))
+	case string:
+		return e.writeString0(v, true)
+	case XMLDocument:
+		return e.writeLongString0(XMLDocumentMarker, string(v))
+	case XML:
+		return e.writeLongString0(XMLDocumentMarker, string(v))
+	case time.Time:
+		if err := e.writeByte(DateMarker); err != nil {
+			return err
+		}
+		if err := e.writeDouble(timeToMs(v)); err != nil {
+			return err
+		}
+		return e.write(0, 0) // time zone
+	case Object:
+		return e.writeObject0(v, "", ObjectMarker, v)
+	case ECMAArray:
+		return e.writeObject0(v, "", ECMAArrayMarker, v)
+	case map[string]interface{}:
+		return e.writeObject0(v, "", ObjectMarker, v)
+	case *TypedObject:
+		return e.writeObject0(v, v.Type, TypedObjectMarker, v.Object)
+	case *MixedArray:
+		props := make(map[string]interface{}, len(v.Dense)+len(v.Assoc))
+		for k, item := range v.Assoc {
+			props[k] = item
+		}
+		for i, item := range v.Dense {
+			props[strconv.Itoa(i)] = item
+		}
+		return e.writeObject0(v, "", ECMAArrayMarker, props)
+	case Array:
+		return e.writeStrictArray0(v, v)
+	case []interface{}:
+		return e.writeStrictArray0(v, v)
+	case []byte, []int32, []uint32, []float64, *ObjectVector, *Dictionary, Externalizable:
+		// only AMF3 has them
+		if err := e.writeByte(AVMPlusMarker); err != nil {
+			return err
+		}
+		e.strings, e.objects, e.traits = nil, nil, nil
+		e.nobjects, e.ntraits = 0, 0
+		return e.encodeAMF3(v)
+	}
+
+	if n, ok := Number(v); ok {
+		if err := e.writeByte(NumberMarker); err != nil {
+			return err
+		}
+		return e.writeDouble(n)
+	}
+	return e.encodeReflect0(v)
+}
+
+// encodeReflect0 encodes maps of string keys and slices of other types
+func (e *Encoder) encodeReflect0(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		props := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			props[k.String()] = rv.MapIndex(k).Interface()
+		}
+		return e.writeObject0(v, "", ObjectMarker, props)
+	case reflect.Slice, reflect.Array:
+		arr := make(Array, rv.Len())
+		for i := range arr {
+			arr[i] = rv.Index(i).Interface()
+		}
+		return e.writeStrictArray0(v, arr)
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return e.writeByte(NullMarker)
+		}
+		return e.encodeAMF0(rv.Elem().Interface())
+	}
+	return fmt.Errorf("amf: unsupported type %T", v)
+}
+
+func (e *Encoder) writeString0(s string, marker bool) error {
+	if len(s) > math.MaxUint16 {
+		if !marker {
+			return fmt.Errorf("amf: key of %d bytes", len(s))
+		}
+		return e.writeLongString0(LongStringMarker, s)
+	}
+	if marker {
+		if err := e.writeByte(StringMarker); err != nil {
+			return err
+		}
+	}
+	if err := e.write(byte(len(s)>>8), byte(len(s))); err != nil {
+		return err
+	}
+	return e.writeStr(s)
+}
+
+func (e *Encoder) writeLongString0(marker byte, s string) error {
+	if err := e.write(marker, byte(len(s)>>24), byte(len(s)>>16), byte(len(s)>>8), byte(len(s))); err != nil {
+		return err
+	}
+	return e.writeStr(s)
+}
+
+// writeRef0 writes a reference to v if it's written before, or adds it to the table
+func (e *Encoder) writeRef0(v interface{}) (bool, error) {
+	key, ok := refKey(v)
+	if ok {
+		if i, seen := e.objects0[key]; seen {
+			return true, e.write(ReferenceMarker, byte(i>>8), byte(i))
+		}
+		if e.nobjects0 <= maxRef0 {
+			e.objects0[key] = e.nobjects0
+		}
+	}
+	e.nobjects0++
+	return false, nil
+}
+
+// writeObject0 writes an object, typed object or ECMA array of props, keys are sorted
+func (e *Encoder) writeObject0(v interface{}, className string, marker byte, props map[string]interface{}) error {
+	if ref, err := e.writeRef0(v); ref || err != nil {
+		return err
+	}
+
+	if err := e.writeByte(marker); err != nil {
+		return err
+	}
+	switch marker {
+	case TypedObjectMarker:
+		if err := e.writeString0(className, false); err != nil {
+			return err
+		}
+	case ECMAArrayMarker:
+		n := len(props)
+		if err := e.write(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range sortedKeys(props) {
+		if err := e.writeString0(k, false); err != nil {
+			return err
+		}
+		if err := e.encodeAMF0(props[k]); err != nil {
+			return err
+		}
+	}
+	return e.write(0, 0, ObjectEndMarker)
+}
+
+func (e *Encoder) writeStrictArray0(v interface{}, arr []interface{}) error {
+	if ref, err := e.writeRef0(v); ref || err != nil {
+		return err
+	}
+	n := len(arr)
+	if err := e.write(StrictArrayMarker, byte(n>>24), byte(n>>16), byte(n>>8), byte(n)); err != nil {
+		return err
+	}
+	for _, v := range arr {
+		if err := e.encodeAMF0(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,779 @@
+package amf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// AMF3 markers
+const (
+	undefinedMarker3    = 0x00
+	nullMarker3         = 0x01
+	falseMarker3        = 0x02
+	trueMarker3         = 0x03
+	integerMarker3      = 0x04
+	doubleMarker3       = 0x05
+	stringMarker3       = 0x06
+	xmlDocMarker3       = 0x07
+	dateMarker3         = 0x08
+	arrayMarker3        = 0x09
+	objectMarker3       = 0x0a
+	xmlMarker3          = 0x0b
+	byteArrayMarker3    = 0x0c
+	vectorIntMarker3    = 0x0d
+	vectorUintMarker3   = 0x0e
+	vectorDoubleMarker3 = 0x0f
+	vectorObjectMarker3 = 0x10
+	dictionaryMarker3   = 0x11
+)
+
+const (
+	maxInt3 = 1<<28 - 1 // range of U29 signed integers
+	minInt3 = -1 << 28
+	maxU29  = 1<<29 - 1
+)
+
+func (d *Decoder) decodeAMF3(marker byte) (interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	switch marker {
+	case undefinedMarker3:
+		return Undefined{}, nil
+	case nullMarker3:
+		return nil, nil
+	case falseMarker3:
+		return false, nil
+	case trueMarker3:
+		return true, nil
+	case integerMarker3:
+		u, err := d.readU29()
+		if err != nil {
+			return nil, err
+		}
+		return int32(u<<3) >> 3, nil // sign extended
+	case doubleMarker3:
+		return d.readDouble()
+	case stringMarker3:
+		return d.readString3()
+	case xmlDocMarker3, xmlMarker3:
+		return d.readXML3(marker)
+	case dateMarker3:
+		return d.readDate3()
+	case arrayMarker3:
+		return d.readArray3()
+	case objectMarker3:
+		return d.readObject3()
+	case byteArrayMarker3:
+		return d.readByteArray3()
+	case vectorIntMarker3, vectorUintMarker3, vectorDoubleMarker3:
+		return d.readNumberVector3(marker)
+	case vectorObjectMarker3:
+		return d.readObjectVector3()
+	case dictionaryMarker3:
+		return d.readDictionary3()
+	}
+	return nil, fmt.Errorf("%v 0x%02x of AMF3", ErrUnknownMarker, marker)
+}
+
+// readU29 reads a variable length unsigned 29 bits integer
+func (d *Decoder) readU29() (uint32, error) {
+	var u uint32
+	for i := 0; i < 3; i++ {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		u = u<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			return u, nil
+		}
+	}
+	b, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	return u<<8 | uint32(b), nil
+}
+
+// readRef3 reads the header of a value which may be a reference, inline values return the
+// header without the flag
+func (d *Decoder) readRef3() (u uint32, inline bool, err error) {
+	if u, err = d.readU29(); err != nil {
+		return
+	}
+	return u >> 1, u&1 == 1, nil
+}
+
+func (d *Decoder) objectRef3(i uint32) (interface{}, error) {
+	if int(i) >= len(d.objects) {
+		return nil, ErrInvalidRef
+	}
+	return d.objects[i], nil
+}
+
+// addObject3 reserves a slot of the object table, set when the value is complete
+func (d *Decoder) addObject3(v interface{}) int {
+	d.objects = append(d.objects, v)
+	return len(d.objects) - 1
+}
+
+func (d *Decoder) readString3() (string, error) {
+	n, inline, err := d.readRef3()
+	if err != nil {
+		return "", err
+	}
+	if !inline {
+		if int(n) >= len(d.strings) {
+			return "", ErrInvalidRef
+		}
+		return d.strings[n], nil
+	}
+
+	b, err := d.readBytes(int(n))
+	if err != nil {
+		return "", err
+	}
+	s := string(b)
+	if s != "" { // the empty string is never referenced
+		d.strings = append(d.strings, s)
+	}
+	return s, nil
+}
+
+func (d *Decoder) readXML3(marker byte) (interface{}, error) {
+	n, inline, err := d.readRef3()
+	if err != nil || !inline {
+		if err != nil {
+			return nil, err
+		}
+		return d.objectRef3(n)
+	}
+
+	b, err := d.readBytes(int(n))
+	if err != nil {
+		return nil, err
+	}
+	var v interface{} = XML(b)
+	if marker == xmlDocMarker3 {
+		v = XMLDocument(b)
+	}
+	d.addObject3(v)
+	return v, nil
+}
+
+func (d *Decoder) readDate3() (interface{}, error) {
+	n, inline, err := d.readRef3()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.objectRef3(n)
+	}
+
+	ms, err := d.readDouble()
+	if err != nil {
+		return nil, err
+	}
+	t := msToTime(ms)
+	d.addObject3(t)
+	return t, nil
+}
+
+func (d *Decoder) readArray3() (interface{}, error) {
+	n, inline, err := d.readRef3()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.objectRef3(n)
+	}
+	ref := d.addObject3(nil)
+
+	var assoc Object
+	for {
+		key, err := d.readString3()
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			break
+		}
+		if assoc == nil {
+			assoc = make(Object)
+			d.objects[ref] = &MixedArray{Assoc: assoc}
+		}
+		if assoc[key], err = d.DecodeAMF3(); err != nil {
+			return nil, err
+		}
+	}
+
+	dense := make(Array, 0, prealloc(n))
+	for i := uint32(0); i < n; i++ {
+		v, err := d.DecodeAMF3()
+		if err != nil {
+			return nil, err
+		}
+		dense = append(dense, v)
+	}
+
+	if assoc != nil {
+		mixed := d.objects[ref].(*MixedArray)
+		mixed.Dense = dense
+		return mixed, nil
+	}
+	d.objects[ref] = dense
+	return dense, nil
+}
+
+func (d *Decoder) readTraits3(u uint32) (*traits, error) {
+	if u&1 == 0 { // traits reference
+		if int(u>>1) >= len(d.traits) {
+			return nil, ErrInvalidRef
+		}
+		return d.traits[u>>1], nil
+	}
+
+	t := &traits{externalizable: u&2 != 0, dynamic: u&4 != 0}
+	var err error
+	if t.className, err = d.readString3(); err != nil {
+		return nil, err
+	}
+	if !t.externalizable {
+		n := u >> 3
+		t.members = make([]string, 0, prealloc(n))
+		for i := uint32(0); i < n; i++ {
+			name, err := d.readString3()
+			if err != nil {
+				return nil, err
+			}
+			t.members = append(t.members, name)
+		}
+	}
+	d.traits = append(d.traits, t)
+	return t, nil
+}
+
+func (d *Decoder) readObject3() (interface{}, error) {
+	u, inline, err := d.readRef3()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.objectRef3(u)
+	}
+
+	t, err := d.readTraits3(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.externalizable {
+		ext, err := newExternalizable(t.className)
+		if err != nil {
+			return nil, err
+		}
+		d.addObject3(ext)
+		if err := ext.ReadExternal(d); err != nil {
+			return nil, err
+		}
+		return ext, nil
+	}
+
+	obj := make(Object, len(t.members))
+	var v interface{} = obj
+	if t.className != "" {
+		v = &TypedObject{Type: t.className, Object: obj}
+	}
+	d.addObject3(v)
+
+	for _, name := range t.members {
+		if obj[name], err = d.DecodeAMF3(); err != nil {
+			return nil, err
+		}
+	}
+	if t.dynamic {
+		for {
+			key, err := d.readString3()
+			if err != nil {
+				return nil, err
+			}
+			if key == "" {
+				break
+			}
+			if obj[key], err = d.DecodeAMF3(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+func (d *Decoder) readByteArray3() (interface{}, error) {
+	n, inline, err := d.readRef3()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.objectRef3(n)
+	}
+
+	b, err := d.readBytes(int(n))
+	if err != nil {
+		return nil, err
+	}
+	d.addObject3(b)
+	return b, nil
+}
+
+func (d *Decoder) readNumberVector3(marker byte) (interface{}, error) {
+	n, inline, err := d.readRef3()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.objectRef3(n)
+	}
+	if _, err := d.readByte(); err != nil { // fixed
+		return nil, err
+	}
+
+	size := 4
+	if marker == vectorDoubleMarker3 {
+		size = 8
+	}
+	b, err := d.readBytes(int(n) * size)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	switch marker {
+	case vectorIntMarker3:
+		items := make([]int32, n)
+		for i := range items {
+			items[i] = int32(binary.BigEndian.Uint32(b[i*4:]))
+		}
+		v = items
+	case vectorUintMarker3:
+		items := make([]uint32, n)
+		for i := range items {
+			items[i] = binary.BigEndian.Uint32(b[i*4:])
+		}
+		v = items
+	default:
+		items := make([]float64, n)
+		for i := range items {
+			items[i] = math.Float64frombits(binary.BigEndian.Uint64(b[i*8:]))
+		}
+		v = items
+	}
+	d.addObject3(v)
+	return v, nil
+}
+
+func (d *Decoder) readObjectVector3() (interface{}, error) {
+	n, inline, err := d.readRef3()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.objectRef3(n)
+	}
+	fixed, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	typeName, err := d.readString3()
+	if err != nil {
+		return nil, err
+	}
+
+	vec := &ObjectVector{Type: typeName, Fixed: fixed != 0, Items: make([]interface{}, 0, prealloc(n))}
+	d.addObject3(vec)
+	for i := uint32(0); i < n; i++ {
+		v, err := d.DecodeAMF3()
+		if err != nil {
+			return nil, err
+		}
+		vec.Items = append(vec.Items, v)
+	}
+	return vec, nil
+}
+
+func (d *Decoder) readDictionary3() (interface{}, error) {
+	n, inline, err := d.readRef3()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.objectRef3(n)
+	}
+	weak, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	dict := &Dictionary{WeakKeys: weak != 0, Entries: make([]DictionaryEntry, 0, prealloc(n))}
+	d.addObject3(dict)
+	for i := uint32(0); i < n; i++ {
+		key, err := d.DecodeAMF3()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.DecodeAMF3()
+		if err != nil {
+			return nil, err
+		}
+		dict.Entries = append(dict.Entries, DictionaryEntry{key, value})
+	}
+	return dict, nil
+}
+
+func (e *Encoder) encodeAMF3(v interface{}) error {
+	if err := e.enter(); err != nil {
+		return err
+	}
+	defer e.leave()
+
+	if e.strings == nil {
+		e.strings = make(map[string]int)
+		e.objects = make(map[refID]int)
+		e.traits = make(map[string]int)
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return e.writeByte(nullMarker3)
+	case Undefined, Unsupported:
+		return e.writeByte(undefinedMarker3)
+	case bool:
+		if v {
+			return e.writeByte(trueMarker3)
+		}
+		return e.writeByte(falseMarker3)
+	case float64:
+		return e.writeDouble3(v)
+	case float32:
+		return e.writeDouble3(float64(v))
+	case string:
+		if err := e.writeByte(stringMarker3); err != nil {
+			return err
+		}
+		return e.writeString3(v)
+	case XMLDocument:
+		return e.writeBytes3(xmlDocMarker3, v, []byte(v))
+	case XML:
+		return e.writeBytes3(xmlMarker3, v, []byte(v))
+	case time.Time:
+		if ref, err := e.writeRef3(dateMarker3, v); ref || err != nil {
+			return err
+		}
+		if err := e.write(dateMarker3, 0x01); err != nil {
+			return err
+		}
+		return e.writeDouble(timeToMs(v))
+	case Array:
+		return e.writeArray3(v, v, nil)
+	case []interface{}:
+		return e.writeArray3(v, v, nil)
+	case ECMAArray:
+		return e.writeArray3(v, nil, v)
+	case *MixedArray:
+		return e.writeArray3(v, v.Dense, v.Assoc)
+	case Object:
+		return e.writeObject3(v, "", v)
+	case map[string]interface{}:
+		return e.writeObject3(v, "", v)
+	case *TypedObject:
+		return e.writeObject3(v, v.Type, v.Object)
+	case Externalizable:
+		return e.writeExternalizable3(v)
+	case []byte:
+		return e.writeBytes3(byteArrayMarker3, v, v)
+	case []int32:
+		b := make([]byte, len(v)*4)
+		for i, n := range v {
+			binary.BigEndian.PutUint32(b[i*4:], uint32(n))
+		}
+		return e.writeNumberVector3(vectorIntMarker3, v, len(v), b)
+	case []uint32:
+		b := make([]byte, len(v)*4)
+		for i, n := range v {
+			binary.BigEndian.PutUint32(b[i*4:], n)
+		}
+		return e.writeNumberVector3(vectorUintMarker3, v, len(v), b)
+	case []float64:
+		b := make([]byte, len(v)*8)
+		for i, n := range v {
+			binary.BigEndian.PutUint64(b[i*8:], math.Float64bits(n))
+		}
+		return e.writeNumberVector3(vectorDoubleMarker3, v, len(v), b)
+	case *ObjectVector:
+		return e.writeObjectVector3(v)
+	case *Dictionary:
+		return e.writeDictionary3(v)
+	}
+
+	if n, ok := Number(v); ok {
+		if n == math.Trunc(n) && n >= minInt3 && n <= maxInt3 {
+			if err := e.writeByte(integerMarker3); err != nil {
+				return err
+			}
+			return e.writeU29(uint32(int32(n)) & maxU29)
+		}
+		return e.writeDouble3(n)
+	}
+	return e.encodeReflect3(v)
+}
+
+// encodeReflect3 encodes maps of string keys and slices of other types
+func (e *Encoder) encodeReflect3(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		props := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			props[k.String()] = rv.MapIndex(k).Interface()
+		}
+		return e.writeObject3(v, "", props)
+	case reflect.Slice, reflect.Array:
+		arr := make(Array, rv.Len())
+		for i := range arr {
+			arr[i] = rv.Index(i).Interface()
+		}
+		return e.writeArray3(v, arr, nil)
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return e.writeByte(nullMarker3)
+		}
+		return e.encodeAMF3(rv.Elem().Interface())
+	}
+	return fmt.Errorf("amf: unsupported type %T", v)
+}
+
+func (e *Encoder) writeU29(u uint32) error {
+	switch {
+	case u < 1<<7:
+		return e.write(byte(u))
+	case u < 1<<14:
+		return e.write(byte(u>>7)|0x80, byte(u)&0x7f)
+	case u < 1<<21:
+		return e.write(byte(u>>14)|0x80, byte(u>>7)|0x80, byte(u)&0x7f)
+	case u <= maxU29:
+		return e.write(byte(u>>22)|0x80, byte(u>>15)|0x80, byte(u>>8)|0x80, byte(u))
+	}
+	return fmt.Errorf("amf: %d out of U29", u)
+}
+
+func (e *Encoder) writeDouble3(f float64) error {
+	if err := e.writeByte(doubleMarker3); err != nil {
+		return err
+	}
+	return e.writeDouble(f)
+}
+
+// writeString3 writes a string without marker, or its reference
+func (e *Encoder) writeString3(s string) error {
+	if i, ok := e.strings[s]; ok {
+		return e.writeU29(uint32(i) << 1)
+	}
+	if s != "" {
+		e.strings[s] = len(e.strings)
+	}
+	if err := e.writeU29(uint32(len(s))<<1 | 1); err != nil {
+		return err
+	}
+	return e.writeStr(s)
+}
+
+// writeRef3 writes marker and a reference to v if it's written before, or adds it to the
+// object table
+func (e *Encoder) writeRef3(marker byte, v interface{}) (bool, error) {
+	key, ok := refKey(v)
+	if ok {
+		if i, seen := e.objects[key]; seen {
+			if err := e.writeByte(marker); err != nil {
+				return true, err
+			}
+			return true, e.writeU29(uint32(i) << 1)
+		}
+		if e.nobjects <= maxInt3 {
+			e.objects[key] = e.nobjects
+		}
+	}
+	e.nobjects++
+	return false, nil
+}
+
+// writeInline3 writes marker and the header of an inline value of n
+func (e *Encoder) writeInline3(marker byte, n int) error {
+	if n > maxInt3 {
+		return fmt.Errorf("amf: %d items out of U29", n)
+	}
+	if err := e.writeByte(marker); err != nil {
+		return err
+	}
+	return e.writeU29(uint32(n)<<1 | 1)
+}
+
+// writeBytes3 writes a byte array or XML
+func (e *Encoder) writeBytes3(marker byte, v interface{}, b []byte) error {
+	if ref, err := e.writeRef3(marker, v); ref || err != nil {
+		return err
+	}
+	if err := e.writeInline3(marker, len(b)); err != nil {
+		return err
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+// writeArray3 writes an array, the associative part with sorted keys
+func (e *Encoder) writeArray3(v interface{}, dense []interface{}, assoc map[string]interface{}) error {
+	if ref, err := e.writeRef3(arrayMarker3, v); ref || err != nil {
+		return err
+	}
+	if err := e.writeInline3(arrayMarker3, len(dense)); err != nil {
+		return err
+	}
+	if err := e.writeProps3(assoc); err != nil {
+		return err
+	}
+	for _, item := range dense {
+		if err := e.encodeAMF3(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeObject3 writes an object as dynamic, whose traits are referenced by class
+func (e *Encoder) writeObject3(v interface{}, className string, props map[string]interface{}) error {
+	if ref, err := e.writeRef3(objectMarker3, v); ref || err != nil {
+		return err
+	}
+	if err := e.writeByte(objectMarker3); err != nil {
+		return err
+	}
+	if err := e.writeTraits3("dynamic/"+className, 0x0b, className); err != nil { // no sealed members
+		return err
+	}
+	return e.writeProps3(props)
+}
+
+func (e *Encoder) writeExternalizable3(v Externalizable) error {
+	if ref, err := e.writeRef3(objectMarker3, v); ref || err != nil {
+		return err
+	}
+	if err := e.writeByte(objectMarker3); err != nil {
+		return err
+	}
+	if err := e.writeTraits3("external/"+v.ClassName(), 0x07, v.ClassName()); err != nil {
+		return err
+	}
+	return v.WriteExternal(e)
+}
+
+// writeTraits3 writes inline traits of header, or the reference to traits of key written before
+func (e *Encoder) writeTraits3(key string, header uint32, className string) error {
+	if i, ok := e.traits[key]; ok {
+		return e.writeU29(uint32(i)<<2 | 0x01)
+	}
+	if e.ntraits <= maxInt3>>1 {
+		e.traits[key] = e.ntraits
+	}
+	e.ntraits++
+	if err := e.writeU29(header); err != nil {
+		return err
+	}
+	return e.writeString3(className)
+}
+
+// writeProps3 writes dynamic properties with sorted keys, ended by the empty string
+func (e *Encoder) writeProps3(props map[string]interface{}) error {
+	for _, k := range sortedKeys(props) {
+		if k == "" {
+			return errors.New("amf: empty key of AMF3 object")
+		}
+		if err := e.writeString3(k); err != nil {
+			return err
+		}
+		if err := e.encodeAMF3(props[k]); err != nil {
+			return err
+		}
+	}
+	return e.writeString3("")
+}
+
+func (e *Encoder) writeNumberVector3(marker byte, v interface{}, n int, b []byte) error {
+	if ref, err := e.writeRef3(marker, v); ref || err != nil {
+		return err
+	}
+	if err := e.writeInline3(marker, n); err != nil {
+		return err
+	}
+	if err := e.writeByte(0); err != nil { // not fixed
+		return err
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *Encoder) writeObjectVector3(v *ObjectVector) error {
+	if ref, err := e.writeRef3(vectorObjectMarker3, v); ref || err != nil {
+		return err
+	}
+	if err := e.writeInline3(vectorObjectMarker3, len(v.Items)); err != nil {
+		return err
+	}
+	if err := e.writeByte(boolByte(v.Fixed)); err != nil {
+		return err
+	}
+	if err := e.writeString3(v.Type); err != nil {
+		return err
+	}
+	for _, item := range v.Items {
+		if err := e.encodeAMF3(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) writeDictionary3(v *Dictionary) error {
+	if ref, err := e.writeRef3(dictionaryMarker3, v); ref || err != nil {
+		return err
+	}
+	if err := e.writeInline3(dictionaryMarker3, len(v.Entries)); err != nil {
+		return err
+	}
+	if err := e.writeByte(boolByte(v.WeakKeys)); err != nil {
+		return err
+	}
+	for _, entry := range v.Entries {
+		if err := e.encodeAMF3(entry.Key); err != nil {
+			return err
+		}
+		if err := e.encodeAMF3(entry.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,331 @@
+package amf
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAMF0(t *testing.T) {
+	// connect of a client, an object and an ECMA array
+	b := []byte{
+		StringMarker, 0, 7, 'c', 'o', 'n', 'n', 'e', 'c', 't',
+		NumberMarker, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0,
+		ObjectMarker, 0, 3, 'a', 'p', 'p', StringMarker, 0, 4, 'l', 'i', 'v', 'e',
+		0, 4, 'f', 'p', 'a', 'd', BooleanMarker, 0,
+		0, 0, ObjectEndMarker,
+		ECMAArrayMarker, 0, 0, 0, 9, // count is ignored
+		0, 5, 'w', 'i', 'd', 't', 'h', NumberMarker, 0x40, 0x94, 0, 0, 0, 0, 0, 0,
+		0, 0, ObjectEndMarker,
+		NullMarker, UndefinedMarker,
+	}
+	vs, err := Unmarshal(b, AMF0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{
+		"connect", 1.0,
+		Object{"app": "live", "fpad": false},
+		ECMAArray{"width": 1280.0},
+		nil, Undefined{},
+	}
+	if !reflect.DeepEqual(vs, want) {
+		t.Fatalf("got %#v, want %#v", vs, want)
+	}
+
+	again, err := Marshal(AMF0, vs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[bytes.IndexByte(b, ECMAArrayMarker)+4] = 1 // the real count
+	if !bytes.Equal(again, b) {
+		t.Errorf("got % x, want % x", again, b)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	date := time.Date(2020, 5, 17, 8, 30, 0, 123e6, time.UTC)
+	long := strings.Repeat("x", 70000)
+	tests := []struct {
+		v, want interface{}
+	}{
+		{1.5, nil},
+		{"", nil},
+		{long, nil},
+		{true, nil},
+		{date, nil},
+		{XMLDocument("<a/>"), nil},
+		{Unsupported{}, nil},
+		{Array{1.0, "a", nil}, nil},
+		{&TypedObject{Type: "com.Foo", Object: Object{"bar": "baz"}}, nil},
+		{ECMAArray{"duration": 0.0, "encoder": "obs"}, nil},
+		{42, 42.0},
+		{uint8(7), 7.0},
+		{map[string]interface{}{"a": 1.0}, Object{"a": 1.0}},
+		{[]string{"a", "b"}, Array{"a", "b"}},
+		{&MixedArray{Dense: Array{"a"}, Assoc: Object{"k": "v"}}, ECMAArray{"0": "a", "k": "v"}},
+		{XML("<b/>"), XMLDocument("<b/>")},
+		{[]byte{1, 2, 3}, nil}, // avmplus
+		{[]int32{-1, 1}, nil},
+	}
+	for _, tt := range tests {
+		if tt.want == nil {
+			tt.want = tt.v
+		}
+		b, err := Marshal(AMF0, tt.v)
+		if err != nil {
+			t.Errorf("%#v: %v", tt.v, err)
+			continue
+		}
+		vs, err := Unmarshal(b, AMF0)
+		if err != nil || len(vs) != 1 || !reflect.DeepEqual(vs[0], tt.want) {
+			t.Errorf("%#v: got %#v, %v", tt.v, vs, err)
+		}
+	}
+}
+
+func TestAMF3(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want interface{}
+	}{
+		{[]byte{integerMarker3, 0x7f}, int32(127)},
+		{[]byte{integerMarker3, 0x81, 0x00}, int32(128)},
+		{[]byte{integerMarker3, 0xbf, 0xff, 0xff, 0xff}, int32(maxInt3)},
+		{[]byte{integerMarker3, 0xff, 0xff, 0xff, 0xff}, int32(-1)},
+		{[]byte{integerMarker3, 0xc0, 0x80, 0x80, 0x00}, int32(minInt3)},
+		{[]byte{doubleMarker3, 0x40, 0x09, 0x21, 0xfb, 0x54, 0x44, 0x2d, 0x18}, 3.141592653589793},
+		{[]byte{stringMarker3, 0x07, 'a', 'b', 'c'}, "abc"},
+		{[]byte{stringMarker3, 0x01}, ""},
+		{[]byte{byteArrayMarker3, 0x05, 1, 2}, []byte{1, 2}},
+		{[]byte{arrayMarker3, 0x05, 0x01, integerMarker3, 1, stringMarker3, 0x03, 'a'}, Array{int32(1), "a"}},
+		{[]byte{arrayMarker3, 0x03, 0x03, 'k', trueMarker3, 0x01, nullMarker3}, &MixedArray{Dense: Array{nil}, Assoc: Object{"k": true}}},
+		{[]byte{vectorIntMarker3, 0x05, 0, 0xff, 0xff, 0xff, 0xfe, 0, 0, 0, 3}, []int32{-2, 3}},
+		{[]byte{vectorUintMarker3, 0x03, 1, 0xff, 0xff, 0xff, 0xfe}, []uint32{0xfffffffe}},
+		{[]byte{vectorDoubleMarker3, 0x03, 0, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0}, []float64{1}},
+		{[]byte{vectorObjectMarker3, 0x03, 1, 0x03, '*', falseMarker3}, &ObjectVector{Type: "*", Fixed: true, Items: []interface{}{false}}},
+		{[]byte{dictionaryMarker3, 0x03, 0, integerMarker3, 1, stringMarker3, 0x03, 'v'}, &Dictionary{Entries: []DictionaryEntry{{int32(1), "v"}}}},
+		{[]byte{xmlMarker3, 0x09, '<', 'a', '/', '>'}, XML("<a/>")},
+		{[]byte{dateMarker3, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}, time.Unix(0, 0).UTC()},
+		// sealed typed object of member x, dynamic anonymous object and the traits referenced
+		{[]byte{arrayMarker3, 0x07, 0x01,
+			objectMarker3, 0x13, 0x07, 'P', 'n', 't', 0x03, 'x', integerMarker3, 1,
+			objectMarker3, 0x0b, 0x01, 0x03, 'y', integerMarker3, 2, 0x01,
+			objectMarker3, 0x01, integerMarker3, 3,
+		}, Array{
+			&TypedObject{Type: "Pnt", Object: Object{"x": int32(1)}},
+			Object{"y": int32(2)},
+			&TypedObject{Type: "Pnt", Object: Object{"x": int32(3)}},
+		}},
+		// externalizable ArrayCollection of an array
+		{[]byte{objectMarker3, 0x07, 0x43}, nil},
+	}
+	tests[len(tests)-1].b = append(tests[len(tests)-1].b, classArrayCollection...)
+	tests[len(tests)-1].b = append(tests[len(tests)-1].b, arrayMarker3, 0x03, 0x01, stringMarker3, 0x01)
+	tests[len(tests)-1].want = &ArrayCollection{Source: Array{""}}
+
+	for _, tt := range tests {
+		vs, err := Unmarshal(tt.b, AMF3)
+		if err != nil || len(vs) != 1 || !reflect.DeepEqual(vs[0], tt.want) {
+			t.Errorf("% x: got %#v, %v", tt.b, vs, err)
+			continue
+		}
+
+		b, err := Marshal(AMF3, vs[0])
+		if err != nil {
+			t.Errorf("%#v: %v", vs[0], err)
+			continue
+		}
+		again, err := Unmarshal(b, AMF3)
+		if err != nil || !reflect.DeepEqual(again, vs) {
+			t.Errorf("%#v: got %#v, %v", vs[0], again, err)
+		}
+	}
+}
+
+func TestAMF3References(t *testing.T) {
+	obj := Object{"name": "abc"}
+	obj["self"] = obj
+	arr := Array{obj, obj, "abc", "abc", []byte{1}}
+
+	b, err := Marshal(AMF3, arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		arrayMarker3, 0x0b, 0x01,
+		objectMarker3, 0x0b, 0x01, 0x09, 'n', 'a', 'm', 'e', stringMarker3, 0x07, 'a', 'b', 'c',
+		0x09, 's', 'e', 'l', 'f', objectMarker3, 0x02, 0x01, // the object itself
+		objectMarker3, 0x02,
+		stringMarker3, 0x02, stringMarker3, 0x02,
+		byteArrayMarker3, 0x03, 1,
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("got % x, want % x", b, want)
+	}
+
+	vs, err := Unmarshal(b, AMF3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := vs[0].(Array)
+	o := got[0].(Object)
+	if reflect.ValueOf(got[1]).Pointer() != reflect.ValueOf(o).Pointer() || reflect.ValueOf(o["self"]).Pointer() != reflect.ValueOf(o).Pointer() {
+		t.Errorf("references are not resolved: %v", got)
+	}
+}
+
+func TestAMF0References(t *testing.T) {
+	obj := Object{"a": 1.0}
+	obj["self"] = obj
+	b, err := Marshal(AMF0, Array{obj, obj})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(b, []byte{ReferenceMarker, 0, 1}) {
+		t.Errorf("no reference to the object: % x", b)
+	}
+
+	vs, err := Unmarshal(b, AMF0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := vs[0].(Array)
+	o := got[0].(Object)
+	if reflect.ValueOf(got[1]).Pointer() != reflect.ValueOf(o).Pointer() || reflect.ValueOf(o["self"]).Pointer() != reflect.ValueOf(o).Pointer() {
+		t.Errorf("references are not resolved: %v", got)
+	}
+}
+
+func TestAVMPlus(t *testing.T) {
+	// AMF0 command of objectEncoding 3, whose object is AMF3
+	b := []byte{
+		StringMarker, 0, 4, 'c', 'a', 'l', 'l', NumberMarker, 0, 0, 0, 0, 0, 0, 0, 0,
+		AVMPlusMarker, objectMarker3, 0x0b, 0x01, 0x03, 'n', integerMarker3, 5, 0x01,
+		AVMPlusMarker, stringMarker3, 0x03, 'n', // tables are new
+	}
+	vs, err := Unmarshal(b, AMF0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"call", 0.0, Object{"n": int32(5)}, "n"}
+	if !reflect.DeepEqual(vs, want) {
+		t.Errorf("got %#v, want %#v", vs, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	deep := bytes.Repeat([]byte{StrictArrayMarker, 0, 0, 0, 1}, maxDepth+1)
+	tests := []struct {
+		b   []byte
+		ver Version
+		err error
+	}{
+		{[]byte{StringMarker, 0, 5, 'a'}, AMF0, io.ErrUnexpectedEOF},
+		{[]byte{LongStringMarker, 0xff, 0xff, 0xff, 0xff}, AMF0, io.ErrUnexpectedEOF},
+		{[]byte{ObjectMarker, 0, 1, 'a'}, AMF0, io.ErrUnexpectedEOF},
+		{[]byte{ReferenceMarker, 0, 0}, AMF0, ErrInvalidRef},
+		{deep, AMF0, ErrNestingTooDeep},
+		{[]byte{stringMarker3, 0x00}, AMF3, ErrInvalidRef},
+		{[]byte{objectMarker3, 0x00}, AMF3, ErrInvalidRef},
+		{[]byte{objectMarker3, 0x05}, AMF3, ErrInvalidRef}, // traits
+		{[]byte{arrayMarker3, 0xff, 0xff, 0xff, 0xff, 0x01}, AMF3, io.ErrUnexpectedEOF},
+		{[]byte{integerMarker3, 0xff}, AMF3, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		if _, err := Unmarshal(tt.b, tt.ver); err != tt.err {
+			t.Errorf("% x: got %v, want %v", tt.b, err, tt.err)
+		}
+	}
+
+	for _, tt := range []struct {
+		b   []byte
+		ver Version
+	}{
+		{[]byte{MovieClipMarker}, AMF0},
+		{[]byte{0x12}, AMF3},
+		{[]byte{objectMarker3, 0x07, 0x03, 'X'}, AMF3}, // unregistered externalizable
+	} {
+		if _, err := Unmarshal(tt.b, tt.ver); err == nil {
+			t.Errorf("% x: no error", tt.b)
+		}
+	}
+}
+
+func TestMetaDataReform(t *testing.T) {
+	meta, err := Marshal(AMF0, OnMetaData, ECMAArray{"width": 1280.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withFrame, err := Marshal(AMF0, SetDataFrame, OnMetaData, ECMAArray{"width": 1280.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		in   []byte
+		flag uint8
+		want []byte
+	}{
+		{meta, ADD, withFrame},
+		{withFrame, ADD, withFrame},
+		{withFrame, DEL, meta},
+		{meta, DEL, meta},
+	} {
+		got, err := MetaDataReform(tt.in, tt.flag)
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("% x %d: got % x, %v", tt.in, tt.flag, got, err)
+		}
+	}
+	if _, err := MetaDataReform([]byte{NumberMarker, 0, 0, 0, 0, 0, 0, 0, 0}, DEL); err == nil {
+		t.Error("no error of metadata without name")
+	}
+}
+
+// TestFuzz runs mutations of valid messages through the fuzz check of go-fuzz
+func TestFuzz(t *testing.T) {
+	var seeds [][]byte
+	for _, v := range []interface{}{
+		Array{"connect", 1.0, Object{"app": "live", "objectEncoding": 3.0}},
+		&TypedObject{Type: "a.B", Object: Object{"c": time.Unix(1, 0), "d": XML("<x/>")}},
+		ECMAArray{"duration": 10.0, "tags": Array{"a", "b"}},
+		&MixedArray{Dense: Array{int32(1), 2.5}, Assoc: Object{"k": []byte{1, 2}}},
+		&Dictionary{Entries: []DictionaryEntry{{Object{"o": 1}, []uint32{1}}}},
+		&ObjectVector{Type: "a.B", Items: []interface{}{&ArrayCollection{Source: Array{"x"}}}},
+		&ObjectProxy{Object: Object{"p": []float64{1, 2}}},
+	} {
+		for _, ver := range []Version{AMF0, AMF3} {
+			b, err := Marshal(ver, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seeds = append(seeds, b)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, seed := range seeds {
+		fuzz(seed)
+		for i := 0; i < 2000; i++ {
+			b := append([]byte(nil), seed...)
+			for n := rnd.Intn(4) + 1; n > 0; n-- {
+				switch pos := rnd.Intn(len(b)); rnd.Intn(3) {
+				case 0:
+					b[pos] = byte(rnd.Intn(256))
+				case 1:
+					b = b[:pos]
+				default:
+					b = append(b[:pos], append([]byte{byte(rnd.Intn(0x12))}, b[pos:]...)...)
+				}
+				if len(b) == 0 {
+					break
+				}
+			}
+			fuzz(b)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package amf
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	maxDepth      = 256     // of nested values
+	maxPrealloc   = 1024    // items allocated before they are read
+	readChunkSize = 1 << 16 // of long strings and byte arrays, whose length may lie
+)
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// oneByteReader reads a byte at a time from readers without ReadByte, not to read ahead
+type oneByteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *oneByteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.Reader, r.b[:]); err != nil {
+		return 0, err
+	}
+	return r.b[0], nil
+}
+
+// Decoder decodes the values of a message, references are resolved in the message
+type Decoder struct {
+	r     byteReader
+	ver   Version
+	depth int
+
+	objects0 []interface{} // AMF0 reference table
+
+	// AMF3 reference tables, new for every switch from AMF0
+	strings []string
+	objects []interface{}
+	traits  []*traits
+}
+
+// traits of AMF3 objects of a class
+type traits struct {
+	className      string
+	externalizable bool
+	dynamic        bool
+	members        []string // sealed
+}
+
+// NewDecoder returns a decoder of ver, AMF0 decodes AMF3 values after avmplus markers
+func NewDecoder(r io.Reader, ver Version) *Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = &oneByteReader{Reader: r}
+	}
+	return &Decoder{r: br, ver: ver}
+}
+
+// Read reads raw bytes, for Externalizable
+func (d *Decoder) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
+
+// Decode decodes the next value, io.EOF at the end
+func (d *Decoder) Decode() (interface{}, error) {
+	marker, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if d.ver == AMF3 {
+		return d.decodeAMF3(marker)
+	}
+	return d.decodeAMF0(marker)
+}
+
+// DecodeAll decodes values until the end
+func (d *Decoder) DecodeAll() ([]interface{}, error) {
+	var vs []interface{}
+	for {
+		v, err := d.Decode()
+		if err == io.EOF {
+			return vs, nil
+		}
+		if err != nil {
+			return vs, err
+		}
+		vs = append(vs, v)
+	}
+}
+
+// DecodeAMF3 decodes an AMF3 value with the reference tables of the value being decoded, for
+// Externalizable
+func (d *Decoder) DecodeAMF3() (interface{}, error) {
+	marker, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeAMF3(marker)
+}
+
+func (d *Decoder) enter() error {
+	if d.depth++; d.depth > maxDepth {
+		return ErrNestingTooDeep
+	}
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// readByte reads in a value, where the end is unexpected
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	return b, unexpectedEOF(err)
+}
+
+func (d *Decoder) readFull(b []byte) error {
+	_, err := io.ReadFull(d.r, b)
+	return unexpectedEOF(err)
+}
+
+// readBytes reads n bytes, allocating as they arrive
+func (d *Decoder) readBytes(n int) ([]byte, error) {
+	if n <= readChunkSize {
+		b := make([]byte, n)
+		return b, d.readFull(b)
+	}
+
+	b := make([]byte, 0, readChunkSize)
+	for len(b) < n {
+		size := n - len(b)
+		if size > readChunkSize {
+			size = readChunkSize
+		}
+		b = append(b, make([]byte, size)...)
+		if err := d.readFull(b[len(b)-size:]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (d *Decoder) readU16() (uint16, error) {
+	var b [2]byte
+	if err := d.readFull(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+func (d *Decoder) readU32() (uint32, error) {
+	var b [4]byte
+	if err := d.readFull(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+func (d *Decoder) readDouble() (float64, error) {
+	var b [8]byte
+	if err := d.readFull(b[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b[:])), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// msToTime converts milliseconds since the epoch to UTC time
+func msToTime(ms float64) time.Time {
+	if math.IsNaN(ms) || math.IsInf(ms, 0) {
+		return time.Time{}
+	}
+	sec := math.Floor(ms / 1000)
+	return time.Unix(int64(sec), int64((ms-sec*1000)*float64(time.Millisecond))).UTC()
+}
+
+func timeToMs(t time.Time) float64 {
+	return float64(t.Unix())*1000 + float64(t.Nanosecond()/int(time.Millisecond))
+}
+
+// prealloc returns the capacity allocated for n items not read yet
+func prealloc(n uint32) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(n)
+}
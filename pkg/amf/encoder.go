@@ -0,0 +1,108 @@
+package amf
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+)
+
+// Encoder encodes the values of a message, maps, pointers and slices met again are references
+type Encoder struct {
+	w     io.Writer
+	ver   Version
+	depth int
+	buf   [9]byte
+
+	objects0  map[refID]int // AMF0 reference table
+	nobjects0 int
+
+	// AMF3 reference tables, new for every switch from AMF0
+	strings  map[string]int
+	objects  map[refID]int
+	nobjects int
+	traits   map[string]int
+	ntraits  int
+}
+
+// refID identifies a map, pointer or slice, with the type as pointers to a struct and its
+// first field are equal
+type refID struct {
+	t reflect.Type
+	p uintptr
+	n int
+}
+
+func refKey(v interface{}) (refID, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map, reflect.Ptr:
+		if rv.IsNil() {
+			return refID{}, false
+		}
+		return refID{rv.Type(), rv.Pointer(), 0}, true
+	case reflect.Slice:
+		if rv.Len() == 0 { // may share the address of zero size values
+			return refID{}, false
+		}
+		return refID{rv.Type(), rv.Pointer(), rv.Len()}, true
+	}
+	return refID{}, false
+}
+
+// NewEncoder returns an encoder of ver, AMF0 switches to AMF3 for values only AMF3 has
+func NewEncoder(w io.Writer, ver Version) *Encoder {
+	return &Encoder{w: w, ver: ver, objects0: make(map[refID]int)}
+}
+
+// Write writes raw bytes, for Externalizable
+func (e *Encoder) Write(p []byte) (int, error) {
+	return e.w.Write(p)
+}
+
+// Encode encodes v
+func (e *Encoder) Encode(v interface{}) error {
+	if e.ver == AMF3 {
+		return e.encodeAMF3(v)
+	}
+	return e.encodeAMF0(v)
+}
+
+// EncodeAMF3 encodes an AMF3 value with the reference tables of the value being encoded, for
+// Externalizable
+func (e *Encoder) EncodeAMF3(v interface{}) error {
+	return e.encodeAMF3(v)
+}
+
+func (e *Encoder) enter() error {
+	if e.depth++; e.depth > maxDepth {
+		return ErrNestingTooDeep
+	}
+	return nil
+}
+
+func (e *Encoder) leave() {
+	e.depth--
+}
+
+func (e *Encoder) write(b ...byte) error {
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *Encoder) writeByte(b byte) error {
+	e.buf[0] = b
+	_, err := e.w.Write(e.buf[:1])
+	return err
+}
+
+func (e *Encoder) writeStr(s string) error {
+	_, err := io.WriteString(e.w, s)
+	return err
+}
+
+func (e *Encoder) writeDouble(f float64) error {
+	binary.BigEndian.PutUint64(e.buf[:8], math.Float64bits(f))
+	_, err := e.w.Write(e.buf[:8])
+	return err
+}
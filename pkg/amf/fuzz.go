@@ -0,0 +1,35 @@
+package amf
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// fuzz decodes data of both versions, values decoded must encode to bytes which decode and
+// encode to the same bytes again. It's the go-fuzz entry, see Fuzz.
+func fuzz(data []byte) int {
+	score := 0
+	for _, ver := range []Version{AMF0, AMF3} {
+		vs, err := Unmarshal(data, ver)
+		if err != nil {
+			continue
+		}
+		b1, err := Marshal(ver, vs...)
+		if err != nil {
+			continue // e.g. AMF3 sealed members of empty names, which can't be dynamic
+		}
+		vs, err = Unmarshal(b1, ver)
+		if err != nil {
+			panic(fmt.Sprintf("AMF%d decode % x: %v", ver, b1, err))
+		}
+		b2, err := Marshal(ver, vs...)
+		if err != nil {
+			panic(fmt.Sprintf("AMF%d encode %#v: %v", ver, vs, err))
+		}
+		if !bytes.Equal(b1, b2) {
+			panic(fmt.Sprintf("AMF%d unstable % x != % x", ver, b1, b2))
+		}
+		score = 1
+	}
+	return score
+}
@@ -0,0 +1,9 @@
+//go:build gofuzz
+// +build gofuzz
+
+package amf
+
+// Fuzz is the entry of go-fuzz: go-fuzz-build playground/pkg/amf
+func Fuzz(data []byte) int {
+	return fuzz(data)
+}
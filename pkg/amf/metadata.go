@@ -0,0 +1,55 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// flags of MetaDataReform
+const (
+	ADD = 0x0 // add @setDataFrame, as publishers send
+	DEL = 0x3 // delete @setDataFrame, as players receive
+)
+
+const (
+	SetDataFrame = "@setDataFrame"
+	OnMetaData   = "onMetaData"
+)
+
+// setDataFrame is SetDataFrame encoded
+var setDataFrame = []byte{StringMarker, 0, byte(len(SetDataFrame))}
+
+func init() {
+	setDataFrame = append(setDataFrame, SetDataFrame...)
+}
+
+// MetaDataReform adds or deletes the @setDataFrame of a metadata message by flag
+func MetaDataReform(p []byte, flag uint8) ([]byte, error) {
+	r := bytes.NewReader(p)
+	v, err := NewDecoder(r, AMF0).Decode()
+	if err != nil {
+		return nil, err
+	}
+	name, ok := v.(string)
+	if !ok {
+		return nil, errors.New("amf: metadata without name")
+	}
+
+	switch flag {
+	case ADD:
+		if name != SetDataFrame {
+			b := make([]byte, len(setDataFrame)+len(p))
+			copy(b, setDataFrame)
+			copy(b[len(setDataFrame):], p)
+			p = b
+		}
+	case DEL:
+		if name == SetDataFrame {
+			p = p[len(p)-r.Len():]
+		}
+	default:
+		return nil, fmt.Errorf("amf: invalid metadata flag %d", flag)
+	}
+	return p, nil
+}
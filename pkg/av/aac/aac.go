@@ -0,0 +1,207 @@
+// Package aac parses AudioSpecificConfig of flv AAC sequence headers, and converts raw AAC
+// frames of flv and mp4 from and to ADTS of mpeg-ts.
+package aac
+
+import (
+	"errors"
+	"fmt"
+)
+
+// audio object types
+const (
+	ObjectTypeMain = 1
+	ObjectTypeLC   = 2
+	ObjectTypeSSR  = 3
+	ObjectTypeLTP  = 4
+	ObjectTypeSBR  = 5  // HE-AAC
+	ObjectTypePS   = 29 // HE-AACv2
+)
+
+// SamplesPerFrame of the core codec, doubled in output by SBR
+const SamplesPerFrame = 1024
+
+// SampleRates of sampling frequency indexes
+var SampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+const (
+	explicitRateIndex = 0x0f // the rate follows in 24 bits
+	syncExtensionType = 0x2b7
+	psSyncExtension   = 0x548
+)
+
+var ErrInvalidConfig = errors.New("aac: invalid AudioSpecificConfig")
+
+// Config is the AudioSpecificConfig of flv AAC sequence header and mp4 esds
+type Config struct {
+	ObjectType    uint8 // of the core codec, e.g. ObjectTypeLC of HE-AAC
+	SampleRate    int   // of the core codec
+	ChannelConfig uint8 // 0 if defined by a program config element in the stream
+
+	// HE-AAC signalled explicitly, or by the sync extension
+	SBR           bool
+	PS            bool
+	ExtSampleRate int // output sample rate of SBR
+}
+
+// ParseConfig decodes an AudioSpecificConfig
+func ParseConfig(b []byte) (*Config, error) {
+	r := &bitReader{b: b}
+	cfg := &Config{}
+
+	objectType := readObjectType(r)
+	cfg.SampleRate = readSampleRate(r)
+	cfg.ChannelConfig = uint8(r.bits(4))
+
+	if objectType == ObjectTypeSBR || objectType == ObjectTypePS {
+		cfg.SBR = true
+		cfg.PS = objectType == ObjectTypePS
+		cfg.ExtSampleRate = readSampleRate(r)
+		objectType = readObjectType(r)
+	}
+	cfg.ObjectType = objectType
+
+	if r.err != nil || objectType == 0 || cfg.SampleRate == 0 {
+		return nil, ErrInvalidConfig
+	}
+	if cfg.ChannelConfig > 7 {
+		return nil, fmt.Errorf("aac: invalid channel config %d", cfg.ChannelConfig)
+	}
+
+	// GASpecificConfig, the sync extension of backward compatible HE-AAC may follow
+	if objectType >= ObjectTypeMain && objectType <= ObjectTypeLTP && cfg.ChannelConfig != 0 && !cfg.SBR {
+		r.bit() // frameLengthFlag
+		if r.bit() == 1 {
+			r.bits(14) // coreCoderDelay
+		}
+		r.bit() // extensionFlag
+		cfg.parseSyncExtension(r)
+	}
+	return cfg, nil
+}
+
+// parseSyncExtension reads the implicit signalling of SBR and PS, which is optional
+func (cfg *Config) parseSyncExtension(r *bitReader) {
+	if r.left() < 16 || r.bits(11) != syncExtensionType {
+		return
+	}
+	if readObjectType(r) != ObjectTypeSBR || r.bit() != 1 || r.err != nil {
+		return
+	}
+	rate := readSampleRate(r)
+	if r.err != nil || rate == 0 {
+		return
+	}
+	cfg.SBR, cfg.ExtSampleRate = true, rate
+
+	if r.left() >= 12 && r.bits(11) == psSyncExtension {
+		cfg.PS = r.bit() == 1 && r.err == nil
+	}
+}
+
+func readObjectType(r *bitReader) uint8 {
+	t := r.bits(5)
+	if t == 31 {
+		t = 32 + r.bits(6)
+	}
+	return uint8(t)
+}
+
+func readSampleRate(r *bitReader) int {
+	i := r.bits(4)
+	if i == explicitRateIndex {
+		return int(r.bits(24))
+	}
+	if int(i) >= len(SampleRates) {
+		return 0
+	}
+	return SampleRates[i]
+}
+
+// Marshal encodes the config, HE-AAC is signalled explicitly
+func (cfg *Config) Marshal() []byte {
+	w := &bitWriter{}
+	if cfg.SBR {
+		objectType := uint32(ObjectTypeSBR)
+		if cfg.PS {
+			objectType = ObjectTypePS
+		}
+		w.bits(objectType, 5)
+		writeSampleRate(w, cfg.SampleRate)
+		w.bits(uint32(cfg.ChannelConfig), 4)
+		writeSampleRate(w, cfg.ExtSampleRate)
+		writeObjectType(w, cfg.ObjectType)
+	} else {
+		writeObjectType(w, cfg.ObjectType)
+		writeSampleRate(w, cfg.SampleRate)
+		w.bits(uint32(cfg.ChannelConfig), 4)
+	}
+	w.bits(0, 3) // GASpecificConfig of 1024 samples frames
+	return w.b
+}
+
+func writeObjectType(w *bitWriter, t uint8) {
+	if t >= 31 {
+		w.bits(31, 5)
+		w.bits(uint32(t-32), 6)
+		return
+	}
+	w.bits(uint32(t), 5)
+}
+
+func writeSampleRate(w *bitWriter, rate int) {
+	if i := sampleRateIndex(rate); i >= 0 {
+		w.bits(uint32(i), 4)
+		return
+	}
+	w.bits(explicitRateIndex, 4)
+	w.bits(uint32(rate), 24)
+}
+
+func sampleRateIndex(rate int) int {
+	for i, r := range SampleRates {
+		if r == rate {
+			return i
+		}
+	}
+	return -1
+}
+
+// Channels returns the output channels, 0 if defined in the stream
+func (cfg *Config) Channels() int {
+	switch {
+	case cfg.PS && cfg.ChannelConfig == 1:
+		return 2
+	case cfg.ChannelConfig == 7:
+		return 8
+	}
+	return int(cfg.ChannelConfig)
+}
+
+// OutputSampleRate returns the sample rate after SBR
+func (cfg *Config) OutputSampleRate() int {
+	if cfg.SBR && cfg.ExtSampleRate > 0 {
+		return cfg.ExtSampleRate
+	}
+	return cfg.SampleRate
+}
+
+// Profile returns the name of the codec, e.g. HE-AAC
+func (cfg *Config) Profile() string {
+	switch {
+	case cfg.PS:
+		return "HE-AACv2"
+	case cfg.SBR:
+		return "HE-AAC"
+	}
+	switch cfg.ObjectType {
+	case ObjectTypeMain:
+		return "Main"
+	case ObjectTypeLC:
+		return "LC"
+	case ObjectTypeSSR:
+		return "SSR"
+	case ObjectTypeLTP:
+		return "LTP"
+	}
+	return fmt.Sprintf("%d", cfg.ObjectType)
+}
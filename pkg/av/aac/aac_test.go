@@ -0,0 +1,116 @@
+package aac
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	// LC 22.05kHz stereo with the sync extension of SBR 44.1kHz and PS
+	w := &bitWriter{}
+	w.bits(ObjectTypeLC, 5)
+	w.bits(7, 4)
+	w.bits(2, 4)
+	w.bits(0, 3)
+	w.bits(syncExtensionType, 11)
+	w.bits(ObjectTypeSBR, 5)
+	w.bits(1, 1)
+	w.bits(4, 4)
+	w.bits(psSyncExtension, 11)
+	w.bits(1, 1)
+	implicit := w.b
+
+	// LC 37.8kHz mono, an explicit rate
+	w = &bitWriter{}
+	w.bits(ObjectTypeLC, 5)
+	w.bits(explicitRateIndex, 4)
+	w.bits(37800, 24)
+	w.bits(1, 4)
+	w.bits(0, 3)
+	explicitRate := w.b
+
+	tests := []struct {
+		b       []byte
+		want    Config
+		profile string
+		rate    int
+		chans   int
+	}{
+		{[]byte{0x12, 0x10}, Config{ObjectType: ObjectTypeLC, SampleRate: 44100, ChannelConfig: 2}, "LC", 44100, 2},
+		{[]byte{0x2b, 0x92, 0x08, 0x00}, Config{ObjectType: ObjectTypeLC, SampleRate: 22050, ChannelConfig: 2, SBR: true, ExtSampleRate: 44100}, "HE-AAC", 44100, 2},
+		{[]byte{0xeb, 0x09, 0x88, 0x00}, Config{ObjectType: ObjectTypeLC, SampleRate: 24000, ChannelConfig: 1, SBR: true, PS: true, ExtSampleRate: 48000}, "HE-AACv2", 48000, 2},
+		{implicit, Config{ObjectType: ObjectTypeLC, SampleRate: 22050, ChannelConfig: 2, SBR: true, PS: true, ExtSampleRate: 44100}, "HE-AACv2", 44100, 2},
+		{explicitRate, Config{ObjectType: ObjectTypeLC, SampleRate: 37800, ChannelConfig: 1}, "LC", 37800, 1},
+		{[]byte{0x11, 0xb8}, Config{ObjectType: ObjectTypeLC, SampleRate: 48000, ChannelConfig: 7}, "LC", 48000, 8},
+	}
+	for _, tt := range tests {
+		cfg, err := ParseConfig(tt.b)
+		if err != nil {
+			t.Errorf("% x: %v", tt.b, err)
+			continue
+		}
+		if *cfg != tt.want {
+			t.Errorf("% x: got %+v, want %+v", tt.b, *cfg, tt.want)
+		}
+		if cfg.Profile() != tt.profile || cfg.OutputSampleRate() != tt.rate || cfg.Channels() != tt.chans {
+			t.Errorf("% x: %s %d %d", tt.b, cfg.Profile(), cfg.OutputSampleRate(), cfg.Channels())
+		}
+
+		again, err := ParseConfig(cfg.Marshal())
+		if err != nil || *again != *cfg {
+			t.Errorf("% x: marshalled % x parsed %+v %v", tt.b, cfg.Marshal(), again, err)
+		}
+	}
+
+	if b := (&Config{ObjectType: ObjectTypeLC, SampleRate: 44100, ChannelConfig: 2}).Marshal(); !bytes.Equal(b, []byte{0x12, 0x10}) {
+		t.Errorf("marshal % x", b)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, b := range [][]byte{nil, {0x12}, {0x00, 0x10}, {0x17, 0x90}, {0x12, 0x40}} {
+		if cfg, err := ParseConfig(b); err == nil {
+			t.Errorf("% x: got %+v", b, cfg)
+		}
+	}
+}
+
+func TestADTS(t *testing.T) {
+	cfg := &Config{ObjectType: ObjectTypeLC, SampleRate: 48000, ChannelConfig: 2, SBR: true, ExtSampleRate: 96000}
+	raw := bytes.Repeat([]byte{0xab}, 300)
+	frame, err := cfg.AppendADTSHeader(nil, len(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame = append(frame, raw...)
+
+	got, hdrSize, frameLen, err := ParseADTS(append(frame, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdrSize != ADTSHeaderSize || frameLen != len(frame) || !bytes.Equal(frame[hdrSize:frameLen], raw) {
+		t.Errorf("header %d, frame %d of %d", hdrSize, frameLen, len(frame))
+	}
+	// the core codec only
+	if want := (Config{ObjectType: ObjectTypeLC, SampleRate: 48000, ChannelConfig: 2}); *got != want {
+		t.Errorf("got %+v, want %+v", *got, want)
+	}
+
+	for _, bad := range []*Config{
+		{ObjectType: ObjectTypeSBR, SampleRate: 44100, ChannelConfig: 2},
+		{ObjectType: ObjectTypeLC, SampleRate: 37800, ChannelConfig: 2},
+	} {
+		if _, err := bad.AppendADTSHeader(nil, 10); err == nil {
+			t.Errorf("%+v: no error", bad)
+		}
+	}
+	if _, err := cfg.AppendADTSHeader(nil, 8192); err == nil {
+		t.Error("oversized frame: no error")
+	}
+
+	for _, b := range [][]byte{frame[:6], frame[:100], append([]byte{0xfe}, frame[1:]...)} {
+		if _, _, _, err := ParseADTS(b); err == nil {
+			t.Errorf("% x: no error", b[:7])
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package aac
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ADTSHeaderSize without crc
+const ADTSHeaderSize = 7
+
+const maxADTSFrameSize = 1<<13 - 1
+
+// AppendADTSHeader appends the adts header without crc of a raw frame of size to dst. ADTS
+// carries the core codec only, SBR and PS are signalled implicitly by the frames.
+func (cfg *Config) AppendADTSHeader(dst []byte, size int) ([]byte, error) {
+	if cfg.ObjectType < ObjectTypeMain || cfg.ObjectType > ObjectTypeLTP {
+		return nil, fmt.Errorf("aac: object type %d can't be carried by adts", cfg.ObjectType)
+	}
+	freqIndex := sampleRateIndex(cfg.SampleRate)
+	if freqIndex < 0 {
+		return nil, fmt.Errorf("aac: sample rate %d can't be carried by adts", cfg.SampleRate)
+	}
+	frameLen := ADTSHeaderSize + size
+	if frameLen > maxADTSFrameSize {
+		return nil, fmt.Errorf("aac: frame size %d exceeds adts", size)
+	}
+
+	profile, freq, channels := cfg.ObjectType-1, byte(freqIndex), cfg.ChannelConfig
+	return append(dst,
+		0xff,
+		0xf1, // mpeg-4, layer 0, protection absent
+		profile<<6|freq<<2|channels>>2,
+		channels<<6|byte(frameLen>>11),
+		byte(frameLen>>3),
+		byte(frameLen<<5)|0x1f, // buffer fullness 0x7ff
+		0xfc,
+	), nil
+}
+
+// ParseADTS returns the config, header size and frame size of the adts frame at b, the raw
+// frame is b[hdrSize:frameLen]
+func ParseADTS(b []byte) (cfg *Config, hdrSize, frameLen int, err error) {
+	if len(b) < ADTSHeaderSize || b[0] != 0xff || b[1]&0xf6 != 0xf0 {
+		return nil, 0, 0, errors.New("aac: invalid adts header")
+	}
+
+	freqIndex := int(b[2] >> 2 & 0x0f)
+	if freqIndex >= len(SampleRates) {
+		return nil, 0, 0, fmt.Errorf("aac: invalid adts frequency index %d", freqIndex)
+	}
+	cfg = &Config{
+		ObjectType:    b[2]>>6 + 1,
+		SampleRate:    SampleRates[freqIndex],
+		ChannelConfig: (b[2]&0x01)<<2 | b[3]>>6,
+	}
+	hdrSize = ADTSHeaderSize
+	if b[1]&0x01 == 0 { // crc present
+		hdrSize += 2
+	}
+	frameLen = int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5]>>5)
+	if frameLen < hdrSize || frameLen > len(b) {
+		return nil, 0, 0, fmt.Errorf("aac: invalid adts frame length %d", frameLen)
+	}
+	return cfg, hdrSize, frameLen, nil
+}
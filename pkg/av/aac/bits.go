@@ -0,0 +1,45 @@
+package aac
+
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err error
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.b)*8 {
+		r.err = ErrInvalidConfig
+		return 0
+	}
+	v := r.b[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return uint32(v)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+// left returns the bits not read
+func (r *bitReader) left() int {
+	return len(r.b)*8 - r.pos
+}
+
+type bitWriter struct {
+	b []byte
+	n int // bits written
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << (7 - uint(w.n%8))
+		w.n++
+	}
+}
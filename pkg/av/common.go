@@ -8,6 +8,11 @@ const (
 const (
 	KEY_FRAME   = 1
 	INTER_FRAME = 2
+	INFO_FRAME  = 5 // video info or command frame
+)
+
+const (
+	VIDEO_H264 = 7 // flv video codec id of AVC
 )
 
 const (
@@ -39,4 +44,40 @@ const (
 
 	AAC_SEQHDR = 0
 	AAC_RAW    = 1
-)	
\ No newline at end of file
+)
+
+// enhanced rtmp, whose tag headers carry a FourCC instead of the codec id
+const (
+	VIDEO_EX_HEADER = 0x80 // flag of the first byte of video tags
+	SOUND_EX_HEADER = 9    // sound format of audio tags
+
+	// packet types of ExVideoTagHeader, the first three are shared by ExAudioTagHeader and
+	// match AVC and AAC packet types
+	EX_SEQUENCE_START         = 0
+	EX_CODED_FRAMES           = 1 // with composition time of avc1 and hvc1
+	EX_SEQUENCE_END           = 2
+	EX_CODED_FRAMESX          = 3 // composition time is 0
+	EX_METADATA               = 4
+	EX_MPEG2TS_SEQUENCE_START = 5
+	EX_MULTITRACK             = 6
+	EX_MODEX                  = 7
+
+	// packet types of ExAudioTagHeader only
+	EX_AUDIO_MULTICHANNEL_CONFIG = 4
+	EX_AUDIO_MULTITRACK          = 5
+	EX_AUDIO_MODEX               = 7
+)
+
+const (
+	FOURCC_AVC  = "avc1"
+	FOURCC_HEVC = "hvc1"
+	FOURCC_AV1  = "av01"
+	FOURCC_VP9  = "vp09"
+
+	FOURCC_AAC  = "mp4a"
+	FOURCC_MP3  = ".mp3"
+	FOURCC_OPUS = "Opus"
+	FOURCC_FLAC = "fLaC"
+	FOURCC_AC3  = "ac-3"
+	FOURCC_EAC3 = "ec-3"
+)
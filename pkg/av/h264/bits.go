@@ -0,0 +1,64 @@
+package h264
+
+// bitReader reads exp-golomb coded fields of a rbsp
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err error
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.b)*8 {
+		r.err = ErrInvalidSPS
+		return 0
+	}
+	v := r.b[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return uint32(v)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bit() == 0 && r.err == nil {
+		if zeros++; zeros > 31 {
+			r.err = ErrInvalidSPS
+			return 0
+		}
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 != 0 {
+		return int32(v+1) / 2
+	}
+	return -int32(v / 2)
+}
+
+// rbsp removes emulation prevention bytes of a nalu
+func rbsp(nalu []byte) []byte {
+	b := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, v := range nalu {
+		if zeros >= 2 && v == 3 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		b = append(b, v)
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+package h264
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidConfig = errors.New("h264: invalid AVCDecoderConfigurationRecord")
+
+// AVCConfig is the AVCDecoderConfigurationRecord of flv AVC sequence header and mp4 avcC
+type AVCConfig struct {
+	Profile              uint8
+	ProfileCompatibility uint8
+	Level                uint8
+	LengthSize           int // of nalu length in AVCC frames, 1, 2 or 4
+	SPS, PPS             [][]byte
+}
+
+func ParseAVCConfig(b []byte) (*AVCConfig, error) {
+	if len(b) < 7 || b[0] != 1 {
+		return nil, ErrInvalidConfig
+	}
+
+	cfg := &AVCConfig{
+		Profile:              b[1],
+		ProfileCompatibility: b[2],
+		Level:                b[3],
+		LengthSize:           int(b[4]&0x03) + 1,
+	}
+	if cfg.LengthSize == 3 {
+		return nil, ErrInvalidConfig
+	}
+	b = b[5:]
+
+	var err error
+	if cfg.SPS, b, err = readParamSets(b, int(b[0]&0x1f)); err != nil {
+		return nil, err
+	}
+	if len(cfg.SPS) == 0 {
+		return nil, errors.New("h264: no sps in AVCDecoderConfigurationRecord")
+	}
+	if len(b) < 1 {
+		return nil, errors.New("h264: no pps in AVCDecoderConfigurationRecord")
+	}
+	// the extension of high profiles after pps is not kept
+	if cfg.PPS, _, err = readParamSets(b, int(b[0])); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readParamSets reads n parameter sets with 2 bytes length after the count byte
+func readParamSets(b []byte, n int) ([][]byte, []byte, error) {
+	b = b[1:]
+	sets := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 2 {
+			return nil, nil, errors.New("h264: truncated parameter set")
+		}
+		size := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+size || size == 0 {
+			return nil, nil, errors.New("h264: truncated parameter set")
+		}
+		sets = append(sets, b[2:2+size])
+		b = b[2+size:]
+	}
+	return sets, b, nil
+}
+
+// Marshal builds the record, profile and level are of the first sps if zero, nalu length is
+// 4 bytes if LengthSize is zero
+func (cfg *AVCConfig) Marshal() []byte {
+	profile, compat, level := cfg.Profile, cfg.ProfileCompatibility, cfg.Level
+	if profile == 0 && len(cfg.SPS) > 0 && len(cfg.SPS[0]) >= 4 {
+		sps := cfg.SPS[0]
+		profile, compat, level = sps[1], sps[2], sps[3]
+	}
+	lengthSize := cfg.LengthSize
+	if lengthSize == 0 {
+		lengthSize = 4
+	}
+
+	b := []byte{1, profile, compat, level, 0xfc | byte(lengthSize-1), 0xe0 | byte(len(cfg.SPS))}
+	for _, s := range cfg.SPS {
+		b = append(b, byte(len(s)>>8), byte(len(s)))
+		b = append(b, s...)
+	}
+	b = append(b, byte(len(cfg.PPS)))
+	for _, p := range cfg.PPS {
+		b = append(b, byte(len(p)>>8), byte(len(p)))
+		b = append(b, p...)
+	}
+	return b
+}
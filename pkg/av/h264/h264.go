@@ -0,0 +1,130 @@
+// Package h264 parses H.264 codec configs of flv sequence headers, and converts nalus between
+// AVCC, prefixed by their length as in flv and mp4, and Annex-B, separated by start codes as
+// in mpeg-ts.
+package h264
+
+import (
+	"errors"
+	"fmt"
+)
+
+// nal unit types
+const (
+	NALUNonIDR = 1
+	NALUIDR    = 5
+	NALUSEI    = 6
+	NALUSPS    = 7
+	NALUPPS    = 8
+	NALUAUD    = 9
+)
+
+// StartCode separates Annex-B nalus
+var StartCode = []byte{0, 0, 0, 1}
+
+// NALUType returns the type of nalu, 0 if empty
+func NALUType(nalu []byte) uint8 {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] & 0x1f
+}
+
+// RangeAVCC calls fn for every nalu of b prefixed by lengthSize bytes length, until fn
+// returns false
+func RangeAVCC(b []byte, lengthSize int, fn func(nalu []byte) bool) error {
+	if lengthSize < 1 || lengthSize > 4 {
+		return fmt.Errorf("h264: invalid nalu length size %d", lengthSize)
+	}
+
+	for len(b) > 0 {
+		if len(b) < lengthSize {
+			return errors.New("h264: truncated nalu length")
+		}
+		var size int
+		for i := 0; i < lengthSize; i++ {
+			size = size<<8 | int(b[i])
+		}
+		b = b[lengthSize:]
+		if size > len(b) {
+			return fmt.Errorf("h264: nalu size %d exceeds %d", size, len(b))
+		}
+		if !fn(b[:size]) {
+			return nil
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+// SplitAVCC splits nalus prefixed by lengthSize bytes length
+func SplitAVCC(b []byte, lengthSize int) ([][]byte, error) {
+	var nalus [][]byte
+	err := RangeAVCC(b, lengthSize, func(nalu []byte) bool {
+		nalus = append(nalus, nalu)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nalus, nil
+}
+
+// SplitAnnexB splits nalus separated by 3 or 4 bytes start codes
+func SplitAnnexB(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); {
+		if b[i] == 0 && b[i+1] == 0 && b[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				if end > start && b[end-1] == 0 { // 4 bytes start code
+					end--
+				}
+				nalus = append(nalus, b[start:end])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(b) {
+		nalus = append(nalus, b[start:])
+	}
+	return nalus
+}
+
+// AppendAVCC appends nalus with 4 bytes length to dst
+func AppendAVCC(dst []byte, nalus ...[]byte) []byte {
+	for _, n := range nalus {
+		dst = append(dst, byte(len(n)>>24), byte(len(n)>>16), byte(len(n)>>8), byte(len(n)))
+		dst = append(dst, n...)
+	}
+	return dst
+}
+
+// AppendAnnexB appends nalus with 4 bytes start code to dst
+func AppendAnnexB(dst []byte, nalus ...[]byte) []byte {
+	for _, n := range nalus {
+		dst = append(append(dst, StartCode...), n...)
+	}
+	return dst
+}
+
+// AVCCToAnnexB converts nalus prefixed by lengthSize bytes length to Annex-B
+func AVCCToAnnexB(b []byte, lengthSize int) ([]byte, error) {
+	out := make([]byte, 0, len(b)+16)
+	err := RangeAVCC(b, lengthSize, func(nalu []byte) bool {
+		out = AppendAnnexB(out, nalu)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AnnexBToAVCC converts Annex-B nalus to AVCC with 4 bytes length
+func AnnexBToAVCC(b []byte) []byte {
+	return AppendAVCC(make([]byte, 0, len(b)+16), SplitAnnexB(b)...)
+}
@@ -0,0 +1,229 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10}
+	testPPS = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+// bitWriter writes exp-golomb coded fields, the inverse of bitReader
+type bitWriter struct {
+	b []byte
+	n int // bits of the last byte
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << (7 - uint(w.n%8))
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for v>>uint(n) > 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+// nalu ends the rbsp and inserts emulation prevention bytes
+func (w *bitWriter) nalu(typ byte) []byte {
+	w.bits(1, 1) // rbsp_stop_one_bit
+	b := []byte{0x60 | typ}
+	zeros := 0
+	for _, v := range w.b {
+		if zeros >= 2 && v <= 3 {
+			b = append(b, 3)
+			zeros = 0
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		b = append(b, v)
+	}
+	return b
+}
+
+// sps1080 is a 1080p high profile sps with cropping and 29.97fps vui timing
+func sps1080(frameMbsOnly bool) []byte {
+	w := &bitWriter{}
+	w.bits(100, 8)
+	w.bits(0, 8)
+	w.bits(40, 8)
+	w.ue(0) // id
+	w.ue(1) // chroma_format_idc
+	w.ue(0)
+	w.ue(0)
+	w.bits(0, 2) // qpprime_y_zero_transform_bypass_flag, seq_scaling_matrix_present_flag
+	w.ue(0)      // log2_max_frame_num_minus4
+	w.ue(0)      // pic_order_cnt_type
+	w.ue(2)
+	w.ue(4)      // max_num_ref_frames
+	w.bits(0, 1) // gaps_in_frame_num_value_allowed_flag
+	w.ue(119)
+	if frameMbsOnly {
+		w.ue(67)
+		w.bits(1, 1)
+	} else {
+		w.ue(33)
+		w.bits(0, 2) // mb_adaptive_frame_field_flag
+	}
+	w.bits(1, 1) // direct_8x8_inference_flag
+	w.bits(1, 1) // frame_cropping_flag
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	if frameMbsOnly {
+		w.ue(4)
+	} else {
+		w.ue(2)
+	}
+
+	w.bits(1, 1)      // vui_parameters_present_flag
+	w.bits(1, 1)      // aspect_ratio_info_present_flag
+	w.bits(255, 8)    // Extended_SAR
+	w.bits(4, 16)     // sar_width
+	w.bits(3, 16)     // sar_height
+	w.bits(0, 3)      // overscan, video signal type, chroma loc
+	w.bits(1, 1)      // timing_info_present_flag
+	w.bits(1001, 32)  // num_units_in_tick
+	w.bits(60000, 32) // time_scale
+	w.bits(1, 1)      // fixed_frame_rate_flag
+	w.bits(0, 5)      // nal, vcl hrd, pic struct, bitstream restriction
+	return w.nalu(NALUSPS)
+}
+
+func TestParseSPS(t *testing.T) {
+	s, err := ParseSPS(testSPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Width != 1280 || s.Height != 720 || s.Profile() != "High" || s.Level() != "3.1" || s.ChromaFormatIdc != 1 || !s.FrameMbsOnly {
+		t.Errorf("got %+v", s)
+	}
+	if s.FrameRate() != 0 {
+		t.Errorf("frame rate %v without timing", s.FrameRate())
+	}
+
+	for _, progressive := range []bool{true, false} {
+		b := sps1080(progressive)
+		s, err := ParseSPS(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Width != 1920 || s.Height != 1080 || s.FrameMbsOnly != progressive || s.Level() != "4.0" {
+			t.Errorf("got %+v", s)
+		}
+		if s.SarWidth != 4 || s.SarHeight != 3 || !s.FixedFrameRate {
+			t.Errorf("vui %+v", s)
+		}
+		if fps := s.FrameRate(); fps < 29.97 || fps > 29.98 {
+			t.Errorf("frame rate %v", fps)
+		}
+	}
+}
+
+func TestParseSPSErrors(t *testing.T) {
+	for _, b := range [][]byte{nil, testPPS, testSPS[:5], {0x67, 0x42, 0, 0x1e, 0, 0, 0}} {
+		if _, err := ParseSPS(b); err == nil {
+			t.Errorf("% x: no error", b)
+		}
+	}
+
+	// truncated vui is ignored
+	b := sps1080(true)
+	s, err := ParseSPS(b[:len(b)-8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Width != 1920 || s.FrameRate() != 0 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestAVCConfig(t *testing.T) {
+	b := (&AVCConfig{SPS: [][]byte{testSPS}, PPS: [][]byte{testPPS}}).Marshal()
+	cfg, err := ParseAVCConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Profile != 0x64 || cfg.Level != 0x1f || cfg.LengthSize != 4 {
+		t.Errorf("got %+v", cfg)
+	}
+	if len(cfg.SPS) != 1 || !bytes.Equal(cfg.SPS[0], testSPS) || len(cfg.PPS) != 1 || !bytes.Equal(cfg.PPS[0], testPPS) {
+		t.Errorf("parameter sets % x % x", cfg.SPS, cfg.PPS)
+	}
+	if !bytes.Equal(cfg.Marshal(), b) {
+		t.Errorf("marshal % x, want % x", cfg.Marshal(), b)
+	}
+
+	for i := 1; i < len(b)-1; i++ {
+		if _, err := ParseAVCConfig(b[:i]); err == nil {
+			t.Errorf("truncated at %d: no error", i)
+		}
+	}
+}
+
+func TestAnnexB(t *testing.T) {
+	b := []byte{0, 0, 0, 1, 9, 0xf0, 0, 0, 1, 0x65, 1, 2, 0, 0, 0, 1, 0x41, 3}
+	nalus := SplitAnnexB(b)
+	want := [][]byte{{9, 0xf0}, {0x65, 1, 2}, {0x41, 3}}
+	if len(nalus) != len(want) {
+		t.Fatalf("got %d nalus, want %d", len(nalus), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(nalus[i], want[i]) {
+			t.Errorf("nalu %d: % x, want % x", i, nalus[i], want[i])
+		}
+	}
+
+	avcc := AnnexBToAVCC(b)
+	if got, _ := SplitAVCC(avcc, 4); len(got) != 3 || !bytes.Equal(got[1], want[1]) {
+		t.Errorf("avcc % x", avcc)
+	}
+	annexB, err := AVCCToAnnexB(avcc, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(annexB, AppendAnnexB(nil, want...)) {
+		t.Errorf("annex-b % x", annexB)
+	}
+}
+
+func TestRangeAVCC(t *testing.T) {
+	b := []byte{0, 2, 0x65, 1, 0, 1, 0x41}
+	var types []uint8
+	if err := RangeAVCC(b, 2, func(nalu []byte) bool {
+		types = append(types, NALUType(nalu))
+		return true
+	}); err != nil || len(types) != 2 || types[0] != NALUIDR || types[1] != NALUNonIDR {
+		t.Errorf("got %v %v", types, err)
+	}
+
+	n := 0
+	RangeAVCC(b, 2, func([]byte) bool { n++; return false })
+	if n != 1 {
+		t.Errorf("called %d times after false", n)
+	}
+
+	for _, bad := range [][]byte{{0, 3, 1, 2}, {0}} {
+		if _, err := SplitAVCC(bad, 2); err == nil {
+			t.Errorf("% x: no error", bad)
+		}
+	}
+	if _, err := SplitAVCC(b, 0); err == nil {
+		t.Error("length size 0: no error")
+	}
+}
@@ -0,0 +1,235 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidSPS = errors.New("h264: invalid sps")
+
+// SPS is the sequence parameter set, which has the picture size and frame rate of a stream
+type SPS struct {
+	ProfileIdc      uint8
+	ConstraintFlags uint8
+	LevelIdc        uint8
+	ID              uint32
+
+	ChromaFormatIdc uint32 // 0 monochrome, 1 4:2:0, 2 4:2:2, 3 4:4:4
+	BitDepthLuma    uint32
+	BitDepthChroma  uint32
+	FrameMbsOnly    bool // progressive
+
+	Width, Height int // cropped
+
+	// vui, zero if absent
+	SarWidth, SarHeight uint32 // sample aspect ratio
+	NumUnitsInTick      uint32
+	TimeScale           uint32
+	FixedFrameRate      bool
+}
+
+// ParseSPS decodes a sps nalu, with the nalu header
+func ParseSPS(nalu []byte) (*SPS, error) {
+	if len(nalu) < 4 || NALUType(nalu) != NALUSPS {
+		return nil, ErrInvalidSPS
+	}
+	r := &bitReader{b: rbsp(nalu[1:])}
+
+	s := &SPS{
+		ProfileIdc:      uint8(r.bits(8)),
+		ConstraintFlags: uint8(r.bits(8)),
+		LevelIdc:        uint8(r.bits(8)),
+		ID:              r.ue(),
+		ChromaFormatIdc: 1,
+		BitDepthLuma:    8,
+		BitDepthChroma:  8,
+	}
+
+	separateColourPlane := false
+	switch s.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if s.ChromaFormatIdc = r.ue(); s.ChromaFormatIdc == 3 {
+			separateColourPlane = r.bit() == 1
+		}
+		s.BitDepthLuma = r.ue() + 8
+		s.BitDepthChroma = r.ue() + 8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+
+		// seq_scaling_matrix_present_flag
+		if r.bit() == 1 {
+			n := 8
+			if s.ChromaFormatIdc == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if r.bit() == 1 {
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue()
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+
+	mbWidth := r.ue() + 1
+	mbHeight := r.ue() + 1
+	s.FrameMbsOnly = r.bit() == 1
+	if !s.FrameMbsOnly {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.bit() == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	vui := r.bit() == 1
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// crop units of the chroma format
+	fieldMbs := uint32(2)
+	if s.FrameMbsOnly {
+		fieldMbs = 1
+	}
+	cropX, cropY := uint32(1), fieldMbs
+	if !separateColourPlane && s.ChromaFormatIdc != 0 {
+		if s.ChromaFormatIdc == 1 || s.ChromaFormatIdc == 2 {
+			cropX = 2
+		}
+		if s.ChromaFormatIdc == 1 {
+			cropY *= 2
+		}
+	}
+
+	width, height := mbWidth*16, mbHeight*16*fieldMbs
+	if (cropLeft+cropRight)*cropX >= width || (cropTop+cropBottom)*cropY >= height {
+		return nil, ErrInvalidSPS
+	}
+	s.Width = int(width - (cropLeft+cropRight)*cropX)
+	s.Height = int(height - (cropTop+cropBottom)*cropY)
+
+	if vui {
+		s.parseVUI(r)
+	}
+	return s, nil
+}
+
+// sample aspect ratios of aspect_ratio_idc 1 to 16
+var sampleAspectRatios = [][2]uint32{
+	{1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11}, {32, 11},
+	{80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+const extendedSAR = 255
+
+// parseVUI reads the aspect ratio and timing of vui, which are left zero if truncated as
+// written by some encoders
+func (s *SPS) parseVUI(r *bitReader) {
+	var sarWidth, sarHeight uint32
+	if r.bit() == 1 { // aspect_ratio_info_present_flag
+		idc := r.bits(8)
+		switch {
+		case idc == extendedSAR:
+			sarWidth, sarHeight = r.bits(16), r.bits(16)
+		case idc >= 1 && int(idc) <= len(sampleAspectRatios):
+			sarWidth, sarHeight = sampleAspectRatios[idc-1][0], sampleAspectRatios[idc-1][1]
+		}
+	}
+	if r.bit() == 1 { // overscan_info_present_flag
+		r.bit()
+	}
+	if r.bit() == 1 { // video_signal_type_present_flag
+		r.bits(4) // video_format, video_full_range_flag
+		if r.bit() == 1 {
+			r.bits(24) // colour_primaries, transfer_characteristics, matrix_coefficients
+		}
+	}
+	if r.bit() == 1 { // chroma_loc_info_present_flag
+		r.ue()
+		r.ue()
+	}
+	if r.err != nil {
+		return
+	}
+	s.SarWidth, s.SarHeight = sarWidth, sarHeight
+
+	if r.bit() == 1 { // timing_info_present_flag
+		numUnits, timeScale := r.bits(32), r.bits(32)
+		fixed := r.bit() == 1
+		if r.err == nil {
+			s.NumUnitsInTick, s.TimeScale, s.FixedFrameRate = numUnits, timeScale, fixed
+		}
+	}
+}
+
+// FrameRate returns frames per second of vui timing, 0 if unknown
+func (s *SPS) FrameRate() float64 {
+	if s.NumUnitsInTick == 0 || s.TimeScale == 0 {
+		return 0
+	}
+	return float64(s.TimeScale) / float64(2*s.NumUnitsInTick)
+}
+
+// Profile returns the name of the profile, e.g. High
+func (s *SPS) Profile() string {
+	switch s.ProfileIdc {
+	case 66:
+		if s.ConstraintFlags&0x40 != 0 {
+			return "Constrained Baseline"
+		}
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4"
+	}
+	return fmt.Sprintf("%d", s.ProfileIdc)
+}
+
+// Level returns the level, e.g. 3.1
+func (s *SPS) Level() string {
+	constrained := s.ConstraintFlags&0x10 != 0 && (s.ProfileIdc == 66 || s.ProfileIdc == 77 || s.ProfileIdc == 88)
+	if s.LevelIdc == 9 || (s.LevelIdc == 11 && constrained) {
+		return "1b"
+	}
+	return fmt.Sprintf("%d.%d", s.LevelIdc/10, s.LevelIdc%10)
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
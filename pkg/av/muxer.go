@@ -1,3 +1,6 @@
 package av
 
-//TODO:
\ No newline at end of file
+// Muxer writes packets into a container, e.g. flv file or mpeg-ts
+type Muxer interface {
+	WritePacket(*Packet) error
+}
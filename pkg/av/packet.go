@@ -6,14 +6,20 @@ type AudioPacketHeader interface {
 	PacketHeader
 	SoundFormat() uint8
 	AACPacketType() uint8
+	IsSeq() bool // AAC or enhanced sequence header
+	IsExHeader() bool
+	FourCC() string
 }
 
 type VideoPacketHeader interface {
 	PacketHeader
 	IsKeyFrame() bool
 	IsSeq() bool
-	CodecID() uint8
+	CodecID() uint8 // 0 of enhanced rtmp
 	CompositionTime() int32
+	IsExHeader() bool
+	FourCC() string
+	PacketType() uint8
 }
 
 type Packet struct {
@@ -8,9 +8,23 @@ func NewDemuxer() *Demuxer {
 	return &Demuxer{}
 }
 
+// Demux returns a packet of the payload, whose tag header is decoded as Header. Metadata is
+// returned unchanged.
 func (dm *Demuxer) Demux(pkt *av.Packet) (*av.Packet, error) {
-	//TODO:
-	return pkt, nil
+	if !pkt.IsAudio && !pkt.IsVideo {
+		return pkt, nil
+	}
+
+	t := new(Tag)
+	n, err := t.decodeMediaTagHeader(pkt.Data, pkt.IsVideo)
+	if err != nil {
+		return nil, err
+	}
+
+	p := *pkt
+	p.Header = t
+	p.Data = pkt.Data[n:]
+	return &p, nil
 }
 
 func (dm *Demuxer) DemuxHdr(pkt *av.Packet) error {
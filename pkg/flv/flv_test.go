@@ -0,0 +1,235 @@
+package flv
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"playground/pkg/amf"
+	"playground/pkg/av"
+)
+
+func metaDataPacket(t *testing.T) *av.Packet {
+	b, err := amf.Marshal(amf.AMF0, amf.OnMetaData, amf.ECMAArray{"width": 1280.0, "height": 720.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &av.Packet{IsMetaData: true, Data: b}
+}
+
+func testPackets(t *testing.T) []*av.Packet {
+	return []*av.Packet{
+		metaDataPacket(t),
+		NewVideoPacket(0, av.KEY_FRAME, av.VIDEO_H264, av.AVC_SEQHDR, 0, []byte{1, 0x64, 0, 0x1f, 0xff}),
+		NewAudioPacket(0, av.SOUND_AAC, av.SOUND_44Khz, av.SOUND_16BIT, av.SOUND_STEREO, av.AAC_SEQHDR, []byte{0x12, 0x10}),
+		NewVideoPacket(40, av.KEY_FRAME, av.VIDEO_H264, av.AVC_NALU, 80, []byte{0, 0, 0, 1, 0x65}),
+		NewVideoPacket(80, av.INTER_FRAME, av.VIDEO_H264, av.AVC_NALU, -40, []byte{0, 0, 0, 1, 0x41}),
+		NewVideoPacket(120, av.INTER_FRAME, av.VIDEO_H264, av.AVC_NALU, -1<<23, []byte{0, 0, 0, 1, 0x01}),
+		NewAudioPacket(0x1234567, av.SOUND_AAC, av.SOUND_44Khz, av.SOUND_16BIT, av.SOUND_STEREO, av.AAC_RAW, []byte{7, 8, 9}),
+		NewAudioPacket(0x89abcdef, av.SOUND_MP3, av.SOUND_22Khz, av.SOUND_16BIT, av.SOUND_MONO, 0, []byte{1, 2}),
+	}
+}
+
+func writeFile(t *testing.T, pkts []*av.Packet) []byte {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	if err := w.WriteHeader(true, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range pkts {
+		if err := w.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	pkts := testPackets(t)
+	r := NewReader(bytes.NewReader(writeFile(t, pkts)))
+
+	hasAudio, hasVideo, err := r.ReadHeader()
+	if err != nil || !hasAudio || !hasVideo {
+		t.Fatalf("ReadHeader: %v %v %v", hasAudio, hasVideo, err)
+	}
+
+	for i, want := range pkts {
+		got, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if got.IsAudio != want.IsAudio || got.IsVideo != want.IsVideo || got.IsMetaData != want.IsMetaData {
+			t.Fatalf("packet %d: type differs", i)
+		}
+		if got.TimeStamp != want.TimeStamp {
+			t.Errorf("packet %d: timestamp 0x%x, want 0x%x", i, got.TimeStamp, want.TimeStamp)
+		}
+		if !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("packet %d: data % x, want % x", i, got.Data, want.Data)
+		}
+
+		tag := got.Header.(*Tag)
+		switch {
+		case got.IsVideo:
+			wh := want.Header.(*Tag)
+			if tag.CompositionTime() != wh.CompositionTime() || tag.IsKeyFrame() != wh.IsKeyFrame() || tag.IsSeq() != wh.IsSeq() || tag.CodecID() != wh.CodecID() {
+				t.Errorf("packet %d: video header %+v, want %+v", i, tag.mediaTag, wh.mediaTag)
+			}
+			if tag.TagType() != av.TagVideo {
+				t.Errorf("packet %d: tag type %d", i, tag.TagType())
+			}
+		case got.IsAudio:
+			wh := want.Header.(*Tag)
+			if tag.SoundFormat() != wh.SoundFormat() || tag.AACPacketType() != wh.AACPacketType() || tag.mediaTag.SoundRate != wh.mediaTag.SoundRate || tag.mediaTag.SoundType != wh.mediaTag.SoundType {
+				t.Errorf("packet %d: audio header %+v, want %+v", i, tag.mediaTag, wh.mediaTag)
+			}
+		}
+	}
+
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("got %v at the end, want EOF", err)
+	}
+}
+
+func TestTagReader(t *testing.T) {
+	pkts := testPackets(t)[1:]
+	b := writeFile(t, pkts)[fileHeaderSize+4:] // tags only, as aggregate messages
+
+	r := NewTagReader(bytes.NewReader(b))
+	for i, want := range pkts {
+		got, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if got.TimeStamp != want.TimeStamp || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("packet %d: %d % x, want %d % x", i, got.TimeStamp, got.Data, want.TimeStamp, want.Data)
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("got %v at the end, want EOF", err)
+	}
+}
+
+func TestNegativeCompositionTime(t *testing.T) {
+	for _, cts := range []int32{-1, -40, -1 << 23, 1<<23 - 1, 0, 33} {
+		pkt := NewVideoPacket(0, av.INTER_FRAME, av.VIDEO_H264, av.AVC_NALU, cts, nil)
+
+		if err := NewDemuxer().DemuxHdr(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if got := pkt.Header.(av.VideoPacketHeader).CompositionTime(); got != cts {
+			t.Errorf("composition time %d, want %d", got, cts)
+		}
+	}
+}
+
+func TestDemux(t *testing.T) {
+	pkt := NewVideoPacket(0, av.KEY_FRAME, av.VIDEO_H264, av.AVC_NALU, -2, []byte{1, 2, 3})
+	p, err := NewDemuxer().Demux(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Data, []byte{1, 2, 3}) || p.Header.(*Tag).CompositionTime() != -2 {
+		t.Fatalf("demuxed % x, cts %d", p.Data, p.Header.(*Tag).CompositionTime())
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	b := writeFile(t, testPackets(t)[:2])
+
+	bad := append([]byte{}, b...)
+	bad[len(bad)-1]++ // PreviousTagSize of the last tag
+	r := NewReader(bytes.NewReader(bad))
+	if _, err := r.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadPacket(); err != ErrPreviousTagSize {
+		t.Errorf("got %v, want ErrPreviousTagSize", err)
+	}
+
+	r = NewReader(bytes.NewReader(b[:len(b)-2]))
+	r.ReadPacket()
+	if _, err := r.ReadPacket(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated: got %v, want ErrUnexpectedEOF", err)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("FLX\x01\x05\x00\x00\x00\x09\x00\x00\x00\x00"))).ReadPacket(); err != ErrInvalidHeader {
+		t.Errorf("got %v, want ErrInvalidHeader", err)
+	}
+}
+
+func TestEnhancedHeader(t *testing.T) {
+	tests := []struct {
+		pkt        *av.Packet
+		seq, key   bool
+		fourCC     string
+		packetType uint8
+		cts        int32
+		headerSize int
+	}{
+		{NewExVideoPacket(0, av.KEY_FRAME, av.EX_SEQUENCE_START, av.FOURCC_HEVC, 0, []byte{1, 2}), true, true, av.FOURCC_HEVC, av.EX_SEQUENCE_START, 0, 5},
+		{NewExVideoPacket(40, av.INTER_FRAME, av.EX_CODED_FRAMES, av.FOURCC_HEVC, -40, []byte{3}), false, false, av.FOURCC_HEVC, av.EX_CODED_FRAMES, -40, 8},
+		{NewExVideoPacket(80, av.KEY_FRAME, av.EX_CODED_FRAMESX, av.FOURCC_AV1, 0, []byte{4}), false, true, av.FOURCC_AV1, av.EX_CODED_FRAMESX, 0, 5},
+		{NewExVideoPacket(0, av.KEY_FRAME, av.EX_CODED_FRAMES, av.FOURCC_VP9, 33, []byte{5}), false, true, av.FOURCC_VP9, av.EX_CODED_FRAMES, 0, 5},
+		{NewExAudioPacket(0, av.EX_SEQUENCE_START, av.FOURCC_OPUS, []byte{6}), true, false, av.FOURCC_OPUS, av.EX_SEQUENCE_START, 0, 5},
+		{NewExAudioPacket(20, av.EX_CODED_FRAMES, av.FOURCC_OPUS, []byte{7}), false, false, av.FOURCC_OPUS, av.EX_CODED_FRAMES, 0, 5},
+	}
+
+	for i, tt := range tests {
+		p, err := NewDemuxer().Demux(&av.Packet{IsAudio: tt.pkt.IsAudio, IsVideo: tt.pkt.IsVideo, Data: tt.pkt.Data})
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		tag := p.Header.(*Tag)
+		if !tag.IsExHeader() || tag.IsSeq() != tt.seq || tag.FourCC() != tt.fourCC || tag.CodecID() != 0 {
+			t.Errorf("%d: ex %v seq %v fourcc %q codec %d", i, tag.IsExHeader(), tag.IsSeq(), tag.FourCC(), tag.CodecID())
+		}
+		if len(tt.pkt.Data)-len(p.Data) != tt.headerSize {
+			t.Errorf("%d: header size %d, want %d", i, len(tt.pkt.Data)-len(p.Data), tt.headerSize)
+		}
+		if tt.pkt.IsVideo && (tag.IsKeyFrame() != tt.key || tag.PacketType() != tt.packetType || tag.CompositionTime() != tt.cts) {
+			t.Errorf("%d: key %v packet type %d cts %d", i, tag.IsKeyFrame(), tag.PacketType(), tag.CompositionTime())
+		}
+	}
+
+	// a command frame has no FourCC
+	pkt := &av.Packet{IsVideo: true, Data: []byte{av.VIDEO_EX_HEADER | av.INFO_FRAME<<4 | av.EX_CODED_FRAMES, 0}}
+	if err := NewDemuxer().DemuxHdr(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if tag := pkt.Header.(*Tag); tag.IsKeyFrame() || tag.IsSeq() || tag.FourCC() != "" {
+		t.Errorf("command frame %+v", tag.mediaTag)
+	}
+
+	for _, b := range [][]byte{
+		{av.VIDEO_EX_HEADER | av.KEY_FRAME<<4 | av.EX_MULTITRACK, 'h', 'v', 'c', '1'},
+		{av.VIDEO_EX_HEADER | av.KEY_FRAME<<4 | av.EX_CODED_FRAMES, 'h', 'v', 'c', '1', 0},
+		{av.VIDEO_EX_HEADER | av.KEY_FRAME<<4, 'a', 'v'},
+	} {
+		if err := NewDemuxer().DemuxHdr(&av.Packet{IsVideo: true, Data: b}); err == nil {
+			t.Errorf("% x: no error", b)
+		}
+	}
+
+	// audio packet types are numbered apart from video ones
+	for _, c := range []struct {
+		packetType uint8
+		ok         bool
+	}{
+		{av.EX_AUDIO_MULTICHANNEL_CONFIG, true},
+		{av.EX_AUDIO_MULTITRACK, false},
+		{av.EX_MULTITRACK, true},
+		{av.EX_AUDIO_MODEX, false},
+	} {
+		b := []byte{av.SOUND_EX_HEADER<<4 | c.packetType, 'O', 'p', 'u', 's'}
+		if err := NewDemuxer().DemuxHdr(&av.Packet{IsAudio: true, Data: b}); (err == nil) != c.ok {
+			t.Errorf("audio packet type %d: %v", c.packetType, err)
+		}
+	}
+
+	// legacy headers map to FourCC
+	aac := testPackets(t)[2]
+	if tag := aac.Header.(*Tag); tag.FourCC() != av.FOURCC_AAC || !tag.IsSeq() || tag.IsExHeader() {
+		t.Errorf("aac %q seq %v", tag.FourCC(), tag.IsSeq())
+	}
+}
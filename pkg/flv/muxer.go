@@ -0,0 +1,244 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"playground/pkg/amf"
+	"playground/pkg/av"
+)
+
+const flagsOffset = 4 // of the file header
+
+var _ av.Muxer = (*Muxer)(nil)
+
+// Muxer writes av packets as a flv file. The file starts with an onMetaData of the first
+// packet if it is metadata, whose duration and filesize are patched by Close, so the writer
+// must be seekable. Timestamps of the file start at 0.
+type Muxer struct {
+	w  io.WriteSeeker
+	cw *countWriter
+	fw *Writer
+
+	started  bool
+	closed   bool
+	flags    byte
+	hasBase  bool
+	base     uint32 // timestamp of the first audio or video packet
+	duration uint32
+
+	durationOffset int64 // of the duration number in the file
+	filesizeOffset int64
+}
+
+func NewMuxer(w io.WriteSeeker) *Muxer {
+	cw := &countWriter{w: w}
+	return &Muxer{w: w, cw: cw, fw: NewWriter(cw)}
+}
+
+// WritePacket writes pkt as a tag, metadata after the first packet is dropped
+func (m *Muxer) WritePacket(pkt *av.Packet) error {
+	if m.closed {
+		return errors.New("flv: muxer closed")
+	}
+
+	if !m.started {
+		m.started = true
+		if err := m.writeHead(pkt); err != nil {
+			return err
+		}
+		if pkt.IsMetaData {
+			return nil
+		}
+	}
+
+	var tagType byte
+	switch {
+	case pkt.IsAudio:
+		tagType = av.TagAudio
+		m.flags |= FlagAudio
+	case pkt.IsVideo:
+		tagType = av.TagVideo
+		m.flags |= FlagVideo
+	case pkt.IsMetaData:
+		return nil
+	default:
+		return errors.New("flv: unknown packet type")
+	}
+
+	if !m.hasBase {
+		m.hasBase = true
+		m.base = pkt.TimeStamp
+	}
+	ts := pkt.TimeStamp - m.base
+	if int32(ts) < 0 { // the first frames out of order
+		ts = 0
+	}
+	if ts > m.duration {
+		m.duration = ts
+	}
+
+	return m.fw.writeTag(tagType, ts, pkt.Data)
+}
+
+// writeHead writes the file header and onMetaData, with properties of pkt if it is metadata
+func (m *Muxer) writeHead(pkt *av.Packet) error {
+	// both flags until Close knows the tracks
+	if err := m.fw.WriteHeader(true, true); err != nil {
+		return err
+	}
+
+	var props map[string]interface{}
+	if pkt.IsMetaData {
+		props = MetaDataProps(pkt.Data)
+	}
+
+	data, durationPos, filesizePos, err := encodeOnMetaData(props)
+	if err != nil {
+		return err
+	}
+	pos := m.cw.n + tagHeaderSize
+	m.durationOffset = pos + int64(durationPos)
+	m.filesizeOffset = pos + int64(filesizePos)
+
+	return m.fw.writeTag(TagScriptData, 0, data)
+}
+
+// Size returns the bytes written
+func (m *Muxer) Size() int64 {
+	return m.cw.n
+}
+
+// Duration returns the timestamp of the last packet
+func (m *Muxer) Duration() time.Duration {
+	return time.Duration(m.duration) * time.Millisecond
+}
+
+// Close patches the file header and onMetaData, w is left at the end but not closed
+func (m *Muxer) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if !m.started {
+		return nil
+	}
+
+	patches := []struct {
+		offset int64
+		b      []byte
+	}{
+		{flagsOffset, []byte{m.flags}},
+		{m.durationOffset, float64Bytes(float64(m.duration) / 1000)},
+		{m.filesizeOffset, float64Bytes(float64(m.cw.n))},
+	}
+	for _, p := range patches {
+		if _, err := m.w.Seek(p.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := m.w.Write(p.b); err != nil {
+			return err
+		}
+	}
+
+	_, err := m.w.Seek(0, io.SeekEnd)
+	return err
+}
+
+// MetaDataProps returns the properties of onMetaData, nil if invalid
+func MetaDataProps(data []byte) map[string]interface{} {
+	data, err := amf.MetaDataReform(data, amf.DEL)
+	if err != nil {
+		return nil
+	}
+
+	// values before a broken one are enough
+	vals, _ := amf.Unmarshal(data, amf.AMF0)
+	if len(vals) < 2 {
+		return nil
+	}
+	if name, _ := vals[0].(string); name != amf.OnMetaData {
+		return nil
+	}
+	switch props := vals[1].(type) {
+	case amf.ECMAArray:
+		return props
+	case amf.Object:
+		return props
+	}
+	return nil
+}
+
+// encodeOnMetaData encodes onMetaData of props in an ecma array, led by duration and filesize
+// whose numbers are at durationPos and filesizePos of data
+func encodeOnMetaData(props map[string]interface{}) (data []byte, durationPos, filesizePos int, err error) {
+	var b bytes.Buffer
+	if data, err = amf.Marshal(amf.AMF0, amf.OnMetaData); err != nil {
+		return
+	}
+	b.Write(data)
+
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		if k != "duration" && k != "filesize" && len(k) <= math.MaxUint16 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	b.WriteByte(amf.ECMAArrayMarker)
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(len(keys)+2))
+	b.Write(count[:])
+
+	writeKey := func(k string) {
+		b.Write([]byte{byte(len(k) >> 8), byte(len(k))})
+		b.WriteString(k)
+	}
+	for _, k := range []string{"duration", "filesize"} {
+		writeKey(k)
+		if k == "duration" {
+			durationPos = b.Len() + 1 // after the marker
+		} else {
+			filesizePos = b.Len() + 1
+		}
+		b.WriteByte(amf.NumberMarker)
+		b.Write(float64Bytes(0))
+	}
+
+	// every value is encoded alone, players don't resolve references of metadata
+	for _, k := range keys {
+		v, err := amf.Marshal(amf.AMF0, props[k])
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		writeKey(k)
+		b.Write(v)
+	}
+	b.Write([]byte{0, 0, amf.ObjectEndMarker})
+
+	return b.Bytes(), durationPos, filesizePos, nil
+}
+
+func float64Bytes(f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return b
+}
+
+// countWriter counts the bytes written
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,135 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"playground/pkg/av"
+)
+
+const tagFilter = 0x20 // tag type bit of encrypted tags
+
+var (
+	ErrInvalidHeader   = errors.New("flv: invalid file header")
+	ErrPreviousTagSize = errors.New("flv: PreviousTagSize mismatch")
+)
+
+// Reader reads av packets from a flv file, the inverse of Writer
+type Reader struct {
+	r          io.Reader
+	headerRead bool
+	hasAudio   bool
+	hasVideo   bool
+	buf        [tagHeaderSize]byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// NewTagReader returns a Reader of tags without the file header, as rtmp aggregate messages are
+func NewTagReader(r io.Reader) *Reader {
+	return &Reader{r: r, headerRead: true}
+}
+
+// ReadHeader reads the file header and PreviousTagSize0, it is read by the first ReadPacket
+// if not called
+func (fr *Reader) ReadHeader() (hasAudio, hasVideo bool, err error) {
+	if fr.headerRead {
+		return fr.hasAudio, fr.hasVideo, nil
+	}
+
+	h := make([]byte, fileHeaderSize)
+	if _, err = io.ReadFull(fr.r, h); err != nil {
+		return
+	}
+	if h[0] != 'F' || h[1] != 'L' || h[2] != 'V' || h[3] != 1 {
+		return false, false, ErrInvalidHeader
+	}
+	flags := h[4]
+	offset := binary.BigEndian.Uint32(h[5:])
+	if offset < fileHeaderSize {
+		return false, false, ErrInvalidHeader
+	}
+	if _, err = io.CopyN(ioutil.Discard, fr.r, int64(offset-fileHeaderSize)); err != nil {
+		return
+	}
+
+	if _, err = io.ReadFull(fr.r, h[:4]); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(h) != 0 {
+		return false, false, ErrPreviousTagSize
+	}
+
+	fr.headerRead = true
+	fr.hasAudio, fr.hasVideo = flags&FlagAudio != 0, flags&FlagVideo != 0
+	return fr.hasAudio, fr.hasVideo, nil
+}
+
+// ReadPacket reads the next audio, video or script data tag, other tags are skipped. Header
+// of the packet is a *Tag. It returns io.EOF at the end of file.
+func (fr *Reader) ReadPacket() (*av.Packet, error) {
+	if _, _, err := fr.ReadHeader(); err != nil {
+		return nil, err
+	}
+
+	for {
+		h := fr.buf[:]
+		if _, err := io.ReadFull(fr.r, h); err != nil {
+			return nil, err // io.EOF between tags
+		}
+
+		t := new(Tag)
+		t.flvTag = flvTag{
+			TagType:   h[0],
+			DataSize:  uint32(h[1])<<16 | uint32(h[2])<<8 | uint32(h[3]),
+			TimeStamp: uint32(h[7])<<24 | uint32(h[4])<<16 | uint32(h[5])<<8 | uint32(h[6]),
+			StreamID:  uint32(h[8])<<16 | uint32(h[9])<<8 | uint32(h[10]),
+		}
+
+		data := make([]byte, t.flvTag.DataSize+4)
+		if _, err := io.ReadFull(fr.r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if binary.BigEndian.Uint32(data[t.flvTag.DataSize:]) != tagHeaderSize+t.flvTag.DataSize {
+			return nil, ErrPreviousTagSize
+		}
+		data = data[:t.flvTag.DataSize]
+
+		if t.flvTag.TagType&tagFilter != 0 {
+			return nil, errors.New("flv: encrypted tag")
+		}
+
+		pkt := &av.Packet{Header: t, Data: data, TimeStamp: t.flvTag.TimeStamp, StreamID: t.flvTag.StreamID}
+		switch t.flvTag.TagType {
+		case av.TagAudio:
+			pkt.IsAudio = true
+		case av.TagVideo:
+			pkt.IsVideo = true
+		case TagScriptData:
+			pkt.IsMetaData = true
+			return pkt, nil
+		default:
+			continue
+		}
+
+		if len(data) == 0 { // nothing to decode, e.g. end of a track
+			continue
+		}
+		if _, err := t.decodeMediaTagHeader(data, pkt.IsVideo); err != nil {
+			return nil, fmt.Errorf("flv: tag at %d: %v", t.flvTag.TimeStamp, err)
+		}
+		return pkt, nil
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -95,6 +95,11 @@ type mediaTag struct {
 	AvcPacketType uint8
 
 	compositionTime int32
+
+	// enhanced rtmp, ExVideoTagHeader or ExAudioTagHeader
+	isExHeader bool
+	packetType uint8 // av.EX_*
+	fourCC     string
 }
 
 type Tag struct {
@@ -102,6 +107,11 @@ type Tag struct {
 	mediaTag mediaTag
 }
 
+// TagType is av.TagAudio, av.TagVideo or TagScriptData, set by Reader
+func (t *Tag) TagType() uint8 {
+	return t.flvTag.TagType
+}
+
 // Audio CodecID
 func (t *Tag) SoundFormat() uint8 {
 	return t.mediaTag.soundFormat
@@ -116,24 +126,65 @@ func (t *Tag) IsKeyFrame() bool {
 	return t.mediaTag.FrameType == av.KEY_FRAME
 }
 
+// IsSeq reports whether the tag is a sequence header of AVC, AAC or an enhanced codec. The
+// MPEG2TSSequenceStart of enhanced rtmp is not, it's sent with the frames.
 func (t *Tag) IsSeq() bool {
-	return t.IsKeyFrame() && t.mediaTag.AvcPacketType == av.AVC_SEQHDR
+	m := &t.mediaTag
+	switch {
+	case m.isExHeader:
+		return m.packetType == av.EX_SEQUENCE_START
+	case t.flvTag.TagType == av.TagAudio:
+		return m.soundFormat == av.SOUND_AAC && m.aacPacketType == av.AAC_SEQHDR
+	}
+	return t.IsKeyFrame() && m.AvcPacketType == av.AVC_SEQHDR
 }
 
-// Video CodecID
+// Video CodecID, 0 of enhanced rtmp
 func (t *Tag) CodecID() uint8 {
 	return t.mediaTag.codecID
 }
 
+// IsExHeader reports whether the tag is of enhanced rtmp
+func (t *Tag) IsExHeader() bool {
+	return t.mediaTag.isExHeader
+}
+
+// FourCC returns the codec of enhanced rtmp, or of AVC, AAC and MP3 of the legacy header
+func (t *Tag) FourCC() string {
+	m := &t.mediaTag
+	switch {
+	case m.isExHeader:
+		return m.fourCC
+	case t.flvTag.TagType == av.TagAudio && m.soundFormat == av.SOUND_AAC:
+		return av.FOURCC_AAC
+	case t.flvTag.TagType == av.TagAudio && m.soundFormat == av.SOUND_MP3:
+		return av.FOURCC_MP3
+	case t.flvTag.TagType == av.TagVideo && m.codecID == av.VIDEO_H264:
+		return av.FOURCC_AVC
+	}
+	return ""
+}
+
+// PacketType returns the packet type of enhanced rtmp, or AvcPacketType of the legacy header
+// whose values match
+func (t *Tag) PacketType() uint8 {
+	if t.mediaTag.isExHeader {
+		return t.mediaTag.packetType
+	}
+	return t.mediaTag.AvcPacketType
+}
+
 func (t *Tag) CompositionTime() int32 {
 	return t.mediaTag.compositionTime
 }
 
 func (t *Tag) decodeMediaTagHeader(b []byte, isVideo bool) (n int, err error) {
 	if isVideo {
+		t.flvTag.TagType = av.TagVideo
 		return t.decodeVideoHeader(b)
 	}
 
+	t.flvTag.TagType = av.TagAudio
 	return t.decodeAudioHeader(b)
 }
 
@@ -145,6 +196,9 @@ func (t *Tag) decodeAudioHeader(b []byte) (n int, err error) {
 
 	flags := b[0]
 	t.mediaTag.soundFormat = flags >> 4
+	if t.mediaTag.soundFormat == av.SOUND_EX_HEADER {
+		return t.decodeExAudioHeader(b)
+	}
 	t.mediaTag.SoundRate = (flags >> 2) & 0x3
 	t.mediaTag.SoundSize = (flags >> 1) & 0x01
 	t.mediaTag.SoundType = flags & 0x01
@@ -152,6 +206,10 @@ func (t *Tag) decodeAudioHeader(b []byte) (n int, err error) {
 
 	switch t.mediaTag.soundFormat {
 	case av.SOUND_AAC:
+		if len(b) < 2 {
+			err = fmt.Errorf("invalid AAC Data len=%d", len(b))
+			return
+		}
 		t.mediaTag.aacPacketType = b[1]
 		n++
 	}
@@ -159,7 +217,25 @@ func (t *Tag) decodeAudioHeader(b []byte) (n int, err error) {
 	return
 }
 
+// decodeExAudioHeader decodes the ExAudioTagHeader of a single track
+func (t *Tag) decodeExAudioHeader(b []byte) (n int, err error) {
+	t.mediaTag.isExHeader = true
+	t.mediaTag.packetType = b[0] & 0x0f
+	if err = checkExPacketType(t.mediaTag.packetType, true); err != nil {
+		return
+	}
+	if len(b) < 5 {
+		err = fmt.Errorf("invalid ExAudio Data len=%d", len(b))
+		return
+	}
+	t.mediaTag.fourCC = string(b[1:5])
+	return 5, nil
+}
+
 func (t *Tag) decodeVideoHeader(b []byte) (n int, err error) {
+	if len(b) > 0 && b[0]&av.VIDEO_EX_HEADER != 0 {
+		return t.decodeExVideoHeader(b)
+	}
 	if len(b) < 5 {
 		err = fmt.Errorf("invalid Video Data len=%d", len(b))
 		return
@@ -172,11 +248,167 @@ func (t *Tag) decodeVideoHeader(b []byte) (n int, err error) {
 
 	if t.mediaTag.FrameType == av.INTER_FRAME || t.mediaTag.FrameType == av.KEY_FRAME {
 		t.mediaTag.AvcPacketType = b[1]
-		for i := 2; i < 5; i++ {
-			t.mediaTag.compositionTime = t.mediaTag.compositionTime<<8 + int32(b[i])
-		}
+		// SI24, sign extended
+		t.mediaTag.compositionTime = int32(uint32(b[2])<<24|uint32(b[3])<<16|uint32(b[4])<<8) >> 8
 		n += 4
 	}
 
 	return
 }
+
+// decodeExVideoHeader decodes the ExVideoTagHeader of a single track
+func (t *Tag) decodeExVideoHeader(b []byte) (n int, err error) {
+	m := &t.mediaTag
+	m.isExHeader = true
+	m.FrameType = b[0] >> 4 & 0x07
+	m.packetType = b[0] & 0x0f
+
+	if m.FrameType == av.INFO_FRAME && m.packetType != av.EX_METADATA {
+		// a video command without FourCC
+		if len(b) < 2 {
+			err = fmt.Errorf("invalid ExVideo command len=%d", len(b))
+			return
+		}
+		return 2, nil
+	}
+	if err = checkExPacketType(m.packetType, false); err != nil {
+		return
+	}
+	if len(b) < 5 {
+		err = fmt.Errorf("invalid ExVideo Data len=%d", len(b))
+		return
+	}
+	m.fourCC = string(b[1:5])
+	n = 5
+
+	if m.hasExCompositionTime() {
+		if len(b) < 8 {
+			err = fmt.Errorf("invalid ExVideo CodedFrames len=%d", len(b))
+			return
+		}
+		m.compositionTime = int32(uint32(b[5])<<24|uint32(b[6])<<16|uint32(b[7])<<8) >> 8
+		n += 3
+	}
+	return
+}
+
+// hasExCompositionTime reports whether the enhanced video tag has SI24 composition time
+func (m *mediaTag) hasExCompositionTime() bool {
+	return m.packetType == av.EX_CODED_FRAMES && (m.fourCC == av.FOURCC_AVC || m.fourCC == av.FOURCC_HEVC)
+}
+
+// checkExPacketType rejects the multitrack and ModEx packets of enhanced rtmp v2, which are
+// numbered differently in audio and video tags
+func checkExPacketType(packetType uint8, isAudio bool) error {
+	multitrack, modEx := uint8(av.EX_MULTITRACK), uint8(av.EX_MODEX)
+	if isAudio {
+		multitrack, modEx = av.EX_AUDIO_MULTITRACK, av.EX_AUDIO_MODEX
+	}
+	if packetType == multitrack || packetType == modEx {
+		return fmt.Errorf("unsupported enhanced packet type %d", packetType)
+	}
+	return nil
+}
+
+// encodeAudioHeader is the inverse of decodeAudioHeader
+func (t *Tag) encodeAudioHeader() []byte {
+	m := &t.mediaTag
+	if m.isExHeader {
+		return append([]byte{av.SOUND_EX_HEADER<<4 | m.packetType&0x0f}, m.fourCC...)
+	}
+	b := []byte{m.soundFormat<<4 | (m.SoundRate&0x3)<<2 | (m.SoundSize&0x1)<<1 | m.SoundType&0x1}
+	if m.soundFormat == av.SOUND_AAC {
+		b = append(b, m.aacPacketType)
+	}
+	return b
+}
+
+// encodeVideoHeader is the inverse of decodeVideoHeader
+func (t *Tag) encodeVideoHeader() []byte {
+	m := &t.mediaTag
+	if m.isExHeader {
+		b := append([]byte{av.VIDEO_EX_HEADER | (m.FrameType&0x07)<<4 | m.packetType&0x0f}, m.fourCC...)
+		if m.hasExCompositionTime() {
+			cts := uint32(m.compositionTime)
+			b = append(b, byte(cts>>16), byte(cts>>8), byte(cts))
+		}
+		return b
+	}
+	b := []byte{m.FrameType<<4 | m.codecID&0xf}
+	if m.FrameType == av.INTER_FRAME || m.FrameType == av.KEY_FRAME {
+		cts := uint32(m.compositionTime)
+		b = append(b, m.AvcPacketType, byte(cts>>16), byte(cts>>8), byte(cts))
+	}
+	return b
+}
+
+// NewAudioPacket returns an audio packet of payload led by the tag header, aacPacketType is
+// only for AAC
+func NewAudioPacket(timeStamp uint32, soundFormat, soundRate, soundSize, soundType, aacPacketType uint8, payload []byte) *av.Packet {
+	t := &Tag{
+		flvTag: flvTag{TagType: av.TagAudio, TimeStamp: timeStamp},
+		mediaTag: mediaTag{
+			soundFormat:   soundFormat,
+			SoundRate:     soundRate,
+			SoundSize:     soundSize,
+			SoundType:     soundType,
+			aacPacketType: aacPacketType,
+		},
+	}
+	data := append(t.encodeAudioHeader(), payload...)
+	t.flvTag.DataSize = uint32(len(data))
+
+	return &av.Packet{Header: t, Data: data, TimeStamp: timeStamp, IsAudio: true}
+}
+
+// NewVideoPacket returns a video packet of payload led by the tag header, compositionTime is
+// the pts - dts of AVC in [-2^23, 2^23)
+func NewVideoPacket(timeStamp uint32, frameType, codecID, avcPacketType uint8, compositionTime int32, payload []byte) *av.Packet {
+	t := &Tag{
+		flvTag: flvTag{TagType: av.TagVideo, TimeStamp: timeStamp},
+		mediaTag: mediaTag{
+			FrameType:       frameType,
+			codecID:         codecID,
+			AvcPacketType:   avcPacketType,
+			compositionTime: compositionTime,
+		},
+	}
+	data := append(t.encodeVideoHeader(), payload...)
+	t.flvTag.DataSize = uint32(len(data))
+
+	return &av.Packet{Header: t, Data: data, TimeStamp: timeStamp, IsVideo: true}
+}
+
+// NewExAudioPacket returns an enhanced rtmp audio packet of payload led by the ExAudioTagHeader
+func NewExAudioPacket(timeStamp uint32, packetType uint8, fourCC string, payload []byte) *av.Packet {
+	t := &Tag{
+		flvTag:   flvTag{TagType: av.TagAudio, TimeStamp: timeStamp},
+		mediaTag: mediaTag{soundFormat: av.SOUND_EX_HEADER, isExHeader: true, packetType: packetType, fourCC: fourCC},
+	}
+	data := append(t.encodeAudioHeader(), payload...)
+	t.flvTag.DataSize = uint32(len(data))
+
+	return &av.Packet{Header: t, Data: data, TimeStamp: timeStamp, IsAudio: true}
+}
+
+// NewExVideoPacket returns an enhanced rtmp video packet of payload led by the ExVideoTagHeader,
+// compositionTime is only for CodedFrames of avc1 and hvc1
+func NewExVideoPacket(timeStamp uint32, frameType, packetType uint8, fourCC string, compositionTime int32, payload []byte) *av.Packet {
+	t := &Tag{
+		flvTag: flvTag{TagType: av.TagVideo, TimeStamp: timeStamp},
+		mediaTag: mediaTag{
+			FrameType:       frameType,
+			isExHeader:      true,
+			packetType:      packetType,
+			fourCC:          fourCC,
+			compositionTime: compositionTime,
+		},
+	}
+	if !t.mediaTag.hasExCompositionTime() {
+		t.mediaTag.compositionTime = 0
+	}
+	data := append(t.encodeVideoHeader(), payload...)
+	t.flvTag.DataSize = uint32(len(data))
+
+	return &av.Packet{Header: t, Data: data, TimeStamp: timeStamp, IsVideo: true}
+}
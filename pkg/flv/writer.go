@@ -0,0 +1,105 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"playground/pkg/amf"
+
+	"playground/pkg/av"
+)
+
+const (
+	fileHeaderSize = 9
+	tagHeaderSize  = 11
+
+	TagScriptData = 0x12
+)
+
+// flags of file header
+const (
+	FlagAudio = 0x04
+	FlagVideo = 0x01
+)
+
+// Writer writes av packets as flv file, every tag is followed by its PreviousTagSize
+type Writer struct {
+	w   io.Writer
+	buf [tagHeaderSize]byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteHeader writes the file header and PreviousTagSize0
+func (fw *Writer) WriteHeader(hasAudio, hasVideo bool) error {
+	var flags byte
+	if hasAudio {
+		flags |= FlagAudio
+	}
+	if hasVideo {
+		flags |= FlagVideo
+	}
+
+	h := []byte{'F', 'L', 'V', 0x01, flags, 0, 0, 0, fileHeaderSize, 0, 0, 0, 0}
+	_, err := fw.w.Write(h)
+	return err
+}
+
+// WritePacket writes pkt as one tag, metadata is written as script data without @setDataFrame
+func (fw *Writer) WritePacket(pkt *av.Packet) error {
+	data := pkt.Data
+
+	var tagType byte
+	switch {
+	case pkt.IsAudio:
+		tagType = av.TagAudio
+	case pkt.IsVideo:
+		tagType = av.TagVideo
+	case pkt.IsMetaData:
+		tagType = TagScriptData
+
+		var err error
+		if data, err = amf.MetaDataReform(data, amf.DEL); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown packet type")
+	}
+
+	return fw.writeTag(tagType, pkt.TimeStamp, data)
+}
+
+func (fw *Writer) writeTag(tagType byte, timeStamp uint32, data []byte) error {
+	if len(data) > 0xffffff {
+		return fmt.Errorf("tag data too large: %d", len(data))
+	}
+
+	h := fw.buf[:]
+	h[0] = tagType
+	putUint24(h[1:4], uint32(len(data)))
+	putUint24(h[4:7], timeStamp&0xffffff)
+	h[7] = byte(timeStamp >> 24) // extended timestamp
+	putUint24(h[8:11], 0)        // stream id, always 0
+
+	if _, err := fw.w.Write(h); err != nil {
+		return err
+	}
+	if _, err := fw.w.Write(data); err != nil {
+		return err
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(tagHeaderSize+len(data)))
+	_, err := fw.w.Write(size[:])
+	return err
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
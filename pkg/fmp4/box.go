@@ -0,0 +1,79 @@
+package fmp4
+
+import "encoding/binary"
+
+// boxWriter appends boxes to a buffer, the size of a box is filled by end
+type boxWriter struct {
+	b []byte
+}
+
+// start begins a box and returns its offset for end
+func (w *boxWriter) start(typ string) int {
+	off := len(w.b)
+	w.b = append(w.b, 0, 0, 0, 0)
+	w.b = append(w.b, typ...)
+	return off
+}
+
+// startFull begins a full box with version and 24 bits flags
+func (w *boxWriter) startFull(typ string, version uint8, flags uint32) int {
+	off := w.start(typ)
+	w.u32(uint32(version)<<24 | flags&0xffffff)
+	return off
+}
+
+func (w *boxWriter) end(off int) {
+	binary.BigEndian.PutUint32(w.b[off:], uint32(len(w.b)-off))
+}
+
+func (w *boxWriter) u8(v uint8) {
+	w.b = append(w.b, v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	w.b = append(w.b, byte(v>>8), byte(v))
+}
+
+func (w *boxWriter) u24(v uint32) {
+	w.b = append(w.b, byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *boxWriter) u32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *boxWriter) u64(v uint64) {
+	w.u32(uint32(v >> 32))
+	w.u32(uint32(v))
+}
+
+func (w *boxWriter) bytes(b []byte) {
+	w.b = append(w.b, b...)
+}
+
+func (w *boxWriter) zeros(n int) {
+	for i := 0; i < n; i++ {
+		w.b = append(w.b, 0)
+	}
+}
+
+// matrix writes the unity transformation matrix of mvhd and tkhd
+func (w *boxWriter) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
+
+// descriptor writes a MPEG-4 descriptor of esds with a 4 bytes length
+func (w *boxWriter) descriptor(tag uint8, body func()) {
+	w.u8(tag)
+	off := len(w.b)
+	w.zeros(4)
+	body()
+
+	n := len(w.b) - off - 4
+	w.b[off] = 0x80 | byte(n>>21)&0x7f
+	w.b[off+1] = 0x80 | byte(n>>14)&0x7f
+	w.b[off+2] = 0x80 | byte(n>>7)&0x7f
+	w.b[off+3] = byte(n) & 0x7f
+}
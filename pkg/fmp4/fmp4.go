@@ -0,0 +1,333 @@
+// Package fmp4 writes fragmented MP4 (ISO BMFF, CMAF) init segments and fragments of H.264
+// and AAC tracks, whose samples are the payload of flv video and audio tags.
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"playground/pkg/av/aac"
+	"playground/pkg/av/h264"
+)
+
+// Timescale of all tracks, the millisecond of flv timestamps
+const Timescale = 1000
+
+// sample flags of trun
+const (
+	syncSampleFlags    = 0x02000000 // depends on no other sample
+	nonSyncSampleFlags = 0x01010000 // depends on others, not a sync sample
+)
+
+// Track is a H.264 video or AAC audio track
+type Track struct {
+	ID uint32
+
+	AVCConfig     []byte // AVCDecoderConfigurationRecord of video
+	Width, Height int
+
+	AudioConfig []byte // AudioSpecificConfig of audio
+	SampleRate  int
+	Channels    int
+}
+
+// NewVideoTrack returns a H.264 track of the AVCDecoderConfigurationRecord of flv sequence header
+func NewVideoTrack(id uint32, avcConfig []byte) (*Track, error) {
+	cfg, err := h264.ParseAVCConfig(avcConfig)
+	if err != nil {
+		return nil, err
+	}
+	sps, err := h264.ParseSPS(cfg.SPS[0])
+	if err != nil {
+		return nil, err
+	}
+	return &Track{ID: id, AVCConfig: avcConfig, Width: sps.Width, Height: sps.Height}, nil
+}
+
+// NewAudioTrack returns an AAC track of the AudioSpecificConfig of flv sequence header
+func NewAudioTrack(id uint32, audioConfig []byte) (*Track, error) {
+	cfg, err := aac.ParseConfig(audioConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Track{
+		ID:          id,
+		AudioConfig: audioConfig,
+		SampleRate:  cfg.SampleRate,
+		Channels:    cfg.Channels(),
+	}, nil
+}
+
+func (t *Track) IsVideo() bool {
+	return t.AVCConfig != nil
+}
+
+// Codec returns the codecs parameter of the track for playlists and manifests, e.g. avc1.64001f
+func (t *Track) Codec() string {
+	if t.IsVideo() {
+		return fmt.Sprintf("avc1.%02x%02x%02x", t.AVCConfig[1], t.AVCConfig[2], t.AVCConfig[3])
+	}
+	return fmt.Sprintf("mp4a.40.%d", t.AudioConfig[0]>>3)
+}
+
+// Sample is a frame of a track fragment
+type Sample struct {
+	Duration              uint32
+	CompositionTimeOffset int32
+	KeyFrame              bool
+	Data                  []byte // AVCC nalus of video, raw AAC frame of audio
+}
+
+// TrackFragment is the samples of a track in a fragment
+type TrackFragment struct {
+	Track          *Track
+	BaseDecodeTime uint64
+	Samples        []Sample
+}
+
+// InitSegment returns ftyp and moov of the tracks
+func InitSegment(tracks ...*Track) []byte {
+	w := &boxWriter{}
+
+	ftyp := w.start("ftyp")
+	w.bytes([]byte("iso6"))
+	w.u32(0)
+	w.bytes([]byte("iso6cmfcisommp41dash"))
+	w.end(ftyp)
+
+	moov := w.start("moov")
+
+	mvhd := w.startFull("mvhd", 0, 0)
+	w.u32(0) // creation time
+	w.u32(0) // modification time
+	w.u32(Timescale)
+	w.u32(0) // duration
+	w.u32(0x00010000)
+	w.u16(0x0100)
+	w.zeros(10)
+	w.matrix()
+	w.zeros(24)
+	w.u32(0xffffffff) // next track id
+	w.end(mvhd)
+
+	for _, t := range tracks {
+		writeTrak(w, t)
+	}
+
+	mvex := w.start("mvex")
+	for _, t := range tracks {
+		trex := w.startFull("trex", 0, 0)
+		w.u32(t.ID)
+		w.u32(1) // sample description index
+		w.u32(0) // duration
+		w.u32(0) // size
+		w.u32(0) // flags
+		w.end(trex)
+	}
+	w.end(mvex)
+
+	w.end(moov)
+	return w.b
+}
+
+func writeTrak(w *boxWriter, t *Track) {
+	trak := w.start("trak")
+
+	tkhd := w.startFull("tkhd", 0, 3) // enabled, in movie
+	w.u32(0)
+	w.u32(0)
+	w.u32(t.ID)
+	w.u32(0)
+	w.u32(0) // duration
+	w.zeros(8)
+	w.u16(0) // layer
+	w.u16(0) // alternate group
+	if t.IsVideo() {
+		w.u16(0)
+	} else {
+		w.u16(0x0100) // volume
+	}
+	w.u16(0)
+	w.matrix()
+	w.u32(uint32(t.Width) << 16)
+	w.u32(uint32(t.Height) << 16)
+	w.end(tkhd)
+
+	mdia := w.start("mdia")
+
+	mdhd := w.startFull("mdhd", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.u32(Timescale)
+	w.u32(0)
+	w.u16(0x55c4) // und
+	w.u16(0)
+	w.end(mdhd)
+
+	hdlr := w.startFull("hdlr", 0, 0)
+	w.u32(0)
+	if t.IsVideo() {
+		w.bytes([]byte("vide"))
+	} else {
+		w.bytes([]byte("soun"))
+	}
+	w.zeros(12)
+	if t.IsVideo() {
+		w.bytes([]byte("VideoHandler\x00"))
+	} else {
+		w.bytes([]byte("SoundHandler\x00"))
+	}
+	w.end(hdlr)
+
+	minf := w.start("minf")
+	if t.IsVideo() {
+		vmhd := w.startFull("vmhd", 0, 1)
+		w.zeros(8)
+		w.end(vmhd)
+	} else {
+		smhd := w.startFull("smhd", 0, 0)
+		w.zeros(4)
+		w.end(smhd)
+	}
+
+	dinf := w.start("dinf")
+	dref := w.startFull("dref", 0, 0)
+	w.u32(1)
+	url := w.startFull("url ", 0, 1) // media in the same file
+	w.end(url)
+	w.end(dref)
+	w.end(dinf)
+
+	stbl := w.start("stbl")
+	stsd := w.startFull("stsd", 0, 0)
+	w.u32(1)
+	if t.IsVideo() {
+		writeAVC1(w, t)
+	} else {
+		writeMP4A(w, t)
+	}
+	w.end(stsd)
+	for _, typ := range []string{"stts", "stsc", "stco"} { // empty, samples are in fragments
+		b := w.startFull(typ, 0, 0)
+		w.u32(0)
+		w.end(b)
+	}
+	stsz := w.startFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.end(stsz)
+	w.end(stbl)
+
+	w.end(minf)
+	w.end(mdia)
+	w.end(trak)
+}
+
+func writeAVC1(w *boxWriter, t *Track) {
+	avc1 := w.start("avc1")
+	w.zeros(6)
+	w.u16(1) // data reference index
+	w.zeros(16)
+	w.u16(uint16(t.Width))
+	w.u16(uint16(t.Height))
+	w.u32(0x00480000) // 72 dpi
+	w.u32(0x00480000)
+	w.u32(0)
+	w.u16(1) // frame count
+	w.zeros(32)
+	w.u16(0x0018) // depth
+	w.u16(0xffff)
+
+	avcC := w.start("avcC")
+	w.bytes(t.AVCConfig)
+	w.end(avcC)
+
+	w.end(avc1)
+}
+
+func writeMP4A(w *boxWriter, t *Track) {
+	mp4a := w.start("mp4a")
+	w.zeros(6)
+	w.u16(1)
+	w.zeros(8)
+	w.u16(uint16(t.Channels))
+	w.u16(16) // sample size
+	w.u32(0)
+	w.u32(uint32(t.SampleRate) << 16)
+
+	esds := w.startFull("esds", 0, 0)
+	w.descriptor(0x03, func() { // ES_Descriptor
+		w.u16(uint16(t.ID))
+		w.u8(0)
+		w.descriptor(0x04, func() { // DecoderConfigDescriptor
+			w.u8(0x40) // MPEG-4 audio
+			w.u8(0x15) // audio stream
+			w.u24(0)   // buffer size
+			w.u32(0)   // max bitrate
+			w.u32(0)   // avg bitrate
+
+			// DecoderSpecificInfo
+			w.descriptor(0x05, func() { w.bytes(t.AudioConfig) })
+		})
+		w.descriptor(0x06, func() { // SLConfigDescriptor
+			w.u8(0x02)
+		})
+	})
+	w.end(esds)
+
+	w.end(mp4a)
+}
+
+// Fragment returns moof and mdat of the track fragments, seq is the fragment sequence number
+func Fragment(seq uint32, frags ...TrackFragment) []byte {
+	w := &boxWriter{}
+
+	moof := w.start("moof")
+	mfhd := w.startFull("mfhd", 0, 0)
+	w.u32(seq)
+	w.end(mfhd)
+
+	dataOffsets := make([]int, len(frags)) // data offset fields of trun to fill
+	for i, f := range frags {
+		traf := w.start("traf")
+
+		tfhd := w.startFull("tfhd", 0, 0x020000) // default base is moof
+		w.u32(f.Track.ID)
+		w.end(tfhd)
+
+		tfdt := w.startFull("tfdt", 1, 0)
+		w.u64(f.BaseDecodeTime)
+		w.end(tfdt)
+
+		// data offset, sample duration, size, flags and composition time offset
+		trun := w.startFull("trun", 1, 0x000f01)
+		w.u32(uint32(len(f.Samples)))
+		dataOffsets[i] = len(w.b)
+		w.u32(0)
+		for _, s := range f.Samples {
+			w.u32(s.Duration)
+			w.u32(uint32(len(s.Data)))
+			if s.KeyFrame || !f.Track.IsVideo() {
+				w.u32(syncSampleFlags)
+			} else {
+				w.u32(nonSyncSampleFlags)
+			}
+			w.u32(uint32(s.CompositionTimeOffset))
+		}
+		w.end(trun)
+
+		w.end(traf)
+	}
+	w.end(moof)
+
+	mdat := w.start("mdat")
+	for i, f := range frags {
+		binary.BigEndian.PutUint32(w.b[dataOffsets[i]:], uint32(len(w.b)-moof))
+		for _, s := range f.Samples {
+			w.bytes(s.Data)
+		}
+	}
+	w.end(mdat)
+
+	return w.b
+}
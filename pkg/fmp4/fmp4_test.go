@@ -0,0 +1,182 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+type box struct {
+	typ      string
+	off      int // offset of the box in the parsed buffer
+	body     []byte
+	children []*box
+}
+
+// containers whose bodies are boxes, after the skipped bytes of full boxes and entries
+var containers = map[string]int{
+	"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "dinf": 0, "stbl": 0, "mvex": 0, "moof": 0, "traf": 0,
+	"dref": 8, "stsd": 8,
+}
+
+func parseBoxes(t *testing.T, b []byte, base int) []*box {
+	var boxes []*box
+	for off := 0; off < len(b); {
+		if len(b)-off < 8 {
+			t.Fatalf("%d bytes left at %d", len(b)-off, base+off)
+		}
+		size := int(binary.BigEndian.Uint32(b[off:]))
+		if size < 8 || off+size > len(b) {
+			t.Fatalf("box %q at %d: size %d of %d left", b[off+4:off+8], base+off, size, len(b)-off)
+		}
+		bx := &box{typ: string(b[off+4 : off+8]), off: base + off, body: b[off+8 : off+size]}
+		if skip, ok := containers[bx.typ]; ok {
+			bx.children = parseBoxes(t, bx.body[skip:], base+off+8+skip)
+		}
+		boxes = append(boxes, bx)
+		off += size
+	}
+	return boxes
+}
+
+func boxTypes(boxes []*box) string {
+	types := make([]string, 0, len(boxes))
+	for _, b := range boxes {
+		types = append(types, b.typ)
+	}
+	return strings.Join(types, " ")
+}
+
+// find returns the first box of the path of types below boxes
+func find(boxes []*box, path ...string) *box {
+	for _, b := range boxes {
+		if b.typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return b
+		}
+		if found := find(b.children, path[1:]...); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func testTracks(t *testing.T) (*Track, *Track) {
+	video := &Track{ID: 1, AVCConfig: []byte{1, 0x64, 0, 0x1f, 0xff, 0xe0, 0, 0}, Width: 1280, Height: 720}
+	audio, err := NewAudioTrack(2, []byte{0x12, 0x10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video, audio
+}
+
+func TestTrack(t *testing.T) {
+	video, audio := testTracks(t)
+	if audio.SampleRate != 44100 || audio.Channels != 2 || audio.IsVideo() {
+		t.Errorf("audio track %+v", audio)
+	}
+	if c := video.Codec(); c != "avc1.64001f" {
+		t.Errorf("video codec %s", c)
+	}
+	if c := audio.Codec(); c != "mp4a.40.2" {
+		t.Errorf("audio codec %s", c)
+	}
+	if _, err := NewVideoTrack(1, []byte{1, 0x64}); err == nil {
+		t.Error("video track of a truncated config")
+	}
+}
+
+func TestInitSegment(t *testing.T) {
+	video, audio := testTracks(t)
+	boxes := parseBoxes(t, InitSegment(video, audio), 0)
+
+	if got := boxTypes(boxes); got != "ftyp moov" {
+		t.Fatalf("boxes %s", got)
+	}
+	moov := find(boxes, "moov")
+	if got := boxTypes(moov.children); got != "mvhd trak trak mvex" {
+		t.Fatalf("moov boxes %s", got)
+	}
+	if got := boxTypes(find(boxes, "moov", "mvex").children); got != "trex trex" {
+		t.Errorf("mvex boxes %s", got)
+	}
+
+	avcC := find(boxes, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+	if avcC == nil || len(avcC.children) != 1 || avcC.children[0].typ != "avc1" {
+		t.Fatal("no avc1 sample entry")
+	}
+	if entry := avcC.children[0].body; !bytes.HasSuffix(entry, append([]byte{0, 0, 0, byte(8 + len(video.AVCConfig)), 'a', 'v', 'c', 'C'}, video.AVCConfig...)) {
+		t.Errorf("avc1 % x", entry)
+	} else if w, h := binary.BigEndian.Uint16(entry[24:]), binary.BigEndian.Uint16(entry[26:]); w != 1280 || h != 720 {
+		t.Errorf("avc1 size %dx%d", w, h)
+	}
+
+	trak := moov.children[2]
+	mp4a := find(trak.children, "mdia", "minf", "stbl", "stsd", "mp4a")
+	if mp4a == nil {
+		t.Fatal("no mp4a sample entry")
+	}
+	if !bytes.Contains(mp4a.body, []byte{0x05, 0x80, 0x80, 0x80, 2, 0x12, 0x10}) { // DecoderSpecificInfo of 4 bytes length
+		t.Errorf("mp4a % x", mp4a.body)
+	}
+}
+
+func TestFragment(t *testing.T) {
+	video, audio := testTracks(t)
+	frags := []TrackFragment{
+		{Track: video, BaseDecodeTime: 1000, Samples: []Sample{
+			{Duration: 40, CompositionTimeOffset: 80, KeyFrame: true, Data: []byte{0, 0, 0, 1, 0x65}},
+			{Duration: 40, CompositionTimeOffset: -40, Data: []byte{0, 0, 0, 1, 0x41}},
+		}},
+		{Track: audio, BaseDecodeTime: 990, Samples: []Sample{
+			{Duration: 23, Data: []byte{7, 8, 9}},
+		}},
+	}
+	b := Fragment(7, frags...)
+	boxes := parseBoxes(t, b, 0)
+	if got := boxTypes(boxes); got != "moof mdat" {
+		t.Fatalf("boxes %s", got)
+	}
+	moof := boxes[0]
+	if got := boxTypes(moof.children); got != "mfhd traf traf" {
+		t.Fatalf("moof boxes %s", got)
+	}
+	if seq := binary.BigEndian.Uint32(moof.children[0].body[4:]); seq != 7 {
+		t.Errorf("sequence number %d", seq)
+	}
+
+	for i, traf := range moof.children[1:] {
+		f := frags[i]
+		tfdt := find(traf.children, "tfdt")
+		if d := binary.BigEndian.Uint64(tfdt.body[4:]); d != f.BaseDecodeTime {
+			t.Errorf("track %d: base decode time %d", f.Track.ID, d)
+		}
+
+		trun := find(traf.children, "trun").body
+		if n := binary.BigEndian.Uint32(trun[4:]); int(n) != len(f.Samples) {
+			t.Fatalf("track %d: %d samples", f.Track.ID, n)
+		}
+		// the data offset from moof points at the samples in mdat
+		off := moof.off + int(binary.BigEndian.Uint32(trun[8:]))
+		for j, s := range f.Samples {
+			entry := trun[12+16*j:]
+			if dur, size := binary.BigEndian.Uint32(entry), binary.BigEndian.Uint32(entry[4:]); dur != s.Duration || int(size) != len(s.Data) {
+				t.Errorf("track %d sample %d: duration %d size %d", f.Track.ID, j, dur, size)
+			}
+			sync := binary.BigEndian.Uint32(entry[8:]) == syncSampleFlags
+			if sync != (s.KeyFrame || !f.Track.IsVideo()) {
+				t.Errorf("track %d sample %d: flags %08x", f.Track.ID, j, binary.BigEndian.Uint32(entry[8:]))
+			}
+			if cto := int32(binary.BigEndian.Uint32(entry[12:])); cto != s.CompositionTimeOffset {
+				t.Errorf("track %d sample %d: composition time offset %d", f.Track.ID, j, cto)
+			}
+			if !bytes.Equal(b[off:off+len(s.Data)], s.Data) {
+				t.Errorf("track %d sample %d: data % x", f.Track.ID, j, b[off:off+len(s.Data)])
+			}
+			off += len(s.Data)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+const (
+	defaultAggregateMaxMessages = 16
+	defaultAggregateMaxBytes    = 64 * 1024
+	maxAggregateBytes           = 0xffffff // of the message length
+)
+
+// AggregateConfig bundles audio/video messages sent to rtmp players into aggregate messages,
+// fewer messages cost less to high fan-out streams
+type AggregateConfig struct {
+	MaxMessages int           // messages per aggregate, default 16
+	MaxBytes    int           // bytes of tags per aggregate, default 64KB
+	MaxDelay    time.Duration // time messages wait for more, default 0 bundles only messages queued
+}
+
+func (ac *AggregateConfig) maxMessages() int {
+	if ac.MaxMessages > 0 {
+		return ac.MaxMessages
+	}
+	return defaultAggregateMaxMessages
+}
+
+func (ac *AggregateConfig) maxBytes() int {
+	switch {
+	case ac.MaxBytes <= 0:
+		return defaultAggregateMaxBytes
+	case ac.MaxBytes > maxAggregateBytes:
+		return maxAggregateBytes
+	}
+	return ac.MaxBytes
+}
+
+// splitAggregate returns the packets of the flv tags of an aggregate message, timestamps of
+// tags are offsets from the first one to the message timestamp
+func splitAggregate(cs *ChunkStream) ([]*av.Packet, error) {
+	r := flv.NewTagReader(bytes.NewReader(cs.ChunkBody))
+	var pkts []*av.Packet
+	var first uint32
+	for {
+		pkt, err := r.ReadPacket()
+		if err == io.EOF {
+			return pkts, nil
+		}
+		if err != nil {
+			return pkts, err
+		}
+
+		if len(pkts) == 0 {
+			first = pkt.TimeStamp
+		}
+		pkt.TimeStamp = cs.TimeStamp + (pkt.TimeStamp - first)
+		pkt.StreamID = cs.MsgStreamID
+		pkts = append(pkts, pkt)
+	}
+}
+
+// aggregator bundles audio/video packets as the tags of an aggregate message, which carry
+// absolute timestamps with the message timestamp of the first
+type aggregator struct {
+	maxMessages int
+	maxBytes    int
+	maxDelay    time.Duration
+
+	buf      bytes.Buffer
+	w        *flv.Writer
+	n        int
+	first    uint32 // timestamp
+	streamID uint32
+	msg      ChunkStream // sent by take, whose body is not shared with packets
+}
+
+func newAggregator(config *AggregateConfig) *aggregator {
+	a := &aggregator{
+		maxMessages: config.maxMessages(),
+		maxBytes:    config.maxBytes(),
+		maxDelay:    config.MaxDelay,
+	}
+	a.w = flv.NewWriter(&a.buf)
+	return a
+}
+
+// fits reports whether pkt can join the pending packets
+func (a *aggregator) fits(pkt *av.Packet) bool {
+	return a.n == 0 || pkt.StreamID == a.streamID && a.buf.Len()+len(pkt.Data)+15 <= a.maxBytes
+}
+
+// add adds pkt, full if no more packets should be added
+func (a *aggregator) add(pkt *av.Packet) (full bool, err error) {
+	if a.n == 0 {
+		a.first, a.streamID = pkt.TimeStamp, pkt.StreamID
+	}
+	if err := a.w.WritePacket(pkt); err != nil {
+		return false, err
+	}
+	a.n++
+	return a.n >= a.maxMessages || a.buf.Len() >= a.maxBytes, nil
+}
+
+func (a *aggregator) pending() bool {
+	return a.n > 0
+}
+
+// take returns the aggregate message of the pending packets, which are cleared
+func (a *aggregator) take() *ChunkStream {
+	cs := &a.msg
+	cs.ChunkBody = append(cs.ChunkBody[:0], a.buf.Bytes()...)
+	cs.MsgLength = uint32(len(cs.ChunkBody))
+	cs.MsgTypeID = MsgAggregateMessage
+	cs.MsgStreamID = a.streamID
+	cs.TimeStamp = a.first
+
+	a.buf.Reset()
+	a.n = 0
+	return cs
+}
@@ -0,0 +1,70 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+func TestAggregate(t *testing.T) {
+	pkts := []*av.Packet{
+		flv.NewVideoPacket(1000, av.KEY_FRAME, av.VIDEO_H264, av.AVC_NALU, 0, []byte{0, 0, 0, 1, 0x65}),
+		flv.NewAudioPacket(1020, av.SOUND_AAC, av.SOUND_44Khz, av.SOUND_16BIT, av.SOUND_STEREO, av.AAC_RAW, []byte{7, 8, 9}),
+		flv.NewVideoPacket(1040, av.INTER_FRAME, av.VIDEO_H264, av.AVC_NALU, 0, []byte{0, 0, 0, 1, 0x41}),
+	}
+
+	a := newAggregator(&AggregateConfig{})
+	ends := make([]int, 0, len(pkts)) // body length once every tag is added
+	for _, pkt := range pkts {
+		pkt.StreamID = 1
+		if _, err := a.add(pkt); err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, a.buf.Len())
+	}
+	msg := a.take()
+	if msg.TimeStamp != 1000 || msg.MsgStreamID != 1 || int(msg.MsgLength) != ends[len(ends)-1] {
+		t.Fatalf("aggregate message: ts %d, stream id %d, length %d", msg.TimeStamp, msg.MsgStreamID, msg.MsgLength)
+	}
+	if a.pending() {
+		t.Fatal("pending after take")
+	}
+
+	// the publisher's timestamp of the message rebases the tags
+	cs := newChunkStream()
+	cs.ChunkBody = append([]byte(nil), msg.ChunkBody...)
+	cs.TimeStamp = 5000
+	body := cs.ChunkBody
+	got, err := splitAggregate(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(pkts) {
+		t.Fatalf("split %d packets, want %d", len(got), len(pkts))
+	}
+	for i, pkt := range got {
+		if pkt.TimeStamp != 5000+pkts[i].TimeStamp-1000 || pkt.IsVideo != pkts[i].IsVideo || !bytes.Equal(pkt.Data, pkts[i].Data) {
+			t.Errorf("packet %d: %+v", i, pkt)
+		}
+	}
+
+	// tags before the truncated one are still returned
+	for n := 0; n < len(body); n++ {
+		complete := 0
+		for complete < len(ends) && ends[complete] <= n {
+			complete++
+		}
+		atEnd := n == 0 || complete > 0 && n == ends[complete-1]
+
+		cs.ChunkBody = body[:n]
+		got, err := splitAggregate(cs)
+		if len(got) != complete {
+			t.Errorf("truncated at %d: split %d packets, want %d", n, len(got), complete)
+		}
+		if (err == nil) != atEnd {
+			t.Errorf("truncated at %d: %v", n, err)
+		}
+	}
+}
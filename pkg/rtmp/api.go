@@ -0,0 +1,292 @@
+package rtmp
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"playground/internal/errno"
+)
+
+const apiPrefix = "/api/v1/"
+
+// ListenAndServeAPI serves the admin api of the server's streams on addr,
+// it returns ErrServerClosed after Shutdown.
+func (srv *Server) ListenAndServeAPI(addr string) error {
+	hs := &http.Server{Addr: addr, Handler: http.HandlerFunc(srv.serveAPI)}
+	if !srv.trackHTTPServer(hs, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackHTTPServer(hs, false)
+
+	if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+		srv.Config().Logger.WithField("event", "ListenAndServeAPI").Error(err)
+		return err
+	}
+	return ErrServerClosed
+}
+
+// serveAPI serves the admin api, responses are errno json with the result in data:
+//
+//	GET    /api/v1/vhosts                               vhosts with their apps and streams count
+//	GET    /api/v1/streams[?vhost=&app=]                streams with publisher info
+//	GET    /api/v1/streams/{id}                         one stream with its subscribers
+//	DELETE /api/v1/streams/{id}/publisher               kick the publisher
+//	DELETE /api/v1/streams/{id}/subscribers/{subID}     kick a subscriber
+//	GET    /api/v1/disabled                             stream keys refused to publish and play
+//	PUT    /api/v1/disabled/{vhost}/{app}/{stream}      disable a stream key, its publisher is kicked
+//	DELETE /api/v1/disabled/{vhost}/{app}/{stream}      enable a stream key again
+//
+// The id of a stream is its session id, which is kept across republish.
+func (srv *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	if len(path) == len(r.URL.Path) {
+		writeAPI(w, errno.ErrParam)
+		return
+	}
+
+	elems := strings.SplitN(path, "/", 2)
+	var rest string
+	if len(elems) == 2 {
+		rest = elems[1]
+	}
+
+	switch {
+	case elems[0] == "vhosts" && rest == "" && r.Method == http.MethodGet:
+		writeAPI(w, errno.ErrOK.WithData(srv.apiVhosts()))
+	case elems[0] == "streams" && rest == "" && r.Method == http.MethodGet:
+		writeAPI(w, errno.ErrOK.WithData(srv.apiStreams(r.URL.Query().Get("vhost"), r.URL.Query().Get("app"))))
+	case elems[0] == "streams" && rest != "":
+		srv.serveAPIStream(w, r, strings.SplitN(rest, "/", 3)) // ids of forwarders have '/'
+	case elems[0] == "disabled":
+		srv.serveAPIDisabled(w, r, rest)
+	default:
+		writeAPI(w, errno.ErrParam)
+	}
+}
+
+func (srv *Server) serveAPIStream(w http.ResponseWriter, r *http.Request, elems []string) {
+	ss := srv.findStreamByID(elems[0])
+	if ss == nil {
+		writeAPI(w, errno.ErrStreamNotFound)
+		return
+	}
+
+	switch {
+	case len(elems) == 1 && r.Method == http.MethodGet:
+		stream := newAPIStream(ss)
+		stream.Subscribers = []apiSubscriber{}
+		for _, sub := range ss.subscriberList() {
+			stream.Subscribers = append(stream.Subscribers, newAPISubscriber(sub))
+		}
+		sort.Slice(stream.Subscribers, func(i, j int) bool { return stream.Subscribers[i].ID < stream.Subscribers[j].ID })
+		writeAPI(w, errno.ErrOK.WithData(stream))
+	case len(elems) == 2 && elems[1] == "publisher" && r.Method == http.MethodDelete:
+		pub := ss.getPublisher()
+		if pub == nil {
+			writeAPI(w, errno.ErrClientNotFound)
+			return
+		}
+		srv.Config().Logger.WithFields(logrus.Fields{"event": "kick publisher", "streamKey": ss.streamKey, "clientID": pub.rtmpConn.clientID}).Info("")
+		pub.kick()
+		writeAPI(w, errno.ErrOK)
+	case len(elems) == 3 && elems[1] == "subscribers" && r.Method == http.MethodDelete:
+		for _, sub := range ss.subscriberList() {
+			if sub.id == elems[2] {
+				srv.Config().Logger.WithFields(logrus.Fields{"event": "kick subscriber", "streamKey": ss.streamKey, "id": sub.id}).Info("")
+				sub.stop()
+				writeAPI(w, errno.ErrOK)
+				return
+			}
+		}
+		writeAPI(w, errno.ErrClientNotFound)
+	default:
+		writeAPI(w, errno.ErrParam)
+	}
+}
+
+func (srv *Server) serveAPIDisabled(w http.ResponseWriter, r *http.Request, streamKey string) {
+	if streamKey == "" {
+		if r.Method != http.MethodGet {
+			writeAPI(w, errno.ErrParam)
+			return
+		}
+		keys := []string{}
+		srv.ssMgr.disabled.Range(func(key, _ interface{}) bool {
+			keys = append(keys, key.(string))
+			return true
+		})
+		sort.Strings(keys)
+		writeAPI(w, errno.ErrOK.WithData(keys))
+		return
+	}
+
+	if _, _, _, ok := splitStreamKey(streamKey); !ok {
+		writeAPI(w, errno.ErrParam)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		srv.ssMgr.disabled.Store(streamKey, struct{}{})
+		srv.Config().Logger.WithFields(logrus.Fields{"event": "disable stream", "streamKey": streamKey}).Info("")
+		if val, ok := srv.ssMgr.streamMap.Load(streamKey); ok {
+			if pub := val.(*streamSource).getPublisher(); pub != nil {
+				pub.kick()
+			}
+		}
+		writeAPI(w, errno.ErrOK)
+	case http.MethodDelete:
+		srv.ssMgr.disabled.Delete(streamKey)
+		srv.Config().Logger.WithFields(logrus.Fields{"event": "enable stream", "streamKey": streamKey}).Info("")
+		writeAPI(w, errno.ErrOK)
+	default:
+		writeAPI(w, errno.ErrParam)
+	}
+}
+
+func writeAPI(w http.ResponseWriter, e errno.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = io.WriteString(w, e.String())
+}
+
+type apiVhost struct {
+	Name string   `json:"name"`
+	Apps []apiApp `json:"apps"`
+}
+
+type apiApp struct {
+	Name    string `json:"name"`
+	Streams int    `json:"streams"`
+}
+
+type apiStream struct {
+	ID             string          `json:"id"`
+	Vhost          string          `json:"vhost"`
+	App            string          `json:"app"`
+	Name           string          `json:"name"`
+	Publisher      *apiPublisher   `json:"publisher"` // null while not published
+	NumSubscribers int             `json:"num_subscribers"`
+	Subscribers    []apiSubscriber `json:"subscribers,omitempty"` // of one stream only
+}
+
+type apiPublisher struct {
+	ClientID   string    `json:"client_id"`
+	RemoteAddr string    `json:"remote_addr"` // empty if published by a file
+	TcUrl      string    `json:"tc_url"`
+	StartTime  time.Time `json:"start_time"`
+	VideoCodec string    `json:"video_codec"` // FourCC, or the flv codec id of codecs without one
+	AudioCodec string    `json:"audio_codec"`
+	RTT        int64     `json:"rtt_ms"`
+}
+
+type apiSubscriber struct {
+	ID        string    `json:"id"` // remote addr of rtmp players, others are prefixed by their kind
+	StartTime time.Time `json:"start_time"`
+	Queued    int       `json:"queued"` // packets waiting to be sent
+	RTT       int64     `json:"rtt_ms"` // of rtmp players
+}
+
+func newAPIStream(ss *streamSource) apiStream {
+	vhost, app, name, _ := splitStreamKey(ss.streamKey)
+	stream := apiStream{
+		ID:             ss.sessionID,
+		Vhost:          vhost,
+		App:            app,
+		Name:           name,
+		NumSubscribers: ss.numSubscribers(),
+	}
+
+	if pub := ss.getPublisher(); pub != nil {
+		c := pub.rtmpConn
+		stream.Publisher = &apiPublisher{
+			ClientID:  c.clientID,
+			TcUrl:     c.tcUrl,
+			StartTime: pub.startTime,
+			RTT:       int64(c.RTT() / time.Millisecond),
+		}
+		if c.conn != nil {
+			stream.Publisher.RemoteAddr = c.RemoteAddr().String()
+		}
+		stream.Publisher.VideoCodec, stream.Publisher.AudioCodec = pub.codecs()
+	}
+	return stream
+}
+
+func newAPISubscriber(sub *subscriber) apiSubscriber {
+	s := apiSubscriber{
+		ID:        sub.id,
+		StartTime: sub.startTime,
+		Queued:    len(sub.avPktQueue),
+	}
+	if sub.rtmpConn != nil {
+		s.RTT = int64(sub.rtmpConn.RTT() / time.Millisecond)
+	}
+	return s
+}
+
+// apiStreams returns the streams of vhost and app sorted by key, empty matches any
+func (srv *Server) apiStreams(vhost, app string) []apiStream {
+	var sss []*streamSource
+	srv.ssMgr.streamMap.Range(func(_, val interface{}) bool {
+		sss = append(sss, val.(*streamSource))
+		return true
+	})
+	sort.Slice(sss, func(i, j int) bool { return sss[i].streamKey < sss[j].streamKey })
+
+	streams := []apiStream{}
+	for _, ss := range sss {
+		stream := newAPIStream(ss)
+		if (vhost == "" || stream.Vhost == vhost) && (app == "" || stream.App == app) {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+func (srv *Server) apiVhosts() []apiVhost {
+	apps := make(map[string]map[string]int) // streams count by vhost and app
+	for _, stream := range srv.apiStreams("", "") {
+		if apps[stream.Vhost] == nil {
+			apps[stream.Vhost] = make(map[string]int)
+		}
+		apps[stream.Vhost][stream.App]++
+	}
+
+	vhosts := []apiVhost{}
+	for vhost, counts := range apps {
+		vh := apiVhost{Name: vhost}
+		for app, n := range counts {
+			vh.Apps = append(vh.Apps, apiApp{Name: app, Streams: n})
+		}
+		sort.Slice(vh.Apps, func(i, j int) bool { return vh.Apps[i].Name < vh.Apps[j].Name })
+		vhosts = append(vhosts, vh)
+	}
+	sort.Slice(vhosts, func(i, j int) bool { return vhosts[i].Name < vhosts[j].Name })
+	return vhosts
+}
+
+func (srv *Server) findStreamByID(id string) *streamSource {
+	var found *streamSource
+	srv.ssMgr.streamMap.Range(func(_, val interface{}) bool {
+		if ss := val.(*streamSource); ss.sessionID == id {
+			found = ss
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// splitStreamKey is the reverse of genStreamKey, the app may have '/'
+func splitStreamKey(streamKey string) (vhost, app, stream string, ok bool) {
+	first, last := strings.IndexByte(streamKey, '/'), strings.LastIndexByte(streamKey, '/')
+	if first <= 0 || last-first <= 1 || last == len(streamKey)-1 {
+		return "", "", "", false
+	}
+	return streamKey[:first], streamKey[first+1 : last], streamKey[last+1:], true
+}
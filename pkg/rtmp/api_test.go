@@ -0,0 +1,146 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"playground/internal/errno"
+)
+
+func TestSplitStreamKey(t *testing.T) {
+	for _, c := range []struct {
+		key              string
+		vhost, app, name string
+		ok               bool
+	}{
+		{"v/live/test", "v", "live", "test", true},
+		{"v/live/sub/test", "v", "live/sub", "test", true},
+		{genStreamKey(defaultVhost, "live", "test"), defaultVhost, "live", "test", true},
+		{"", "", "", "", false},
+		{"v/test", "", "", "", false},
+		{"/live/test", "", "", "", false},
+		{"v//test", "", "", "", false},
+		{"v/live/", "", "", "", false},
+	} {
+		vhost, app, name, ok := splitStreamKey(c.key)
+		if vhost != c.vhost || app != c.app || name != c.name || ok != c.ok {
+			t.Errorf("%q: %q %q %q %v", c.key, vhost, app, name, ok)
+		}
+	}
+}
+
+type apiResult struct {
+	ErrNo int             `json:"errno"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func errNo(e errno.Error) int {
+	var r apiResult
+	_ = json.Unmarshal([]byte(e.String()), &r)
+	return r.ErrNo
+}
+
+// callAPI serves one admin api request, the data of the result is decoded into data if not nil
+func callAPI(t *testing.T, srv *Server, method, path string, data interface{}) int {
+	w := httptest.NewRecorder()
+	srv.serveAPI(w, httptest.NewRequest(method, path, nil))
+
+	var r apiResult
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatalf("%s %s: %v, %s", method, path, err, w.Body.Bytes())
+	}
+	if data != nil && r.ErrNo == 0 {
+		if err := json.Unmarshal(r.Data, data); err != nil {
+			t.Fatalf("%s %s: %v, %s", method, path, err, r.Data)
+		}
+	}
+	return r.ErrNo
+}
+
+func TestAPI(t *testing.T) {
+	srv, addr := startServer(t, &Config{})
+	url := "rtmp://" + addr + "/live/test"
+	pub := dialPublish(t, url, &Config{})
+	defer pub.Close()
+	player := dialPlay(t, url, &Config{})
+	defer player.Close()
+
+	var streams []apiStream
+	waitFor(t, "player", func() bool {
+		callAPI(t, srv, http.MethodGet, apiPrefix+"streams", &streams)
+		return len(streams) == 1 && streams[0].NumSubscribers == 1
+	})
+	stream := streams[0]
+	if stream.Vhost != defaultVhost || stream.App != "live" || stream.Name != "test" || stream.Publisher == nil || stream.Publisher.RemoteAddr == "" {
+		t.Fatalf("stream %+v", stream)
+	}
+
+	var vhosts []apiVhost
+	if n := callAPI(t, srv, http.MethodGet, apiPrefix+"vhosts", &vhosts); n != 0 || len(vhosts) != 1 || vhosts[0].Name != defaultVhost ||
+		len(vhosts[0].Apps) != 1 || vhosts[0].Apps[0] != (apiApp{Name: "live", Streams: 1}) {
+		t.Errorf("vhosts %d %+v", n, vhosts)
+	}
+	if callAPI(t, srv, http.MethodGet, apiPrefix+"streams?app=other", &streams); len(streams) != 0 {
+		t.Errorf("streams of other app: %+v", streams)
+	}
+
+	var one apiStream
+	if n := callAPI(t, srv, http.MethodGet, apiPrefix+"streams/"+stream.ID, &one); n != 0 || len(one.Subscribers) != 1 {
+		t.Fatalf("stream %d %+v", n, one)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		want         errno.Error
+	}{
+		{http.MethodGet, "/vhosts", errno.ErrParam},
+		{http.MethodPost, apiPrefix + "vhosts", errno.ErrParam},
+		{http.MethodGet, apiPrefix + "unknown", errno.ErrParam},
+		{http.MethodGet, apiPrefix + "streams/unknown", errno.ErrStreamNotFound},
+		{http.MethodPost, apiPrefix + "streams/" + stream.ID, errno.ErrParam},
+		{http.MethodDelete, apiPrefix + "streams/" + stream.ID + "/subscribers/unknown", errno.ErrClientNotFound},
+		{http.MethodPut, apiPrefix + "disabled/live/test", errno.ErrParam},
+		{http.MethodPost, apiPrefix + "disabled", errno.ErrParam},
+		{http.MethodDelete, apiPrefix + "streams/" + stream.ID + "/subscribers/" + one.Subscribers[0].ID, errno.ErrOK},
+	} {
+		if n := callAPI(t, srv, c.method, c.path, nil); n != errNo(c.want) {
+			t.Errorf("%s %s: errno %d, want %d", c.method, c.path, n, errNo(c.want))
+		}
+	}
+	waitFor(t, "kicked player", func() bool {
+		one = apiStream{}
+		callAPI(t, srv, http.MethodGet, apiPrefix+"streams/"+stream.ID, &one)
+		return len(one.Subscribers) == 0
+	})
+
+	// a disabled key kicks the publisher and refuses to publish again until enabled
+	keyPath := apiPrefix + "disabled/" + genStreamKey(defaultVhost, "live", "test")
+	if n := callAPI(t, srv, http.MethodPut, keyPath, nil); n != 0 {
+		t.Fatalf("disable: errno %d", n)
+	}
+	var keys []string
+	if callAPI(t, srv, http.MethodGet, apiPrefix+"disabled", &keys); len(keys) != 1 || keys[0] != genStreamKey(defaultVhost, "live", "test") {
+		t.Errorf("disabled keys %v", keys)
+	}
+	waitFor(t, "kicked publisher", func() bool {
+		one = apiStream{}
+		callAPI(t, srv, http.MethodGet, apiPrefix+"streams/"+stream.ID, &one)
+		return one.Publisher == nil
+	})
+
+	if c, err := Dial(url, &Config{Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := c.Publish(); err == nil {
+			t.Error("published a disabled key")
+		}
+		c.Close()
+	}
+
+	if n := callAPI(t, srv, http.MethodDelete, keyPath, nil); n != 0 {
+		t.Fatalf("enable: errno %d", n)
+	}
+	dialPublish(t, url, &Config{}).Close()
+}
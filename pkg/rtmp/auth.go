@@ -0,0 +1,160 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"playground/internal/lru"
+)
+
+// query parameters of a signed url, in tcUrl or after '?' of the stream name
+const (
+	authParamExpire = "expire" // unix seconds the url expires at
+	authParamToken  = "token"  // hex hmac-sha256 signature
+	authParamIP     = "ip"     // optional, the only client ip allowed
+
+	defaultReplayCacheSize = 10240
+)
+
+// AuthConfig enables signed url authentication for publish and play.
+//
+// Secrets are looked up by "vhost/app", "vhost/*" and "*" in order, apps without a secret
+// are not authenticated. A url is signed by SignToken with its stream key "vhost/app/stream",
+// the expire time and the optional client ip, e.g.
+//
+//	rtmp://host/app/stream?expire=1600000000&token=<SignToken(...)>
+//
+// A publish token can be used only once before it expires, play tokens may be reused so players
+// can reconnect.
+type AuthConfig struct {
+	Secrets         map[string]string
+	ReplayCacheSize int // used publish tokens remembered to block replay, default 10240, negative disables
+}
+
+func (ac *AuthConfig) secret(vhost, app string) (string, bool) {
+	for _, k := range appKeys(vhost, app) {
+		if s, ok := ac.Secrets[k]; ok {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// SignToken returns the token of a signed url
+func SignToken(secret, streamKey string, expire int64, ip string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	_, _ = h.Write([]byte(streamKey))
+	_, _ = h.Write([]byte(":" + strconv.FormatInt(expire, 10)))
+	if ip != "" {
+		_, _ = h.Write([]byte(":" + ip))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tokenCache remembers used tokens until they expire
+type tokenCache struct {
+	mu    sync.Mutex
+	cache *lru.Cache // <token, expire time>
+}
+
+func newTokenCache(size int) *tokenCache {
+	return &tokenCache{cache: lru.New(size)}
+}
+
+// use marks token used, false if it has been used and not expired yet
+func (tc *tokenCache) use(token string, expire time.Time) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if v, ok := tc.cache.Get(token); ok && time.Now().Before(v.(time.Time)) {
+		return false
+	}
+	tc.cache.Add(token, expire)
+	return true
+}
+
+// authorizeConnect rejects a tcUrl token which is malformed, expired or for another ip,
+// the signature is checked by authorizeStream once the stream name is known
+func (c *Conn) authorizeConnect() error {
+	ac := c.config.Auth
+	if ac == nil {
+		return nil
+	}
+	if _, ok := ac.secret(c.vhost, c.appName); !ok {
+		return nil
+	}
+
+	if c.urlValues.Get(authParamToken) == "" {
+		return nil // may be given in stream name
+	}
+
+	_, err := c.checkTokenParams(c.urlValues)
+	return err
+}
+
+// authorizeStream checks the signed url of streamKey, the params of stream name take precedence over tcUrl
+func (c *Conn) authorizeStream() error {
+	ac := c.config.Auth
+	if ac == nil {
+		return nil
+	}
+	secret, ok := ac.secret(c.vhost, c.appName)
+	if !ok {
+		return nil
+	}
+
+	params := c.urlValues
+	if c.streamValues.Get(authParamToken) != "" {
+		params = c.streamValues
+	}
+
+	expire, err := c.checkTokenParams(params)
+	if err != nil {
+		return err
+	}
+
+	token := params.Get(authParamToken)
+	expect := SignToken(secret, c.streamKey, expire.Unix(), params.Get(authParamIP))
+	if !hmac.Equal([]byte(token), []byte(expect)) {
+		return errors.New("invalid token")
+	}
+
+	if c.isPublisher && c.server != nil && c.server.usedTokens != nil && ac.ReplayCacheSize >= 0 {
+		if !c.server.usedTokens.use(token, expire) {
+			return errors.New("token has been used")
+		}
+	}
+
+	return nil
+}
+
+// check the token exists, not expired and the client ip matches, returns the expire time
+func (c *Conn) checkTokenParams(params url.Values) (time.Time, error) {
+	if params.Get(authParamToken) == "" {
+		return time.Time{}, errors.New("no token")
+	}
+
+	sec, err := strconv.ParseInt(params.Get(authParamExpire), 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid %s: '%s'", authParamExpire, params.Get(authParamExpire))
+	}
+	expire := time.Unix(sec, 0)
+	if time.Now().After(expire) {
+		return time.Time{}, errors.New("token expired")
+	}
+
+	if ip := params.Get(authParamIP); ip != "" {
+		if c.remoteIP() != ip {
+			return time.Time{}, errors.Errorf("token is for ip %s", ip)
+		}
+	}
+
+	return expire, nil
+}
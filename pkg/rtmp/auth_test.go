@@ -0,0 +1,96 @@
+package rtmp
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeStream(t *testing.T) {
+	const secret = "s3cret"
+	config := &Config{Auth: &AuthConfig{Secrets: map[string]string{defaultVhost + "/live": secret}}}
+	srv := NewServer("", config)
+	streamKey := genStreamKey(defaultVhost, "live", "test")
+
+	signed := func(expire time.Time, ip string) url.Values {
+		sec := expire.Unix()
+		v := url.Values{}
+		v.Set(authParamExpire, strconv.FormatInt(sec, 10))
+		v.Set(authParamToken, SignToken(secret, streamKey, sec, ip))
+		if ip != "" {
+			v.Set(authParamIP, ip)
+		}
+		return v
+	}
+	newConn := func(app string, params url.Values, publish bool) *Conn {
+		return &Conn{
+			server:         srv,
+			config:         config,
+			vhost:          defaultVhost,
+			appName:        app,
+			streamKey:      genStreamKey(defaultVhost, app, "test"),
+			urlValues:      url.Values{},
+			streamValues:   params,
+			httpRemoteAddr: "10.0.0.1:50000",
+			isPublisher:    publish,
+		}
+	}
+
+	valid := signed(time.Now().Add(time.Hour), "")
+	forged := signed(time.Now().Add(time.Hour), "")
+	forged.Set(authParamToken, SignToken("other", streamKey, time.Now().Add(time.Hour).Unix(), ""))
+	for _, c := range []struct {
+		name    string
+		app     string
+		params  url.Values
+		publish bool
+		ok      bool
+	}{
+		{"no secret", "open", url.Values{}, true, true},
+		{"no token", "live", url.Values{}, false, false},
+		{"valid", "live", valid, false, true},
+		{"forged", "live", forged, false, false},
+		{"expired", "live", signed(time.Now().Add(-time.Second), ""), false, false},
+		{"ip matched", "live", signed(time.Now().Add(time.Hour), "10.0.0.1"), false, true},
+		{"ip mismatched", "live", signed(time.Now().Add(time.Hour), "10.0.0.2"), false, false},
+		{"ip changed", "live", func() url.Values {
+			v := signed(time.Now().Add(time.Hour), "10.0.0.2")
+			v.Set(authParamIP, "10.0.0.1")
+			return v
+		}(), false, false},
+	} {
+		if err := newConn(c.app, c.params, c.publish).authorizeStream(); (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+
+	// play tokens may be reused, publish tokens may not
+	play := signed(time.Now().Add(time.Minute), "")
+	for i := 0; i < 2; i++ {
+		if err := newConn("live", play, false).authorizeStream(); err != nil {
+			t.Fatalf("play #%d: %v", i, err)
+		}
+	}
+	publish := signed(time.Now().Add(2*time.Minute), "")
+	if err := newConn("live", publish, true).authorizeStream(); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := newConn("live", publish, true).authorizeStream(); err == nil {
+		t.Fatal("publish token replayed")
+	}
+
+	// tcUrl params are used if the stream name has none
+	c := newConn("live", url.Values{}, false)
+	c.urlValues = valid
+	if err := c.authorizeStream(); err != nil {
+		t.Fatalf("tcUrl token: %v", err)
+	}
+}
+
+func TestReplayCacheDisabled(t *testing.T) {
+	srv := NewServer("", &Config{Auth: &AuthConfig{ReplayCacheSize: -1}})
+	if srv.usedTokens != nil {
+		t.Fatal("replay cache allocated while disabled")
+	}
+}
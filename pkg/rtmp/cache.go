@@ -1,9 +1,17 @@
 package rtmp
 
 import (
+	"bytes"
+
 	"playground/pkg/av"
 )
 
+const (
+	defaultGopCacheNum        = 1       // keep the latest complete gop
+	defaultGopCacheMaxPackets = 512     // less than subscriber's av queue size
+	defaultGopCacheMaxBytes   = 8 << 20 // 8MB
+)
+
 type SpecialCache struct {
 	full bool
 	pkt  *av.Packet
@@ -18,15 +26,97 @@ func (c *SpecialCache) Write(pkt *av.Packet) {
 	c.full = true
 }
 
+// gop is a group of packets starting with a video key frame
+type gop struct {
+	pkts  []*av.Packet
+	bytes int
+}
+
+// GopCache keeps the last num gops, limited by maxPackets and maxBytes in total.
+// A gop exceeds the limit alone is dropped, caching restarts from the next key frame.
+type GopCache struct {
+	num        int
+	maxPackets int
+	maxBytes   int
+
+	gops    []*gop // oldest first, the last one is being filled
+	packets int
+	bytes   int
+}
+
+func NewGopCache(num, maxPackets, maxBytes int) *GopCache {
+	return &GopCache{
+		num:        num,
+		maxPackets: maxPackets,
+		maxBytes:   maxBytes,
+	}
+}
+
+func (c *GopCache) Write(pkt *av.Packet) {
+	if c.num <= 0 {
+		return
+	}
+
+	if pkt.IsVideo {
+		if vh, ok := pkt.Header.(av.VideoPacketHeader); ok && vh.IsKeyFrame() {
+			c.gops = append(c.gops, &gop{})
+		}
+	}
+
+	if len(c.gops) == 0 { // wait for the first key frame
+		return
+	}
+
+	cur := c.gops[len(c.gops)-1]
+	cur.pkts = append(cur.pkts, pkt)
+	cur.bytes += len(pkt.Data)
+	c.packets++
+	c.bytes += len(pkt.Data)
+
+	for len(c.gops) > 0 && (len(c.gops) > c.num+1 || c.overflow()) {
+		c.dropOldest()
+	}
+}
+
+// the gop being filled is not complete yet, so num+1 gops are kept at most
+func (c *GopCache) overflow() bool {
+	return (c.maxPackets > 0 && c.packets > c.maxPackets) || (c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+func (c *GopCache) dropOldest() {
+	old := c.gops[0]
+	c.packets -= len(old.pkts)
+	c.bytes -= old.bytes
+
+	c.gops[0] = nil
+	c.gops = c.gops[1:]
+}
+
+// Packets returns the cached packets in order, starting with a key frame
+func (c *GopCache) Packets() []*av.Packet {
+	pkts := make([]*av.Packet, 0, c.packets)
+	for _, g := range c.gops {
+		pkts = append(pkts, g.pkts...)
+	}
+	return pkts
+}
+
+func (c *GopCache) Clear() {
+	c.gops = nil
+	c.packets = 0
+	c.bytes = 0
+}
+
 type Cache struct {
-	//TODO:gop
+	gop      *GopCache
 	videoSeq *SpecialCache
 	audioSeq *SpecialCache
 	metaData *SpecialCache
 }
 
-func NewCache() *Cache {
+func NewCache(gop *GopCache) *Cache {
 	return &Cache{
+		gop:      gop,
 		videoSeq: NewSpecialCache(),
 		audioSeq: NewSpecialCache(),
 		metaData: NewSpecialCache(),
@@ -41,17 +131,20 @@ func (c *Cache) Write(pkt *av.Packet) {
 		if !pkt.IsVideo {
 			ah, ok := pkt.Header.(av.AudioPacketHeader)
 			if ok {
-				if ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+				if ah.IsSeq() {
 					c.audioSeq.Write(pkt)
 					return
-				} else {
-					return
 				}
+			} else {
+				return
 			}
 		} else {
 			vh, ok := pkt.Header.(av.VideoPacketHeader)
 			if ok {
 				if vh.IsSeq() {
+					if c.videoSeq.full && !bytes.Equal(c.videoSeq.pkt.Data, pkt.Data) {
+						c.gop.Clear() // codec changed, old gops can't be decoded anymore
+					}
 					c.videoSeq.Write(pkt)
 					return
 				}
@@ -61,5 +154,5 @@ func (c *Cache) Write(pkt *av.Packet) {
 		}
 	}
 
-	//TODO: GOP cache
+	c.gop.Write(pkt)
 }
@@ -0,0 +1,103 @@
+package rtmp
+
+import (
+	"testing"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+// videoPacket is a demuxed h264 frame of size bytes
+func videoPacket(t *testing.T, ts uint32, key bool, size int) *av.Packet {
+	frameType := uint8(av.INTER_FRAME)
+	if key {
+		frameType = av.KEY_FRAME
+	}
+	pkt := flv.NewVideoPacket(ts, frameType, av.VIDEO_H264, av.AVC_NALU, 0, make([]byte, size-5))
+	if err := flv.NewDemuxer().DemuxHdr(pkt); err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func timeStamps(pkts []*av.Packet) []uint32 {
+	ts := make([]uint32, 0, len(pkts))
+	for _, pkt := range pkts {
+		ts = append(ts, pkt.TimeStamp)
+	}
+	return ts
+}
+
+func equalTimeStamps(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGopCache(t *testing.T) {
+	// gops of 3 packets of 100 bytes at 0, 30, 60 and 90, the last one being filled
+	frames := []struct {
+		ts  uint32
+		key bool
+	}{
+		{0, true}, {10, false}, {20, false},
+		{30, true}, {40, false}, {50, false},
+		{60, true}, {70, false}, {80, false},
+		{90, true}, {100, false},
+	}
+
+	for _, c := range []struct {
+		name                 string
+		num, maxPkts, maxLen int
+		want                 []uint32
+	}{
+		{"one gop", 1, 0, 0, []uint32{60, 70, 80, 90, 100}},
+		{"two gops", 2, 0, 0, []uint32{30, 40, 50, 60, 70, 80, 90, 100}},
+		{"max packets", 3, 6, 0, []uint32{60, 70, 80, 90, 100}},
+		{"max bytes", 3, 0, 400, []uint32{90, 100}},
+		{"gop over the limit alone", 3, 1, 0, nil},
+		{"disabled", -1, 0, 0, nil},
+	} {
+		cache := NewGopCache(c.num, c.maxPkts, c.maxLen)
+		cache.Write(videoPacket(t, 0, false, 100)) // before the first key frame
+		for _, f := range frames {
+			cache.Write(videoPacket(t, f.ts, f.key, 100))
+		}
+
+		pkts := cache.Packets()
+		if got := timeStamps(pkts); !equalTimeStamps(got, c.want) {
+			t.Errorf("%s: cached %v, want %v", c.name, got, c.want)
+		}
+		if cache.packets != len(pkts) || cache.bytes != 100*len(pkts) {
+			t.Errorf("%s: counted %d packets %d bytes", c.name, cache.packets, cache.bytes)
+		}
+	}
+}
+
+func TestCacheVideoSeqChange(t *testing.T) {
+	seq := func(b byte) *av.Packet {
+		pkt := flv.NewVideoPacket(0, av.KEY_FRAME, av.VIDEO_H264, av.AVC_SEQHDR, 0, []byte{1, b})
+		if err := flv.NewDemuxer().DemuxHdr(pkt); err != nil {
+			t.Fatal(err)
+		}
+		return pkt
+	}
+
+	cache := NewCache(NewGopCache(1, 0, 0))
+	cache.Write(seq(1))
+	cache.Write(videoPacket(t, 0, true, 10))
+	cache.Write(seq(1)) // resent unchanged
+	if n := len(cache.gop.Packets()); n != 1 {
+		t.Fatalf("gop cleared by the same sequence header, %d packets left", n)
+	}
+	cache.Write(seq(2))
+	if n := len(cache.gop.Packets()); n != 0 {
+		t.Fatalf("gop kept after codec change, %d packets", n)
+	}
+}
@@ -287,10 +287,13 @@ func (c *Conn) readChunkMessageBody(cs *ChunkStream) error {
 
 // write one chunk stream fully
 func (c *Conn) writeChunkStream(cs *ChunkStream) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
 	switch cs.MsgTypeID {
 	case MsgAudioMessage:
 		cs.Csid = 4
-	case MsgVideoMessage, MsgAMF3DataMessage, MSGAMF0DataMessage:
+	case MsgVideoMessage, MsgAMF3DataMessage, MSGAMF0DataMessage, MsgAggregateMessage:
 		cs.Csid = 6
 	}
 
@@ -344,6 +347,8 @@ func (c *Conn) onReadChunkStreamSucc(cs *ChunkStream) {
 	case MsgWindowAcknowledgementSize:
 		c.remoteWindowAckSize = binary.BigEndian.Uint32(cs.ChunkBody)
 		c.logger.WithFields(logrus.Fields{"event": "save remoteWindowAckSize", "data": c.remoteWindowAckSize}).Trace("")
+	case MsgUserControlMessage:
+		c.handleUserControlMessage(cs)
 	default:
 	}
 
@@ -374,25 +379,25 @@ func (c *Conn) writeChunkBasicHeader(fmt uint8, csid uint32) error {
 	switch {
 	case csid < 64:
 		h |= csid
-		if err := c.writeUint(h, c.basicHdrBuf[0:1], false); err != nil {
+		if err := c.writeUint(h, c.writeHdrBuf[0:1], false); err != nil {
 			return err
 		}
 	case csid-64 < 256:
 		h |= 0
-		if err := c.writeUint(h, c.basicHdrBuf[0:1], false); err != nil {
+		if err := c.writeUint(h, c.writeHdrBuf[0:1], false); err != nil {
 			return err
 		}
 
-		if err := c.writeUint(csid-64, c.basicHdrBuf[0:1], false); err != nil {
+		if err := c.writeUint(csid-64, c.writeHdrBuf[0:1], false); err != nil {
 			return err
 		}
 	case csid-64 < 65536:
 		h |= 1
-		if err := c.writeUint(h, c.basicHdrBuf[0:1], false); err != nil {
+		if err := c.writeUint(h, c.writeHdrBuf[0:1], false); err != nil {
 			return err
 		}
 
-		if err := c.writeUint(csid-64, c.basicHdrBuf[0:2], false); err != nil {
+		if err := c.writeUint(csid-64, c.writeHdrBuf[0:2], false); err != nil {
 			return err
 		}
 	}
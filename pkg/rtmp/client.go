@@ -0,0 +1,395 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"playground/pkg/amf"
+	"playground/pkg/av"
+)
+
+const (
+	defaultRtmpPort = 1935
+	dialTimeout     = 10 * time.Second
+
+	// chunk stream id used by client for command messages
+	clientCmdCsid = 3
+)
+
+// Dial connects to the rtmp server of rawurl(rtmp://host[:port]/app/stream[?query], or rtmps://
+// over tls whose port is 443 by default), finishes handshake and connect command, then Publish
+// or Play should be called.
+func Dial(rawurl string, config *Config) (*Conn, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.Logger == nil {
+		config.Logger = logrus.StandardLogger()
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse url")
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "rtmp" && scheme != "rtmps" {
+		return nil, errors.Errorf("not rtmp scheme: %s", u.Scheme)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), strconv.Itoa(defaultPort(scheme)))
+	}
+
+	var netConn net.Conn
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if scheme == "rtmps" {
+		tlsConfig := config.TLSClientConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		netConn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+
+	c := Client(netConn, config)
+	if err := c.parseDialUrl(u); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// a silent server fails handshake and connect in time instead of blocking forever
+	if err := netConn.SetDeadline(time.Now().Add(config.handshakeTimeout())); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "set handshake deadline")
+	}
+
+	if err := c.Handshake(); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "client handshake")
+	}
+
+	if err := c.connect(); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "connect")
+	}
+
+	if err := netConn.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "clear handshake deadline")
+	}
+
+	return c, nil
+}
+
+// rtmp://host:port/app/stream?query => tcUrl: rtmp://host:port/app?query, app: app, stream: stream
+func (c *Conn) parseDialUrl(u *url.URL) error {
+	path := strings.TrimPrefix(u.Path, "/")
+	idx := strings.LastIndex(path, "/")
+	if idx <= 0 || idx == len(path)-1 {
+		return errors.Errorf("invalid rtmp url path: '%s', should be /app/stream", u.Path)
+	}
+
+	c.appName = path[:idx]
+	c.streamName = path[idx+1:]
+	c.rawQuery = u.RawQuery
+	c.urlValues = u.Query()
+	c.host = u.Hostname()
+	c.port, _ = strconv.Atoi(u.Port())
+	if c.port == 0 {
+		c.port = defaultPort(strings.ToLower(u.Scheme))
+	}
+
+	tcUrl := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + c.appName, RawQuery: u.RawQuery}
+	c.tcUrl = tcUrl.String()
+
+	return nil
+}
+
+func defaultPort(scheme string) int {
+	if scheme == "rtmps" {
+		return defaultRtmpsPort
+	}
+	return defaultRtmpPort
+}
+
+func (c *Conn) connect() error {
+	// set chunk size
+	cs := NewProtolControlMessage(MsgSetChunkSize, 4, c.localChunksize)
+	if err := c.writeChunkStream(cs); err != nil {
+		return errors.Wrap(err, "send Set Chunk Size")
+	}
+
+	event := make(amf.Object)
+	event["app"] = c.appName
+	event["type"] = "nonprivate"
+	event["flashVer"] = "FMLE/3.0 (compatible; FMSc/1.0)"
+	event["swfUrl"] = c.tcUrl
+	event["tcUrl"] = c.tcUrl
+	event["fpad"] = false
+	event["capabilities"] = 15
+	event["audioCodecs"] = 3191
+	event["videoCodecs"] = 252
+	event["videoFunction"] = 1
+	event["fourCcList"] = fourCCList(enhancedFourCCs)
+	event["objectEncoding"] = c.objectEncoding
+
+	vs, err := c.callCommand(cmdConnect, 0, event)
+	if err != nil {
+		return err
+	}
+
+	if code := statusCode(vs); code != "NetConnection.Connect.Success" {
+		return errors.Errorf("connect rejected: '%s'", code)
+	}
+	c.logger.WithFields(logrus.Fields{"event": "client connect", "tcUrl": c.tcUrl}).Trace("success")
+
+	return nil
+}
+
+// Publish starts to publish the stream of the dialed url, packets are then sent by WritePacket.
+func (c *Conn) Publish() error {
+	_ = c.sendCommand(cmdReleaseStream, 0, nil, c.streamName)
+	_ = c.sendCommand(cmdFcpublish, 0, nil, c.streamName)
+
+	if err := c.createStream(); err != nil {
+		return err
+	}
+
+	if err := c.sendCommand(cmdPublish, c.streamID, nil, c.streamName, "live"); err != nil {
+		return errors.Wrap(err, "send publish")
+	}
+
+	if err := c.waitStatus("NetStream.Publish.Start"); err != nil {
+		return err
+	}
+
+	c.isPublisher = true
+	c.logger.WithFields(logrus.Fields{"event": "client publish", "stream": c.streamName}).Trace("success")
+	return nil
+}
+
+// Play starts to play the stream of the dialed url, packets are then received by ReadPacket.
+func (c *Conn) Play() error {
+	if err := c.createStream(); err != nil {
+		return err
+	}
+
+	if err := c.sendCommand(cmdPlay, c.streamID, nil, c.streamName); err != nil {
+		return errors.Wrap(err, "send play")
+	}
+
+	if err := c.waitStatus("NetStream.Play.Start"); err != nil {
+		return err
+	}
+
+	c.isPublisher = false
+	c.logger.WithFields(logrus.Fields{"event": "client play", "stream": c.streamName}).Trace("success")
+	return nil
+}
+
+// ReadPacket reads next audio/video/metadata packet from a playing client connection,
+// io.EOF is returned once the peer stops the stream.
+func (c *Conn) ReadPacket() (*av.Packet, error) {
+	for {
+		if len(c.aggPkts) > 0 {
+			pkt := c.aggPkts[0]
+			c.aggPkts = c.aggPkts[1:]
+			return pkt, nil
+		}
+
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			return nil, err
+		}
+
+		pkt := new(av.Packet)
+		switch cs.MsgTypeID {
+		case MsgAudioMessage:
+			pkt.IsAudio = true
+		case MsgVideoMessage:
+			pkt.IsVideo = true
+		case MSGAMF0DataMessage, MsgAMF3DataMessage:
+			pkt.IsMetaData = true
+			cs.ChunkBody = amfBody(cs)
+		case MsgAMF0CommandMessage, MsgAMF3CommandMessage:
+			vs, err := c.decodeAMF(cs)
+			if err != nil {
+				return nil, err
+			}
+			switch statusCode(vs) {
+			case "NetStream.Play.Stop", "NetStream.Play.UnpublishNotify", "NetStream.Unpublish.Notify":
+				return nil, io.EOF
+			}
+			continue
+		case MsgAggregateMessage:
+			if c.aggPkts, err = splitAggregate(cs); err != nil {
+				c.logger.WithField("event", "split aggregate").Error(err)
+			}
+			continue
+		default:
+			continue
+		}
+
+		pkt.StreamID = cs.MsgStreamID
+		pkt.Data = cs.ChunkBody
+		pkt.TimeStamp = cs.TimeStamp
+
+		if err := c.demuxer.DemuxHdr(pkt); err != nil && !pkt.IsMetaData {
+			c.logger.WithField("event", "flv Demux Hdr").Error(err)
+		}
+
+		return pkt, nil
+	}
+}
+
+// WritePacket sends one audio/video/metadata packet on a publishing client connection.
+func (c *Conn) WritePacket(pkt *av.Packet) error {
+	cs := newChunkStream()
+	cs.ChunkBody = pkt.Data
+	cs.MsgStreamID = c.streamID
+	cs.TimeStamp = pkt.TimeStamp
+
+	switch {
+	case pkt.IsVideo:
+		cs.MsgTypeID = MsgVideoMessage
+	case pkt.IsAudio:
+		cs.MsgTypeID = MsgAudioMessage
+	case pkt.IsMetaData:
+		cs.MsgTypeID = MSGAMF0DataMessage
+
+		var err error
+		if cs.ChunkBody, err = amf.MetaDataReform(cs.ChunkBody, amf.ADD); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown packet type")
+	}
+	cs.MsgLength = uint32(len(cs.ChunkBody))
+
+	return c.writeChunkStream(cs)
+}
+
+func (c *Conn) createStream() error {
+	vs, err := c.callCommand(cmdCreateStream, 0, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vs[2:] {
+		if id, ok := v.(float64); ok {
+			c.streamID = uint32(id)
+			return nil
+		}
+	}
+
+	return errors.New("createStream: no stream id in result")
+}
+
+// send one command message with a new transaction id
+func (c *Conn) sendCommand(name string, streamID uint32, args ...interface{}) error {
+	c.transactionID++
+	return c.writeCommandMessage(clientCmdCsid, streamID, append([]interface{}{name, c.transactionID}, args...)...)
+}
+
+// send one command message and wait for its _result/_error
+func (c *Conn) callCommand(name string, streamID uint32, args ...interface{}) ([]interface{}, error) {
+	if err := c.sendCommand(name, streamID, args...); err != nil {
+		return nil, errors.Wrapf(err, "send %s", name)
+	}
+	transactionID := c.transactionID
+
+	for {
+		vs, err := c.readCommandMessage()
+		if err != nil {
+			return nil, errors.Wrapf(err, "wait %s result", name)
+		}
+
+		if len(vs) < 2 {
+			continue
+		}
+		if id, ok := vs[1].(float64); !ok || int(id) != transactionID {
+			continue
+		}
+
+		switch vs[0] {
+		case "_result":
+			return vs, nil
+		case "_error":
+			return nil, errors.Errorf("%s error: '%s'", name, statusCode(vs))
+		}
+	}
+}
+
+// wait onStatus message with the expected code, error level status fails
+func (c *Conn) waitStatus(code string) error {
+	for {
+		vs, err := c.readCommandMessage()
+		if err != nil {
+			return errors.Wrapf(err, "wait %s", code)
+		}
+
+		if len(vs) == 0 || vs[0] != "onStatus" {
+			continue
+		}
+
+		got := statusCode(vs)
+		if got == code {
+			return nil
+		}
+		if statusLevel(vs) == "error" {
+			return errors.Errorf("%s failed: '%s'", code, got)
+		}
+	}
+}
+
+// read until a command message arrives, protocol control messages are handled meanwhile
+func (c *Conn) readCommandMessage() ([]interface{}, error) {
+	for {
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			return nil, err
+		}
+
+		switch cs.MsgTypeID {
+		case MsgAMF0CommandMessage, MsgAMF3CommandMessage:
+			return c.decodeAMF(cs)
+		}
+	}
+}
+
+// find the "code" of the info object in a command message
+func statusCode(vs []interface{}) string {
+	return statusField(vs, "code")
+}
+
+func statusLevel(vs []interface{}) string {
+	return statusField(vs, "level")
+}
+
+func statusField(vs []interface{}, key string) string {
+	for _, v := range vs {
+		if obj, ok := v.(amf.Object); ok {
+			if s, ok := obj[key].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
@@ -1,12 +1,146 @@
 package rtmp
 
 import (
+	"crypto/tls"
+	"time"
+
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
+
+	"playground/pkg/amf"
+	"playground/pkg/av"
+)
+
+const (
+	defaultVhost = "_defaultVhost_"
+
+	defaultChunkSize           = 60000
+	defaultWindowAckSize       = 2500000
+	defaultPeerBandwidth       = 2500000
+	defaultSubscriberQueueSize = 1024
+	minSubscriberQueueSize     = 128 // subscriber drops packets when less than 24 slots left
+	defaultHandshakeTimeout    = 10 * time.Second
+	defaultPingInterval        = 10 * time.Second
 )
 
+// Config holds the connection parameters, the zero value of every option means its default.
 type Config struct {
 	Logger *logrus.Logger
+
+	ChunkSize           uint32        // local chunk size sent by Set Chunk Size, default 60000
+	WindowAckSize       uint32        // local window ack size sent by Window Acknowledgement Size, default 2500000
+	PeerBandwidth       uint32        // bandwidth sent by Set Peer Bandwidth, default 2500000
+	SubscriberQueueSize int           // av packet queue size of every subscriber, default 1024
+	GopCacheNum         int           // complete gops cached per stream, default 1, negative disables gop cache
+	GopCacheMaxPackets  int           // max packets of gop cache, default 512
+	GopCacheMaxBytes    int           // max bytes of gop cache, default 8MB
+	HandshakeTimeout    time.Duration // deadline of handshake and commands before publish/play, default 10s
+	IdleTimeout         time.Duration // publisher without media, or player not written or silent while pinged, 0 means no timeout
+	PingInterval        time.Duration // PingRequest to publishers and players for RTT, default 10s or IdleTimeout/3, negative disables
+	MaxConns            int           // max connections served at the same time, 0 means no limit
+
+	Hooks   *HookConfig    // http callbacks, nil disables
+	Auth    *AuthConfig    // signed url authentication, nil disables
+	Forward *ForwardConfig // push published streams to other servers, nil disables
+	Edge    *EdgeConfig    // pull streams not published here from origins, nil disables
+	HTTP    *HTTPConfig    // options of http playback, which is served by Server.ListenAndServeHTTP
+	TLS     *TLSConfig     // certificates of rtmps, which is served by Server.ListenAndServeTLS
+	HLS     *HLSConfig     // hls output of published streams, nil disables
+	LLHLS   *LLHLSConfig   // low-latency hls output of published streams, nil disables
+	DASH    *DASHConfig    // mpeg-dash output of published streams, nil disables
+	DVR     *DVRConfig     // record published streams to flv files, nil disables
+
+	Aggregate *AggregateConfig // bundle audio/video messages sent to rtmp players, nil disables
+
+	SimpleHandshake bool        // client only, use simple handshake instead of complex(digest) one
+	TLSClientConfig *tls.Config // tls config of rtmps urls dialed by clients, forwards and edge pulls, nil uses the defaults
+}
+
+// dialConfig is the config of connections dialed by a server, i.e. forwards and edge pulls
+func (cfg *Config) dialConfig() *Config {
+	return &Config{
+		Logger:           cfg.Logger,
+		ChunkSize:        cfg.ChunkSize,
+		HandshakeTimeout: cfg.HandshakeTimeout,
+		TLSClientConfig:  cfg.TLSClientConfig,
+	}
+}
+
+func (cfg *Config) chunkSize() uint32 {
+	if cfg.ChunkSize > 0 {
+		return cfg.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+func (cfg *Config) windowAckSize() uint32 {
+	if cfg.WindowAckSize > 0 {
+		return cfg.WindowAckSize
+	}
+	return defaultWindowAckSize
+}
+
+func (cfg *Config) peerBandwidth() uint32 {
+	if cfg.PeerBandwidth > 0 {
+		return cfg.PeerBandwidth
+	}
+	return defaultPeerBandwidth
+}
+
+func (cfg *Config) subscriberQueueSize() int {
+	switch {
+	case cfg.SubscriberQueueSize <= 0:
+		return defaultSubscriberQueueSize
+	case cfg.SubscriberQueueSize < minSubscriberQueueSize:
+		return minSubscriberQueueSize
+	}
+	return cfg.SubscriberQueueSize
+}
+
+func (cfg *Config) newGopCache() *GopCache {
+	num, maxPackets, maxBytes := cfg.GopCacheNum, cfg.GopCacheMaxPackets, cfg.GopCacheMaxBytes
+	if num == 0 {
+		num = defaultGopCacheNum
+	}
+	if maxPackets <= 0 {
+		maxPackets = defaultGopCacheMaxPackets
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultGopCacheMaxBytes
+	}
+	return NewGopCache(num, maxPackets, maxBytes)
+}
+
+// replayCacheSize returns 0 if replay is not blocked
+func (cfg *Config) replayCacheSize() int {
+	switch {
+	case cfg.Auth != nil && cfg.Auth.ReplayCacheSize < 0:
+		return 0
+	case cfg.Auth != nil && cfg.Auth.ReplayCacheSize > 0:
+		return cfg.Auth.ReplayCacheSize
+	}
+	return defaultReplayCacheSize
+}
+
+// pingInterval returns 0 if ping is disabled, pings are frequent enough to keep players alive
+// within IdleTimeout
+func (cfg *Config) pingInterval() time.Duration {
+	switch {
+	case cfg.PingInterval < 0:
+		return 0
+	case cfg.PingInterval > 0:
+		return cfg.PingInterval
+	case cfg.IdleTimeout > 0 && cfg.IdleTimeout/3 < defaultPingInterval:
+		return cfg.IdleTimeout / 3
+	}
+	return defaultPingInterval
+}
+
+func (cfg *Config) handshakeTimeout() time.Duration {
+	if cfg.HandshakeTimeout > 0 {
+		return cfg.HandshakeTimeout
+	}
+	return defaultHandshakeTimeout
 }
 
 type ConnectionState struct {
@@ -14,6 +148,11 @@ type ConnectionState struct {
 	Vhost             string
 }
 
+// appKeys returns the keys of per app settings in lookup order
+func appKeys(vhost, app string) []string {
+	return []string{vhost + "/" + app, vhost + "/*", "*"}
+}
+
 func genStreamKey(domain, app, stream string) string {
 	return domain + "/" + app + "/" + stream
 }
@@ -22,6 +161,37 @@ func genUuid() string {
 	return uuid.NewV4().String()
 }
 
+// enhancedFourCCs are the codecs of enhanced rtmp relayed, by fourCcList of connect
+var enhancedFourCCs = []string{
+	av.FOURCC_HEVC, av.FOURCC_AV1, av.FOURCC_VP9, av.FOURCC_AVC,
+	av.FOURCC_OPUS, av.FOURCC_FLAC, av.FOURCC_AC3, av.FOURCC_EAC3, av.FOURCC_MP3, av.FOURCC_AAC,
+}
+
+// supportedFourCCs returns the codecs of the client fourCcList relayed, "*" means any codec
+func supportedFourCCs(client []string) amf.Array {
+	var list []string
+	for _, fourCC := range client {
+		if fourCC == "*" {
+			return fourCCList(enhancedFourCCs)
+		}
+		for _, e := range enhancedFourCCs {
+			if fourCC == e {
+				list = append(list, fourCC)
+				break
+			}
+		}
+	}
+	return fourCCList(list)
+}
+
+func fourCCList(fourCCs []string) amf.Array {
+	list := make(amf.Array, len(fourCCs))
+	for i, fourCC := range fourCCs {
+		list[i] = fourCC
+	}
+	return list
+}
+
 const (
 	cmdConnect       = "connect"
 	cmdFcpublish     = "FCPublish"
@@ -31,14 +201,18 @@ const (
 	cmdFCUnpublish   = "FCUnpublish"
 	cmdDeleteStream  = "deleteStream"
 	cmdPlay          = "play"
+	cmdCloseStream   = "closeStream"
 )
 
+// chunk stream id of onStatus sent by server out of the command flow
+const statusCsid = 5
+
 const (
 	streamBegin uint32 = 0
 	//streamEOF        uint32 = 1
 	//streamDry        uint32 = 2
 	//setBufferLen     uint32 = 3
 	streamIsRecorded uint32 = 4
-	//pingRequest      uint32 = 6
-	//pingResponse     uint32 = 7
+	pingRequest      uint32 = 6
+	pingResponse     uint32 = 7
 )
@@ -2,7 +2,7 @@ package rtmp
 
 import (
 	"bufio"
-	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -13,9 +13,12 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+
+	"playground/pkg/amf"
+	"playground/pkg/av"
+	"playground/pkg/flv"
 )
 
 type Conn struct {
@@ -27,6 +30,7 @@ type Conn struct {
 	writeBuffer net.Buffers
 
 	// config and logger pointer
+	server *Server // nil for client
 	config *Config
 	logger *logrus.Logger
 
@@ -37,9 +41,10 @@ type Conn struct {
 	handshakeErr    error
 
 	// handle command message
+	clientID                 string // unique id of connection, reported to hooks
+	httpRemoteAddr           string // remote addr of http players, which have no conn
+	connected                bool   // connect command succeeded
 	transactionID            int
-	amfDecoder               *amf.Decoder
-	amfEncoder               *amf.Encoder
 	handleCommandMessageDone bool
 
 	// client connect info
@@ -48,6 +53,7 @@ type Conn struct {
 	swfUrl         string
 	tcUrl          string
 	objectEncoding int
+	fourCCs        []string // fourCcList, enhanced rtmp codecs of the client
 
 	// parse tcUrl result
 	host      string
@@ -56,14 +62,25 @@ type Conn struct {
 	rawQuery  string
 	urlValues url.Values
 
+	// query after '?' of stream name
+	streamRawQuery string
+	streamValues   url.Values
+
 	// client role and associate with stream source manager
 	isPublisher bool             // true: publish  false: play
 	streamName  string           // set while publish/play command
 	ssMgr       *streamSourceMgr // stream source manager pointer
 	streamKey   string           // generate by func genStreamKey
+	streamID    uint32           // message stream id of createStream result, publish/play use it
+	streaming   int32            // accessed atomically, non-zero once publishing or playing
+	demuxer     *flv.Demuxer     // demux av packet header read by client
+	aggPkts     []*av.Packet     // packets of the aggregate read by client, returned first
 
 	basicHdrBuf []byte                  //rtmp chunk basic header, at most 3 bytes
 	chunks      map[uint32]*ChunkStream //<CSID, ChunkStream>
+	writeHdrBuf [3]byte                 // chunk basic header written
+	writeMux    sync.Mutex              // writes of the streaming, reading and ping goroutines
+	rtt         int64                   // accessed atomically, of the last PingResponse
 
 	localChunksize      uint32 // local chunk size
 	localWindowAckSize  uint32 // local window ack size
@@ -73,6 +90,7 @@ type Conn struct {
 
 	bytesRecv      uint32
 	bytesRecvReset uint32
+	bytesSent      uint64
 }
 
 func (c *Conn) LocalAddr() net.Addr {
@@ -83,6 +101,16 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// remoteIP returns the ip of the client, empty for file sources
+func (c *Conn) remoteIP() string {
+	addr := c.httpRemoteAddr
+	if c.conn != nil {
+		addr = c.RemoteAddr().String()
+	}
+	ip, _, _ := net.SplitHostPort(addr)
+	return ip
+}
+
 func (c *Conn) SetDeadline(t time.Time) error {
 	return c.conn.SetDeadline(t)
 }
@@ -99,6 +127,114 @@ func (c *Conn) Close() error {
 	return c.conn.Close()
 }
 
+// extend read or write deadline by IdleTimeout while streaming
+func (c *Conn) setIdleDeadline(read bool) {
+	if c.config.IdleTimeout <= 0 {
+		return
+	}
+
+	t := time.Now().Add(c.config.IdleTimeout)
+	if read {
+		_ = c.conn.SetReadDeadline(t)
+	} else {
+		_ = c.conn.SetWriteDeadline(t)
+	}
+}
+
+// isTimeout reports whether err is of the deadline
+func isTimeout(err error) bool {
+	ne, ok := errors.Cause(err).(net.Error)
+	return ok && ne.Timeout()
+}
+
+// RTT returns the round trip time measured by the last ping, 0 before any PingResponse
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// pingMillis is the timestamp of PingRequest, which PingResponse echoes
+func pingMillis() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+func (c *Conn) writePing(event, timeStamp uint32) error {
+	cs := NewUserControlMessage(event, 4)
+	binary.BigEndian.PutUint32(cs.ChunkBody[2:], timeStamp)
+	return c.writeChunkStream(cs)
+}
+
+// handleUserControlMessage answers PingRequest of the peer and measures RTT by PingResponse
+func (c *Conn) handleUserControlMessage(cs *ChunkStream) {
+	if len(cs.ChunkBody) < 6 {
+		return
+	}
+
+	timeStamp := binary.BigEndian.Uint32(cs.ChunkBody[2:])
+	switch uint32(binary.BigEndian.Uint16(cs.ChunkBody)) {
+	case pingRequest:
+		if err := c.writePing(pingResponse, timeStamp); err != nil {
+			c.logger.WithField("event", "send PingResponse").Error(err)
+		}
+	case pingResponse:
+		rtt := time.Duration(pingMillis()-timeStamp) * time.Millisecond
+		atomic.StoreInt64(&c.rtt, int64(rtt))
+		c.logger.WithFields(logrus.Fields{"event": "recv PingResponse", "rtt": rtt}).Trace("")
+	}
+}
+
+// pingCycle sends PingRequest every interval until done
+func (c *Conn) pingCycle(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.setIdleDeadline(false)
+			if err := c.writePing(pingRequest, pingMillis()); err != nil {
+				c.logger.WithField("event", "send PingRequest").Error(err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// playerReadingCycle reads the messages of a player while playing, which are acks and
+// PingResponse mostly. A player pinged is idle if nothing is read in IdleTimeout. The play ends
+// by the read error, or io.EOF once the player closes the stream.
+func (c *Conn) playerReadingCycle(sub *subscriber) {
+	pinged := c.config.pingInterval() > 0
+	for {
+		if pinged {
+			c.setIdleDeadline(true)
+		}
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			sub.readDone(err)
+			return
+		}
+
+		switch cs.MsgTypeID {
+		case MsgAMF0CommandMessage, MsgAMF3CommandMessage:
+			vs, err := c.decodeAMF(cs)
+			if err != nil {
+				sub.readDone(err)
+				return
+			}
+			if len(vs) > 0 && (vs[0] == cmdCloseStream || vs[0] == cmdDeleteStream) {
+				sub.readDone(io.EOF)
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) isStreaming() bool {
+	return atomic.LoadInt32(&c.streaming) != 0
+}
+
 func (c *Conn) Read(b []byte) (int, error) {
 	return io.ReadAtLeast(c.reader, b, len(b))
 	//return c.conn.Read(b)
@@ -107,7 +243,9 @@ func (c *Conn) Read(b []byte) (int, error) {
 func (c *Conn) Write(b []byte) (int, error) {
 	c.writeBuffer = append(c.writeBuffer, b)
 	if len(c.writeBuffer) > 0 {
-		if nw, err := c.writeBuffer.WriteTo(c.conn); err != nil {
+		nw, err := c.writeBuffer.WriteTo(c.conn)
+		c.bytesSent += uint64(nw)
+		if err != nil {
 			return int(nw), err
 		}
 	}
@@ -116,7 +254,9 @@ func (c *Conn) Write(b []byte) (int, error) {
 
 func (c *Conn) Flush() error {
 	//logrus.Errorf("buff size: %d", len(c.writeBuffer))
-	if _, err := c.writeBuffer.WriteTo(c.conn); err != nil {
+	nw, err := c.writeBuffer.WriteTo(c.conn)
+	c.bytesSent += uint64(nw)
+	if err != nil {
 		return err
 	}
 	return nil
@@ -128,11 +268,17 @@ func (c *Conn) Serve() {
 	logger := c.logger.WithFields(logrus.Fields{"event": "Serve Rtmp Conn"})
 	logger.Tracef("local: %s, remote: %s, network: %s", c.LocalAddr().String(), c.RemoteAddr().String(), c.LocalAddr().Network())
 
-	/*
-		if err := c.SetDeadline(time.Now().Add(10 * time.Second)); err != nil { //TODO: timeout config
-			_ = c.logger.Log("level", "ERROR", "event", "failed to set deadline")
-		}
-	*/
+	if !c.server.trackConn(c) {
+		logger.Errorf("server closed or too many connections, max: %d", c.config.MaxConns)
+		return
+	}
+	defer c.server.untrackConn(c)
+
+	// handshake and commands before publish/play must be done in time
+	if err := c.SetDeadline(time.Now().Add(c.config.handshakeTimeout())); err != nil {
+		logger.WithField("action", "set handshake deadline").Error(err)
+		return
+	}
 
 	logger = c.logger.WithFields(logrus.Fields{"event": "serverHandshake"})
 	if err := c.Handshake(); err != nil {
@@ -143,61 +289,71 @@ func (c *Conn) Serve() {
 
 	logger = c.logger.WithFields(logrus.Fields{"event": "handleCommandMessage"})
 	c.basicHdrBuf = make([]byte, 3)
+	defer func() {
+		if c.connected {
+			c.notifyHook(hookOnClose)
+		}
+	}()
 	if err := c.handleCommandMessage(); err != nil {
 		logger.Error(err)
 		return
 	}
 	logger.Trace("success")
 
-	logger = c.logger.WithFields(logrus.Fields{"event": "discover tcUrl"})
-	if err := c.discoverTcUrl(); err != nil {
-		logger.Error(err)
+	logger.WithFields(logrus.Fields{"vhost": c.vhost, "app": c.appName, "stream": c.streamName, "rawQuery": c.rawQuery, "streamKey": c.streamKey}).Trace("")
+
+	if err := c.SetDeadline(time.Time{}); err != nil { // idle timeout is set while streaming
+		logger.WithField("action", "clear handshake deadline").Error(err)
 		return
 	}
-	c.streamKey = genStreamKey(c.vhost, c.appName, c.streamName)
-	logger.WithFields(logrus.Fields{"vhost": c.vhost, "app": c.appName, "stream": c.streamName, "rawQuery": c.rawQuery, "streamKey": c.streamKey}).Trace("")
+	atomic.StoreInt32(&c.streaming, 1)
+
+	if interval := c.config.pingInterval(); interval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go c.pingCycle(interval, done)
+	}
 
 	if c.isPublisher { // publish
 		logger = c.logger.WithFields(logrus.Fields{"event": "publish"})
 
-		var ss *streamSource
-		val, ok := c.ssMgr.streamMap.Load(c.streamKey)
-		if !ok { //stream source not exists
-			pub := newPublisher(c, c.streamKey)
-			ss = newStreamSource(pub, c.streamKey, c.ssMgr)
-
-			c.ssMgr.streamMap.Store(c.streamKey, ss) // save <streamKey, streamSource> pair
-		} else {
+		pub := newPublisher(c, c.streamKey)
+		ss := newStreamSource(pub, c.streamKey, c.ssMgr, c.config)
+		if val, loaded := c.ssMgr.streamMap.LoadOrStore(c.streamKey, ss); loaded { // stream source exists
 			ss = val.(*streamSource)
-			if ss.publisher != nil { // stream exists and is publishing
+			if !ss.setPublisher(pub) { // publishing or pulled by another one
 				logger.Error("stream is busy")
 				return
-			} else {
-				ss.setPublisher(newPublisher(c, c.streamKey))
 			}
 		}
 
+		defer c.notifyHook(hookOnUnpublish)
 		defer ss.delPublisher()
+		ss.startForwarders(c)
+		defer ss.stopForwarders()
+		ss.startPackagers(c)
+		defer ss.stopPackagers()
 		if err := ss.doPublishing(); err != nil {
 			return
 		}
 	} else { //play
 		logger = c.logger.WithFields(logrus.Fields{"event": "play"})
 
-		val, ok := c.ssMgr.streamMap.Load(c.streamKey)
-		if !ok {
-			logger.Error("stream not exists")
+		ss, err := c.server.lookupStream(c.config, c.vhost, c.appName, c.streamName)
+		if err != nil {
+			logger.Error(err)
 			return
 		}
 
-		sub := newSubscriber(c, 1024) //TODO: avQueueSize use config's value
-		ss := val.(*streamSource)
+		sub := newSubscriber(c, c.config.subscriberQueueSize())
 		if !ss.addSubscriber(sub) {
-			logger.Error("already subscribe")
+			logger.Error("stream closed or already subscribe")
 			return
 		}
 
+		defer c.notifyHook(hookOnStop)
 		defer ss.delSubscriber(sub)
+		go c.playerReadingCycle(sub)
 		if err := ss.doPlaying(sub); err != nil {
 			return
 		}
@@ -264,16 +420,18 @@ func (c *Conn) discoverTcUrl() error {
 	}
 	c.logger.Tracef("tcUrl: %#v", u)
 
-	if strings.ToLower(u.Scheme) != "rtmp" {
+	if scheme := strings.ToLower(u.Scheme); scheme != "rtmp" && scheme != "rtmps" {
 		return errors.Errorf("not rtmp scheme: %s", u.Scheme)
 	}
 
 	c.rawQuery = u.RawQuery // vhost=...&token=...
 	c.urlValues, _ = url.ParseQuery(c.rawQuery)
 
-	parseVhost := func() {
+	parseVhost := func() { // the vhost parameter, or the SNI of rtmps
 		if v, ok := c.urlValues["vhost"]; ok {
 			c.vhost = v[0]
+		} else if name := c.tlsServerName(); name != "" {
+			c.vhost = name
 		}
 	}
 
@@ -305,7 +463,7 @@ func (c *Conn) discoverTcUrl() error {
 	}
 
 	if c.vhost == "" {
-		c.vhost = "_defaultVhost_"
+		c.vhost = defaultVhost
 	}
 
 	if idx := strings.Index(c.appName, "?"); idx > 0 {
@@ -317,17 +475,14 @@ func (c *Conn) discoverTcUrl() error {
 }
 
 func (c *Conn) decodeCommandMessage(cs *ChunkStream) error {
-	if cs.MsgTypeID == MsgAMF3CommandMessage {
-		cs.ChunkBody = cs.ChunkBody[1:]
-	}
-
-	r := bytes.NewReader(cs.ChunkBody)
-	vs, err := c.amfDecoder.DecodeBatch(r, amf.Version(amf.AMF0))
-	if err != nil && err != io.EOF {
+	vs, err := c.decodeAMF(cs)
+	if err != nil {
 		c.logger.WithField("event", "amf decode chunk body").Error(err)
 		return err
 	}
-	c.logger.WithField("event", "amf decode chunk body").WithField("data", fmt.Sprintf("%#v", vs)).Trace("")
+	if len(vs) == 0 {
+		return errors.New("empty command message")
+	}
 
 	if cmdStr, ok := vs[0].(string); ok {
 		switch cmdStr {
@@ -335,9 +490,21 @@ func (c *Conn) decodeCommandMessage(cs *ChunkStream) error {
 			if err := c.decodeConnectCmdMessage(vs[1:]); err != nil {
 				return err
 			}
+			if err := c.discoverTcUrl(); err != nil {
+				return errors.Wrap(err, "discover tcUrl")
+			}
+			if err := c.authorizeConnect(); err != nil {
+				_ = c.respConnectRejected(cs, err.Error())
+				return errors.Wrap(err, "authorize connect")
+			}
+			if err := c.onConnect(); err != nil {
+				_ = c.respConnectRejected(cs, err.Error())
+				return err
+			}
 			if err := c.respConnectCmdMessage(cs); err != nil {
 				return err
 			}
+			c.connected = true
 		case cmdReleaseStream: // "releaseStream"
 			_ = c.decodeReleaseStreamCmdMessage(vs[1:]) //do nothing
 		case cmdFcpublish: // "FCPublish"
@@ -350,20 +517,40 @@ func (c *Conn) decodeCommandMessage(cs *ChunkStream) error {
 				return err
 			}
 		case cmdPublish: // "publish"
+			c.streamID = cs.MsgStreamID
 			if err := c.decodePulishCmdMessage(vs[1:]); err != nil {
 				return err
 			}
+			c.streamKey = genStreamKey(c.vhost, c.appName, c.streamName)
+			c.isPublisher = true // publish tokens are single-use
+			if err := c.authorizeStream(); err != nil {
+				_ = c.writeStatus("error", "NetStream.Publish.BadName", err.Error())
+				return errors.Wrap(err, "authorize publish")
+			}
+			if c.ssMgr.isDisabled(c.streamKey) {
+				_ = c.writeStatus("error", "NetStream.Publish.Denied", errStreamDisabled.Error())
+				return errStreamDisabled
+			}
+			if err := c.onPublish(); err != nil {
+				_ = c.writeStatus("error", "NetStream.Publish.Denied", err.Error())
+				return err
+			}
 			if err := c.respPulishCmdMessage(cs); err != nil {
 				return err
 			}
 
 			c.handleCommandMessageDone = true
-			c.isPublisher = true
 			c.logger.WithField("event", "decode Publish Msg").Trace("success")
 		case cmdPlay:
+			c.streamID = cs.MsgStreamID
 			if err := c.decodePlayCmdMessage(vs[1:]); err != nil {
 				return err
 			}
+			c.streamKey = genStreamKey(c.vhost, c.appName, c.streamName)
+			if code, err := c.authorizePlay(); err != nil {
+				_ = c.writeStatus("error", code, err.Error())
+				return err
+			}
 			if err := c.respPlayCmdMessage(cs); err != nil {
 				return err
 			}
@@ -408,16 +595,24 @@ func (c *Conn) decodeConnectCmdMessage(vs []interface{}) error {
 				c.tcUrl = tcUrl.(string)
 			}
 
-			if encoding, ok := v["objectEncoding"]; ok {
-				c.objectEncoding = int(encoding.(float64))
+			if encoding, ok := amf.Number(v["objectEncoding"]); ok {
+				c.objectEncoding = int(encoding)
+			}
+
+			if list, ok := v["fourCcList"].(amf.Array); ok {
+				for _, fourCC := range list {
+					if fourCC, ok := fourCC.(string); ok {
+						c.fourCCs = append(c.fourCCs, fourCC)
+					}
+				}
 			}
 		}
 	}
 
 	c.logger.WithFields(logrus.Fields{
 		"event": "parse connect command msg",
-		"data": fmt.Sprintf("transactionID: %d, app: '%s', flashVer: '%s', swfUrl: '%s', tcUrl: '%s', objectEncoding: %d",
-			c.transactionID, c.appName, c.flashVer, c.swfUrl, c.tcUrl, c.objectEncoding),
+		"data": fmt.Sprintf("transactionID: %d, app: '%s', flashVer: '%s', swfUrl: '%s', tcUrl: '%s', objectEncoding: %d, fourCcList: %v",
+			c.transactionID, c.appName, c.flashVer, c.swfUrl, c.tcUrl, c.objectEncoding, c.fourCCs),
 	}).Trace("")
 
 	return nil
@@ -433,7 +628,7 @@ func (c *Conn) respConnectCmdMessage(cs *ChunkStream) error {
 	c.logger.WithField("event", "Set WindowAckSize Message").Trace("success")
 
 	// Set Peer Bandwidth
-	respCs = NewProtolControlMessage(MsgSetPeerBandwidth, 5, 2500000)
+	respCs = NewProtolControlMessage(MsgSetPeerBandwidth, 5, c.config.peerBandwidth())
 	respCs.ChunkBody[4] = 2
 	if err := c.writeChunkStream(respCs); err != nil {
 		c.logger.WithField("event", "Set Peer Bandwidth").Error(err)
@@ -453,6 +648,9 @@ func (c *Conn) respConnectCmdMessage(cs *ChunkStream) error {
 	resp := make(amf.Object)
 	resp["fmsVer"] = "FMS/3,0,1,123"
 	resp["capabilities"] = 31
+	if len(c.fourCCs) > 0 { // enhanced rtmp client, tell the codecs relayed
+		resp["fourCcList"] = supportedFourCCs(c.fourCCs)
+	}
 
 	event := make(amf.Object)
 	event["level"] = "status"
@@ -468,6 +666,53 @@ func (c *Conn) respConnectCmdMessage(cs *ChunkStream) error {
 	return nil
 }
 
+func (c *Conn) respConnectRejected(cs *ChunkStream, description string) error {
+	event := make(amf.Object)
+	event["level"] = "error"
+	event["code"] = "NetConnection.Connect.Rejected"
+	event["description"] = description
+
+	return c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "_error", c.transactionID, nil, event)
+}
+
+// onConnect checks whether the client is allowed to connect once tcUrl is discovered
+func (c *Conn) onConnect() error {
+	return c.callHook(hookOnConnect)
+}
+
+// onPublish checks whether the client is allowed to publish streamKey
+func (c *Conn) onPublish() error {
+	return c.callHook(hookOnPublish)
+}
+
+// onPlay checks whether the client is allowed to play streamKey
+func (c *Conn) onPlay() error {
+	return c.callHook(hookOnPlay)
+}
+
+// authorizePlay checks the signed url, the disabled keys and on_play hook of a player in order,
+// rtmp and http players alike. The onStatus code of a rtmp player is returned with the refusal.
+func (c *Conn) authorizePlay() (string, error) {
+	if err := c.checkPlay(); err != nil {
+		return "NetConnection.Connect.Rejected", err
+	}
+	if err := c.onPlay(); err != nil {
+		return "NetStream.Play.Failed", err
+	}
+	return "", nil
+}
+
+// checkPlay is authorizePlay without on_play hook, for http requests which are not a session
+func (c *Conn) checkPlay() error {
+	if err := c.authorizeStream(); err != nil {
+		return errors.Wrap(err, "authorize play")
+	}
+	if c.ssMgr.isDisabled(c.streamKey) {
+		return errStreamDisabled
+	}
+	return nil
+}
+
 func (c *Conn) decodeCreateStreamCmdMessage(vs []interface{}) error {
 	for _, v := range vs {
 		switch v := v.(type) {
@@ -582,6 +827,11 @@ func (c *Conn) publishOrPlay(vs []interface{}) error {
 		case string:
 			if k == 2 {
 				c.streamName = v
+				if idx := strings.Index(v, "?"); idx >= 0 { // stream?expire=...&token=...
+					c.streamName = v[:idx]
+					c.streamRawQuery = v[idx+1:]
+					c.streamValues, _ = url.ParseQuery(c.streamRawQuery)
+				}
 			} else if k == 3 {
 				if c.appName == "" {
 					c.appName = v //has assigned very likely while decode connect command message
@@ -596,16 +846,37 @@ func (c *Conn) publishOrPlay(vs []interface{}) error {
 	return nil
 }
 
+// decodeAMF decodes the values of a command message, AMF3 values of objectEncoding 3 follow
+// avmplus markers
+func (c *Conn) decodeAMF(cs *ChunkStream) ([]interface{}, error) {
+	vs, err := amf.Unmarshal(amfBody(cs), amf.AMF0)
+	if err != nil {
+		return nil, err
+	}
+	c.logger.WithField("event", "amf decode chunk body").WithField("data", fmt.Sprintf("%#v", vs)).Trace("")
+
+	return vs, nil
+}
+
+// amfBody returns the AMF0 body of a command or data message, AMF3 messages begin with a 0 byte
+func amfBody(cs *ChunkStream) []byte {
+	body := cs.ChunkBody
+	switch cs.MsgTypeID {
+	case MsgAMF3CommandMessage, MsgAMF3DataMessage:
+		if len(body) > 0 && body[0] == 0 {
+			body = body[1:]
+		}
+	}
+	return body
+}
+
 // send MsgAMF0CommandMessage msg
 func (c *Conn) writeCommandMessage(csid, streamID uint32, args ...interface{}) error {
-	buffer := bytes.NewBuffer([]byte{})
-	for _, v := range args {
-		if _, err := c.amfEncoder.Encode(buffer, v, amf.AMF0); err != nil {
-			c.logger.WithField("event", "amf encode").Error(err)
-			return err
-		}
+	cmdMsgBody, err := amf.Marshal(amf.AMF0, args...)
+	if err != nil {
+		c.logger.WithField("event", "amf encode").Error(err)
+		return err
 	}
-	cmdMsgBody := buffer.Bytes()
 
 	cs := newChunkStream()
 	cs = cs.setBasicHeader(0, csid)
@@ -620,6 +891,16 @@ func (c *Conn) writeCommandMessage(csid, streamID uint32, args ...interface{}) e
 	return nil
 }
 
+// send onStatus command message on the publishing/playing message stream
+func (c *Conn) writeStatus(level, code, description string) error {
+	event := make(amf.Object)
+	event["level"] = level
+	event["code"] = code
+	event["description"] = description
+
+	return c.writeCommandMessage(statusCsid, c.streamID, "onStatus", 0, nil, event)
+}
+
 func (c *Conn) ConnectionState() ConnectionState {
 	c.handshakeMutex.Lock()
 	defer c.handshakeMutex.Unlock()
@@ -0,0 +1,507 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/fmp4"
+)
+
+const (
+	defaultDASHSegmentDuration = 2 * time.Second
+	defaultDASHWindow          = 10
+)
+
+// DASHConfig enables MPEG-DASH output of the streams published to the server, served by the
+// http playback of Server.ListenAndServeHTTP.
+//
+// Video and audio are separate adaptation sets of fMP4 segments, cut at the first key frame
+// after SegmentDuration. Every publisher of a stream, or a codec change, starts a new period.
+type DASHConfig struct {
+	SegmentDuration time.Duration // default 2s
+	Window          int           // segments in the manifest, default 10
+}
+
+func (dc *DASHConfig) segmentDuration() time.Duration {
+	if dc.SegmentDuration > 0 {
+		return dc.SegmentDuration
+	}
+	return defaultDASHSegmentDuration
+}
+
+func (dc *DASHConfig) window() int {
+	if dc.Window > 0 {
+		return dc.Window
+	}
+	return defaultDASHWindow
+}
+
+// dashMedia is the segment of a track
+type dashMedia struct {
+	start    uint64 // decode time of the first sample
+	duration uint64
+	data     []byte
+}
+
+type dashSegment struct {
+	period       *dashPeriod
+	video, audio *dashMedia
+}
+
+// dashPeriod is the segments of the same tracks, a publisher or a codec config
+type dashPeriod struct {
+	id           int
+	start        time.Duration // since availabilityStartTime
+	pto          uint64        // decode time at start
+	video, audio *fmp4.Track
+	videoInit    []byte
+	audioInit    []byte
+}
+
+// dashStream is the window of segments of a stream source
+type dashStream struct {
+	config *DASHConfig
+
+	mu                    sync.Mutex
+	availabilityStartTime time.Time
+	periods               []*dashPeriod
+	segments              []*dashSegment
+	closed                bool
+}
+
+func newDASHStream(config *DASHConfig) *dashStream {
+	return &dashStream{config: config}
+}
+
+func (ds *dashStream) newSegmenter(*Conn) segmenter {
+	return &dashSegmenter{ds: ds}
+}
+
+// startPeriod starts a period of the tracks, its first sample at decode time ts is now
+func (ds *dashStream) startPeriod(video, audio *fmp4.Track, ts uint32) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	now := time.Now()
+	if ds.availabilityStartTime.IsZero() {
+		ds.availabilityStartTime = now.Add(-time.Duration(ts) * time.Millisecond)
+	}
+
+	p := &dashPeriod{video: video, audio: audio, pto: uint64(ts)}
+	if n := len(ds.periods); n > 0 {
+		p.id = ds.periods[n-1].id + 1
+		p.start = now.Sub(ds.availabilityStartTime)
+	}
+	if video != nil {
+		p.videoInit = fmp4.InitSegment(video)
+	}
+	if audio != nil {
+		p.audioInit = fmp4.InitSegment(audio)
+	}
+	ds.periods = append(ds.periods, p)
+}
+
+func (ds *dashStream) addSegment(video, audio *dashMedia) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed || len(ds.periods) == 0 {
+		return
+	}
+
+	ds.segments = append(ds.segments, &dashSegment{
+		period: ds.periods[len(ds.periods)-1],
+		video:  video,
+		audio:  audio,
+	})
+
+	for len(ds.segments) > ds.config.window() {
+		ds.segments[0] = nil
+		ds.segments = ds.segments[1:]
+	}
+	for len(ds.periods) > 1 && ds.periods[0] != ds.segments[0].period {
+		ds.periods[0] = nil
+		ds.periods = ds.periods[1:]
+	}
+}
+
+func (ds *dashStream) close() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.closed = true
+	ds.periods = nil
+	ds.segments = nil
+}
+
+// initSegment returns the init segment of a track of period
+func (ds *dashStream) initSegment(kind string, period int) ([]byte, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for _, p := range ds.periods {
+		if p.id == period {
+			if kind == "video" {
+				return p.videoInit, p.videoInit != nil
+			}
+			return p.audioInit, p.audioInit != nil
+		}
+	}
+	return nil, false
+}
+
+// media returns the media segment of a track of period starting at decode time start
+func (ds *dashStream) media(kind string, period int, start uint64) ([]byte, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for _, seg := range ds.segments {
+		if seg.period.id != period {
+			continue
+		}
+		m := seg.audio
+		if kind == "video" {
+			m = seg.video
+		}
+		if m != nil && m.start == start {
+			return m.data, true
+		}
+	}
+	return nil, false
+}
+
+// mpd elements of the dynamic manifest
+type (
+	mpd struct {
+		XMLName                    xml.Name    `xml:"MPD"`
+		Xmlns                      string      `xml:"xmlns,attr"`
+		Profiles                   string      `xml:"profiles,attr"`
+		Type                       string      `xml:"type,attr"`
+		AvailabilityStartTime      string      `xml:"availabilityStartTime,attr"`
+		PublishTime                string      `xml:"publishTime,attr"`
+		MinimumUpdatePeriod        string      `xml:"minimumUpdatePeriod,attr"`
+		MinBufferTime              string      `xml:"minBufferTime,attr"`
+		TimeShiftBufferDepth       string      `xml:"timeShiftBufferDepth,attr"`
+		SuggestedPresentationDelay string      `xml:"suggestedPresentationDelay,attr"`
+		MaxSegmentDuration         string      `xml:"maxSegmentDuration,attr"`
+		Periods                    []mpdPeriod `xml:"Period"`
+	}
+
+	mpdPeriod struct {
+		ID             string             `xml:"id,attr"`
+		Start          string             `xml:"start,attr"`
+		AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+	}
+
+	mpdAdaptationSet struct {
+		ID               int               `xml:"id,attr"`
+		ContentType      string            `xml:"contentType,attr"`
+		MimeType         string            `xml:"mimeType,attr"`
+		SegmentAlignment bool              `xml:"segmentAlignment,attr"`
+		StartWithSAP     int               `xml:"startWithSAP,attr"`
+		Representation   mpdRepresentation `xml:"Representation"`
+	}
+
+	mpdRepresentation struct {
+		ID                        string             `xml:"id,attr"`
+		Codecs                    string             `xml:"codecs,attr"`
+		Bandwidth                 int                `xml:"bandwidth,attr"`
+		Width                     int                `xml:"width,attr,omitempty"`
+		Height                    int                `xml:"height,attr,omitempty"`
+		AudioSamplingRate         int                `xml:"audioSamplingRate,attr,omitempty"`
+		AudioChannelConfiguration *mpdDescriptor     `xml:"AudioChannelConfiguration,omitempty"`
+		SegmentTemplate           mpdSegmentTemplate `xml:"SegmentTemplate"`
+	}
+
+	mpdDescriptor struct {
+		SchemeIDURI string `xml:"schemeIdUri,attr"`
+		Value       string `xml:"value,attr"`
+	}
+
+	mpdSegmentTemplate struct {
+		Timescale              int       `xml:"timescale,attr"`
+		Initialization         string    `xml:"initialization,attr"`
+		Media                  string    `xml:"media,attr"`
+		PresentationTimeOffset uint64    `xml:"presentationTimeOffset,attr"`
+		Timeline               []mpdTime `xml:"SegmentTimeline>S"`
+	}
+
+	mpdTime struct {
+		T uint64 `xml:"t,attr"`
+		D uint64 `xml:"d,attr"`
+	}
+)
+
+// xsDuration formats d as xs:duration
+func xsDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// manifest returns the mpd, false if there is no segment yet. Segment urls are relative
+// to /{app}/{stream}.mpd, query is appended to them. Media segments are addressed by $Time$,
+// since a track may have no media in some segments, e.g. audio starting late.
+func (ds *dashStream) manifest(stream, query string) ([]byte, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if len(ds.segments) == 0 {
+		return nil, false
+	}
+
+	segDuration := ds.config.segmentDuration()
+	var maxDuration uint64
+	for _, seg := range ds.segments {
+		for _, m := range []*dashMedia{seg.video, seg.audio} {
+			if m != nil && m.duration > maxDuration {
+				maxDuration = m.duration
+			}
+		}
+	}
+
+	m := &mpd{
+		Xmlns:                      "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                       "dynamic",
+		AvailabilityStartTime:      ds.availabilityStartTime.UTC().Format(time.RFC3339Nano),
+		PublishTime:                time.Now().UTC().Format(time.RFC3339Nano),
+		MinimumUpdatePeriod:        xsDuration(segDuration),
+		MinBufferTime:              xsDuration(segDuration),
+		TimeShiftBufferDepth:       xsDuration(time.Duration(ds.config.window()) * segDuration),
+		SuggestedPresentationDelay: xsDuration(3 * segDuration),
+		MaxSegmentDuration:         xsDuration(time.Duration(maxDuration) * time.Millisecond),
+	}
+
+	prefix := url.PathEscape(stream) + "/dash-"
+	for _, p := range ds.periods {
+		var segs []*dashSegment
+		for _, seg := range ds.segments {
+			if seg.period == p {
+				segs = append(segs, seg)
+			}
+		}
+		if len(segs) == 0 {
+			continue
+		}
+
+		mp := mpdPeriod{ID: fmt.Sprint(p.id), Start: xsDuration(p.start)}
+		for i, kind := range []string{"video", "audio"} {
+			track := p.video
+			if kind == "audio" {
+				track = p.audio
+			}
+			if track == nil {
+				continue
+			}
+
+			var timeline []mpdTime
+			var bytes, duration uint64
+			for _, seg := range segs {
+				media := seg.video
+				if kind == "audio" {
+					media = seg.audio
+				}
+				if media == nil {
+					continue
+				}
+				timeline = append(timeline, mpdTime{T: media.start, D: media.duration})
+				bytes += uint64(len(media.data))
+				duration += media.duration
+			}
+			if len(timeline) == 0 {
+				continue
+			}
+
+			rep := mpdRepresentation{
+				ID:     kind,
+				Codecs: track.Codec(),
+				SegmentTemplate: mpdSegmentTemplate{
+					Timescale:              fmp4.Timescale,
+					Initialization:         fmt.Sprintf("%s%s-init-%d.mp4%s", prefix, kind, p.id, query),
+					Media:                  fmt.Sprintf("%s%s-%d-$Time$.m4s%s", prefix, kind, p.id, query),
+					PresentationTimeOffset: p.pto,
+					Timeline:               timeline,
+				},
+			}
+			if duration > 0 {
+				rep.Bandwidth = int(bytes * 8 * fmp4.Timescale / duration)
+			}
+			if kind == "video" {
+				rep.Width, rep.Height = track.Width, track.Height
+			} else {
+				rep.AudioSamplingRate = track.SampleRate
+				rep.AudioChannelConfiguration = &mpdDescriptor{
+					SchemeIDURI: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+					Value:       fmt.Sprint(track.Channels),
+				}
+			}
+
+			mp.AdaptationSets = append(mp.AdaptationSets, mpdAdaptationSet{
+				ID:               i,
+				ContentType:      kind,
+				MimeType:         kind + "/mp4",
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+				Representation:   rep,
+			})
+		}
+		m.Periods = append(m.Periods, mp)
+	}
+
+	b, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, false
+	}
+	return append([]byte(xml.Header), b...), true
+}
+
+// dashSegmenter cuts the packets of one publisher into segments of a dashStream, a segment
+// of every track
+type dashSegmenter struct {
+	fmp4Tracks
+	ds *dashStream
+
+	started bool
+	start   uint32 // of the segment being filled
+	seq     uint32
+}
+
+func (sg *dashSegmenter) sendAVPacket(pkt *av.Packet) error {
+	t, keyFrame, err := sg.media(pkt)
+	if t == nil || err != nil {
+		return err
+	}
+
+	if t != sg.clock() {
+		if sg.started {
+			t.push(pkt)
+		}
+		return nil
+	}
+	if !sg.started && !keyFrame {
+		return nil
+	}
+	t.push(pkt)
+
+	elapsed := time.Duration(int32(pkt.TimeStamp-sg.start)) * time.Millisecond
+	if keyFrame && (!sg.started || sg.changed || elapsed >= sg.ds.config.segmentDuration() || elapsed < 0) {
+		sg.flush()
+		if !sg.started || sg.changed {
+			var video, audio *fmp4.Track
+			if sg.video != nil {
+				video = sg.video.track
+			}
+			if sg.audio != nil {
+				audio = sg.audio.track
+			}
+			sg.ds.startPeriod(video, audio, pkt.TimeStamp)
+			sg.changed = false
+		}
+		sg.started = true
+		sg.start = pkt.TimeStamp
+	}
+	return nil
+}
+
+// flush adds the done samples as a segment
+func (sg *dashSegmenter) flush() {
+	var media [2]*dashMedia
+	for i, t := range []*fmp4Track{sg.video, sg.audio} {
+		if t == nil || len(t.samples) == 0 {
+			continue
+		}
+		sg.seq++
+		f := t.fragment()
+		media[i] = &dashMedia{start: f.BaseDecodeTime, data: fmp4.Fragment(sg.seq, f)}
+		for _, s := range f.Samples {
+			media[i].duration += uint64(s.Duration)
+		}
+	}
+	if media[0] != nil || media[1] != nil {
+		sg.ds.addSegment(media[0], media[1])
+	}
+}
+
+// sendStopStatus does nothing, the last segment is added by finish after the subscriber stops
+func (sg *dashSegmenter) sendStopStatus() {}
+
+func (sg *dashSegmenter) finish() {
+	if sg.started {
+		sg.addPending()
+	}
+	sg.flush()
+}
+
+func (srv *Server) findDASH(vhost, app, stream string) *dashStream {
+	ds, _ := srv.findPackager(vhost, app, stream, packagerDASH).(*dashStream)
+	return ds
+}
+
+func (srv *Server) serveDASHManifest(w http.ResponseWriter, r *http.Request) {
+	app, stream, ok := parseStreamPath(r.URL.Path, ".mpd")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	vhost := httpVhost(r)
+	if !srv.checkHTTPPlay(w, r, vhost, app, stream) {
+		return
+	}
+	ds := srv.findDASH(vhost, app, stream)
+	if ds == nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, ok := ds.manifest(stream, hlsQuery(r))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// serveDASHMedia serves /{app}/{stream}/dash-{video|audio}-init-{period}.mp4 and
+// /{app}/{stream}/dash-{video|audio}-{period}-{time}.m4s
+func (srv *Server) serveDASHMedia(w http.ResponseWriter, r *http.Request) {
+	dir, file := path.Split(r.URL.Path)
+	app, stream, ok := parseStreamPath(strings.TrimSuffix(dir, "/"), "")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	vhost := httpVhost(r)
+	if !srv.checkHTTPPlay(w, r, vhost, app, stream) {
+		return
+	}
+	ds := srv.findDASH(vhost, app, stream)
+	if ds == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, kind := range []string{"video", "audio"} {
+		if v, ok := parseMediaName(file, "dash-"+kind+"-init", ".mp4", 1); ok {
+			data, ok := ds.initSegment(kind, int(v[0]))
+			serveMedia(w, r, data, ok)
+			return
+		}
+		if v, ok := parseMediaName(file, "dash-"+kind, ".m4s", 2); ok {
+			data, ok := ds.media(kind, int(v[0]), v[1])
+			serveMedia(w, r, data, ok)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,78 @@
+package rtmp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+
+	"playground/pkg/fmp4"
+)
+
+func TestDASHManifest(t *testing.T) {
+	video := &fmp4.Track{ID: 1, AVCConfig: []byte{1, 0x64, 0, 0x1f, 0xff, 0xe0, 0, 0}, Width: 1280, Height: 720}
+	audio, err := fmp4.NewAudioTrack(2, []byte{0x12, 0x10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := newDASHStream(&DASHConfig{})
+	ds.startPeriod(video, audio, 1000)
+	// audio starts in the second segment
+	ds.addSegment(&dashMedia{start: 1000, duration: 2000, data: []byte{1}}, nil)
+	ds.addSegment(&dashMedia{start: 3000, duration: 2000, data: []byte{2}}, &dashMedia{start: 3010, duration: 1990, data: []byte{3}})
+	ds.addSegment(&dashMedia{start: 5000, duration: 2000, data: []byte{4}}, &dashMedia{start: 5000, duration: 2000, data: []byte{5}})
+
+	b, ok := ds.manifest("test", "?vhost=v")
+	if !ok {
+		t.Fatal("no manifest")
+	}
+	var m mpd
+	if err := xml.Unmarshal(b, &m); err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+	if len(m.Periods) != 1 || len(m.Periods[0].AdaptationSets) != 2 {
+		t.Fatalf("manifest:\n%s", b)
+	}
+
+	for _, c := range []struct {
+		kind     string
+		timeline []mpdTime
+		data     []byte
+	}{
+		{"video", []mpdTime{{1000, 2000}, {3000, 2000}, {5000, 2000}}, []byte{1, 2, 4}},
+		{"audio", []mpdTime{{3010, 1990}, {5000, 2000}}, []byte{3, 5}},
+	} {
+		var tmpl *mpdSegmentTemplate
+		sets := m.Periods[0].AdaptationSets
+		for i := range sets {
+			if sets[i].ContentType == c.kind {
+				tmpl = &sets[i].Representation.SegmentTemplate
+			}
+		}
+		if tmpl == nil {
+			t.Fatalf("no %s adaptation set", c.kind)
+		}
+		if want := "test/dash-" + c.kind + "-0-$Time$.m4s?vhost=v"; tmpl.Media != want {
+			t.Errorf("%s media %q, want %q", c.kind, tmpl.Media, want)
+		}
+		if fmt.Sprint(tmpl.Timeline) != fmt.Sprint(c.timeline) {
+			t.Errorf("%s timeline %v, want %v", c.kind, tmpl.Timeline, c.timeline)
+		}
+
+		// every entry of the timeline is served by the time in its url
+		for i, s := range tmpl.Timeline {
+			file := strings.Replace(tmpl.Media[len("test/"):strings.IndexByte(tmpl.Media, '?')], "$Time$", fmt.Sprint(s.T), 1)
+			v, ok := parseMediaName(file, "dash-"+c.kind, ".m4s", 2)
+			if !ok {
+				t.Fatalf("%s: media name %s", c.kind, file)
+			}
+			if data, ok := ds.media(c.kind, int(v[0]), v[1]); !ok || len(data) != 1 || data[0] != c.data[i] {
+				t.Errorf("%s %s: % x, %v", c.kind, file, data, ok)
+			}
+		}
+	}
+	if _, ok := ds.media("audio", 0, 1000); ok {
+		t.Error("audio of the segment without audio")
+	}
+}
@@ -0,0 +1,238 @@
+package rtmp
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+const dvrFileMode = 0644
+
+// DVRConfig records published streams to flv files.
+//
+// Rules are path templates looked up by "vhost/app", "vhost/*" and "*" in order, streams of an
+// app without a rule are not recorded. {vhost}, {app} and {stream} of a template are replaced,
+// other {...} is the time the file is opened, in yyyy, MM, dd, HH, mm, ss and SSS, e.g.
+//
+//	{app}/{stream}/{yyyyMMdd-HHmmss}.flv
+//
+// A file is split at the first key frame after Duration or Size, and the on_dvr hook is called
+// when a file is closed. Packets are never dropped from a recording, the publisher waits for a
+// slow disk instead.
+type DVRConfig struct {
+	Rules    map[string]string
+	Dir      string        // templates are relative to it, default the working directory
+	Duration time.Duration // max duration of a file, 0 means no limit
+	Size     int64         // max bytes of a file, 0 means no limit
+}
+
+func (dc *DVRConfig) template(vhost, app string) string {
+	for _, k := range appKeys(vhost, app) {
+		if t, ok := dc.Rules[k]; ok {
+			return t
+		}
+	}
+	return ""
+}
+
+var (
+	dvrTimeVar     = regexp.MustCompile(`\{[^{}]*\}`)
+	dvrTimeLayout  = strings.NewReplacer("yyyy", "2006", "MM", "01", "dd", "02", "HH", "15", "mm", "04", "ss", "05", "SSS", "000")
+	dvrNameEscaper = strings.NewReplacer("/", "_", `\`, "_", "..", "__")
+)
+
+// dvrPath replaces the variables of a template, names of the publisher can't leave the directory
+func dvrPath(tmpl string, c *Conn, t time.Time) string {
+	p := strings.NewReplacer(
+		"{vhost}", dvrNameEscaper.Replace(c.vhost),
+		"{app}", dvrNameEscaper.Replace(c.appName),
+		"{stream}", dvrNameEscaper.Replace(c.streamName),
+	).Replace(tmpl)
+
+	return dvrTimeVar.ReplaceAllStringFunc(p, func(v string) string {
+		return t.Format(dvrTimeLayout.Replace(v[1 : len(v)-1]))
+	})
+}
+
+// dvrRecorder records a stream source, a file is never shared by publishers
+type dvrRecorder struct {
+	config *DVRConfig
+}
+
+func (dr *dvrRecorder) newSegmenter(c *Conn) segmenter {
+	return &dvrSegmenter{
+		config: dr.config,
+		c:      c,
+		tmpl:   dr.config.template(c.vhost, c.appName),
+		logger: c.config.Logger.WithFields(logrus.Fields{"event": packagerDVR, "streamKey": c.streamKey}),
+	}
+}
+
+// close does nothing, the files are kept
+func (dr *dvrRecorder) close() {}
+
+// dvrSegmenter writes the packets of one publisher to files
+type dvrSegmenter struct {
+	config *DVRConfig
+	c      *Conn
+	tmpl   string
+	logger *logrus.Entry
+
+	// written at the start of every file
+	metaData, videoSeq, audioSeq *av.Packet
+	hasVideo                     bool
+
+	file  *os.File
+	path  string
+	muxer *flv.Muxer
+	start uint32 // timestamp of the first frame of the file
+}
+
+func (sg *dvrSegmenter) sendAVPacket(pkt *av.Packet) error {
+	var keyFrame bool
+	switch {
+	case pkt.IsMetaData:
+		sg.metaData = pkt // of the next file
+		return nil
+	case pkt.IsVideo:
+		sg.hasVideo = true
+		vh, ok := pkt.Header.(av.VideoPacketHeader)
+		if ok && vh.IsSeq() {
+			sg.videoSeq = pkt
+			return sg.writeSeq(pkt)
+		}
+		keyFrame = ok && vh.IsKeyFrame()
+	case pkt.IsAudio:
+		ah, ok := pkt.Header.(av.AudioPacketHeader)
+		if ok && ah.IsSeq() {
+			sg.audioSeq = pkt
+			return sg.writeSeq(pkt)
+		}
+		keyFrame = !sg.hasVideo // every frame of audio only streams
+	}
+
+	if keyFrame && (sg.muxer == nil || sg.full(pkt)) {
+		if err := sg.open(pkt.TimeStamp); err != nil {
+			sg.logger.Error(err)
+			return err
+		}
+	}
+	if sg.muxer == nil { // wait for the first key frame
+		return nil
+	}
+
+	return sg.write(pkt)
+}
+
+// writeSeq writes a sequence header to the file, which changes the codec config
+func (sg *dvrSegmenter) writeSeq(pkt *av.Packet) error {
+	if sg.muxer == nil {
+		return nil
+	}
+	return sg.write(pkt)
+}
+
+func (sg *dvrSegmenter) write(pkt *av.Packet) error {
+	if err := sg.muxer.WritePacket(pkt); err != nil {
+		sg.logger.WithField("file", sg.path).Error(err)
+		return err
+	}
+	return nil
+}
+
+// full reports whether the file reaches the limit by pkt
+func (sg *dvrSegmenter) full(pkt *av.Packet) bool {
+	elapsed := time.Duration(int32(pkt.TimeStamp-sg.start)) * time.Millisecond
+	return (sg.config.Duration > 0 && elapsed >= sg.config.Duration) ||
+		(sg.config.Size > 0 && sg.muxer.Size() >= sg.config.Size)
+}
+
+// open closes the current file and starts a new one with a frame at ts
+func (sg *dvrSegmenter) open(ts uint32) error {
+	sg.closeFile()
+
+	path, file, err := createDVRFile(filepath.Join(sg.config.Dir, dvrPath(sg.tmpl, sg.c, time.Now())))
+	if err != nil {
+		return err
+	}
+	sg.path, sg.file, sg.muxer = path, file, flv.NewMuxer(file)
+	sg.start = ts
+	sg.logger.WithField("file", path).Info("recording")
+
+	if sg.metaData != nil {
+		if err := sg.write(sg.metaData); err != nil {
+			return err
+		}
+	}
+	for _, seq := range []*av.Packet{sg.videoSeq, sg.audioSeq} {
+		if seq == nil {
+			continue
+		}
+		p := *seq
+		p.TimeStamp = ts // may be long ago, the file starts at ts
+		if err := sg.write(&p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDVRFile creates path, or path-N if it exists
+func createDVRFile(path string) (string, *os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", nil, err
+	}
+
+	ext := filepath.Ext(path)
+	name := path
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, dvrFileMode)
+		if err == nil {
+			return name, f, nil
+		}
+		if !os.IsExist(err) || i > 100 {
+			return "", nil, errors.Wrap(err, "create dvr file")
+		}
+		name = strings.TrimSuffix(path, ext) + "-" + strconv.Itoa(i) + ext
+	}
+}
+
+// closeFile finishes the current file and calls the on_dvr hook
+func (sg *dvrSegmenter) closeFile() {
+	if sg.muxer == nil {
+		return
+	}
+
+	logger := sg.logger.WithFields(logrus.Fields{"file": sg.path, "size": sg.muxer.Size(), "duration": sg.muxer.Duration()})
+	err := sg.muxer.Close()
+	if cerr := sg.file.Close(); err == nil {
+		err = cerr
+	}
+	path := sg.path
+	sg.file, sg.path, sg.muxer = nil, "", nil
+
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	logger.Info("recorded")
+
+	cwd, _ := os.Getwd()
+	sg.c.notifyDvr(cwd, path)
+}
+
+// sendStopStatus does nothing, the file is closed by finish after the subscriber stops
+func (sg *dvrSegmenter) sendStopStatus() {}
+
+func (sg *dvrSegmenter) finish() {
+	sg.closeFile()
+}
@@ -0,0 +1,62 @@
+package rtmp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+func TestDVRLastPacket(t *testing.T) {
+	dir := tempDir(t)
+	srv, addr := startServer(t, &Config{DVR: &DVRConfig{Rules: map[string]string{"*": "{stream}.flv"}, Dir: dir}, SubscriberQueueSize: 32})
+
+	// the queue is too small for the packets, the recorder misses none of them though, and the
+	// publisher leaves at once while packets are still queued to the recorder
+	const last = 40 * 300
+	pub := dialPublish(t, "rtmp://"+addr+"/live/test", &Config{})
+	pkts := testPackets(t)
+	for ts := uint32(80); ts <= last; ts += 40 {
+		pkts = append(pkts, flv.NewVideoPacket(ts, av.INTER_FRAME, av.VIDEO_H264, av.AVC_NALU, 0, []byte{0, 0, 0, 1, 0x41}))
+	}
+	for _, pkt := range pkts {
+		if err := pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub.Close()
+
+	waitFor(t, "recorded", func() bool {
+		val, ok := srv.ssMgr.streamMap.Load(genStreamKey(defaultVhost, "live", "test"))
+		return ok && val.(*streamSource).getPublisher() == nil
+	})
+
+	f, err := os.Open(filepath.Join(dir, "test.flv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := flv.NewReader(f)
+	if _, _, err := r.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	var ts uint32
+	for {
+		pkt, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.IsVideo {
+			n, ts = n+1, pkt.TimeStamp
+		}
+	}
+	if n != len(pkts)-1 || ts != last {
+		t.Fatalf("recorded %d video packets, the last at %d, want %d at %d", n, ts, len(pkts)-1, last)
+	}
+}
@@ -0,0 +1,214 @@
+package rtmp
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"playground/internal/balance"
+)
+
+const (
+	defaultEdgeIdleTimeout = 30 * time.Second
+	edgeOriginVNodes       = 160 // virtual nodes of every origin on the hash ring
+	edgeIdleCheckInterval  = time.Second
+)
+
+// EdgeConfig makes the server an edge of origins. A stream played but not published here is
+// pulled from the origin chosen by consistent hash of its stream key, the pull is shared by all
+// players of the stream and stops IdleTimeout after the last player leaves.
+type EdgeConfig struct {
+	Origins     []string      // "host[:port]" of origin servers
+	IdleTimeout time.Duration // default 30s
+}
+
+func (ec *EdgeConfig) idleTimeout() time.Duration {
+	if ec.IdleTimeout > 0 {
+		return ec.IdleTimeout
+	}
+	return defaultEdgeIdleTimeout
+}
+
+// originRing picks the origin of stream keys by consistent hash, it's built by the server and
+// rebuilt once Config.Edge.Origins is changed by SetConfig
+type originRing struct {
+	mu      sync.Mutex
+	origins []string // the ring is built of
+	lb      balance.LoadBalance
+}
+
+// get returns the origin of streamKey among origins
+func (r *originRing) get(origins []string, streamKey string) (string, error) {
+	if len(origins) == 0 {
+		return "", errors.New("no origin")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lb == nil || !equalStrings(r.origins, origins) {
+		lb := balance.NewLoadBalance(balance.ConsistentHash)
+		for _, o := range origins {
+			_ = lb.Add(o, strconv.Itoa(edgeOriginVNodes))
+		}
+		r.lb, r.origins = lb, append([]string(nil), origins...)
+	}
+
+	return r.lb.Get(streamKey)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pullStream returns the stream source of streamKey pulled from origin,
+// a new pull is started if the stream is not pulled yet
+func (srv *Server) pullStream(config *Config, vhost, app, stream string) (*streamSource, error) {
+	streamKey := genStreamKey(vhost, app, stream)
+	origin, err := srv.origins.get(config.Edge.Origins, streamKey)
+	if err != nil {
+		return nil, err
+	}
+
+	mgr := srv.ssMgr
+	ss := newStreamSource(nil, streamKey, mgr, config)
+	ss.pulling = true
+	if val, loaded := mgr.streamMap.LoadOrStore(streamKey, ss); loaded {
+		return val.(*streamSource), nil
+	}
+
+	go ss.pull(pullURL(origin, vhost, app, stream), config)
+	return ss, nil
+}
+
+// pullURL is the url of the stream on origin, the vhost is passed by query
+func pullURL(origin, vhost, app, stream string) string {
+	u := "rtmp://" + origin + "/" + app + "/" + stream
+	if vhost != defaultVhost {
+		u += "?vhost=" + url.QueryEscape(vhost)
+	}
+	return u
+}
+
+// pull plays rawurl and publishes it to the stream source until the origin stops the stream
+// or no player is left, players are stopped then. The stream source is removed once the pull
+// ends, failed or not, so the next player starts a new pull.
+func (ss *streamSource) pull(rawurl string, config *Config) {
+	logger := config.Logger.WithFields(logrus.Fields{"event": "edge pull", "streamKey": ss.streamKey, "url": rawurl})
+	defer ss.stopPulling()
+
+	// players may leave while connecting to origin, so the idle check starts first
+	pc := &pullConn{}
+	done := make(chan struct{})
+	defer close(done)
+	go ss.closeIdlePull(pc, config.Edge.idleTimeout(), done)
+
+	dialConfig := config.dialConfig()
+	dialConfig.IdleTimeout = config.IdleTimeout
+	conn, err := Dial(rawurl, dialConfig)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	defer conn.Close()
+	if !pc.set(conn) {
+		logger.Info("no player left")
+		return
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(config.handshakeTimeout())); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err := conn.Play(); err != nil {
+		logger.Error(err)
+		return
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		logger.Error(err)
+		return
+	}
+	logger.Info("start")
+
+	ss.setPulledPublisher(newPublisher(conn, ss.streamKey))
+	err = ss.doPublishing()
+	logger.Infof("stop: %v", err)
+}
+
+// setPulledPublisher sets the publisher of a pull, local publishers are refused by setPublisher
+// while the source is pulled, so it's never taken while dialing origin
+func (ss *streamSource) setPulledPublisher(pub *publisher) {
+	ss.pubMux.Lock()
+	defer ss.pubMux.Unlock()
+	ss.publisher = pub
+}
+
+// pullConn is the connection of a pull, which may be closed before it's dialed
+type pullConn struct {
+	mu     sync.Mutex
+	conn   *Conn
+	closed bool
+}
+
+// set keeps conn to be closed by close, false if closed already
+func (pc *pullConn) set(conn *Conn) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.conn = conn
+	return !pc.closed
+}
+
+func (pc *pullConn) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.closed = true
+	if pc.conn != nil {
+		_ = pc.conn.Close()
+	}
+}
+
+// closeIdlePull closes the pull connection once the stream has no subscriber for timeout
+func (ss *streamSource) closeIdlePull(pc *pullConn, timeout time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(edgeIdleCheckInterval)
+	defer ticker.Stop()
+
+	lastActive := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if ss.numSubscribers() > 0 {
+				lastActive = now
+			} else if now.Sub(lastActive) >= timeout {
+				pc.close()
+				return
+			}
+		}
+	}
+}
+
+// stopPulling removes the pulled stream source, then stops its players
+func (ss *streamSource) stopPulling() {
+	if val, ok := ss.ssMgr.streamMap.Load(ss.streamKey); ok && val.(*streamSource) == ss {
+		ss.ssMgr.streamMap.Delete(ss.streamKey)
+	}
+	ss.clearPublisher()
+
+	ss.addSubMux.Lock()
+	ss.closed = true
+	ss.addSubMux.Unlock()
+	ss.stopSubscribers()
+}
@@ -0,0 +1,242 @@
+package rtmp
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+const defaultFileFrameInterval = 40 * time.Millisecond // between loops if the file has one frame
+
+// FileSource publishes a flv file to a stream as if an encoder were publishing, returned by
+// Server.PublishFile
+type FileSource struct {
+	path string
+	loop bool
+	ss   *streamSource
+	c    *Conn // the stream, for forwarders and packagers
+
+	logger *logrus.Entry
+
+	quit     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	err      error
+}
+
+// PublishFile publishes the flv file at path to {app}/{stream} of vhost(empty for the default
+// vhost), packets are paced in real time by their timestamps. If loop, the file is played
+// again from the start with timestamps going on, until Stop. Players, forwarders and packagers
+// of the stream work as with a rtmp publisher, hooks are not called.
+//
+// It fails if the file is not flv or the stream is being published.
+func (srv *Server) PublishFile(path, vhost, app, stream string, loop bool) (*FileSource, error) {
+	if vhost == "" {
+		vhost = defaultVhost
+	}
+	config := srv.Config()
+
+	f, r, err := openFLV(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		server:     srv,
+		ssMgr:      srv.ssMgr,
+		config:     config,
+		logger:     config.Logger,
+		clientID:   genUuid(),
+		vhost:      vhost,
+		appName:    app,
+		streamName: stream,
+		streamKey:  genStreamKey(vhost, app, stream),
+	}
+
+	pub := newPublisher(c, c.streamKey)
+	ss := newStreamSource(pub, c.streamKey, srv.ssMgr, config)
+	if val, loaded := srv.ssMgr.streamMap.LoadOrStore(c.streamKey, ss); loaded {
+		ss = val.(*streamSource)
+		if !ss.setPublisher(pub) {
+			f.Close()
+			return nil, errors.Errorf("stream %s is busy", c.streamKey)
+		}
+	}
+
+	fs := &FileSource{
+		path:   path,
+		loop:   loop,
+		ss:     ss,
+		c:      c,
+		logger: config.Logger.WithFields(logrus.Fields{"event": "publish file", "streamKey": c.streamKey, "file": path}),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	pub.kick = func() { fs.stopOnce.Do(func() { close(fs.quit) }) }
+	go fs.run(f, r)
+	return fs, nil
+}
+
+func openFLV(path string) (*os.File, *flv.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := flv.NewReader(bufio.NewReader(f))
+	if _, _, err := r.ReadHeader(); err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, path)
+	}
+	return f, r, nil
+}
+
+// Stop ends publishing like an unpublish, and waits for the last packet
+func (fs *FileSource) Stop() {
+	fs.stopOnce.Do(func() { close(fs.quit) })
+	<-fs.done
+}
+
+// Done is closed when publishing ends
+func (fs *FileSource) Done() <-chan struct{} {
+	return fs.done
+}
+
+// Err returns why publishing ended after Done, nil for the end of file or Stop
+func (fs *FileSource) Err() error {
+	<-fs.done
+	return fs.err
+}
+
+func (fs *FileSource) run(f *os.File, r *flv.Reader) {
+	defer close(fs.done)
+
+	ss := fs.ss
+	defer ss.delPublisher()
+	ss.startForwarders(fs.c)
+	defer ss.stopForwarders()
+	ss.startPackagers(fs.c)
+	defer ss.stopPackagers()
+
+	fs.logger.Info("start")
+	fs.err = fs.publish(f, r)
+	fs.logger.Infof("stop: %v", fs.err)
+}
+
+// publish paces the packets of the file in real time
+func (fs *FileSource) publish(f *os.File, r *flv.Reader) error {
+	defer func() { f.Close() }()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	start := time.Now()
+	clock := &fileClock{}
+	for {
+		pkt, err := r.ReadPacket()
+		if err == io.EOF && fs.loop {
+			if !clock.hasBase {
+				return errors.New("no audio or video to loop")
+			}
+			f.Close()
+			if f, r, err = openFLV(fs.path); err != nil {
+				return err
+			}
+			clock.nextLoop()
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		clock.stamp(pkt)
+		if d := time.Until(start.Add(time.Duration(pkt.TimeStamp-clock.first) * time.Millisecond)); d > 0 {
+			timer.Reset(d)
+			select {
+			case <-timer.C:
+			case <-fs.quit:
+				return nil
+			}
+		} else {
+			select {
+			case <-fs.quit:
+				return nil
+			default:
+			}
+		}
+
+		if fs.ss.ssMgr.isClosing() && fs.ss.atGopBoundary(pkt) {
+			return ErrServerClosed
+		}
+
+		fs.ss.dispatchAVPacket(nil, pkt)
+		fs.ss.cacheAVMetaPacket(pkt)
+	}
+}
+
+// fileClock maps timestamps of the file to the stream, which go on across loops
+type fileClock struct {
+	started     bool
+	first, last uint32 // of the stream
+
+	hasBase bool
+	base    uint32 // the first timestamp of the file, mapped to offset
+	offset  uint32
+
+	hasPrev  [2]bool // of audio and video
+	prev     [2]uint32
+	interval uint32 // of frames, the gap between loops
+}
+
+func (fc *fileClock) stamp(pkt *av.Packet) {
+	if pkt.IsAudio || pkt.IsVideo {
+		if !fc.hasBase {
+			fc.hasBase, fc.base = true, pkt.TimeStamp
+		}
+
+		i := 0
+		if pkt.IsVideo {
+			i = 1
+		}
+		if d := int32(pkt.TimeStamp - fc.prev[i]); fc.hasPrev[i] && d > 0 && d < 1000 {
+			fc.interval = uint32(d)
+		}
+		fc.hasPrev[i], fc.prev[i] = true, pkt.TimeStamp
+	}
+
+	ts := fc.offset // metadata ahead of frames
+	if d := int32(pkt.TimeStamp - fc.base); fc.hasBase && d > 0 {
+		ts += uint32(d)
+	}
+	pkt.TimeStamp = ts
+
+	if !fc.started {
+		fc.started, fc.first, fc.last = true, ts, ts
+	}
+	if int32(ts-fc.last) > 0 {
+		fc.last = ts
+	}
+}
+
+// nextLoop starts the file again a frame after the last timestamp
+func (fc *fileClock) nextLoop() {
+	interval := fc.interval
+	if interval == 0 {
+		interval = uint32(defaultFileFrameInterval / time.Millisecond)
+	}
+	fc.offset = fc.last + interval
+	fc.hasBase = false
+	fc.hasPrev = [2]bool{}
+}
@@ -0,0 +1,123 @@
+package rtmp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+// writeFLV writes pkts to a flv file in dir
+func writeFLV(t *testing.T, dir string, pkts []*av.Packet) string {
+	path := filepath.Join(dir, "test.flv")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := flv.NewWriter(f)
+	if err := w.WriteHeader(false, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range pkts {
+		if err := w.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestFileClock(t *testing.T) {
+	// the file starts at 1000, audio and video interleaved out of order a little
+	file := []struct {
+		video bool
+		ts    uint32
+	}{{true, 1000}, {false, 1010}, {false, 1033}, {true, 1040}, {false, 1056}, {true, 1080}}
+
+	fc := &fileClock{}
+	var got [2][]uint32
+	for loop := 0; loop < 2; loop++ {
+		if loop > 0 {
+			fc.nextLoop()
+		}
+		for _, f := range file {
+			pkt := &av.Packet{IsVideo: f.video, IsAudio: !f.video, TimeStamp: f.ts}
+			fc.stamp(pkt)
+			i := 0
+			if f.video {
+				i = 1
+			}
+			got[i] = append(got[i], pkt.TimeStamp)
+		}
+	}
+
+	// the second loop starts a frame interval after the last timestamp
+	want := [2][]uint32{{10, 33, 56, 130, 153, 176}, {0, 40, 80, 120, 160, 200}}
+	for i := range want {
+		if len(got[i]) != len(want[i]) {
+			t.Fatalf("track %d: %v, want %v", i, got[i], want[i])
+		}
+		for j := range want[i] {
+			if got[i][j] != want[i][j] {
+				t.Fatalf("track %d: %v, want %v", i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestPublishFile(t *testing.T) {
+	srv, addr := startServer(t, &Config{})
+	pkts := testPackets(t)
+	for ts := uint32(80); ts < 400; ts += 40 {
+		pkts = append(pkts, flv.NewVideoPacket(ts, av.INTER_FRAME, av.VIDEO_H264, av.AVC_NALU, 0, []byte{0, 0, 0, 1, 0x41}))
+	}
+	path := writeFLV(t, tempDir(t), pkts)
+
+	fs, err := srv.PublishFile(path, "", "live", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	if _, err := srv.PublishFile(path, "", "live", "test", false); err == nil {
+		t.Error("published a busy stream")
+	}
+	player := dialPlay(t, "rtmp://"+addr+"/live/test", &Config{})
+	defer player.Close()
+
+	// frames come in real time by their timestamps, which go on across loops. The gop cached
+	// before the player is sent at once, so the pace is measured from a later frame.
+	var first, base uint32
+	var start time.Time
+	var last uint32
+	for n := 0; n < 20; {
+		got := readPackets(t, player, 1)[0]
+		if !got.IsVideo || got.Header.(av.VideoPacketHeader).IsSeq() {
+			continue
+		}
+		switch {
+		case n == 0:
+			first = got.TimeStamp
+		case int32(got.TimeStamp-last) <= 0:
+			t.Fatalf("timestamp %d after %d", got.TimeStamp, last)
+		case n == 4:
+			base, start = got.TimeStamp, time.Now()
+		}
+		last = got.TimeStamp
+		n++
+	}
+	if last-first < 400 {
+		t.Fatalf("timestamps %d to %d, not looped", first, last)
+	}
+	if elapsed, d := time.Since(start), time.Duration(last-base)*time.Millisecond; elapsed < d-100*time.Millisecond {
+		t.Fatalf("%s of timestamps in %s", d, elapsed)
+	}
+
+	fs.Stop()
+	if err := fs.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
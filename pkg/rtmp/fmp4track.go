@@ -0,0 +1,163 @@
+package rtmp
+
+import (
+	"bytes"
+
+	"playground/pkg/av"
+	"playground/pkg/fmp4"
+)
+
+const (
+	fmp4VideoTrackID = 1
+	fmp4AudioTrackID = 2
+)
+
+// fmp4Track collects the samples of a track for fMP4 segmenters, the last sample is pending
+// until the next one gives its duration
+type fmp4Track struct {
+	track   *fmp4.Track
+	samples []fmp4.Sample
+	base    uint32 // decode time of samples[0]
+	pending *av.Packet
+	delta   uint32 // duration of the last sample
+}
+
+// push adds pkt as the pending sample, the previous one is done
+func (t *fmp4Track) push(pkt *av.Packet) {
+	if t.pending != nil {
+		if d := int32(pkt.TimeStamp - t.pending.TimeStamp); d > 0 {
+			t.delta = uint32(d)
+		}
+		t.addPending()
+	}
+	t.pending = pkt
+}
+
+func (t *fmp4Track) addPending() {
+	pkt := t.pending
+	t.pending = nil
+
+	if len(t.samples) == 0 {
+		t.base = pkt.TimeStamp
+	}
+	s := fmp4.Sample{Duration: t.delta}
+	if t.track.IsVideo() {
+		vh := pkt.Header.(av.VideoPacketHeader)
+		s.KeyFrame = vh.IsKeyFrame()
+		s.CompositionTimeOffset = vh.CompositionTime()
+		s.Data = pkt.Data[5:]
+	} else {
+		s.Data = pkt.Data[2:]
+	}
+	t.samples = append(t.samples, s)
+}
+
+// duration of the done samples
+func (t *fmp4Track) duration() uint32 {
+	var d uint32
+	for _, s := range t.samples {
+		d += s.Duration
+	}
+	return d
+}
+
+// fragment takes the done samples
+func (t *fmp4Track) fragment() fmp4.TrackFragment {
+	f := fmp4.TrackFragment{Track: t.track, BaseDecodeTime: uint64(t.base), Samples: t.samples}
+	t.samples = nil
+	return f
+}
+
+// fmp4Tracks are the H.264 and AAC tracks of a publisher for fMP4 segmenters
+type fmp4Tracks struct {
+	video, audio *fmp4Track
+	changed      bool // codec configs changed since clearChanged
+}
+
+// media returns the track of a coded frame pkt, sequence headers update the tracks and
+// return nil, so do packets of other codecs
+func (ft *fmp4Tracks) media(pkt *av.Packet) (t *fmp4Track, keyFrame bool, err error) {
+	switch {
+	case pkt.IsVideo:
+		vh, ok := pkt.Header.(av.VideoPacketHeader)
+		if !ok || vh.CodecID() != av.VIDEO_H264 || len(pkt.Data) < 5 {
+			return nil, false, nil
+		}
+		if vh.IsSeq() {
+			return nil, false, ft.setVideoConfig(pkt.Data[5:])
+		}
+		return ft.video, vh.IsKeyFrame(), nil
+	case pkt.IsAudio:
+		ah, ok := pkt.Header.(av.AudioPacketHeader)
+		if !ok || ah.SoundFormat() != av.SOUND_AAC || len(pkt.Data) < 2 {
+			return nil, false, nil
+		}
+		if ah.AACPacketType() == av.AAC_SEQHDR {
+			return nil, false, ft.setAudioConfig(pkt.Data[2:])
+		}
+		return ft.audio, true, nil
+	}
+	return nil, false, nil
+}
+
+func (ft *fmp4Tracks) setVideoConfig(config []byte) error {
+	if ft.video != nil && bytes.Equal(ft.video.track.AVCConfig, config) {
+		return nil // sent again
+	}
+	track, err := fmp4.NewVideoTrack(fmp4VideoTrackID, config)
+	if err != nil {
+		return err
+	}
+
+	if ft.video == nil {
+		ft.video = &fmp4Track{}
+	}
+	ft.video.track = track
+	ft.changed = true
+	return nil
+}
+
+func (ft *fmp4Tracks) setAudioConfig(config []byte) error {
+	if ft.audio != nil && bytes.Equal(ft.audio.track.AudioConfig, config) {
+		return nil
+	}
+	track, err := fmp4.NewAudioTrack(fmp4AudioTrackID, config)
+	if err != nil {
+		return err
+	}
+
+	if ft.audio == nil {
+		ft.audio = &fmp4Track{}
+	}
+	ft.audio.track = track
+	ft.changed = true
+	return nil
+}
+
+// clock is the track whose frames decide cutting, video or audio only
+func (ft *fmp4Tracks) clock() *fmp4Track {
+	if ft.video != nil {
+		return ft.video
+	}
+	return ft.audio
+}
+
+func (ft *fmp4Tracks) all() []*fmp4Track {
+	var ts []*fmp4Track
+	for _, t := range []*fmp4Track{ft.video, ft.audio} {
+		if t != nil {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// addPending makes the pending samples done at the end of stream, with the duration of the
+// sample before
+func (ft *fmp4Tracks) addPending() {
+	for _, t := range ft.all() {
+		if t.pending != nil {
+			t.addPending()
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package rtmp
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"playground/pkg/av"
+)
+
+const (
+	defaultForwardMinBackoff = time.Second
+	defaultForwardMaxBackoff = 30 * time.Second
+	forwardWriteTimeout      = 10 * time.Second
+)
+
+// states of a forward target
+const (
+	ForwardConnecting = "connecting" // dialing and publishing to the target
+	ForwardForwarding = "forwarding" // publishing packets to the target
+	ForwardBackoff    = "backoff"    // failed, waiting to reconnect
+	ForwardStopped    = "stopped"    // the stream is unpublished
+)
+
+// ForwardConfig pushes every stream published to the server to other rtmp servers.
+//
+// Rules are looked up by "vhost/app", "vhost/*" and "*" in order, every target of the rule
+// is an url template where {vhost}, {app}, {stream} and {param}(raw query of the publisher)
+// are replaced, e.g.
+//
+//	rtmp://backup/{app}/{stream}
+//
+// A broken target is reconnected after a backoff doubled on every failure.
+type ForwardConfig struct {
+	Rules      map[string][]string
+	MinBackoff time.Duration // default 1s
+	MaxBackoff time.Duration // default 30s
+}
+
+func (fc *ForwardConfig) targets(vhost, app string) []string {
+	for _, k := range appKeys(vhost, app) {
+		if t, ok := fc.Rules[k]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+func (fc *ForwardConfig) backoff() (time.Duration, time.Duration) {
+	min, max := fc.MinBackoff, fc.MaxBackoff
+	if min <= 0 {
+		min = defaultForwardMinBackoff
+	}
+	if max <= 0 {
+		max = defaultForwardMaxBackoff
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// ForwarderStatus is the status of one forward target of a stream
+type ForwarderStatus struct {
+	StreamKey string    `json:"stream_key"`
+	Target    string    `json:"target"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`   // time of the last state change
+	Retries   int       `json:"retries"` // failures since the last successful publish
+	LastError string    `json:"last_error,omitempty"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+}
+
+// forwarder republishes a stream source to one target, it subscribes the source like a player
+// so the cached metadata, sequence headers and gop are sent first after every reconnection.
+type forwarder struct {
+	ss     *streamSource
+	target string
+	config *Config
+	logger *logrus.Entry
+
+	quit chan struct{} // closed by stop
+
+	mu      sync.Mutex
+	stopped bool
+	sub     *subscriber // subscriber of the current connection
+	status  ForwarderStatus
+}
+
+func newForwarder(ss *streamSource, target string, config *Config) *forwarder {
+	f := &forwarder{
+		ss:     ss,
+		target: target,
+		config: config,
+		logger: config.Logger.WithFields(logrus.Fields{"event": "forward", "streamKey": ss.streamKey, "target": target}),
+		quit:   make(chan struct{}),
+	}
+	f.status = ForwarderStatus{
+		StreamKey: ss.streamKey,
+		Target:    target,
+		State:     ForwardConnecting,
+		Since:     time.Now(),
+	}
+	return f
+}
+
+func (f *forwarder) run() {
+	min, max := f.config.Forward.backoff()
+	backoff := min
+
+	for {
+		if f.isStopped() || f.ss.ssMgr.isClosing() {
+			f.setState(ForwardStopped, nil)
+			return
+		}
+
+		f.setState(ForwardConnecting, nil)
+		published, err := f.forward()
+		if f.isStopped() {
+			f.setState(ForwardStopped, nil)
+			return
+		}
+
+		if published {
+			backoff = min
+		}
+		f.setState(ForwardBackoff, err)
+		f.logger.Warnf("%v, reconnect in %s", err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-f.quit:
+		}
+
+		if backoff *= 2; backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// forward publishes to the target until the connection fails or the forwarder stops,
+// published reports whether the target has accepted the stream
+func (f *forwarder) forward() (published bool, err error) {
+	conn, err := Dial(f.target, f.config.dialConfig())
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(f.config.handshakeTimeout())); err != nil {
+		return false, err
+	}
+	if err := conn.Publish(); err != nil {
+		return false, errors.Wrap(err, "publish")
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return false, err
+	}
+
+	sink := &forwardSink{f: f, conn: conn}
+	sub := newSinkSubscriber("forward:"+f.target, sink, f.config.Logger, f.config.subscriberQueueSize())
+	sub.readErr = make(chan error, 1)
+	if !f.setSubscriber(sub) {
+		return true, nil
+	}
+	defer f.setSubscriber(nil)
+
+	if !f.ss.addSubscriber(sub) {
+		return true, errors.New("already subscribe")
+	}
+	defer f.ss.delSubscriber(sub)
+
+	f.setState(ForwardForwarding, nil)
+	f.logger.Info("forwarding")
+
+	go sink.readingCycle(sub) // ends once conn is closed
+
+	return true, sub.playingCycle(f.ss)
+}
+
+// stop the forwarder, the target connection is closed after an unpublish
+func (f *forwarder) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stopped {
+		return
+	}
+	f.stopped = true
+	close(f.quit)
+	if f.sub != nil {
+		f.sub.stop()
+	}
+}
+
+func (f *forwarder) isStopped() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stopped
+}
+
+// setSubscriber saves the subscriber of the current connection, false if stopped already
+func (f *forwarder) setSubscriber(sub *subscriber) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stopped && sub != nil {
+		return false
+	}
+	f.sub = sub
+	return true
+}
+
+func (f *forwarder) setState(state string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.status.State != state {
+		f.status.State = state
+		f.status.Since = time.Now()
+	}
+
+	switch {
+	case err != nil:
+		f.status.Retries++
+		f.status.LastError = err.Error()
+	case state == ForwardForwarding:
+		f.status.Retries = 0
+	}
+}
+
+func (f *forwarder) addStats(pkt *av.Packet) {
+	f.mu.Lock()
+	f.status.Packets++
+	f.status.Bytes += uint64(len(pkt.Data))
+	f.mu.Unlock()
+}
+
+func (f *forwarder) snapshot() ForwarderStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// forwardSink publishes the packets of a forwarder subscriber on the target connection
+type forwardSink struct {
+	f    *forwarder
+	conn *Conn
+}
+
+func (fs *forwardSink) sendAVPacket(pkt *av.Packet) error {
+	if err := fs.conn.SetWriteDeadline(time.Now().Add(forwardWriteTimeout)); err != nil {
+		return err
+	}
+	if err := fs.conn.WritePacket(pkt); err != nil {
+		return err
+	}
+	fs.f.addStats(pkt)
+	return nil
+}
+
+// readingCycle reads the target while forwarding, so its acks, pings and chunk size changes are
+// handled. The forward ends by the read error, or an error level onStatus of the target.
+func (fs *forwardSink) readingCycle(sub *subscriber) {
+	c := fs.conn
+	for {
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			sub.readDone(err)
+			return
+		}
+
+		switch cs.MsgTypeID {
+		case MsgAMF0CommandMessage, MsgAMF3CommandMessage:
+			vs, err := c.decodeAMF(cs)
+			if err != nil {
+				sub.readDone(err)
+				return
+			}
+			if len(vs) > 0 && vs[0] == "onStatus" && statusLevel(vs) == "error" {
+				sub.readDone(errors.Errorf("target status: '%s'", statusCode(vs)))
+				return
+			}
+		}
+	}
+}
+
+func (fs *forwardSink) sendStopStatus() {
+	c := fs.conn
+	_ = c.SetWriteDeadline(time.Now().Add(forwardWriteTimeout))
+	_ = c.sendCommand(cmdFCUnpublish, 0, nil, c.streamName)
+	_ = c.sendCommand(cmdDeleteStream, 0, nil, c.streamID)
+}
+
+// forwardURL replaces the variables of a target template
+func forwardURL(tmpl string, c *Conn) string {
+	param := c.streamRawQuery
+	if param == "" {
+		param = c.rawQuery
+	}
+	return strings.NewReplacer(
+		"{vhost}", c.vhost,
+		"{app}", c.appName,
+		"{stream}", c.streamName,
+		"{param}", param,
+	).Replace(tmpl)
+}
+
+// startForwarders starts forwarders of the rules matching the publisher connection
+func (ss *streamSource) startForwarders(c *Conn) {
+	fc := c.config.Forward
+	if fc == nil {
+		return
+	}
+
+	ss.fwdMux.Lock()
+	defer ss.fwdMux.Unlock()
+
+	for _, tmpl := range fc.targets(c.vhost, c.appName) {
+		f := newForwarder(ss, forwardURL(tmpl, c), c.config)
+		ss.forwarders = append(ss.forwarders, f)
+		go f.run()
+	}
+}
+
+func (ss *streamSource) stopForwarders() {
+	ss.fwdMux.Lock()
+	defer ss.fwdMux.Unlock()
+
+	for _, f := range ss.forwarders {
+		f.stop()
+	}
+	ss.forwarders = nil
+}
+
+func (ss *streamSource) forwarderStatus() []ForwarderStatus {
+	ss.fwdMux.Lock()
+	defer ss.fwdMux.Unlock()
+
+	status := make([]ForwarderStatus, 0, len(ss.forwarders))
+	for _, f := range ss.forwarders {
+		status = append(status, f.snapshot())
+	}
+	return status
+}
+
+// Forwarders returns the status of all forward targets of streams being published
+func (srv *Server) Forwarders() []ForwarderStatus {
+	var status []ForwarderStatus
+	srv.ssMgr.streamMap.Range(func(key, val interface{}) bool {
+		status = append(status, val.(*streamSource).forwarderStatus()...)
+		return true
+	})
+	return status
+}
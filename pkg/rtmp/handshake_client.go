@@ -1,6 +1,98 @@
 package rtmp
 
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// client version sent in C1, a non-zero value asks the peer for the complex(digest) handshake
+const hsClientVersion = 0x0c00000d
+
 func (c *Conn) clientHandshake() error {
-	//TODO
+	/* random:
+	1. c0c1c2: c0(1) + c1(1536) + c2(1536)
+	2. s0s1s2: s0(1) + s1(1536) + s2(1536)
+	*/
+	var random [(1 + 1536*2) * 2]byte
+
+	c0c1c2 := random[:1536*2+1]
+	c0 := c0c1c2[:1]
+	c1 := c0c1c2[1 : 1536+1]
+	c0c1 := c0c1c2[:1536+1]
+	c2 := c0c1c2[1536+1:]
+
+	s0s1s2 := random[1536*2+1:]
+	s0 := s0s1s2[:1]
+	s1 := s0s1s2[1 : 1536+1]
+	s2 := s0s1s2[1536+1:]
+
+	// write C0C1
+	c0[0] = 3
+	cliTime := uint32(time.Now().Unix())
+	if c.config.SimpleHandshake {
+		uintAsbyteSlice(cliTime, c1[0:4], true)
+		uintAsbyteSlice(0, c1[4:8], true)
+		rand.Read(c1[8:])
+	} else {
+		complexHandshakeCreateS0S1(c0c1, cliTime, hsClientVersion, hsClientPartialKey)
+	}
+
+	if _, err := c.Write(c0c1); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	// read S0S1S2
+	if _, err := c.Read(s0s1s2); err != nil {
+		return err
+	}
+
+	if s0[0] != 3 {
+		return fmt.Errorf("rtmp: handshake version=%d invalid", s0[0])
+	}
+
+	srvVer := byteSliceAsUint(s1[4:8], true)
+	if srvVer != 0 && !c.config.SimpleHandshake {
+		var ok bool
+		var digest []byte
+		if ok, digest = complexHandshakeParseC1(s1, hsServerPartialKey, hsClientFullKey); !ok {
+			return fmt.Errorf("rtmp: handshake client: S1 invalid")
+		}
+
+		if !complexHandshakeCheckS2(s2, c1) {
+			return fmt.Errorf("rtmp: handshake client: S2 invalid")
+		}
+
+		complexHandshakeCreateS2(c2, digest)
+	} else {
+		if !bytes.Equal(s2[8:], c1[8:]) {
+			return fmt.Errorf("rtmp: handshake client: S2 not echo C1")
+		}
+
+		copy(c2, s1)
+	}
+
+	// write C2
+	if _, err := c.Write(c2); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
 	return nil
 }
+
+// S2 carries a digest keyed by the server full key and the digest we put in C1
+func complexHandshakeCheckS2(s2 []byte, c1 []byte) bool {
+	gap := complexHandshakeCalcDigestPos(c1, 8)
+	key := complexHandshakeMakeDigest(hsServerFullKey, c1[gap:gap+32], -1)
+
+	pos := len(s2) - 32
+	digest := complexHandshakeMakeDigest(key, s2, pos)
+	return bytes.Equal(s2[pos:], digest)
+}
@@ -0,0 +1,405 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"playground/pkg/av"
+	"playground/pkg/ts"
+)
+
+const (
+	defaultHLSSegmentDuration = 5 * time.Second
+	defaultHLSWindow          = 5
+)
+
+// HLSConfig enables HLS output of the streams published to the server, served by the http
+// playback of Server.ListenAndServeHTTP.
+//
+// Segments are cut at the first key frame after SegmentDuration, or at any audio frame if the
+// stream has no video. They are kept in memory, or written to Dir/{vhost}/{app}/{stream}/ with
+// the playlist if Dir is set, and removed once they slide out of the playlist. Everything is
+// removed when the stream source is gone after unpublish.
+type HLSConfig struct {
+	SegmentDuration time.Duration // default 5s
+	Window          int           // segments in the playlist, default 5
+	Dir             string        // empty keeps segments in memory
+}
+
+func (hc *HLSConfig) segmentDuration() time.Duration {
+	if hc.SegmentDuration > 0 {
+		return hc.SegmentDuration
+	}
+	return defaultHLSSegmentDuration
+}
+
+func (hc *HLSConfig) window() int {
+	if hc.Window > 0 {
+		return hc.Window
+	}
+	return defaultHLSWindow
+}
+
+type hlsSegment struct {
+	seq           uint64
+	duration      time.Duration
+	discontinuity bool   // first segment after a republish
+	data          []byte // nil if on disk
+}
+
+// hlsStream is the sliding window of segments of a stream source, it lives as long as the
+// stream source so media sequence goes on across republish.
+type hlsStream struct {
+	config *HLSConfig
+	name   string // stream name, prefix of segment names
+	dir    string // empty if in memory
+	logger *logrus.Entry
+
+	mu             sync.Mutex
+	segments       []*hlsSegment
+	nextSeq        uint64
+	discSeq        uint64 // discontinuities slid out of the window
+	targetDuration int    // seconds, never decreases
+	discontinuity  bool   // the next segment follows a republish
+	closed         bool
+}
+
+func newHLSStream(config *HLSConfig, vhost, app, stream string, logger *logrus.Logger) *hlsStream {
+	hs := &hlsStream{
+		config:         config,
+		name:           stream,
+		logger:         logger.WithFields(logrus.Fields{"event": "hls", "streamKey": genStreamKey(vhost, app, stream)}),
+		targetDuration: int(math.Ceil(config.segmentDuration().Seconds())),
+	}
+	if config.Dir != "" {
+		hs.dir = filepath.Join(config.Dir, vhost, app, stream)
+	}
+	return hs
+}
+
+func (hs *hlsStream) segmentName(seq uint64) string {
+	return hs.name + "-" + strconv.FormatUint(seq, 10) + ".ts"
+}
+
+// addSegment appends a complete segment to the window and evicts the oldest ones
+func (hs *hlsStream) addSegment(duration time.Duration, data []byte) error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if hs.closed {
+		return nil
+	}
+
+	seg := &hlsSegment{seq: hs.nextSeq, duration: duration, discontinuity: hs.discontinuity}
+	if hs.dir == "" {
+		seg.data = data
+	} else {
+		if err := os.MkdirAll(hs.dir, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(hs.dir, hs.segmentName(seg.seq)), data, 0644); err != nil {
+			return err
+		}
+	}
+	hs.nextSeq++
+	hs.discontinuity = false
+	hs.segments = append(hs.segments, seg)
+
+	if d := int(math.Ceil(duration.Seconds())); d > hs.targetDuration {
+		hs.targetDuration = d
+	}
+
+	for len(hs.segments) > hs.config.window() {
+		old := hs.segments[0]
+		hs.segments[0] = nil
+		hs.segments = hs.segments[1:]
+
+		if old.discontinuity {
+			hs.discSeq++
+		}
+		if hs.dir != "" {
+			if err := os.Remove(filepath.Join(hs.dir, hs.segmentName(old.seq))); err != nil {
+				hs.logger.Warn(err)
+			}
+		}
+	}
+
+	if hs.dir == "" {
+		return nil
+	}
+	// replaced by rename so a reader never sees a partial playlist
+	path := filepath.Join(hs.dir, hs.name+".m3u8")
+	if err := ioutil.WriteFile(path+".tmp", hs.renderPlaylist(""), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// markDiscontinuity tags the next segment, the publisher is gone and timestamps and codec
+// parameters of the next one may differ
+func (hs *hlsStream) markDiscontinuity() {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	hs.discontinuity = hs.nextSeq > 0
+}
+
+// playlist returns the live playlist, false if there is no segment yet. query is appended
+// to segment uris.
+func (hs *hlsStream) playlist(query string) ([]byte, bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if len(hs.segments) == 0 {
+		return nil, false
+	}
+	return hs.renderPlaylist(query), true
+}
+
+func (hs *hlsStream) renderPlaylist(query string) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", hs.targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", hs.segments[0].seq)
+	if hs.discSeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", hs.discSeq)
+	}
+
+	for _, seg := range hs.segments {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s%s\n", seg.duration.Seconds(), hs.segmentName(seg.seq), query)
+	}
+	return b.Bytes()
+}
+
+// openSegment returns the content of segment seq if it's still in the window
+func (hs *hlsStream) openSegment(seq uint64) (io.ReadSeeker, func(), bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	for _, seg := range hs.segments {
+		if seg.seq != seq {
+			continue
+		}
+		if seg.data != nil {
+			return bytes.NewReader(seg.data), func() {}, true
+		}
+
+		f, err := os.Open(filepath.Join(hs.dir, hs.segmentName(seq)))
+		if err != nil {
+			hs.logger.Error(err)
+			return nil, nil, false
+		}
+		return f, func() { f.Close() }, true
+	}
+	return nil, nil, false
+}
+
+func (hs *hlsStream) newSegmenter(*Conn) segmenter {
+	return newHLSSegmenter(hs)
+}
+
+// close drops all segments and removes the files
+func (hs *hlsStream) close() {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	hs.closed = true
+	hs.segments = nil
+	if hs.dir != "" {
+		if err := os.RemoveAll(hs.dir); err != nil {
+			hs.logger.Warn(err)
+		}
+	}
+}
+
+// hlsSegmenter cuts the packets of one publisher into segments of a hlsStream. It subscribes
+// the stream source like a player, packets before the first key frame are skipped so every
+// segment starts with one.
+type hlsSegmenter struct {
+	hs    *hlsStream
+	muxer *ts.Muxer
+
+	hasVideo   bool
+	buf        *bytes.Buffer // the segment being written, nil before the first key frame
+	start, end uint32        // timestamps of the segment
+}
+
+func newHLSSegmenter(hs *hlsStream) *hlsSegmenter {
+	return &hlsSegmenter{
+		hs:    hs,
+		muxer: ts.NewMuxer(ioutil.Discard),
+	}
+}
+
+func (sg *hlsSegmenter) sendAVPacket(pkt *av.Packet) error {
+	cut := false // a segment can start at pkt
+	switch {
+	case pkt.IsVideo:
+		vh, ok := pkt.Header.(av.VideoPacketHeader)
+		if !ok || vh.CodecID() != av.VIDEO_H264 { // enhanced codecs are not muxed to ts
+			return nil
+		}
+		if vh.IsSeq() {
+			sg.hasVideo = true
+			return sg.muxer.WritePacket(pkt)
+		}
+		cut = vh.IsKeyFrame()
+	case pkt.IsAudio:
+		ah, ok := pkt.Header.(av.AudioPacketHeader)
+		if !ok {
+			return nil
+		}
+		if ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+			return sg.muxer.WritePacket(pkt)
+		}
+		cut = !sg.hasVideo
+	default:
+		return nil
+	}
+
+	// timestamps going back, e.g. an encoder restarts, end the segment as well
+	elapsed := time.Duration(int32(pkt.TimeStamp-sg.start)) * time.Millisecond
+	if cut && (sg.buf == nil || elapsed >= sg.hs.config.segmentDuration() || elapsed < 0) {
+		end := pkt.TimeStamp
+		if elapsed < 0 {
+			end = sg.end
+		}
+		if err := sg.endSegment(end); err != nil {
+			return err
+		}
+		sg.buf = new(bytes.Buffer)
+		sg.start = pkt.TimeStamp
+		sg.muxer.SetWriter(sg.buf)
+	}
+	if sg.buf == nil { // wait for the first key frame
+		return nil
+	}
+
+	sg.end = pkt.TimeStamp
+	return sg.muxer.WritePacket(pkt)
+}
+
+// sendStopStatus does nothing, the last segment is ended by finish after the subscriber stops
+func (sg *hlsSegmenter) sendStopStatus() {}
+
+func (sg *hlsSegmenter) duration(ts uint32) time.Duration {
+	if d := int32(ts - sg.start); d > 0 {
+		return time.Duration(d) * time.Millisecond
+	}
+	return 0
+}
+
+// endSegment adds the segment being written to the window, it ends at timestamp end
+func (sg *hlsSegmenter) endSegment(end uint32) error {
+	if sg.buf == nil || sg.buf.Len() == 0 {
+		return nil
+	}
+	err := sg.hs.addSegment(sg.duration(end), sg.buf.Bytes())
+	sg.buf = nil
+	return err
+}
+
+// finish ends the last segment of the publisher
+func (sg *hlsSegmenter) finish() {
+	if err := sg.endSegment(sg.end); err != nil {
+		sg.hs.logger.Error(err)
+	}
+	sg.hs.markDiscontinuity()
+}
+
+// findHLS returns the hls stream of a stream source, nil if not found
+func (srv *Server) findHLS(vhost, app, stream string) *hlsStream {
+	hs, _ := srv.findPackager(vhost, app, stream, packagerHLS).(*hlsStream)
+	return hs
+}
+
+// hlsQuery keeps the vhost and signed url parameters for media uris relative to the playlist
+func hlsQuery(r *http.Request) string {
+	query, kept := r.URL.Query(), url.Values{}
+	for _, k := range []string{"vhost", authParamExpire, authParamToken, authParamIP} {
+		if v := query.Get(k); v != "" {
+			kept.Set(k, v)
+		}
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	return "?" + kept.Encode()
+}
+
+func (srv *Server) serveHLSPlaylist(w http.ResponseWriter, r *http.Request) {
+	app, stream, ok := parseStreamPath(r.URL.Path, ".m3u8")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	vhost := httpVhost(r)
+	if !srv.checkHTTPPlay(w, r, vhost, app, stream) {
+		return
+	}
+	hs := srv.findHLS(vhost, app, stream)
+	if hs == nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, ok := hs.playlist(hlsQuery(r))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// serveHLSSegment serves /{app}/{stream}-{seq}.ts
+func (srv *Server) serveHLSSegment(w http.ResponseWriter, r *http.Request) {
+	app, name, ok := parseStreamPath(r.URL.Path, ".ts")
+	idx := strings.LastIndex(name, "-")
+	if !ok || idx <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	seq, err := strconv.ParseUint(name[idx+1:], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	vhost := httpVhost(r)
+	if !srv.checkHTTPPlay(w, r, vhost, app, name[:idx]) {
+		return
+	}
+	hs := srv.findHLS(vhost, app, name[:idx])
+	if hs == nil {
+		http.NotFound(w, r)
+		return
+	}
+	content, closeFn, ok := hs.openSegment(seq)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	defer closeFn()
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
@@ -0,0 +1,103 @@
+package rtmp
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHLSPlaylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, dir := range []string{"", dir} {
+		hs := newHLSStream(&HLSConfig{Window: 3, SegmentDuration: 2 * time.Second, Dir: dir}, defaultVhost, "live", "test", testLogger())
+		if _, ok := hs.playlist(""); ok {
+			t.Fatal("playlist without segments")
+		}
+
+		hs.markDiscontinuity() // nothing before the first segment
+		for i := 0; i < 5; i++ {
+			if i == 2 || i == 3 {
+				hs.markDiscontinuity()
+			}
+			if err := hs.addSegment(2*time.Second+time.Duration(i)*300*time.Millisecond, []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// segments 2, 3 and 4 are left, the discontinuities of 2 and 3 are still in the window
+		want := strings.Join([]string{
+			"#EXTM3U",
+			"#EXT-X-VERSION:3",
+			"#EXT-X-TARGETDURATION:4",
+			"#EXT-X-MEDIA-SEQUENCE:2",
+			"#EXT-X-DISCONTINUITY",
+			"#EXTINF:2.600,",
+			"test-2.ts?vhost=v",
+			"#EXT-X-DISCONTINUITY",
+			"#EXTINF:2.900,",
+			"test-3.ts?vhost=v",
+			"#EXTINF:3.200,",
+			"test-4.ts?vhost=v",
+		}, "\n") + "\n"
+		if got, _ := hs.playlist("?vhost=v"); string(got) != want {
+			t.Errorf("dir %q, playlist:\n%s\nwant:\n%s", dir, got, want)
+		}
+
+		if _, _, ok := hs.openSegment(1); ok {
+			t.Errorf("dir %q: segment 1 slid out but opened", dir)
+		}
+		r, done, ok := hs.openSegment(3)
+		if !ok {
+			t.Fatalf("dir %q: segment 3 not opened", dir)
+		}
+		b, _ := ioutil.ReadAll(r)
+		done()
+		if len(b) != 1 || b[0] != 3 {
+			t.Errorf("dir %q: segment 3 is % x", dir, b)
+		}
+
+		// the discontinuity sequence counts the tags slid out
+		if err := hs.addSegment(2*time.Second, []byte{5}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := hs.playlist(""); !strings.Contains(string(got), "#EXT-X-MEDIA-SEQUENCE:3\n#EXT-X-DISCONTINUITY-SEQUENCE:1\n#EXT-X-DISCONTINUITY\n#EXTINF:2.900,\ntest-3.ts\n") {
+			t.Errorf("dir %q, playlist after slide:\n%s", dir, got)
+		}
+
+		if dir != "" {
+			files, _ := filepath.Glob(filepath.Join(hs.dir, "*"))
+			if len(files) != 4 { // 3 segments and the playlist
+				t.Errorf("files left: %v", files)
+			}
+			hs.close()
+			if _, err := os.Stat(hs.dir); !os.IsNotExist(err) {
+				t.Errorf("dir left after close: %v", err)
+			}
+		}
+	}
+}
+
+func TestHLSQuery(t *testing.T) {
+	for _, c := range []struct {
+		url  string
+		want string
+	}{
+		{"/live/test.m3u8", ""},
+		{"/live/test.m3u8?foo=bar", ""},
+		{"/live/test.m3u8?vhost=example.com&foo=bar", "?vhost=example.com"},
+		{"/live/test.m3u8?token=ab&expire=100&ip=1.2.3.4&vhost=v", "?expire=100&ip=1.2.3.4&token=ab&vhost=v"},
+	} {
+		if got := hlsQuery(httptest.NewRequest("GET", c.url, nil)); got != c.want {
+			t.Errorf("%s: %q, want %q", c.url, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hookOnConnect   = "on_connect"
+	hookOnClose     = "on_close"
+	hookOnPublish   = "on_publish"
+	hookOnUnpublish = "on_unpublish"
+	hookOnPlay      = "on_play"
+	hookOnStop      = "on_stop"
+	hookOnDvr       = "on_dvr"
+
+	defaultHookTimeout = 3 * time.Second
+	maxHookRespSize    = 4096
+)
+
+// HookConfig holds SRS compatible http callbacks, every stage may have several urls called in order.
+// on_connect, on_publish and on_play refuse the client if any url responds a non-zero code,
+// the others are notifications and their responses are ignored.
+type HookConfig struct {
+	OnConnect   []string
+	OnClose     []string
+	OnPublish   []string
+	OnUnpublish []string
+	OnPlay      []string
+	OnStop      []string
+	OnDvr       []string // a recorded file is closed
+
+	Timeout  time.Duration // timeout of every request, default 3s
+	FailOpen bool          // allow the client when hook fails(network error, timeout or bad response)
+}
+
+func (hc *HookConfig) urls(action string) []string {
+	switch action {
+	case hookOnConnect:
+		return hc.OnConnect
+	case hookOnClose:
+		return hc.OnClose
+	case hookOnPublish:
+		return hc.OnPublish
+	case hookOnUnpublish:
+		return hc.OnUnpublish
+	case hookOnPlay:
+		return hc.OnPlay
+	case hookOnStop:
+		return hc.OnStop
+	case hookOnDvr:
+		return hc.OnDvr
+	}
+	return nil
+}
+
+func (hc *HookConfig) timeout() time.Duration {
+	if hc.Timeout > 0 {
+		return hc.Timeout
+	}
+	return defaultHookTimeout
+}
+
+// hookRequest is the json body posted to hook urls, same as SRS
+type hookRequest struct {
+	Action    string `json:"action"`
+	ClientID  string `json:"client_id"`
+	IP        string `json:"ip"`
+	Vhost     string `json:"vhost"`
+	App       string `json:"app"`
+	TcUrl     string `json:"tcUrl,omitempty"`
+	Stream    string `json:"stream,omitempty"`
+	Param     string `json:"param,omitempty"`
+	SendBytes uint64 `json:"send_bytes,omitempty"`
+	RecvBytes uint64 `json:"recv_bytes,omitempty"`
+	CWD       string `json:"cwd,omitempty"`
+	File      string `json:"file,omitempty"`
+}
+
+// hookResponse is the json body responded by hook urls, code 0 means allowed
+type hookResponse struct {
+	Code *int `json:"code"`
+}
+
+func (c *Conn) newHookRequest(action string) *hookRequest {
+	req := &hookRequest{
+		Action:   action,
+		ClientID: c.clientID,
+		IP:       c.remoteIP(),
+		Vhost:    c.vhost,
+		App:      c.appName,
+	}
+
+	switch action {
+	case hookOnConnect:
+		req.TcUrl = c.tcUrl
+	case hookOnClose:
+		req.SendBytes = c.bytesSent
+		req.RecvBytes = uint64(c.bytesRecvReset)<<32 + uint64(c.bytesRecv)
+	default:
+		req.Stream = c.streamName
+		if c.streamRawQuery != "" {
+			req.Param = "?" + c.streamRawQuery
+		} else if c.rawQuery != "" {
+			req.Param = "?" + c.rawQuery
+		}
+	}
+
+	return req
+}
+
+// callHook calls every url of action in order, the client is refused by the first non-zero code
+func (c *Conn) callHook(action string) error {
+	hc := c.config.Hooks
+	if hc == nil {
+		return nil
+	}
+
+	urls := hc.urls(action)
+	if len(urls) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(c.newHookRequest(action))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: hc.timeout()}
+	for _, u := range urls {
+		logger := c.logger.WithFields(logrus.Fields{"event": "http hook", "action": action, "url": u})
+
+		code, err := postHook(client, u, body)
+		if err != nil {
+			if hc.FailOpen {
+				logger.WithField("policy", "fail open").Warn(err)
+				continue
+			}
+			logger.WithField("policy", "fail closed").Error(err)
+			return errors.Wrapf(err, "%s hook failed", action)
+		}
+
+		if code != 0 {
+			logger.Infof("refused, code: %d", code)
+			return errors.Errorf("%s hook refused, code: %d", action, code)
+		}
+		logger.Trace("success")
+	}
+
+	return nil
+}
+
+// notifyHook calls urls of a notification action in background, responses are ignored
+func (c *Conn) notifyHook(action string) {
+	hc := c.config.Hooks
+	if hc == nil || len(hc.urls(action)) == 0 {
+		return
+	}
+
+	// build the request now, the connection fields may change after
+	c.postNotification(c.newHookRequest(action))
+}
+
+// notifyDvr calls on_dvr urls in background for a recorded file
+func (c *Conn) notifyDvr(cwd, file string) {
+	hc := c.config.Hooks
+	if hc == nil || len(hc.OnDvr) == 0 {
+		return
+	}
+
+	req := c.newHookRequest(hookOnDvr)
+	req.CWD, req.File = cwd, file
+	c.postNotification(req)
+}
+
+// postNotification posts req to urls of its action in background
+func (c *Conn) postNotification(req *hookRequest) {
+	hc := c.config.Hooks
+	action := req.Action
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{Timeout: hc.timeout()}
+	for _, u := range hc.urls(action) {
+		go func(u string) {
+			if _, err := postHook(client, u, body); err != nil {
+				c.logger.WithFields(logrus.Fields{"event": "http hook", "action": action, "url": u}).Error(err)
+			}
+		}(u)
+	}
+}
+
+// postHook posts body to url, the response is either a number or json like {"code": 0}
+func postHook(client *http.Client, url string, body []byte) (int, error) {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHookRespSize))
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("http status: %d", resp.StatusCode)
+	}
+
+	s := strings.TrimSpace(string(b))
+	if code, err := strconv.Atoi(s); err == nil {
+		return code, nil
+	}
+
+	var hr hookResponse
+	if err := json.Unmarshal(b, &hr); err != nil {
+		return 0, errors.Wrapf(err, "invalid response: '%s'", s)
+	}
+	if hr.Code == nil {
+		return 0, errors.Errorf("no code in response: '%s'", s)
+	}
+
+	return *hr.Code, nil
+}
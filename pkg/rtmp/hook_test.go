@@ -0,0 +1,131 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookServer answers hook requests by the path, the last body of every path is kept
+type hookServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies map[string]hookRequest
+}
+
+func startHookServer(t *testing.T) *hookServer {
+	hs := &hookServer{bodies: make(map[string]hookRequest)}
+	hs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req hookRequest
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &req); err != nil {
+			t.Errorf("hook body %s: %v", b, err)
+		}
+		hs.mu.Lock()
+		hs.bodies[r.URL.Path] = req
+		hs.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/allow":
+			fmt.Fprint(w, `{"code": 0}`)
+		case "/number":
+			fmt.Fprint(w, "0")
+		case "/refuse":
+			fmt.Fprint(w, `{"code": 403}`)
+		case "/error":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+			fmt.Fprint(w, "0")
+		case "/nocode":
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+func (hs *hookServer) body(path string) (hookRequest, bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	req, ok := hs.bodies[path]
+	return req, ok
+}
+
+func TestCallHook(t *testing.T) {
+	hs := startHookServer(t)
+	newConn := func(failOpen bool, urls ...string) *Conn {
+		for i, u := range urls {
+			urls[i] = hs.URL + u
+		}
+		return &Conn{
+			config:         &Config{Hooks: &HookConfig{OnPublish: urls, Timeout: 200 * time.Millisecond, FailOpen: failOpen}},
+			logger:         testLogger(),
+			clientID:       "client",
+			httpRemoteAddr: "10.0.0.1:50000",
+			vhost:          defaultVhost,
+			appName:        "live",
+			streamName:     "test",
+			rawQuery:       "token=ab",
+		}
+	}
+
+	for _, c := range []struct {
+		name     string
+		urls     []string
+		failOpen bool
+		ok       bool
+	}{
+		{"allowed", []string{"/allow", "/number"}, false, true},
+		{"refused", []string{"/allow", "/refuse"}, false, false},
+		{"refused fail open", []string{"/refuse"}, true, false}, // a code is not a failure
+		{"5xx fail closed", []string{"/error"}, false, false},
+		{"5xx fail open", []string{"/error", "/allow"}, true, true},
+		{"timeout fail closed", []string{"/slow"}, false, false},
+		{"timeout fail open", []string{"/slow"}, true, true},
+		{"no code fail closed", []string{"/nocode"}, false, false},
+	} {
+		if err := newConn(c.failOpen, c.urls...).callHook(hookOnPublish); (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+
+	want := hookRequest{Action: hookOnPublish, ClientID: "client", IP: "10.0.0.1", Vhost: defaultVhost, App: "live", Stream: "test", Param: "?token=ab"}
+	if got, ok := hs.body("/allow"); !ok || got != want {
+		t.Errorf("body %+v, want %+v", got, want)
+	}
+}
+
+func TestHookRefuse(t *testing.T) {
+	hs := startHookServer(t)
+	_, addr := startServer(t, &Config{Hooks: &HookConfig{
+		OnPublish: []string{hs.URL + "/refuse"},
+		OnPlay:    []string{hs.URL + "/refuse"},
+	}})
+	url := "rtmp://" + addr + "/live/test"
+
+	for _, publish := range []bool{true, false} {
+		c, err := Dial(url, &Config{Logger: testLogger()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		if publish {
+			err = c.Publish()
+		} else {
+			err = c.Play()
+		}
+		c.Close()
+		if err == nil {
+			t.Errorf("publish %v: not refused", publish)
+		}
+	}
+	if req, ok := hs.body("/refuse"); !ok || req.Action != hookOnPlay || req.Stream != "test" || req.IP != "127.0.0.1" {
+		t.Errorf("on_play body %+v", req)
+	}
+}
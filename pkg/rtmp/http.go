@@ -0,0 +1,176 @@
+package rtmp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"playground/internal/websocket"
+)
+
+// HTTPConfig holds the options of http playback
+type HTTPConfig struct {
+	AllowOrigin string // Access-Control-Allow-Origin of responses, e.g. "*", empty sends no CORS header
+}
+
+// ListenAndServeHTTP serves http playback of the server's streams on addr,
+// it returns ErrServerClosed after Shutdown.
+func (srv *Server) ListenAndServeHTTP(addr string) error {
+	hs := srv.newHTTPServer(addr)
+	if !srv.trackHTTPServer(hs, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackHTTPServer(hs, false)
+
+	if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+		srv.Config().Logger.WithField("event", "ListenAndServeHTTP").Error(err)
+		return err
+	}
+	return ErrServerClosed
+}
+
+// httpConnKey is the context key of the connection of a request served by ListenAndServeHTTP
+type httpConnKey struct{}
+
+// newHTTPServer returns the http server of ListenAndServeHTTP, the connection of a request is in
+// its context, so HTTP-FLV sets a write deadline per tag
+func (srv *Server) newHTTPServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:    addr,
+		Handler: srv,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnKey{}, c)
+		},
+	}
+}
+
+// ServeHTTP serves http playback:
+//
+//	GET /{app}/{stream}.flv           HTTP-FLV, or WebSocket-FLV if upgraded to websocket
+//	GET /{app}/{stream}.m3u8          HLS playlist, if HLS is enabled
+//	GET /{app}/{stream}-{seq}.ts      HLS segment
+//	GET /{app}/{stream}/llhls.m3u8    LL-HLS playlist, if LLHLS is enabled
+//	GET /{app}/{stream}/*.mp4|*.m4s   LL-HLS init segments, segments and parts
+//	GET /{app}/{stream}.mpd           MPEG-DASH manifest, if DASH is enabled
+//	GET /{app}/{stream}/dash-*        MPEG-DASH init and media segments
+//
+// The vhost is the host of request, or the "vhost" query parameter if the host is an ip.
+// HTTP-FLV and WebSocket-FLV players are authorized as rtmp players by the signed url in the
+// query, the disabled keys and on_play hook, and refused with 403. Every request of HLS, LL-HLS
+// and MPEG-DASH is checked the same except the hook, the query is kept in their media uris.
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := srv.Config()
+	if hc := config.HTTP; hc != nil && hc.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", hc.AllowOrigin)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, ".flv") && websocket.IsUpgrade(r):
+		srv.serveWSFLV(w, r, config)
+	case strings.HasSuffix(r.URL.Path, ".flv"):
+		srv.serveFLV(w, r, config)
+	case strings.HasSuffix(r.URL.Path, ".mpd"):
+		srv.serveDASHManifest(w, r)
+	case strings.HasPrefix(path.Base(r.URL.Path), "dash-"):
+		srv.serveDASHMedia(w, r)
+	case strings.HasSuffix(r.URL.Path, "/llhls.m3u8"), strings.HasSuffix(r.URL.Path, ".mp4"), strings.HasSuffix(r.URL.Path, ".m4s"):
+		srv.serveLLHLS(w, r)
+	case strings.HasSuffix(r.URL.Path, ".m3u8"):
+		srv.serveHLSPlaylist(w, r)
+	case strings.HasSuffix(r.URL.Path, ".ts"):
+		srv.serveHLSSegment(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newHTTPPlayer returns the Conn of a http player, which is authorized and reported to hooks as
+// a rtmp player, the query of r is its tcUrl query
+func (srv *Server) newHTTPPlayer(r *http.Request, config *Config, vhost, app, stream string) *Conn {
+	return &Conn{
+		server:         srv,
+		ssMgr:          srv.ssMgr,
+		config:         config,
+		logger:         config.Logger,
+		clientID:       genUuid(),
+		httpRemoteAddr: r.RemoteAddr,
+		vhost:          vhost,
+		appName:        app,
+		streamName:     stream,
+		streamKey:      genStreamKey(vhost, app, stream),
+		rawQuery:       r.URL.RawQuery,
+		urlValues:      r.URL.Query(),
+	}
+}
+
+// checkHTTPPlay refuses a request of hls or dash by checkPlay with 403, on_play hook is not
+// called as the requests of a player are not a session
+func (srv *Server) checkHTTPPlay(w http.ResponseWriter, r *http.Request, vhost, app, stream string) bool {
+	config := srv.Config()
+	c := srv.newHTTPPlayer(r, config, vhost, app, stream)
+	if err := c.checkPlay(); err != nil {
+		config.Logger.WithFields(logrus.Fields{"event": "http play", "remote": r.RemoteAddr, "streamKey": c.streamKey}).Warn(err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// parseStreamPath splits /{app}/{stream}{ext} into app and stream
+func parseStreamPath(path, ext string) (app, stream string, ok bool) {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "/"), ext)
+
+	idx := strings.LastIndex(path, "/")
+	if idx <= 0 || idx == len(path)-1 {
+		return "", "", false
+	}
+	return path[:idx], path[idx+1:], true
+}
+
+// httpVhost returns the vhost of r in the same way as the tcUrl of rtmp
+func httpVhost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	if host == "" || net.ParseIP(host) != nil {
+		if v := r.URL.Query().Get("vhost"); v != "" {
+			return v
+		}
+		return defaultVhost
+	}
+	return host
+}
+
+func (srv *Server) trackHTTPServer(hs *http.Server, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.httpServers == nil {
+		srv.httpServers = make(map[*http.Server]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.httpServers[hs] = struct{}{}
+	} else {
+		delete(srv.httpServers, hs)
+	}
+	return true
+}
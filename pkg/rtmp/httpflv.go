@@ -0,0 +1,119 @@
+package rtmp
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+// httpFLVWriteTimeout ends the play of a client not reading a tag for this long
+var httpFLVWriteTimeout = 10 * time.Second
+
+// serveFLV plays a stream as HTTP-FLV: the file header, then metadata, sequence headers and
+// gop cache, then live tags, sent by chunked transfer until the stream stops or the client leaves.
+// Stalled clients are dropped by the write deadline if served by ListenAndServeHTTP, otherwise
+// by the WriteTimeout of the http server.
+func (srv *Server) serveFLV(w http.ResponseWriter, r *http.Request, config *Config) {
+	app, stream, ok := parseStreamPath(r.URL.Path, ".flv")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	vhost := httpVhost(r)
+
+	logger := config.Logger.WithFields(logrus.Fields{"event": "http-flv", "remote": r.RemoteAddr, "streamKey": genStreamKey(vhost, app, stream)})
+
+	if r.Method == http.MethodHead { // not a player, nor an edge pull
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := srv.newHTTPPlayer(r, config, vhost, app, stream)
+	if _, err := c.authorizePlay(); err != nil {
+		logger.Warn(err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	ss, err := srv.lookupStream(config, vhost, app, stream)
+	if err != nil {
+		logger.Error(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	conn, _ := r.Context().Value(httpConnKey{}).(net.Conn)
+	if conn != nil {
+		defer conn.SetWriteDeadline(time.Time{}) // the connection may be kept alive
+	}
+	sink := &flvSink{w: flv.NewWriter(w), flusher: flusher, conn: conn}
+	sink.setWriteDeadline()
+	if err := sink.w.WriteHeader(ss.tracks()); err != nil { // flv.js creates decoders by the flags
+		logger.Error(err)
+		return
+	}
+	flusher.Flush()
+
+	sub := newSinkSubscriber("http-flv:"+r.RemoteAddr, sink, config.Logger, config.subscriberQueueSize())
+	if !ss.addSubscriber(sub) {
+		logger.Error("stream closed or already subscribe")
+		return
+	}
+	defer c.notifyHook(hookOnStop)
+	defer ss.delSubscriber(sub)
+
+	// stop at once when the client leaves, not at the next failed write
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			sub.leave()
+		case <-done:
+		}
+	}()
+
+	logger.Trace("start")
+	err = ss.doPlaying(sub)
+	logger.Tracef("stop: %v", err)
+}
+
+// flvSink writes the packets of a subscriber as flv tags of a http response
+type flvSink struct {
+	w       *flv.Writer
+	flusher http.Flusher
+	conn    net.Conn // of the response, nil if unknown
+}
+
+func (fs *flvSink) setWriteDeadline() {
+	if fs.conn != nil {
+		_ = fs.conn.SetWriteDeadline(time.Now().Add(httpFLVWriteTimeout))
+	}
+}
+
+func (fs *flvSink) sendAVPacket(pkt *av.Packet) error {
+	fs.setWriteDeadline()
+	if err := fs.w.WritePacket(pkt); err != nil {
+		return err
+	}
+	fs.flusher.Flush()
+	return nil
+}
+
+// sendStopStatus does nothing, the response ends after the subscriber stops
+func (fs *flvSink) sendStopStatus() {}
@@ -0,0 +1,132 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+// startHTTPServer serves the http playback of srv on a random local port until the test ends
+func startHTTPServer(t *testing.T, srv *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := srv.newHTTPServer("")
+	go hs.Serve(l)
+	t.Cleanup(func() { hs.Close() })
+	return l.Addr().String()
+}
+
+func TestHTTPFLV(t *testing.T) {
+	srv, addr := startServer(t, &Config{Auth: &AuthConfig{Secrets: map[string]string{defaultVhost + "/secure": "s3cret"}}})
+	httpAddr := startHTTPServer(t, srv)
+	pub := dialPublish(t, "rtmp://"+addr+"/live/test", &Config{})
+	defer pub.Close()
+	pkts := testPackets(t)
+	if err := pub.WritePacket(pkts[0]); err != nil { // metadata tells the tracks
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodHead, "/live/test.flv", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/secure/test.flv", http.StatusForbidden},
+		{http.MethodGet, "/live/none.flv", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(c.method, "http://"+httpAddr+c.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %s: %s, want %d", c.method, c.path, resp.Status, c.status)
+		}
+	}
+
+	val, _ := srv.ssMgr.streamMap.Load(genStreamKey(defaultVhost, "live", "test"))
+	ss := val.(*streamSource)
+	waitFor(t, "metadata", func() bool {
+		audio, video := ss.tracks()
+		return !audio && video
+	})
+	resp, err := http.Get("http://" + httpAddr + "/live/test.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "video/x-flv" {
+		t.Fatalf("get: %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	r := flv.NewReader(resp.Body)
+	if hasAudio, hasVideo, err := r.ReadHeader(); err != nil || hasAudio || !hasVideo {
+		t.Fatalf("flv header: audio %v video %v, %v", hasAudio, hasVideo, err)
+	}
+
+	waitFor(t, "http-flv player", func() bool { return ss.numSubscribers() == 1 })
+	for _, pkt := range pkts[1:] {
+		if err := pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []*av.Packet
+	for len(got) < len(pkts)-1 {
+		pkt, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pkt.IsMetaData {
+			got = append(got, pkt)
+		}
+	}
+	for i, pkt := range got {
+		if w := pkts[i+1]; pkt.TimeStamp != w.TimeStamp || !bytes.Equal(pkt.Data, w.Data) {
+			t.Errorf("packet %d: %+v, want %+v", i, pkt, w)
+		}
+	}
+}
+
+func TestHTTPFLVStalled(t *testing.T) {
+	defer func(d time.Duration) { httpFLVWriteTimeout = d }(httpFLVWriteTimeout)
+	httpFLVWriteTimeout = 200 * time.Millisecond
+
+	srv, addr := startServer(t, &Config{})
+	httpAddr := startHTTPServer(t, srv)
+	pub := dialPublish(t, "rtmp://"+addr+"/live/test", &Config{})
+	defer pub.Close()
+	for _, pkt := range testPackets(t) {
+		if err := pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the client never reads the response
+	c, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET /live/test.flv HTTP/1.1\r\nHost: %s\r\n\r\n", httpAddr)
+
+	val, _ := srv.ssMgr.streamMap.Load(genStreamKey(defaultVhost, "live", "test"))
+	ss := val.(*streamSource)
+	waitFor(t, "http-flv player", func() bool { return ss.numSubscribers() == 1 })
+	frame := append([]byte{0, 0, 0, 1, 0x41}, make([]byte, 256<<10)...)
+	ts := uint32(80)
+	waitFor(t, "stalled player dropped", func() bool {
+		if err := pub.WritePacket(flv.NewVideoPacket(ts, av.INTER_FRAME, av.VIDEO_H264, av.AVC_NALU, 0, frame)); err != nil {
+			t.Fatal(err)
+		}
+		ts += 40
+		return ss.numSubscribers() == 0
+	})
+}
@@ -0,0 +1,552 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/fmp4"
+)
+
+const (
+	defaultLLHLSPartDuration    = 500 * time.Millisecond
+	defaultLLHLSSegmentDuration = 2 * time.Second
+	defaultLLHLSWindow          = 6
+	llhlsPartSegments           = 3 // the latest segments whose parts are in the playlist
+)
+
+// LLHLSConfig enables Low-Latency HLS of fMP4 (CMAF) segments and partial segments for the
+// streams published to the server, served by the http playback of Server.ListenAndServeHTTP.
+//
+// Partial segments are cut at video samples not to exceed PartDuration, segments at the first
+// key frame after SegmentDuration. Playlist requests with _HLS_msn and _HLS_part are blocked
+// until the requested part is ready, so is the request of the part in the preload hint.
+type LLHLSConfig struct {
+	PartDuration    time.Duration // default 500ms
+	SegmentDuration time.Duration // default 2s
+	Window          int           // segments in the playlist, default 6
+}
+
+func (lc *LLHLSConfig) partDuration() time.Duration {
+	if lc.PartDuration > 0 {
+		return lc.PartDuration
+	}
+	return defaultLLHLSPartDuration
+}
+
+func (lc *LLHLSConfig) segmentDuration() time.Duration {
+	if lc.SegmentDuration > 0 {
+		return lc.SegmentDuration
+	}
+	return defaultLLHLSSegmentDuration
+}
+
+func (lc *LLHLSConfig) window() int {
+	if lc.Window > 0 {
+		return lc.Window
+	}
+	return defaultLLHLSWindow
+}
+
+type llhlsPart struct {
+	duration    time.Duration
+	independent bool // starts with a key frame
+	data        []byte
+}
+
+type llhlsSegment struct {
+	msn           uint64
+	init          int  // id of the init segment
+	discontinuity bool // first segment after a republish
+	parts         []*llhlsPart
+	complete      bool
+	duration      time.Duration // of complete segment
+	data          []byte        // of complete segment
+}
+
+// llhlsStream is the window of fMP4 segments and parts of a stream source
+type llhlsStream struct {
+	config *LLHLSConfig
+
+	mu             sync.Mutex
+	inits          map[int][]byte
+	initID         int // of the segments to start
+	segments       []*llhlsSegment
+	nextMSN        uint64
+	discSeq        uint64
+	targetDuration int
+	discontinuity  bool
+	closed         bool
+	updated        chan struct{} // closed and replaced when a part is added
+}
+
+func newLLHLSStream(config *LLHLSConfig) *llhlsStream {
+	return &llhlsStream{
+		config:         config,
+		inits:          make(map[int][]byte),
+		targetDuration: int(math.Ceil(config.segmentDuration().Seconds())),
+		updated:        make(chan struct{}),
+	}
+}
+
+func (ls *llhlsStream) newSegmenter(*Conn) segmenter {
+	return &llhlsSegmenter{ls: ls}
+}
+
+// setInit sets the init segment of the segments to start
+func (ls *llhlsStream) setInit(init []byte) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ls.initID++
+	ls.inits[ls.initID] = init
+}
+
+// addPart appends a part to the open segment, or to a new one if newSegment
+func (ls *llhlsStream) addPart(part *llhlsPart, newSegment bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.closed {
+		return
+	}
+
+	open := ls.openSegment()
+	if open == nil || newSegment {
+		ls.completeSegment()
+		open = &llhlsSegment{msn: ls.nextMSN, init: ls.initID, discontinuity: ls.discontinuity}
+		ls.nextMSN++
+		ls.discontinuity = false
+		ls.segments = append(ls.segments, open)
+		ls.evict()
+	}
+	open.parts = append(open.parts, part)
+
+	ls.notify()
+}
+
+// endSegment completes the open segment, the publisher is gone
+func (ls *llhlsStream) endSegment() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ls.completeSegment()
+	ls.discontinuity = ls.nextMSN > 0
+	ls.notify()
+}
+
+func (ls *llhlsStream) openSegment() *llhlsSegment {
+	if n := len(ls.segments); n > 0 && !ls.segments[n-1].complete {
+		return ls.segments[n-1]
+	}
+	return nil
+}
+
+func (ls *llhlsStream) completeSegment() {
+	seg := ls.openSegment()
+	if seg == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, p := range seg.parts {
+		seg.duration += p.duration
+		buf.Write(p.data)
+	}
+	seg.data = buf.Bytes()
+	seg.complete = true
+
+	if d := int(math.Ceil(seg.duration.Seconds())); d > ls.targetDuration {
+		ls.targetDuration = d
+	}
+}
+
+// evict drops the oldest segments out of the window, the parts of old segments and the init
+// segments no longer used
+func (ls *llhlsStream) evict() {
+	for len(ls.segments) > ls.config.window()+1 { // and the open one
+		if ls.segments[0].discontinuity {
+			ls.discSeq++
+		}
+		ls.segments[0] = nil
+		ls.segments = ls.segments[1:]
+	}
+
+	if n := len(ls.segments) - llhlsPartSegments; n > 0 {
+		ls.segments[n-1].parts = nil
+	}
+
+	for id := range ls.inits {
+		if id < ls.segments[0].init {
+			delete(ls.inits, id)
+		}
+	}
+}
+
+func (ls *llhlsStream) notify() {
+	close(ls.updated)
+	ls.updated = make(chan struct{})
+}
+
+// wait blocks until ready returns true under lock, false on timeout or ctx done
+func (ls *llhlsStream) wait(ctx context.Context, timeout time.Duration, ready func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		ls.mu.Lock()
+		ok, closed, updated := ready(), ls.closed, ls.updated
+		ls.mu.Unlock()
+		if ok {
+			return true
+		}
+		if closed {
+			return false
+		}
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// hasPart reports whether part of segment msn is available, the whole segment if part < 0
+func (ls *llhlsStream) hasPart(msn uint64, part int) bool {
+	for _, seg := range ls.segments {
+		if seg.msn == msn {
+			return seg.complete || (part >= 0 && part < len(seg.parts))
+		}
+	}
+	return len(ls.segments) > 0 && msn < ls.segments[0].msn
+}
+
+// blockTimeout is how long a blocking request waits, three target durations
+func (ls *llhlsStream) blockTimeout() time.Duration {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return 3 * time.Duration(ls.targetDuration) * time.Second
+}
+
+func (ls *llhlsStream) renderPlaylist(query string) ([]byte, bool) {
+	if len(ls.segments) == 0 {
+		return nil, false
+	}
+
+	partTarget := ls.config.partDuration().Seconds()
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", ls.targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", ls.segments[0].msn)
+	if ls.discSeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", ls.discSeq)
+	}
+
+	for i, seg := range ls.segments {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if i == 0 || seg.init != ls.segments[i-1].init {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%d.mp4%s\"\n", seg.init, query)
+		}
+		for j, p := range seg.parts {
+			fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"part-%d-%d.m4s%s\"", p.duration.Seconds(), seg.msn, j, query)
+			if p.independent {
+				b.WriteString(",INDEPENDENT=YES")
+			}
+			b.WriteString("\n")
+		}
+		if seg.complete {
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg-%d.m4s%s\n", seg.duration.Seconds(), seg.msn, query)
+		}
+	}
+
+	msn, part := ls.nextMSN, 0
+	if open := ls.openSegment(); open != nil {
+		msn, part = open.msn, len(open.parts)
+	}
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-%d-%d.m4s%s\"\n", msn, part, query)
+
+	return b.Bytes(), true
+}
+
+func (ls *llhlsStream) close() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ls.closed = true
+	ls.segments = nil
+	ls.inits = nil
+	ls.notify()
+}
+
+// llhlsSegmenter cuts the packets of one publisher into parts of a llhlsStream, every part
+// is a moof and mdat of both tracks
+type llhlsSegmenter struct {
+	fmp4Tracks
+	ls *llhlsStream
+
+	started      bool // a part is being filled, after the first key frame
+	newSegment   bool // the part being filled starts a segment
+	independent  bool
+	segmentStart uint32
+	partStart    uint32
+	seq          uint32 // fragment sequence number
+}
+
+func (sg *llhlsSegmenter) sendAVPacket(pkt *av.Packet) error {
+	t, keyFrame, err := sg.media(pkt)
+	if t == nil || err != nil {
+		return err
+	}
+
+	if t != sg.clock() {
+		if sg.started {
+			t.push(pkt)
+		}
+		return nil
+	}
+	if !sg.started && !keyFrame {
+		return nil
+	}
+	t.push(pkt)
+	sg.cut(pkt, keyFrame)
+	return nil
+}
+
+// cut ends the part being filled before pkt of the clock track, if pkt starts a new segment
+// or the part would exceed the part target. pkt is pending already, so the samples done are
+// all before it.
+func (sg *llhlsSegmenter) cut(pkt *av.Packet, keyFrame bool) {
+	config := sg.ls.config
+
+	segElapsed := time.Duration(int32(pkt.TimeStamp-sg.segmentStart)) * time.Millisecond
+	newSegment := keyFrame && (!sg.started || sg.changed || segElapsed >= config.segmentDuration() || segElapsed < 0)
+
+	partElapsed := time.Duration(int32(pkt.TimeStamp-sg.partStart)) * time.Millisecond
+	next := time.Duration(sg.clock().delta) * time.Millisecond
+	if !newSegment && (!sg.started || partElapsed+next <= config.partDuration()) {
+		return
+	}
+
+	sg.flushPart()
+
+	if newSegment && sg.changed {
+		var tracks []*fmp4.Track
+		for _, t := range sg.all() {
+			tracks = append(tracks, t.track)
+		}
+		sg.ls.setInit(fmp4.InitSegment(tracks...))
+		sg.changed = false
+	}
+
+	sg.started = true
+	sg.newSegment = newSegment
+	sg.independent = keyFrame
+	sg.partStart = pkt.TimeStamp
+	if newSegment {
+		sg.segmentStart = pkt.TimeStamp
+	}
+}
+
+// flushPart adds the done samples as a part
+func (sg *llhlsSegmenter) flushPart() {
+	var frags []fmp4.TrackFragment
+	var duration uint32
+	for _, t := range sg.all() {
+		if len(t.samples) == 0 {
+			continue
+		}
+		if len(frags) == 0 { // the clock track
+			duration = t.duration()
+		}
+		frags = append(frags, t.fragment())
+	}
+	if len(frags) == 0 {
+		return
+	}
+
+	sg.seq++
+	sg.ls.addPart(&llhlsPart{
+		duration:    time.Duration(duration) * time.Millisecond,
+		independent: sg.independent,
+		data:        fmp4.Fragment(sg.seq, frags...),
+	}, sg.newSegment)
+	sg.newSegment = false
+	sg.independent = false
+}
+
+// sendStopStatus does nothing, the last part is added by finish after the subscriber stops
+func (sg *llhlsSegmenter) sendStopStatus() {}
+
+func (sg *llhlsSegmenter) finish() {
+	if sg.started {
+		sg.addPending()
+	}
+	sg.flushPart()
+	sg.ls.endSegment()
+}
+
+func (srv *Server) findLLHLS(vhost, app, stream string) *llhlsStream {
+	ls, _ := srv.findPackager(vhost, app, stream, packagerLLHLS).(*llhlsStream)
+	return ls
+}
+
+// serveLLHLS serves the files of /{app}/{stream}/
+func (srv *Server) serveLLHLS(w http.ResponseWriter, r *http.Request) {
+	idx := strings.LastIndex(r.URL.Path, "/")
+	dir, file := r.URL.Path[:idx], r.URL.Path[idx+1:]
+	app, stream, ok := parseStreamPath(dir, "")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	vhost := httpVhost(r)
+	if !srv.checkHTTPPlay(w, r, vhost, app, stream) {
+		return
+	}
+	ls := srv.findLLHLS(vhost, app, stream)
+	if ls == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if file == "llhls.m3u8" {
+		ls.servePlaylist(w, r)
+		return
+	}
+
+	if v, ok := parseMediaName(file, "init", ".mp4", 1); ok {
+		ls.mu.Lock()
+		init, ok := ls.inits[int(v[0])]
+		ls.mu.Unlock()
+		serveMedia(w, r, init, ok)
+	} else if v, ok := parseMediaName(file, "seg", ".m4s", 1); ok {
+		var data []byte
+		ls.mu.Lock()
+		for _, seg := range ls.segments {
+			if seg.msn == v[0] && seg.complete {
+				data = seg.data
+			}
+		}
+		ls.mu.Unlock()
+		serveMedia(w, r, data, data != nil)
+	} else if v, ok := parseMediaName(file, "part", ".m4s", 2); ok {
+		ls.servePart(w, r, v[0], int(v[1]))
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// parseMediaName returns the n numbers of file name like {prefix}-1-2{ext}
+func parseMediaName(name, prefix, ext string, n int) ([]uint64, bool) {
+	if !strings.HasPrefix(name, prefix+"-") || !strings.HasSuffix(name, ext) {
+		return nil, false
+	}
+	fields := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, prefix+"-"), ext), "-")
+	if len(fields) != n {
+		return nil, false
+	}
+
+	nums := make([]uint64, n)
+	for i, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, false
+		}
+		nums[i] = v
+	}
+	return nums, true
+}
+
+func serveMedia(w http.ResponseWriter, r *http.Request, data []byte, ok bool) {
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// servePlaylist serves the playlist, blocked by _HLS_msn and _HLS_part until it has the part
+func (ls *llhlsStream) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if v := query.Get("_HLS_msn"); v != "" {
+		msn, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		part := -1
+		if v := query.Get("_HLS_part"); v != "" {
+			if part, err = strconv.Atoi(v); err != nil || part < 0 {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+
+		ls.mu.Lock()
+		tooFar := msn > ls.nextMSN+1
+		ls.mu.Unlock()
+		if tooFar {
+			http.Error(w, "_HLS_msn is too far in the future", http.StatusBadRequest)
+			return
+		}
+
+		if !ls.wait(r.Context(), ls.blockTimeout(), func() bool { return ls.hasPart(msn, part) }) {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	ls.mu.Lock()
+	body, ok := ls.renderPlaylist(hlsQuery(r))
+	ls.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// servePart serves a part, the next one of the preload hint is waited for
+func (ls *llhlsStream) servePart(w http.ResponseWriter, r *http.Request, msn uint64, part int) {
+	find := func() []byte {
+		for _, seg := range ls.segments {
+			if seg.msn == msn && part < len(seg.parts) {
+				return seg.parts[part].data
+			}
+		}
+		return nil
+	}
+
+	ls.mu.Lock()
+	data := find()
+	hinted := data == nil && msn+1 >= ls.nextMSN // the open segment or the next one
+	ls.mu.Unlock()
+
+	if hinted {
+		ls.wait(r.Context(), ls.blockTimeout(), func() bool {
+			data = find()
+			return data != nil
+		})
+	}
+	serveMedia(w, r, data, data != nil)
+}
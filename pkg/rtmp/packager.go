@@ -0,0 +1,138 @@
+package rtmp
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// names of packagers, also the subscriber id of their segmenters
+const (
+	packagerHLS   = "hls"
+	packagerLLHLS = "llhls"
+	packagerDASH  = "dash"
+	packagerDVR   = "dvr"
+)
+
+// segmenter cuts the packets of one publisher for a packager
+type segmenter interface {
+	avSink
+	finish() // the publisher is gone, end the last segment
+}
+
+// packager makes a stream source into segments of a http streaming format, e.g. HLS, or into
+// recorded files. It lives as long as the stream source, so sequence numbers go on across
+// republish, and is fed by a segmenter subscribing the stream source for every publisher.
+type packager interface {
+	newSegmenter(c *Conn) segmenter // for the publisher c
+	close()                         // the stream source is gone, drop everything
+}
+
+type packagerSlot struct {
+	pkg  packager
+	sub  *subscriber   // segmenter of the current publisher
+	done chan struct{} // closed when sub quits
+}
+
+// startPackagers starts the packagers enabled for the publisher connection
+func (ss *streamSource) startPackagers(c *Conn) {
+	config := c.config
+	if hc := config.HLS; hc != nil {
+		ss.startPackager(packagerHLS, c, func() packager {
+			return newHLSStream(hc, c.vhost, c.appName, c.streamName, config.Logger)
+		})
+	}
+	if lc := config.LLHLS; lc != nil {
+		ss.startPackager(packagerLLHLS, c, func() packager {
+			return newLLHLSStream(lc)
+		})
+	}
+	if dc := config.DASH; dc != nil {
+		ss.startPackager(packagerDASH, c, func() packager {
+			return newDASHStream(dc)
+		})
+	}
+	if dc := config.DVR; dc != nil && dc.template(c.vhost, c.appName) != "" {
+		ss.startPackager(packagerDVR, c, func() packager {
+			return &dvrRecorder{config: dc}
+		})
+	}
+}
+
+func (ss *streamSource) startPackager(name string, c *Conn, newPackager func() packager) {
+	ss.pkgMux.Lock()
+	defer ss.pkgMux.Unlock()
+
+	logger := c.config.Logger.WithFields(logrus.Fields{"event": name, "streamKey": ss.streamKey})
+
+	if ss.packagers == nil {
+		ss.packagers = make(map[string]*packagerSlot)
+	}
+	slot, republish := ss.packagers[name]
+	if !republish {
+		slot = &packagerSlot{pkg: newPackager()}
+		ss.packagers[name] = slot
+	}
+
+	sg := slot.pkg.newSegmenter(c)
+	sub := newSinkSubscriber(name, sg, c.config.Logger, c.config.subscriberQueueSize())
+	sub.initCache = republish // the cache holds the last publisher's gop, which is packaged already
+	sub.drain = true
+	sub.lossless = name == packagerDVR // a recording misses nothing, the publisher waits for it instead
+	if !ss.addSubscriber(sub) {
+		logger.Error("stream closed or already subscribe")
+		return
+	}
+
+	done := make(chan struct{})
+	slot.sub, slot.done = sub, done
+	go func() {
+		defer close(done)
+		defer ss.delSubscriber(sub)
+
+		err := sub.playingCycle(ss)
+		sub.leave() // a publisher waiting for room in the queue of a failed segmenter goes on
+		sg.finish()
+		logger.Tracef("stop: %v", err)
+	}()
+}
+
+// stopPackagers stops the segmenters of the publisher and waits for their last segments
+func (ss *streamSource) stopPackagers() {
+	ss.pkgMux.Lock()
+	defer ss.pkgMux.Unlock()
+
+	for _, slot := range ss.packagers {
+		if slot.sub == nil {
+			continue
+		}
+		slot.sub.stop()
+		<-slot.done
+		slot.sub, slot.done = nil, nil
+	}
+}
+
+// closePackagers drops the segments once the stream source is gone
+func (ss *streamSource) closePackagers() {
+	ss.pkgMux.Lock()
+	defer ss.pkgMux.Unlock()
+
+	for _, slot := range ss.packagers {
+		slot.pkg.close()
+	}
+}
+
+// findPackager returns the packager of a stream, nil if not found
+func (srv *Server) findPackager(vhost, app, stream, name string) packager {
+	val, ok := srv.ssMgr.streamMap.Load(genStreamKey(vhost, app, stream))
+	if !ok {
+		return nil
+	}
+
+	ss := val.(*streamSource)
+	ss.pkgMux.Lock()
+	defer ss.pkgMux.Unlock()
+
+	if slot, ok := ss.packagers[name]; ok {
+		return slot.pkg
+	}
+	return nil
+}
@@ -2,10 +2,15 @@ package rtmp
 
 import (
 	//"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"playground/pkg/av"
+	"playground/pkg/av/aac"
+	"playground/pkg/av/h264"
 	"playground/pkg/flv"
 )
 
@@ -15,6 +20,11 @@ type publisher struct {
 
 	demuxer *flv.Demuxer
 	logger  *logrus.Logger
+
+	startTime  time.Time
+	kick       func()       // stops publishing, closes the connection by default
+	videoCodec atomic.Value // string, FourCC of the video
+	audioCodec atomic.Value // string, FourCC of the audio
 }
 
 func newPublisher(c *Conn, streamKey string) *publisher {
@@ -23,18 +33,24 @@ func newPublisher(c *Conn, streamKey string) *publisher {
 		streamKey: streamKey,
 		demuxer:   flv.NewDemuxer(),
 		logger:    c.logger,
+		startTime: time.Now(),
+		kick:      func() { _ = c.Close() },
 	}
 
 	return p
 }
 
 func (p *publisher) publishingCycle(ss *streamSource) error {
-	// start to recv av data
+	// start to recv av data, the deadline is extended by media only
+	p.rtmpConn.setIdleDeadline(true)
 loopRecvAVChunkStream:
 	for {
 		cs, err := p.rtmpConn.readChunkStream(p.rtmpConn.basicHdrBuf)
 		if err != nil {
 			p.logger.WithField("event", "recv av chunk stream").Error(err)
+			if isTimeout(err) {
+				_ = p.rtmpConn.writeStatus("status", "NetConnection.Connect.IdleTimeOut", "No media is published.")
+			}
 			return err
 		}
 		//p.logger.WithField("event", "recv av chunk stream").Tracef("data: %s", fmt.Sprintf("%#v", cs))
@@ -47,10 +63,24 @@ loopRecvAVChunkStream:
 			avPkt.IsVideo = true
 		case MSGAMF0DataMessage, MsgAMF3DataMessage:
 			avPkt.IsMetaData = true
+			cs.ChunkBody = amfBody(cs) // relayed as AMF0 data
+		case MsgAggregateMessage:
+			p.rtmpConn.setIdleDeadline(true)
+			pkts, err := splitAggregate(cs)
+			if err != nil { // tags before the broken one are still published
+				p.logger.WithField("event", "split aggregate").Error(err)
+			}
+			for _, pkt := range pkts {
+				if err := p.publishAVPacket(ss, cs, pkt); err != nil {
+					return err
+				}
+			}
+			continue loopRecvAVChunkStream
 		default:
 			continue loopRecvAVChunkStream
 		}
 
+		p.rtmpConn.setIdleDeadline(true)
 		avPkt.StreamID = cs.MsgStreamID
 		avPkt.Data = cs.ChunkBody
 		avPkt.TimeStamp = cs.TimeStamp
@@ -58,10 +88,132 @@ loopRecvAVChunkStream:
 		if err := p.demuxer.DemuxHdr(avPkt); err != nil { // flv demux av pkt
 			p.logger.WithField("event", "flv Demux Hdr").Error(err)
 		}
+		if err := p.publishAVPacket(ss, cs, avPkt); err != nil {
+			return err
+		}
+	}
+}
+
+// publishAVPacket sends a demuxed packet of cs to subscribers and the cache
+func (p *publisher) publishAVPacket(ss *streamSource, cs *ChunkStream, avPkt *av.Packet) error {
+	p.logCodecConfig(avPkt)
+	p.recordCodec(avPkt)
+
+	if ss.ssMgr.isClosing() && ss.atGopBoundary(avPkt) {
+		p.logger.WithField("event", "recv av chunk stream").Info("stop publishing for server shutdown")
+		return ErrServerClosed
+	}
+
+	ss.dispatchAVPacket(cs, avPkt) // dispatch av pkt, new subscriber gets cache first
+	ss.cacheAVMetaPacket(avPkt)    // cache av meta info and gop
+	return nil
+}
+
+// logCodecConfig logs sequence headers of the publisher
+func (p *publisher) logCodecConfig(pkt *av.Packet) {
+	switch {
+	case pkt.IsVideo:
+		vh, ok := pkt.Header.(av.VideoPacketHeader)
+		if !ok || !vh.IsSeq() {
+			return
+		}
+		if vh.CodecID() == av.VIDEO_H264 {
+			p.logVideoConfig(pkt)
+			return
+		}
+		p.logger.WithFields(logrus.Fields{"event": "video config", "streamKey": p.streamKey}).Infof("enhanced %s", vh.FourCC())
+	case pkt.IsAudio:
+		ah, ok := pkt.Header.(av.AudioPacketHeader)
+		if !ok || !ah.IsSeq() {
+			return
+		}
+		if ah.SoundFormat() == av.SOUND_AAC {
+			p.logAudioConfig(pkt)
+			return
+		}
+		p.logger.WithFields(logrus.Fields{"event": "audio config", "streamKey": p.streamKey}).Infof("enhanced %s", ah.FourCC())
+	}
+}
+
+// recordCodec keeps the codecs reported by the admin api, they are set by sequence headers, or
+// the first packet of codecs without one
+func (p *publisher) recordCodec(pkt *av.Packet) {
+	switch {
+	case pkt.IsVideo:
+		vh, ok := pkt.Header.(av.VideoPacketHeader)
+		if ok && (vh.IsSeq() || p.videoCodec.Load() == nil) {
+			p.videoCodec.Store(codecName(vh.FourCC(), vh.CodecID()))
+		}
+	case pkt.IsAudio:
+		ah, ok := pkt.Header.(av.AudioPacketHeader)
+		if ok && (ah.IsSeq() || p.audioCodec.Load() == nil) {
+			p.audioCodec.Store(codecName(ah.FourCC(), ah.SoundFormat()))
+		}
+	}
+}
+
+// codecName is the FourCC, or the flv codec id of codecs without a FourCC
+func codecName(fourCC string, id uint8) string {
+	if fourCC != "" {
+		return fourCC
+	}
+	return strconv.Itoa(int(id))
+}
+
+// codecs returns the codecs recorded, empty if not known yet
+func (p *publisher) codecs() (video, audio string) {
+	video, _ = p.videoCodec.Load().(string)
+	audio, _ = p.audioCodec.Load().(string)
+	return video, audio
+}
+
+// logVideoConfig logs the h.264 sequence header of the publisher, a broken one is warned but
+// still sent to players
+func (p *publisher) logVideoConfig(pkt *av.Packet) {
+	logger := p.logger.WithFields(logrus.Fields{"event": "video config", "streamKey": p.streamKey})
+	if len(pkt.Data) < 5 {
+		logger.Warn("empty AVC sequence header")
+		return
+	}
+
+	cfg, err := h264.ParseAVCConfig(pkt.Data[5:])
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	sps, err := h264.ParseSPS(cfg.SPS[0])
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"width":     sps.Width,
+		"height":    sps.Height,
+		"profile":   sps.Profile(),
+		"level":     sps.Level(),
+		"frameRate": sps.FrameRate(),
+	}).Info("h264")
+}
+
+// logAudioConfig logs the AudioSpecificConfig of the publisher, whose sample rate and channels
+// are real unlike the flv sound bits
+func (p *publisher) logAudioConfig(pkt *av.Packet) {
+	logger := p.logger.WithFields(logrus.Fields{"event": "audio config", "streamKey": p.streamKey})
+	if len(pkt.Data) < 2 {
+		logger.Warn("empty AAC sequence header")
+		return
+	}
 
-		ss.cacheAVMetaPacket(avPkt)    // cache av meta info
-		ss.dispatchAVPacket(cs, avPkt) // dispatch av pkt
+	cfg, err := aac.ParseConfig(pkt.Data[2:])
+	if err != nil {
+		logger.Warn(err)
+		return
 	}
+	logger.WithFields(logrus.Fields{
+		"profile":    cfg.Profile(),
+		"sampleRate": cfg.OutputSampleRate(),
+		"channels":   cfg.Channels(),
+	}).Info("aac")
 }
 
 /*
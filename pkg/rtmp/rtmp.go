@@ -5,33 +5,33 @@ import (
 
 	"bufio"
 	"net"
-	"os"
 
-	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/sirupsen/logrus"
+
+	"playground/pkg/flv"
 )
 
-// Server returns a new RTMP server side conncetion
-func Server(conn net.Conn, ssMgr *streamSourceMgr, config *Config) *Conn {
+// newServerConn returns a new RTMP server side conncetion, using the server config of now
+func newServerConn(conn net.Conn, srv *Server) *Conn {
+	config := srv.Config()
 	c := &Conn{
-		conn:   conn,
-		ssMgr:  ssMgr,
-		config: config,
+		conn:     conn,
+		server:   srv,
+		ssMgr:    srv.ssMgr,
+		config:   config,
+		clientID: genUuid(),
 	}
 	c.handshakeFn = c.serverHandshake
 
-	//TODO: config
-	c.localChunksize = 60000
+	c.localChunksize = config.chunkSize()
 	c.remoteChunkSize = 128
-	c.localWindowAckSize = 2500000
+	c.localWindowAckSize = config.windowAckSize()
 	c.remoteWindowAckSize = 250000
 
 	//c.readWriter = newReadWriter(c, connReadBufSize, connWriteBufSize)
 	c.reader = bufio.NewReader(conn)
 
 	c.chunks = make(map[uint32]*ChunkStream)
-	c.amfDecoder = &amf.Decoder{}
-	c.amfEncoder = &amf.Encoder{}
 
 	c.logger = config.Logger
 
@@ -46,13 +46,26 @@ func Client(conn net.Conn, config *Config) *Conn {
 		isClient: true,
 	}
 	c.handshakeFn = c.clientHandshake
+
+	c.localChunksize = config.chunkSize()
+	c.remoteChunkSize = 128
+	c.localWindowAckSize = config.windowAckSize()
+	c.remoteWindowAckSize = 2500000
+
+	c.reader = bufio.NewReader(conn)
+	c.basicHdrBuf = make([]byte, 3)
+
+	c.chunks = make(map[uint32]*ChunkStream)
+	c.demuxer = flv.NewDemuxer()
+
+	c.logger = config.Logger
+
 	return c
 }
 
 type listener struct {
 	net.Listener
-	config *Config
-	ssMgr  *streamSourceMgr // streamSourceMgr for every listener/server instance
+	srv *Server // server of every listener instance, owns the streamSourceMgr
 }
 
 func (l *listener) Accept() (net.Conn, error) {
@@ -61,14 +74,13 @@ func (l *listener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	return Server(c, l.ssMgr, l.config), nil
+	return newServerConn(c, l.srv), nil
 }
 
 func NewListener(inner net.Listener, config *Config) net.Listener {
 	l := new(listener)
 	l.Listener = inner
-	l.ssMgr = newStreamSourceMgr()
-	l.config = config
+	l.srv = NewServer(inner.Addr().String(), config)
 	return l
 }
 
@@ -80,26 +92,17 @@ func Listen(network, laddr string, config *Config) (net.Listener, error) {
 	return NewListener(l, config), nil
 }
 
+// ListenAndServe serves rtmp on laddr with a new Server of config
 func ListenAndServe(network, laddr string, config *Config) error {
-	logger := config.Logger.WithFields(logrus.Fields{
-		"event": "ListenAndServe",
-	})
+	if config.Logger == nil {
+		config.Logger = logrus.StandardLogger()
+	}
 
-	l, err := Listen(network, laddr, config)
+	l, err := net.Listen(network, laddr)
 	if err != nil {
-		logger.Error(err)
+		config.Logger.WithField("event", "ListenAndServe").Error(err)
 		return err
 	}
 
-	logger.Tracef("listen at addr: %s, network: %s, pid: %d", l.Addr().String(), l.Addr().Network(), os.Getpid())
-
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			config.Logger.WithFields(logrus.Fields{"event": "Accept"}).Error(err)
-			continue
-		}
-
-		go conn.(*Conn).Serve()
-	}
+	return NewServer(laddr, config).Serve(l)
 }
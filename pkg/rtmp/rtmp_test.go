@@ -0,0 +1,379 @@
+package rtmp
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"playground/pkg/amf"
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return logger
+}
+
+// startServer serves rtmp on a random local port until the test ends
+func startServer(t *testing.T, config *Config) (*Server, string) {
+	if config.Logger == nil {
+		config.Logger = testLogger()
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer("", config)
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+	return srv, l.Addr().String()
+}
+
+func testPackets(t *testing.T) []*av.Packet {
+	meta, err := amf.Marshal(amf.AMF0, amf.OnMetaData, amf.ECMAArray{"width": 1280.0, "videocodecid": 7.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*av.Packet{
+		{IsMetaData: true, Data: meta},
+		flv.NewVideoPacket(0, av.KEY_FRAME, av.VIDEO_H264, av.AVC_SEQHDR, 0, []byte{1, 0x64, 0, 0x1f, 0xff}),
+		flv.NewVideoPacket(0, av.KEY_FRAME, av.VIDEO_H264, av.AVC_NALU, 0, []byte{0, 0, 0, 1, 0x65}),
+		flv.NewVideoPacket(40, av.INTER_FRAME, av.VIDEO_H264, av.AVC_NALU, 0, []byte{0, 0, 0, 1, 0x41}),
+	}
+}
+
+func dialPublish(t *testing.T, rawurl string, config *Config) *Conn {
+	if config.Logger == nil {
+		config.Logger = testLogger()
+	}
+	c, err := Dial(rawurl, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish(); err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	return c
+}
+
+func dialPlay(t *testing.T, rawurl string, config *Config) *Conn {
+	if config.Logger == nil {
+		config.Logger = testLogger()
+	}
+	c, err := Dial(rawurl, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Play(); err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	return c
+}
+
+// readPackets reads n audio/video packets, metadata is skipped
+func readPackets(t *testing.T, c *Conn, n int) []*av.Packet {
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+
+	var pkts []*av.Packet
+	for len(pkts) < n {
+		pkt, err := c.ReadPacket()
+		if err != nil {
+			t.Fatalf("read packet %d: %v", len(pkts), err)
+		}
+		if !pkt.IsMetaData {
+			pkts = append(pkts, pkt)
+		}
+	}
+	return pkts
+}
+
+// waitFor polls cond until it's true, the test fails after 5s
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForward(t *testing.T) {
+	target, targetAddr := startServer(t, &Config{})
+	origin, originAddr := startServer(t, &Config{
+		Forward: &ForwardConfig{
+			Rules:      map[string][]string{"*": {"rtmp://" + targetAddr + "/{app}/{stream}"}},
+			MinBackoff: time.Hour,
+		},
+	})
+
+	pub := dialPublish(t, "rtmp://"+originAddr+"/live/test", &Config{})
+	defer pub.Close()
+
+	var status ForwarderStatus
+	waitFor(t, "forwarding", func() bool {
+		if fs := origin.Forwarders(); len(fs) == 1 {
+			status = fs[0]
+		}
+		return status.State == ForwardForwarding
+	})
+
+	player := dialPlay(t, "rtmp://"+targetAddr+"/live/test", &Config{})
+	defer player.Close()
+	for _, pkt := range testPackets(t) {
+		if err := pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pkts := readPackets(t, player, 3); !pkts[0].IsVideo || pkts[0].TimeStamp != 0 || pkts[2].TimeStamp != 40 {
+		t.Fatalf("forwarded packets: %+v", pkts)
+	}
+
+	// the target connection is read while forwarding, so it's known to be closed without
+	// waiting for the next packet
+	val, ok := target.ssMgr.streamMap.Load(genStreamKey(defaultVhost, "live", "test"))
+	if !ok {
+		t.Fatal("no forwarded stream on target")
+	}
+	val.(*streamSource).publisher.kick()
+
+	waitFor(t, "backoff", func() bool {
+		status = origin.Forwarders()[0]
+		return status.State == ForwardBackoff
+	})
+	if status.Retries != 1 || status.LastError == "" {
+		t.Fatalf("status after kick: %+v", status)
+	}
+}
+
+func TestPublishPlay(t *testing.T) {
+	for _, simple := range []bool{false, true} {
+		srv, addr := startServer(t, &Config{})
+		url := "rtmp://" + addr + "/live/test"
+
+		pub := dialPublish(t, url, &Config{SimpleHandshake: simple})
+		player := dialPlay(t, url, &Config{SimpleHandshake: simple})
+
+		want := testPackets(t)
+		for _, pkt := range want {
+			if err := pub.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := readPackets(t, player, len(want)-1)
+		for i, pkt := range got {
+			w := want[i+1]
+			if pkt.IsVideo != w.IsVideo || pkt.TimeStamp != w.TimeStamp || string(pkt.Data) != string(w.Data) {
+				t.Errorf("simple handshake %v, packet %d: got %+v, want %+v", simple, i, pkt, w)
+			}
+		}
+
+		// a late player starts by the cached sequence header and gop at the next packet
+		late := dialPlay(t, url, &Config{SimpleHandshake: simple})
+		ss, _ := srv.ssMgr.streamMap.Load(genStreamKey(defaultVhost, "live", "test"))
+		waitFor(t, "late player", func() bool { return ss.(*streamSource).numSubscribers() == 2 })
+		next := flv.NewVideoPacket(80, av.INTER_FRAME, av.VIDEO_H264, av.AVC_NALU, 0, []byte{0, 0, 0, 1, 0x41})
+		if err := pub.WritePacket(next); err != nil {
+			t.Fatal(err)
+		}
+		if got := readPackets(t, late, len(want)); !got[0].Header.(av.VideoPacketHeader).IsSeq() || got[2].TimeStamp != 40 || got[3].TimeStamp != 80 {
+			t.Errorf("simple handshake %v, late player: %+v", simple, got)
+		}
+		late.Close()
+		pub.Close()
+		player.Close()
+	}
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// accept and never answer the handshake
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	start := time.Now()
+	if _, err := Dial("rtmp://"+l.Addr().String()+"/live/test", &Config{Logger: testLogger(), HandshakeTimeout: 200 * time.Millisecond}); err == nil {
+		t.Fatal("dial a silent server: no error")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("dial took %s", d)
+	}
+}
+
+func TestEdgePull(t *testing.T) {
+	_, originAddr := startServer(t, &Config{})
+	pub := dialPublish(t, "rtmp://"+originAddr+"/live/test", &Config{})
+	defer pub.Close()
+
+	edge, edgeAddr := startServer(t, &Config{Edge: &EdgeConfig{Origins: []string{originAddr}, IdleTimeout: time.Second}})
+	streamKey := genStreamKey(defaultVhost, "live", "test")
+
+	player := dialPlay(t, "rtmp://"+edgeAddr+"/live/test", &Config{})
+	waitFor(t, "pull", func() bool {
+		val, ok := edge.ssMgr.streamMap.Load(streamKey)
+		return ok && val.(*streamSource).getPublisher() != nil && val.(*streamSource).numSubscribers() == 1
+	})
+	for _, pkt := range testPackets(t) {
+		if err := pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pkts := readPackets(t, player, 3); pkts[2].TimeStamp != 40 {
+		t.Fatalf("pulled packets: %+v", pkts)
+	}
+
+	// the pull stops once no player is left for IdleTimeout
+	player.Close()
+	waitFor(t, "idle pull removed", func() bool {
+		_, ok := edge.ssMgr.streamMap.Load(streamKey)
+		return !ok
+	})
+
+	// a failed pull is removed, so the next player starts a new one
+	if c, err := Dial("rtmp://"+edgeAddr+"/live/none", &Config{Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	} else {
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		_ = c.Play() // started before the pull fails, then stopped
+		c.Close()
+	}
+	waitFor(t, "failed pull removed", func() bool {
+		_, ok := edge.ssMgr.streamMap.Load(genStreamKey(defaultVhost, "live", "none"))
+		return !ok
+	})
+}
+
+func TestEdgePullPending(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		// the origin holds the pull dial until the test closes it
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	edge, edgeAddr := startServer(t, &Config{Edge: &EdgeConfig{Origins: []string{l.Addr().String()}}})
+	url := "rtmp://" + edgeAddr + "/live/test"
+	streamKey := genStreamKey(defaultVhost, "live", "test")
+
+	player, err := Dial(url, &Config{Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	go func() { _ = player.Play() }()
+
+	var origin net.Conn
+	select {
+	case origin = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pull dialed")
+	}
+	val, _ := edge.ssMgr.streamMap.Load(streamKey)
+	pulled := val.(*streamSource)
+
+	// a local publisher is refused while the pull dials origin, the connection is closed
+	pub := dialPublish(t, url, &Config{})
+	_ = pub.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := pub.ReadPacket(); err == nil || isTimeout(err) {
+		t.Fatalf("local publisher of a pending pull: %v", err)
+	}
+	pub.Close()
+	if val, _ := edge.ssMgr.streamMap.Load(streamKey); val != pulled || pulled.getPublisher() != nil {
+		t.Fatal("pending pull taken by the local publisher")
+	}
+
+	// once the pull fails, the stream may be published locally
+	origin.Close()
+	waitFor(t, "failed pull removed", func() bool {
+		_, ok := edge.ssMgr.streamMap.Load(streamKey)
+		return !ok
+	})
+	pub = dialPublish(t, url, &Config{})
+	defer pub.Close()
+	waitFor(t, "local publisher", func() bool {
+		val, ok := edge.ssMgr.streamMap.Load(streamKey)
+		return ok && val.(*streamSource).getPublisher() != nil
+	})
+}
+
+func TestPingRTT(t *testing.T) {
+	c := &Conn{logger: testLogger()}
+	cs := NewUserControlMessage(pingResponse, 4)
+	binary.BigEndian.PutUint32(cs.ChunkBody[2:], pingMillis()-30)
+	c.handleUserControlMessage(cs)
+	if rtt := c.RTT(); rtt < 30*time.Millisecond || rtt > time.Second {
+		t.Fatalf("rtt %s", rtt)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv, addr := startServer(t, &Config{IdleTimeout: 300 * time.Millisecond})
+	url := "rtmp://" + addr + "/live/test"
+
+	pub := dialPublish(t, url, &Config{})
+	defer pub.Close()
+	idle := dialPlay(t, url, &Config{}) // never reads, so pings are not answered
+	defer idle.Close()
+	active := dialPlay(t, url, &Config{})
+	defer active.Close()
+	go func() {
+		for {
+			if _, err := active.ReadPacket(); err != nil {
+				return
+			}
+		}
+	}()
+
+	val, _ := srv.ssMgr.streamMap.Load(genStreamKey(defaultVhost, "live", "test"))
+	ss := val.(*streamSource)
+	waitFor(t, "idle publisher and player dropped", func() bool {
+		return ss.getPublisher() == nil && ss.numSubscribers() == 1
+	})
+	// read after they are dropped, reading answers pings
+	for _, c := range []*Conn{pub, idle} {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := c.waitStatus("NetConnection.Connect.IdleTimeOut"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the active player answers pings, so it's kept for longer than IdleTimeout
+	time.Sleep(time.Second)
+	if n := ss.numSubscribers(); n != 1 {
+		t.Fatalf("%d players left", n)
+	}
+}
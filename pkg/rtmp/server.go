@@ -0,0 +1,247 @@
+package rtmp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultListenAddr = ":1935"
+
+	shutdownPollInterval = 500 * time.Millisecond
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown
+var ErrServerClosed = errors.New("rtmp: Server closed")
+
+// Server serves rtmp connections, every connection uses the Config at the time it's accepted.
+type Server struct {
+	Addr string // tcp address to listen on, ":1935" if empty
+
+	config   atomic.Value     // *Config
+	ssMgr    *streamSourceMgr // streamSourceMgr shared by all connections of the server
+	numConns int32            // connections being served
+
+	usedTokens *tokenCache // tokens of signed urls used already
+	certs      *certCache  // certificates of rtmps
+	origins    *originRing // origins of edge pulls
+
+	inShutdown  int32 // accessed atomically (non-zero means we're in Shutdown)
+	mu          sync.Mutex
+	listeners   map[*net.Listener]struct{}
+	httpServers map[*http.Server]struct{}
+	activeConn  map[*Conn]struct{}
+}
+
+func NewServer(addr string, config *Config) *Server {
+	srv := &Server{
+		Addr:    addr,
+		ssMgr:   newStreamSourceMgr(),
+		certs:   newCertCache(),
+		origins: &originRing{},
+	}
+	if size := config.replayCacheSize(); size > 0 {
+		srv.usedTokens = newTokenCache(size)
+	}
+	srv.SetConfig(config)
+	return srv
+}
+
+// Config returns the config used by new connections
+func (srv *Server) Config() *Config {
+	return srv.config.Load().(*Config)
+}
+
+// SetConfig replaces the config, only connections accepted later are affected
+func (srv *Server) SetConfig(config *Config) {
+	if config.Logger == nil {
+		config.Logger = logrus.StandardLogger()
+	}
+	srv.config.Store(config)
+}
+
+func (srv *Server) ListenAndServe() error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = defaultListenAddr
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		srv.Config().Logger.WithField("event", "ListenAndServe").Error(err)
+		return err
+	}
+
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l and serves each of them in a new goroutine,
+// it always returns a non-nil error, ErrServerClosed after Shutdown.
+func (srv *Server) Serve(l net.Listener) error {
+	if !srv.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(&l, false)
+	defer l.Close()
+
+	logger := srv.Config().Logger.WithFields(logrus.Fields{"event": "Serve"})
+	logger.Tracef("listen at addr: %s, network: %s, pid: %d", l.Addr().String(), l.Addr().Network(), os.Getpid())
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		rw, err := l.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				logger.WithField("action", "Accept").Errorf("%v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			logger.WithField("action", "Accept").Error(err)
+			return err
+		}
+		tempDelay = 0
+
+		c := newServerConn(rw, srv)
+		go c.Serve()
+	}
+}
+
+// Shutdown gracefully shuts down the server: it closes all listeners(http included) and connections not
+// publishing or playing yet, stops players with NetStream.Unpublish.Notify and NetStream.Play.Stop,
+// stops publishers at their next key frame, then waits for connections to finish.
+// Connections still alive when ctx is done are closed forcibly and ctx's error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	for ln := range srv.listeners {
+		_ = (*ln).Close()
+	}
+	httpServers := make([]*http.Server, 0, len(srv.httpServers))
+	for hs := range srv.httpServers {
+		httpServers = append(httpServers, hs)
+	}
+	srv.mu.Unlock()
+
+	srv.ssMgr.close()
+
+	// http players end with their subscribers, so http servers shut down along with rtmp
+	httpDone := make(chan struct{})
+	go func() {
+		defer close(httpDone)
+		for _, hs := range httpServers {
+			if err := hs.Shutdown(ctx); err != nil {
+				_ = hs.Close()
+			}
+		}
+	}()
+	defer func() { <-httpDone }()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleConns() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			srv.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+func (srv *Server) trackListener(ln *net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.listeners == nil {
+		srv.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.listeners[ln] = struct{}{}
+	} else {
+		delete(srv.listeners, ln)
+	}
+	return true
+}
+
+// acquire a connection slot, false if MaxConns is reached or the server is shutting down
+func (srv *Server) trackConn(c *Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.shuttingDown() {
+		return false
+	}
+
+	n := atomic.AddInt32(&srv.numConns, 1)
+	if c.config.MaxConns > 0 && int(n) > c.config.MaxConns {
+		atomic.AddInt32(&srv.numConns, -1)
+		return false
+	}
+
+	if srv.activeConn == nil {
+		srv.activeConn = make(map[*Conn]struct{})
+	}
+	srv.activeConn[c] = struct{}{}
+	return true
+}
+
+func (srv *Server) untrackConn(c *Conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	atomic.AddInt32(&srv.numConns, -1)
+	delete(srv.activeConn, c)
+}
+
+// close connections not publishing or playing, report whether all connections are gone
+func (srv *Server) closeIdleConns() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for c := range srv.activeConn {
+		if !c.isStreaming() {
+			_ = c.Close()
+		}
+	}
+	return len(srv.activeConn) == 0
+}
+
+func (srv *Server) closeAllConns() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for c := range srv.activeConn {
+		_ = c.Close()
+	}
+}
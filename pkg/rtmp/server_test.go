@@ -0,0 +1,101 @@
+package rtmp
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer("", &Config{Logger: testLogger()})
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	url := "rtmp://" + l.Addr().String() + "/live/test"
+
+	pub := dialPublish(t, url, &Config{})
+	defer pub.Close()
+	player := dialPlay(t, url, &Config{})
+	defer player.Close()
+	for _, pkt := range testPackets(t) {
+		if err := pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readPackets(t, player, 3)
+	handshaking, err := net.Dial("tcp", l.Addr().String()) // not publishing or playing
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handshaking.Close()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("serve: %v", err)
+	}
+	if _, err := Dial(url, &Config{Logger: testLogger()}); err == nil {
+		t.Error("dialed after shutdown")
+	}
+	_ = handshaking.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := handshaking.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection not publishing or playing: %v", err)
+	}
+
+	// players are stopped, the publisher goes on until its next key frame
+	if _, err := player.ReadPacket(); err != io.EOF {
+		t.Errorf("player: %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown before the publisher stops: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	key := flv.NewVideoPacket(80, av.KEY_FRAME, av.VIDEO_H264, av.AVC_NALU, 0, []byte{0, 0, 0, 1, 0x65})
+	if err := pub.WritePacket(key); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatalf("shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown not returned once connections are done")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	srv, addr := startServer(t, &Config{})
+	pub := dialPublish(t, "rtmp://"+addr+"/live/test", &Config{})
+	defer pub.Close()
+	for _, pkt := range testPackets(t) {
+		if err := pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// no key frame comes, so the publisher is closed once ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown: %v", err)
+	}
+	_ = pub.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := pub.ReadPacket(); err == nil || isTimeout(err) {
+		t.Fatalf("publisher not closed: %v", err)
+	}
+}
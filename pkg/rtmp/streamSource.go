@@ -2,17 +2,37 @@ package rtmp
 
 import (
 	"playground/pkg/av"
+	"playground/pkg/flv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
+)
+
+// republishTimeout is how long a stream source is kept for its publisher to come back
+var republishTimeout = time.Minute
+
+var (
+	errStreamNotExists = errors.New("stream not exists")
+	errStreamDisabled  = errors.New("stream is disabled")
 )
 
 type streamSource struct {
-	stopPublish chan bool
-	publisher   *publisher
+	publisher *publisher // set by the publishing goroutine, others read it by getPublisher
+	pulling   bool       // published by an edge pull only, set before the source is stored
+	pubMux    sync.Mutex
 
 	subscribers     map[string]*subscriber
 	subscriberCount int
 	addSubMux       sync.Mutex
+	closed          bool // no more subscriber is accepted, set once the source is removed
+
+	forwarders []*forwarder // forwarders of the current publisher
+	fwdMux     sync.Mutex
+
+	packagers map[string]*packagerSlot // http streaming outputs by name, kept across republish
+	pkgMux    sync.Mutex
 
 	streamKey string
 	sessionID string
@@ -20,15 +40,14 @@ type streamSource struct {
 	cache     *Cache
 }
 
-func newStreamSource(pub *publisher, streamKey string, ssMgr *streamSourceMgr) *streamSource {
+func newStreamSource(pub *publisher, streamKey string, ssMgr *streamSourceMgr, config *Config) *streamSource {
 	ss := &streamSource{
-		stopPublish: make(chan bool, 1),
 		publisher:   pub,
 		subscribers: make(map[string]*subscriber),
 		streamKey:   streamKey,
 		sessionID:   genUuid(),
 		ssMgr:       ssMgr,
-		cache:       NewCache(),
+		cache:       NewCache(config.newGopCache()),
 	}
 
 	return ss
@@ -44,23 +63,49 @@ func (ss *streamSource) doPlaying(sub *subscriber) error {
 	return err
 }
 
-func (ss *streamSource) setPublisher(pub *publisher) *streamSource {
+// setPublisher sets pub, false if the stream is being published by another one or pulled
+func (ss *streamSource) setPublisher(pub *publisher) bool {
+	ss.pubMux.Lock()
+	defer ss.pubMux.Unlock()
+
+	if ss.publisher != nil || ss.pulling {
+		return false
+	}
 	ss.publisher = pub
-	return ss
+	return true
 }
 
-func (ss *streamSource) delPublisher() {
+func (ss *streamSource) getPublisher() *publisher {
+	ss.pubMux.Lock()
+	defer ss.pubMux.Unlock()
+	return ss.publisher
+}
+
+func (ss *streamSource) clearPublisher() {
+	ss.pubMux.Lock()
 	ss.publisher = nil
+	ss.pubMux.Unlock()
+}
+
+// delPublisher clears the publisher, the stream source is removed and its players end if it's
+// not republished in republishTimeout
+func (ss *streamSource) delPublisher() {
+	ss.clearPublisher()
 
-	time.AfterFunc(time.Minute, func() {
-		val, ok := ss.ssMgr.streamMap.Load(ss.streamKey)
-		if ok {
-			ssCache := val.(*streamSource)
-			if ssCache.publisher == nil {
-				ss.ssMgr.streamMap.Delete(ss.streamKey)
-				ss.stopPublish <- true
-			}
+	time.AfterFunc(republishTimeout, func() {
+		if val, ok := ss.ssMgr.streamMap.Load(ss.streamKey); !ok || val.(*streamSource) != ss {
+			return // removed by an earlier timer, another source may be stored since
+		}
+		if ss.getPublisher() != nil {
+			return
 		}
+		ss.ssMgr.streamMap.Delete(ss.streamKey)
+
+		ss.addSubMux.Lock()
+		ss.closed = true
+		ss.addSubMux.Unlock()
+		ss.stopSubscribers()
+		ss.closePackagers()
 	})
 }
 
@@ -68,11 +113,14 @@ func (ss *streamSource) addSubscriber(sub *subscriber) bool {
 	ss.addSubMux.Lock()
 	defer ss.addSubMux.Unlock()
 
-	if _, ok := ss.subscribers[sub.rtmpConn.RemoteAddr().String()]; ok { //exists
+	if ss.closed {
+		return false
+	}
+	if _, ok := ss.subscribers[sub.id]; ok { //exists
 		return false
 	}
 
-	ss.subscribers[sub.rtmpConn.RemoteAddr().String()] = sub
+	ss.subscribers[sub.id] = sub
 	ss.subscriberCount++
 
 	return true
@@ -82,11 +130,34 @@ func (ss *streamSource) delSubscriber(sub *subscriber) bool {
 	ss.addSubMux.Lock()
 	defer ss.addSubMux.Unlock()
 
-	delete(ss.subscribers, sub.rtmpConn.RemoteAddr().String())
+	delete(ss.subscribers, sub.id)
 	return true
 }
 
+// subscriberList returns the subscribers at the moment
+func (ss *streamSource) subscriberList() []*subscriber {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
+	subs := make([]*subscriber, 0, len(ss.subscribers))
+	for _, sub := range ss.subscribers {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+func (ss *streamSource) numSubscribers() int {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
+	return len(ss.subscribers)
+}
+
+// cacheAVMetaPacket caches pkt, the cache is read by tracks of http players under the same lock
 func (ss *streamSource) cacheAVMetaPacket(pkt *av.Packet) {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
 	ss.cache.Write(pkt)
 }
 
@@ -95,7 +166,7 @@ func (ss *streamSource) dispatchAVPacket(cs *ChunkStream, pkt *av.Packet) {
 	defer ss.addSubMux.Unlock() //TODO: lock big
 
 	for _, sub := range ss.subscribers {
-		if sub.stopped {
+		if atomic.LoadInt32(&sub.stopped) != 0 {
 			continue
 		}
 
@@ -104,8 +175,71 @@ func (ss *streamSource) dispatchAVPacket(cs *ChunkStream, pkt *av.Packet) {
 	}
 }
 
+// tracks tells whether the stream has audio and video by the cached sequence headers, or the
+// codec ids of metadata for codecs without a sequence header. Both are assumed while nothing is
+// cached yet.
+func (ss *streamSource) tracks() (audio, video bool) {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
+	c := ss.cache
+	audio, video = c.audioSeq.full, c.videoSeq.full
+	if c.metaData.full {
+		if props := flv.MetaDataProps(c.metaData.pkt.Data); props != nil {
+			_, hasAudio := props["audiocodecid"]
+			_, hasVideo := props["videocodecid"]
+			audio, video = audio || hasAudio, video || hasVideo
+		}
+	}
+
+	if !audio && !video {
+		return true, true
+	}
+	return audio, video
+}
+
+// stop all subscribers, they send stop status to players and quit
+func (ss *streamSource) stopSubscribers() {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
+	for _, sub := range ss.subscribers {
+		sub.stop()
+	}
+}
+
+// a publisher quits for shutdown before a key frame, so the last gop is complete.
+// streams without video have no gop, they quit at once.
+func (ss *streamSource) atGopBoundary(pkt *av.Packet) bool {
+	if !ss.cache.videoSeq.full {
+		return true
+	}
+
+	if !pkt.IsVideo {
+		return false
+	}
+	vh, ok := pkt.Header.(av.VideoPacketHeader)
+	return ok && vh.IsKeyFrame() && !vh.IsSeq()
+}
+
+// lookupStream returns the stream source to play, it's pulled from origin on demand in edge mode
+func (srv *Server) lookupStream(config *Config, vhost, app, stream string) (*streamSource, error) {
+	if val, ok := srv.ssMgr.streamMap.Load(genStreamKey(vhost, app, stream)); ok {
+		return val.(*streamSource), nil
+	}
+
+	if config.Edge != nil {
+		ss, err := srv.pullStream(config, vhost, app, stream)
+		return ss, errors.Wrap(err, "edge pull")
+	}
+
+	return nil, errStreamNotExists
+}
+
 type streamSourceMgr struct {
 	streamMap sync.Map //<StreamKey, StreamSource>
+	disabled  sync.Map //<StreamKey, struct{}> stream keys refused to publish and play, until restart
+	closing   int32    // accessed atomically, non-zero once server shutdown begins
 }
 
 func newStreamSourceMgr() *streamSourceMgr {
@@ -113,3 +247,22 @@ func newStreamSourceMgr() *streamSourceMgr {
 
 	return mgr
 }
+
+func (mgr *streamSourceMgr) isDisabled(streamKey string) bool {
+	_, ok := mgr.disabled.Load(streamKey)
+	return ok
+}
+
+func (mgr *streamSourceMgr) isClosing() bool {
+	return atomic.LoadInt32(&mgr.closing) != 0
+}
+
+// close stops subscribers of every stream, publishers stop by themselves at next key frame
+func (mgr *streamSourceMgr) close() {
+	atomic.StoreInt32(&mgr.closing, 1)
+
+	mgr.streamMap.Range(func(key, val interface{}) bool {
+		val.(*streamSource).stopSubscribers()
+		return true
+	})
+}
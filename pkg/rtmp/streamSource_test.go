@@ -0,0 +1,45 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelPublisher(t *testing.T) {
+	defer func(d time.Duration) { republishTimeout = d }(republishTimeout)
+	republishTimeout = 50 * time.Millisecond
+
+	config := &Config{}
+	mgr := &streamSourceMgr{}
+	streamKey := genStreamKey(defaultVhost, "live", "test")
+	old := newStreamSource(nil, streamKey, mgr, config)
+	mgr.streamMap.Store(streamKey, old)
+
+	// published twice, the second timer finds the source removed
+	old.delPublisher()
+	old.delPublisher()
+	waitFor(t, "old source removed", func() bool {
+		_, ok := mgr.streamMap.Load(streamKey)
+		return !ok
+	})
+	if old.addSubscriber(newSinkSubscriber("sub", nil, testLogger(), 1)) {
+		t.Error("subscriber added to a removed source")
+	}
+
+	// the timer of a replaced source leaves the new one alone
+	cur := newStreamSource(nil, streamKey, mgr, config)
+	mgr.streamMap.Store(streamKey, cur)
+	old.delPublisher()
+	time.Sleep(3 * republishTimeout)
+	if val, _ := mgr.streamMap.Load(streamKey); val != cur {
+		t.Fatal("new source removed by the timer of the old one")
+	}
+
+	// a republished source is kept
+	cur.delPublisher()
+	cur.setPublisher(&publisher{})
+	time.Sleep(3 * republishTimeout)
+	if val, _ := mgr.streamMap.Load(streamKey); val != cur {
+		t.Fatal("republished source removed")
+	}
+}
@@ -4,33 +4,71 @@ import (
 	"encoding/binary"
 	"errors"
 	"playground/pkg/av"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/sirupsen/logrus"
+
+	"playground/pkg/amf"
 )
 
+// errClientGone is returned by playingCycle when the player went away by itself
+var errClientGone = errors.New("client gone")
+
+// avSink sends the packets of a subscriber to where they go, a rtmp player by default
+type avSink interface {
+	sendAVPacket(pkt *av.Packet) error
+	sendStopStatus() // the stream is stopped, tell the other side
+}
+
 type subscriber struct {
-	rtmpConn *Conn
+	id       string // unique in the stream source
+	sink     avSink
+	rtmpConn *Conn // nil if not a rtmp player
 
-	stopped bool
-	subType string // "gerneral"
-	logger  *logrus.Logger
+	stopped  int32         // accessed atomically, non-zero once playingCycle returns
+	quit     chan struct{} // closed by stop or leave
+	quitOnce sync.Once
+	quitErr  error  // returned by playingCycle once quit, set before quit is closed
+	subType  string // "gerneral"
+	logger   *logrus.Logger
 
 	avPktQueue     chan *av.Packet
 	avPktQueueSize int //av packet buffer size
 
+	drain              bool // send the packets queued before stop, so segmenters end by the last frames
+	lossless           bool // writeAVPacket waits for room in the queue instead of dropping, e.g. recorders
 	initCache          bool
-	baseTimeStamp      uint32
 	lastAudioTimeStamp uint32
 	lastVideoTimeStamp uint32
 	chunkMsgToSend     *ChunkStream
+	agg                *aggregator // bundles audio/video of rtmp players, nil if disabled
+	readErr            chan error  // ends the play by reading the other side, nil if it's not read
+	startTime          time.Time
 }
 
 func newSubscriber(c *Conn, avQueueSize int) *subscriber {
+	sub := newSinkSubscriber(c.RemoteAddr().String(), nil, c.logger, avQueueSize)
+	sub.rtmpConn = c
+	sub.sink = sub
+	sub.readErr = make(chan error, 1)
+	if c.config.Aggregate != nil {
+		sub.agg = newAggregator(c.config.Aggregate)
+	}
+
+	return sub
+}
+
+// newSinkSubscriber returns a subscriber whose packets are sent by sink instead of a rtmp player
+func newSinkSubscriber(id string, sink avSink, logger *logrus.Logger, avQueueSize int) *subscriber {
 	sub := &subscriber{
-		rtmpConn:       c,
+		id:             id,
+		sink:           sink,
 		subType:        "gerneral",
-		logger:         c.logger,
+		logger:         logger,
+		startTime:      time.Now(),
+		quit:           make(chan struct{}),
 		avPktQueue:     make(chan *av.Packet, avQueueSize),
 		avPktQueueSize: avQueueSize,
 		chunkMsgToSend: new(ChunkStream),
@@ -59,32 +97,132 @@ func (s *subscriber) sendCachePacket(cache *Cache) {
 		s.writeAVPacket(audioSeq.pkt)
 	}
 
+	for _, pkt := range cache.gop.Packets() {
+		s.writeAVPacket(pkt)
+	}
+
 	s.initCache = true
 }
 
+// readDone ends the play by the error of reading the player
+func (s *subscriber) readDone(err error) {
+	select {
+	case s.readErr <- err:
+	default:
+	}
+}
+
+// stop asks playingCycle to notify the player and quit
+func (s *subscriber) stop() {
+	s.quitOnce.Do(func() {
+		s.quitErr = ErrServerClosed
+		close(s.quit)
+	})
+}
+
+// leave asks playingCycle to quit for the player is gone, nothing is sent to it
+func (s *subscriber) leave() {
+	s.quitOnce.Do(func() {
+		s.quitErr = errClientGone
+		close(s.quit)
+	})
+}
+
 func (s *subscriber) playingCycle(ss *streamSource) error {
+	defer atomic.StoreInt32(&s.stopped, 1)
+
+	var flush <-chan time.Time // fires when the pending aggregate waits no more
 	for {
-		pkt, ok := <-s.avPktQueue
+		var pkt *av.Packet
+		var ok bool
+		select {
+		case pkt, ok = <-s.avPktQueue:
+		case <-flush:
+			flush = nil
+			if err := s.flushAggregate(); err != nil {
+				return err
+			}
+			continue
+		case err := <-s.readErr:
+			if isTimeout(err) && s.rtmpConn != nil {
+				if err := s.rtmpConn.writeStatus("status", "NetConnection.Connect.IdleTimeOut", "Player is idle."); err != nil {
+					s.logger.WithField("event", "send NetConnection.Connect.IdleTimeOut").Error(err)
+				}
+			}
+			return err
+		case <-s.quit:
+			if s.quitErr == errClientGone {
+				return errClientGone
+			}
+			if s.drain {
+				if err := s.drainQueue(); err != nil {
+					return err
+				}
+			}
+			if err := s.flushAggregate(); err != nil {
+				s.logger.WithField("event", "send aggregate").Error(err)
+			}
+			s.sink.sendStopStatus()
+			return s.quitErr
+		}
+
 		if !ok {
-			s.stopped = true
 			return errors.New("closed")
 		}
 
-		if err := s.sendAVPacket(pkt); err != nil {
-			s.stopped = true
+		if err := s.sink.sendAVPacket(pkt); err != nil {
 			return err
 		}
 		s.logger.WithField("event", "SendAVPacket").Debugf("pkt: %+v", pkt)
+
+		switch {
+		case s.agg == nil || !s.agg.pending():
+			flush = nil
+		case flush == nil:
+			flush = time.After(s.agg.maxDelay)
+		}
+	}
+}
+
+// drainQueue sends the packets left in the queue, nothing is queued once the publisher stops
+func (s *subscriber) drainQueue() error {
+	for {
+		select {
+		case pkt := <-s.avPktQueue:
+			if err := s.sink.sendAVPacket(pkt); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *subscriber) sendStopStatus() {
+	c := s.rtmpConn
+	if err := c.writeStatus("status", "NetStream.Unpublish.Notify", "Stream is unpublished."); err != nil {
+		s.logger.WithField("event", "send NetStream.Unpublish.Notify").Error(err)
+		return
+	}
+	if err := c.writeStatus("status", "NetStream.Play.Stop", "Stopped playing stream."); err != nil {
+		s.logger.WithField("event", "send NetStream.Play.Stop").Error(err)
 	}
 }
 
 func (s *subscriber) sendAVPacket(pkt *av.Packet) error {
+	if s.agg != nil && (pkt.IsAudio || pkt.IsVideo) {
+		return s.aggregateAVPacket(pkt)
+	}
+	if err := s.flushAggregate(); err != nil { // in order
+		return err
+	}
+
 	cs := s.chunkMsgToSend
 
 	cs.ChunkBody = pkt.Data
 	cs.MsgLength = uint32(len(pkt.Data))
 	cs.MsgStreamID = pkt.StreamID
-	cs.TimeStamp = pkt.TimeStamp + s.getBaseTimeStamp()
+	cs.TimeStamp = pkt.TimeStamp
 
 	switch {
 	case pkt.IsVideo:
@@ -97,9 +235,44 @@ func (s *subscriber) sendAVPacket(pkt *av.Packet) error {
 
 	s.recordTimeStamp(cs.MsgTypeID, cs.TimeStamp)
 
+	s.rtmpConn.setIdleDeadline(false)
 	return s.writeAVChunkStream(cs)
 }
 
+// aggregateAVPacket adds pkt to the pending aggregate, which is sent once full or nothing is
+// queued if it doesn't wait
+func (s *subscriber) aggregateAVPacket(pkt *av.Packet) error {
+	if !s.agg.fits(pkt) {
+		if err := s.flushAggregate(); err != nil {
+			return err
+		}
+	}
+	full, err := s.agg.add(pkt)
+	if err != nil {
+		return err
+	}
+
+	if pkt.IsVideo {
+		s.recordTimeStamp(MsgVideoMessage, pkt.TimeStamp)
+	} else {
+		s.recordTimeStamp(MsgAudioMessage, pkt.TimeStamp)
+	}
+
+	if full || s.agg.maxDelay == 0 && len(s.avPktQueue) == 0 {
+		return s.flushAggregate()
+	}
+	return nil
+}
+
+// flushAggregate sends the pending aggregate if any
+func (s *subscriber) flushAggregate() error {
+	if s.agg == nil || !s.agg.pending() {
+		return nil
+	}
+	s.rtmpConn.setIdleDeadline(false)
+	return s.rtmpConn.writeChunkStream(s.agg.take())
+}
+
 func (s *subscriber) writeAVChunkStream(cs *ChunkStream) error {
 	switch cs.MsgTypeID {
 	case MsgAMF3DataMessage, MSGAMF0DataMessage:
@@ -116,16 +289,27 @@ func (s *subscriber) writeAVChunkStream(cs *ChunkStream) error {
 }
 
 func (s *subscriber) writeAVPacket(pkt *av.Packet) {
+	if s.lossless {
+		select {
+		case s.avPktQueue <- pkt:
+		case <-s.quit: // playingCycle is done, nothing reads the queue
+		}
+		return
+	}
+
 	//s.logger.WithField("event", "avpkt enQueue").Infof("data len: %d", len(pkt.Data))
 	if len(s.avPktQueue) > s.avPktQueueSize-24 {
-		s.dropAVPacket()
+		dropped := s.dropAVPacket() + 1 // pkt is not queued either
+		s.logger.WithFields(logrus.Fields{"event": "dropAvPkt", "subscriber": s.id}).Warnf("queue full, %d packets dropped", dropped)
 	} else {
 		s.avPktQueue <- pkt
 	}
 }
 
-func (s *subscriber) dropAVPacket() {
+// dropAVPacket drops queued packets but sequence headers and key frames, it returns how many
+func (s *subscriber) dropAVPacket() int {
 	//s.logger.WithField("event", "dropAvPkt").Infof("subscriber: %s", s.rtmpConn.RemoteAddr().String())
+	var dropped int
 	for i := 0; i < s.avPktQueueSize-84; i++ {
 		pkt, ok := <-s.avPktQueue
 		if !ok {
@@ -135,8 +319,8 @@ func (s *subscriber) dropAVPacket() {
 		switch {
 		case pkt.IsAudio:
 			if len(s.avPktQueue) > s.avPktQueueSize-2 {
-				s.logger.WithField("event", "dropAvPkt").Infof("drop audio pkt")
 				<-s.avPktQueue
+				dropped += 2
 			} else {
 				s.avPktQueue <- pkt //enqueu again
 			}
@@ -144,14 +328,19 @@ func (s *subscriber) dropAVPacket() {
 			vPkt, ok := pkt.Header.(av.VideoPacketHeader)
 			if ok && (vPkt.IsSeq() || vPkt.IsKeyFrame()) {
 				s.avPktQueue <- pkt
+			} else {
+				dropped++
 			}
 
 			if len(s.avPktQueue) > s.avPktQueueSize-10 {
-				s.logger.WithField("event", "dropAvPkt").Infof("drop audio pkt")
 				<-s.avPktQueue
+				dropped++
 			}
+		default:
+			dropped++
 		}
 	}
+	return dropped
 }
 
 func (s *subscriber) recordTimeStamp(msgTypeID RtmpMsgTypeID, timeStamp uint32) {
@@ -161,15 +350,4 @@ func (s *subscriber) recordTimeStamp(msgTypeID RtmpMsgTypeID, timeStamp uint32)
 	case MsgAudioMessage:
 		s.lastAudioTimeStamp = timeStamp
 	}
-
-	// calcBaseTimeStamp
-	if s.lastAudioTimeStamp > s.lastVideoTimeStamp {
-		s.baseTimeStamp = s.lastAudioTimeStamp
-	} else {
-		s.baseTimeStamp = s.lastVideoTimeStamp
-	}
-}
-
-func (s *subscriber) getBaseTimeStamp() uint32 {
-	return s.baseTimeStamp
 }
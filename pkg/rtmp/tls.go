@@ -0,0 +1,171 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultRtmpsPort = 443
+
+var errNoTLSConfig = errors.New("rtmp: no TLS config")
+
+// TLSConfig holds the certificates of rtmps, which is served by Server.ListenAndServeTLS.
+// Certificate files are loaded at tls handshakes and reloaded once modified, so renewals need
+// no restart.
+type TLSConfig struct {
+	CertFile string             // PEM certificate chain of server names not in Certs
+	KeyFile  string             // PEM private key of CertFile
+	Certs    map[string]TLSCert // certificates by server name(SNI), "*.example.com" matches subdomains
+}
+
+// TLSCert is a pair of PEM certificate chain and private key files
+type TLSCert struct {
+	CertFile string
+	KeyFile  string
+}
+
+// cert returns the certificate files of serverName
+func (tc *TLSConfig) cert(serverName string) TLSCert {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := tc.Certs[name]; ok {
+		return cert
+	}
+	if idx := strings.IndexByte(name, '.'); idx > 0 {
+		if cert, ok := tc.Certs["*"+name[idx:]]; ok {
+			return cert
+		}
+	}
+	return TLSCert{CertFile: tc.CertFile, KeyFile: tc.KeyFile}
+}
+
+// ListenAndServeTLS serves rtmps on addr with the certificates of Config.TLS,
+// it returns ErrServerClosed after Shutdown.
+func (srv *Server) ListenAndServeTLS(addr string) error {
+	if srv.Config().TLS == nil {
+		return errNoTLSConfig
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		srv.Config().Logger.WithField("event", "ListenAndServeTLS").Error(err)
+		return err
+	}
+
+	return srv.ServeTLS(l)
+}
+
+// ServeTLS is Serve of rtmps connections accepted on l
+func (srv *Server) ServeTLS(l net.Listener) error {
+	if srv.Config().TLS == nil {
+		l.Close()
+		return errNoTLSConfig
+	}
+
+	return srv.Serve(tls.NewListener(l, srv.tlsConfig()))
+}
+
+// ListenTLS is Listen of rtmps, the certificates are of config.TLS
+func ListenTLS(network, laddr string, config *Config) (net.Listener, error) {
+	if config.TLS == nil {
+		return nil, errNoTLSConfig
+	}
+
+	l, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ln := NewListener(l, config).(*listener)
+	ln.Listener = tls.NewListener(l, ln.srv.tlsConfig())
+	return ln, nil
+}
+
+// tlsConfig selects certificates by the server config at the time of every handshake, so
+// Server.SetConfig applies to new connections
+func (srv *Server) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			config := srv.Config()
+			if config.TLS == nil {
+				return nil, errNoTLSConfig
+			}
+			return srv.certs.get(config.TLS.cert(hello.ServerName), config.Logger)
+		},
+	}
+}
+
+// certCache keeps the certificates loaded, a certificate is reloaded once its files are
+// modified
+type certCache struct {
+	mu    sync.Mutex
+	certs map[TLSCert]*cachedCert
+}
+
+type cachedCert struct {
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertCache() *certCache {
+	return &certCache{certs: make(map[TLSCert]*cachedCert)}
+}
+
+// get returns the certificate of files, the one loaded before is still used if the reload
+// fails, e.g. the key file is not written yet while renewing
+func (cc *certCache) get(files TLSCert, logger *logrus.Logger) (*tls.Certificate, error) {
+	certMod, keyMod, err := modTimes(files)
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cached, ok := cc.certs[files]
+	if ok && (err != nil || certMod.Equal(cached.certMod) && keyMod.Equal(cached.keyMod)) {
+		return cached.cert, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		if ok {
+			logger.WithFields(logrus.Fields{"event": "reload certificate", "file": files.CertFile}).Warn(err)
+			return cached.cert, nil
+		}
+		return nil, errors.Wrap(err, "load certificate")
+	}
+	if ok {
+		logger.WithFields(logrus.Fields{"event": "reload certificate", "file": files.CertFile}).Info("success")
+	}
+
+	cc.certs[files] = &cachedCert{cert: &cert, certMod: certMod, keyMod: keyMod}
+	return &cert, nil
+}
+
+func modTimes(files TLSCert) (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(files.CertFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(files.KeyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// tlsServerName returns the SNI of rtmps connections, empty if none
+func (c *Conn) tlsServerName() string {
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		return tc.ConnectionState().ServerName
+	}
+	return ""
+}
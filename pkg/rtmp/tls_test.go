@@ -0,0 +1,238 @@
+package rtmp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate of names to dir, the pool trusts it
+func writeCert(t *testing.T, dir, name string, names ...string) (TLSCert, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := TLSCert{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	if err := ioutil.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return files, pool
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rtmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// startTLSServer serves rtmps on a random local port until the test ends
+func startTLSServer(t *testing.T, config *Config) (*Server, string) {
+	if config.Logger == nil {
+		config.Logger = testLogger()
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer("", config)
+	go srv.ServeTLS(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+	return srv, l.Addr().String()
+}
+
+func TestForwardTLS(t *testing.T) {
+	files, pool := writeCert(t, tempDir(t), "target", "localhost")
+	_, targetAddr := startTLSServer(t, &Config{TLS: &TLSConfig{CertFile: files.CertFile, KeyFile: files.KeyFile}})
+	origin, originAddr := startServer(t, &Config{
+		Forward:         &ForwardConfig{Rules: map[string][]string{"*": {"rtmps://" + targetAddr + "/{app}/{stream}"}}},
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	})
+
+	pub := dialPublish(t, "rtmp://"+originAddr+"/live/test", &Config{})
+	defer pub.Close()
+	waitFor(t, "forwarding", func() bool {
+		fs := origin.Forwarders()
+		return len(fs) == 1 && fs[0].State == ForwardForwarding
+	})
+}
+
+func TestTLSConfigCert(t *testing.T) {
+	tc := &TLSConfig{
+		CertFile: "default.crt",
+		KeyFile:  "default.key",
+		Certs: map[string]TLSCert{
+			"example.com":   {CertFile: "exact.crt"},
+			"*.example.com": {CertFile: "wildcard.crt"},
+		},
+	}
+	for name, want := range map[string]string{
+		"example.com":         "exact.crt",
+		"Example.COM.":        "exact.crt",
+		"live.example.com":    "wildcard.crt",
+		"a.live.example.com":  "default.crt", // a wildcard matches one label
+		"example.org":         "default.crt",
+		"":                    "default.crt",
+		"live.example.com.cn": "default.crt",
+	} {
+		if got := tc.cert(name).CertFile; got != want {
+			t.Errorf("%q: %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestCertCache(t *testing.T) {
+	dir := tempDir(t)
+	files, _ := writeCert(t, dir, "live", "localhost")
+	cc := newCertCache()
+	first, err := cc.get(files, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := cc.get(files, testLogger()); again != first {
+		t.Error("reloaded without modification")
+	}
+
+	// a renewal is loaded once the files are modified
+	writeCert(t, dir, "live", "localhost")
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{files.CertFile, files.KeyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	renewed, err := cc.get(files, testLogger())
+	if err != nil || renewed == first || string(renewed.Certificate[0]) == string(first.Certificate[0]) {
+		t.Fatalf("renewal not loaded: %v", err)
+	}
+
+	// the loaded one is kept while the key is not written yet
+	if err := ioutil.WriteFile(files.KeyFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(files.KeyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := cc.get(files, testLogger()); err != nil || cert != renewed {
+		t.Fatalf("broken renewal: %v", err)
+	}
+
+	if _, err := newCertCache().get(files, testLogger()); err == nil {
+		t.Error("broken certificate loaded")
+	}
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	dir := tempDir(t)
+	def, defPool := writeCert(t, dir, "default", "default.test")
+	local, localPool := writeCert(t, dir, "local", "localhost")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	srv := NewServer("", &Config{Logger: testLogger(), TLS: &TLSConfig{
+		CertFile: def.CertFile,
+		KeyFile:  def.KeyFile,
+		Certs:    map[string]TLSCert{"localhost": local},
+	}})
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServeTLS("127.0.0.1:" + port) }()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("ListenAndServeTLS: %v", err)
+		}
+	}()
+
+	// the certificate is chosen by SNI, the default one is of other names
+	localURL := "rtmps://localhost:" + port + "/live/test"
+	var pub *Conn
+	waitFor(t, "rtmps server", func() bool {
+		pub, err = Dial(localURL, &Config{Logger: testLogger(), TLSClientConfig: &tls.Config{RootCAs: localPool}})
+		return err == nil
+	})
+	defer pub.Close()
+	if err := pub.Publish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Dial(localURL, &Config{Logger: testLogger(), TLSClientConfig: &tls.Config{RootCAs: defPool}}); err == nil {
+		t.Error("localhost verified by the default certificate")
+	}
+	if c, err := Dial("rtmps://127.0.0.1:"+port+"/live/test", &Config{Logger: testLogger(), TLSClientConfig: &tls.Config{RootCAs: defPool, ServerName: "default.test"}}); err != nil {
+		t.Errorf("default certificate: %v", err)
+	} else {
+		c.Close()
+	}
+
+	player := dialPlay(t, localURL, &Config{TLSClientConfig: &tls.Config{RootCAs: localPool}})
+	defer player.Close()
+
+	pkts := testPackets(t)
+	val, _ := srv.ssMgr.streamMap.Load(genStreamKey("localhost", "live", "test")) // the vhost is the host of the url
+	waitFor(t, "player", func() bool { return val.(*streamSource).numSubscribers() == 1 })
+	for _, pkt := range pkts {
+		if err := pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readPackets(t, player, len(pkts)-1); got[2].TimeStamp != 40 {
+		t.Fatalf("packets over rtmps: %+v", got)
+	}
+}
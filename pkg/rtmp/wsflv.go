@@ -0,0 +1,155 @@
+package rtmp
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"playground/internal/websocket"
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+const (
+	wsPingInterval = 10 * time.Second
+	wsPongWait     = 3 * wsPingInterval // the player is gone if nothing is read for this long
+	wsWriteTimeout = 10 * time.Second
+)
+
+// serveWSFLV plays a stream as WebSocket-FLV, the flv header and every tag are sent as
+// binary messages in the same order as HTTP-FLV.
+func (srv *Server) serveWSFLV(w http.ResponseWriter, r *http.Request, config *Config) {
+	app, stream, ok := parseStreamPath(r.URL.Path, ".flv")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	vhost := httpVhost(r)
+
+	logger := config.Logger.WithFields(logrus.Fields{"event": "ws-flv", "remote": r.RemoteAddr, "streamKey": genStreamKey(vhost, app, stream)})
+
+	c := srv.newHTTPPlayer(r, config, vhost, app, stream)
+	if _, err := c.authorizePlay(); err != nil { // refused before upgrade
+		logger.Warn(err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	ss, err := srv.lookupStream(config, vhost, app, stream)
+	if err != nil {
+		logger.Error(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	ws, err := websocket.Upgrade(w, r)
+	if err != nil {
+		logger.WithField("action", "upgrade").Error(err)
+		return
+	}
+	defer ws.Close()
+
+	sink := &wsFLVSink{ws: ws, ssMgr: srv.ssMgr}
+	sink.fw = flv.NewWriter(&sink.buf)
+	if err := sink.writeHeader(ss.tracks()); err != nil {
+		logger.Error(err)
+		return
+	}
+
+	sub := newSinkSubscriber("ws-flv:"+r.RemoteAddr, sink, config.Logger, config.subscriberQueueSize())
+	if !ss.addSubscriber(sub) {
+		logger.Error("stream closed or already subscribe")
+		_ = ws.WriteClose(websocket.CloseGoingAway, "stream closed")
+		return
+	}
+	defer c.notifyHook(hookOnStop)
+	defer ss.delSubscriber(sub)
+
+	done := make(chan struct{})
+	defer close(done)
+	go sink.readLoop(sub, logger)
+	go sink.pingLoop(sub, done)
+
+	logger.Trace("start")
+	err = ss.doPlaying(sub)
+	logger.Tracef("stop: %v", err)
+}
+
+// wsFLVSink sends the packets of a subscriber as flv tags in websocket binary messages
+type wsFLVSink struct {
+	ws    *websocket.Conn
+	ssMgr *streamSourceMgr
+	fw    *flv.Writer  // writes to buf
+	buf   bytes.Buffer // one message
+}
+
+func (s *wsFLVSink) writeHeader(audio, video bool) error {
+	s.buf.Reset()
+	if err := s.fw.WriteHeader(audio, video); err != nil {
+		return err
+	}
+	return s.writeMessage()
+}
+
+func (s *wsFLVSink) sendAVPacket(pkt *av.Packet) error {
+	s.buf.Reset()
+	if err := s.fw.WritePacket(pkt); err != nil {
+		return err
+	}
+	return s.writeMessage()
+}
+
+func (s *wsFLVSink) writeMessage() error {
+	if err := s.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+	return s.ws.WriteMessage(websocket.BinaryMessage, s.buf.Bytes())
+}
+
+// sendStopStatus closes the websocket, going away for server shutdown and normal closure
+// for the stream's end
+func (s *wsFLVSink) sendStopStatus() {
+	code, text := websocket.CloseNormalClosure, "stream unpublished"
+	if s.ssMgr.isClosing() {
+		code, text = websocket.CloseGoingAway, "server shutdown"
+	}
+
+	_ = s.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_ = s.ws.WriteClose(code, text)
+}
+
+// readLoop handles the messages of the player, the subscriber leaves once it's gone
+func (s *wsFLVSink) readLoop(sub *subscriber, logger *logrus.Entry) {
+	defer sub.leave()
+
+	for {
+		if err := s.ws.SetReadDeadline(time.Now().Add(wsPongWait)); err != nil {
+			return
+		}
+		if _, _, err := s.ws.ReadMessage(); err != nil {
+			logger.WithField("action", "read").Trace(err)
+			return
+		}
+	}
+}
+
+// pingLoop keeps the websocket alive, a pong or any message of the player extends its read deadline
+func (s *wsFLVSink) pingLoop(sub *subscriber, done chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			_ = s.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := s.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				sub.leave()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"playground/internal/websocket"
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+// wsClient reads the binary messages of a websocket as one byte stream
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+	msg  []byte // left of the current message
+}
+
+// dialWS upgrades GET path to websocket, the response is returned if it's not upgraded
+func dialWS(t *testing.T, addr, path string) (*wsClient, *http.Response) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(c, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, addr, key)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, resp
+	}
+
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != base64.StdEncoding.EncodeToString(h[:]) {
+		t.Fatalf("accept key %q", got)
+	}
+	return &wsClient{conn: c, br: br}, resp
+}
+
+// Read reads the payloads of binary messages, other messages are skipped
+func (wc *wsClient) Read(b []byte) (int, error) {
+	for len(wc.msg) == 0 {
+		var h [2]byte
+		if _, err := io.ReadFull(wc.br, h[:]); err != nil {
+			return 0, err
+		}
+		n := uint64(h[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(wc.br, ext[:]); err != nil {
+				return 0, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(wc.br, ext[:]); err != nil {
+				return 0, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(wc.br, payload); err != nil {
+			return 0, err
+		}
+		switch int(h[0] & 0x0f) {
+		case websocket.BinaryMessage:
+			wc.msg = payload
+		case websocket.CloseMessage:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, wc.msg)
+	wc.msg = wc.msg[n:]
+	return n, nil
+}
+
+func TestWSFLV(t *testing.T) {
+	srv, addr := startServer(t, &Config{Auth: &AuthConfig{Secrets: map[string]string{defaultVhost + "/secure": "s3cret"}}})
+	httpAddr := startHTTPServer(t, srv)
+	pub := dialPublish(t, "rtmp://"+addr+"/live/test", &Config{})
+	defer pub.Close()
+
+	// refused with 403 before upgrade
+	if _, resp := dialWS(t, httpAddr, "/secure/test.flv"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unauthorized upgrade: %s", resp.Status)
+	}
+	if _, resp := dialWS(t, httpAddr, "/live/none.flv"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("upgrade of no stream: %s", resp.Status)
+	}
+
+	wc, resp := dialWS(t, httpAddr, "/live/test.flv")
+	if wc == nil {
+		t.Fatalf("upgrade: %s", resp.Status)
+	}
+	r := flv.NewReader(wc)
+	if _, _, err := r.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	val, _ := srv.ssMgr.streamMap.Load(genStreamKey(defaultVhost, "live", "test"))
+	waitFor(t, "ws-flv player", func() bool { return val.(*streamSource).numSubscribers() == 1 })
+	pkts := testPackets(t)
+	for _, pkt := range pkts {
+		if err := pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []*av.Packet
+	for len(got) < len(pkts) {
+		pkt, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, pkt)
+	}
+	if !got[0].IsMetaData || !got[1].Header.(av.VideoPacketHeader).IsSeq() || got[3].TimeStamp != 40 {
+		t.Fatalf("first frames %+v", got)
+	}
+
+	// the subscriber leaves with the player
+	wc.conn.Close()
+	waitFor(t, "ws-flv player left", func() bool { return val.(*streamSource).numSubscribers() == 0 })
+}
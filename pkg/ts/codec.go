@@ -0,0 +1,6 @@
+package ts
+
+import "playground/pkg/av/h264"
+
+// access unit delimiter of any slice type, muxed before every frame
+var audNALU = []byte{h264.NALUAUD, 0xf0}
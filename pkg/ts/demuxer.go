@@ -0,0 +1,307 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"playground/pkg/av"
+	"playground/pkg/av/aac"
+	"playground/pkg/av/h264"
+	"playground/pkg/flv"
+)
+
+// pesStream collects the pes packet of one elementary stream
+type pesStream struct {
+	streamType uint8
+	buf        []byte
+}
+
+// Demuxer reads H.264 and AAC of MPEG-TS back to flv framed av packets, a sequence header
+// packet is generated before the first frame and whenever SPS/PPS or AAC config changes.
+type Demuxer struct {
+	r   io.Reader
+	buf [PacketSize]byte
+
+	pmtPID  uint16
+	streams map[uint16]*pesStream
+
+	avc *h264.AVCConfig // last config sent as sequence header
+	aac *aac.Config
+
+	pending    []*av.Packet
+	hdrDemuxer *flv.Demuxer
+	eof        bool
+}
+
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r:          r,
+		streams:    make(map[uint16]*pesStream),
+		hdrDemuxer: flv.NewDemuxer(),
+	}
+}
+
+// ReadPacket returns the next packet, io.EOF at the end of input
+func (d *Demuxer) ReadPacket() (*av.Packet, error) {
+	for len(d.pending) == 0 {
+		if d.eof {
+			return nil, io.EOF
+		}
+
+		if _, err := io.ReadFull(d.r, d.buf[:]); err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			// the last pes of every stream ends with input
+			d.eof = true
+			for _, s := range d.streams {
+				if err := d.flushPES(s); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if err := d.readTSPacket(d.buf[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	pkt := d.pending[0]
+	d.pending = d.pending[1:]
+	return pkt, nil
+}
+
+func (d *Demuxer) readTSPacket(b []byte) error {
+	if b[0] != syncByte {
+		return ErrSync
+	}
+
+	unitStart := b[1]&0x40 != 0
+	pid := uint16(b[1]&0x1f)<<8 | uint16(b[2])
+	afc := b[3] >> 4 & 0x03
+
+	payload := b[4:]
+	if afc&0x02 != 0 {
+		n := int(payload[0])
+		if n > len(payload)-1 {
+			return fmt.Errorf("ts: invalid adaptation field length %d", n)
+		}
+		payload = payload[1+n:]
+	}
+	if afc&0x01 == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == pidPAT:
+		return d.readPAT(payload, unitStart)
+	case pid == d.pmtPID && d.pmtPID != 0:
+		return d.readPMT(payload, unitStart)
+	}
+
+	s, ok := d.streams[pid]
+	if !ok {
+		return nil
+	}
+	if unitStart {
+		if err := d.flushPES(s); err != nil {
+			return err
+		}
+	} else if len(s.buf) == 0 {
+		return nil // lost the start
+	}
+	s.buf = append(s.buf, payload...)
+
+	// bounded pes is complete once its length is received
+	if len(s.buf) >= 6 {
+		if size := int(binary.BigEndian.Uint16(s.buf[4:])); size > 0 && len(s.buf) >= 6+size {
+			s.buf = s.buf[:6+size]
+			return d.flushPES(s)
+		}
+	}
+	return nil
+}
+
+// psiSection returns the section after pointer field without crc
+func psiSection(payload []byte, unitStart bool, tableID byte) ([]byte, error) {
+	if !unitStart || len(payload) < 1 {
+		return nil, nil // sections in one packet only
+	}
+	p := int(payload[0])
+	if 1+p+3 > len(payload) {
+		return nil, fmt.Errorf("ts: invalid pointer field %d", p)
+	}
+	section := payload[1+p:]
+	if section[0] != tableID {
+		return nil, nil
+	}
+
+	n := int(binary.BigEndian.Uint16(section[1:]) & 0x0fff)
+	if 3+n > len(section) || n < 9 {
+		return nil, fmt.Errorf("ts: invalid section length %d", n)
+	}
+	section = section[:3+n]
+	if crc32(section) != 0 { // crc over the whole section including crc is zero
+		return nil, fmt.Errorf("ts: crc error of table 0x%02x", tableID)
+	}
+	return section[:len(section)-4], nil
+}
+
+func (d *Demuxer) readPAT(payload []byte, unitStart bool) error {
+	section, err := psiSection(payload, unitStart, tableIDPAT)
+	if err != nil || section == nil {
+		return err
+	}
+
+	for b := section[8:]; len(b) >= 4; b = b[4:] {
+		if program := binary.BigEndian.Uint16(b); program != 0 { // 0 is network pid
+			d.pmtPID = binary.BigEndian.Uint16(b[2:]) & 0x1fff
+			break
+		}
+	}
+	return nil
+}
+
+func (d *Demuxer) readPMT(payload []byte, unitStart bool) error {
+	section, err := psiSection(payload, unitStart, tableIDPMT)
+	if err != nil || section == nil {
+		return err
+	}
+
+	infoLen := int(binary.BigEndian.Uint16(section[10:]) & 0x0fff)
+	if 12+infoLen > len(section) {
+		return fmt.Errorf("ts: invalid program info length %d", infoLen)
+	}
+	for b := section[12+infoLen:]; len(b) >= 5; {
+		streamType := b[0]
+		pid := binary.BigEndian.Uint16(b[1:]) & 0x1fff
+		esInfoLen := int(binary.BigEndian.Uint16(b[3:]) & 0x0fff)
+
+		if streamType == StreamTypeH264 || streamType == StreamTypeAAC {
+			if _, ok := d.streams[pid]; !ok {
+				d.streams[pid] = &pesStream{streamType: streamType}
+			}
+		}
+
+		if 5+esInfoLen > len(b) {
+			break
+		}
+		b = b[5+esInfoLen:]
+	}
+	return nil
+}
+
+// flushPES parses the collected pes packet of s into av packets
+func (d *Demuxer) flushPES(s *pesStream) error {
+	b := s.buf
+	s.buf = nil
+	if len(b) == 0 {
+		return nil
+	}
+
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return fmt.Errorf("ts: invalid pes start code")
+	}
+	flags, hdrLen := b[7], int(b[8])
+	if 9+hdrLen > len(b) {
+		return fmt.Errorf("ts: invalid pes header length %d", hdrLen)
+	}
+
+	var pts, dts uint64
+	if flags&0x80 != 0 {
+		pts = readTimestamp(b[9:])
+		dts = pts
+	}
+	if flags&0x40 != 0 {
+		dts = readTimestamp(b[14:])
+	}
+	frame := b[9+hdrLen:]
+
+	switch s.streamType {
+	case StreamTypeH264:
+		return d.readH264(frame, pts, dts)
+	case StreamTypeAAC:
+		return d.readAAC(frame, pts)
+	}
+	return nil
+}
+
+func (d *Demuxer) readH264(frame []byte, pts, dts uint64) error {
+	var sps, pps [][]byte
+	var nalus [][]byte
+	keyFrame := false
+
+	for _, nalu := range h264.SplitAnnexB(frame) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu) {
+		case h264.NALUAUD:
+		case h264.NALUSPS:
+			sps = append(sps, nalu)
+		case h264.NALUPPS:
+			pps = append(pps, nalu)
+		default:
+			if h264.NALUType(nalu) == h264.NALUIDR {
+				keyFrame = true
+			}
+			nalus = append(nalus, nalu)
+		}
+	}
+
+	timeStamp := uint32(dts / timeScale)
+	if len(sps) > 0 && len(pps) > 0 {
+		cfg := &h264.AVCConfig{LengthSize: 4, SPS: sps, PPS: pps}
+		if d.avc == nil || !bytes.Equal(d.avc.Marshal(), cfg.Marshal()) {
+			d.avc = cfg
+			data := append([]byte{av.KEY_FRAME<<4 | av.VIDEO_H264, av.AVC_SEQHDR, 0, 0, 0}, cfg.Marshal()...)
+			d.emit(&av.Packet{IsVideo: true, TimeStamp: timeStamp, Data: data})
+		}
+	}
+	if d.avc == nil || len(nalus) == 0 {
+		return nil
+	}
+
+	frameType := byte(av.INTER_FRAME)
+	if keyFrame {
+		frameType = av.KEY_FRAME
+	}
+	cts := (int64(pts) - int64(dts)) / timeScale
+	data := h264.AppendAVCC([]byte{frameType<<4 | av.VIDEO_H264, av.AVC_NALU, byte(cts >> 16), byte(cts >> 8), byte(cts)}, nalus...)
+	d.emit(&av.Packet{IsVideo: true, TimeStamp: timeStamp, Data: data})
+	return nil
+}
+
+// flv audio tag header of aac, always 44kHz 16bit stereo
+const aacTagHeader = av.SOUND_AAC<<4 | av.SOUND_44Khz<<2 | av.SOUND_16BIT<<1 | av.SOUND_STEREO
+
+func (d *Demuxer) readAAC(frame []byte, pts uint64) error {
+	for len(frame) > 0 {
+		cfg, hdrSize, frameLen, err := aac.ParseADTS(frame)
+		if err != nil {
+			return err
+		}
+
+		timeStamp := uint32(pts / timeScale)
+		if d.aac == nil || *d.aac != *cfg {
+			d.aac = cfg
+			data := append([]byte{aacTagHeader, av.AAC_SEQHDR}, cfg.Marshal()...)
+			d.emit(&av.Packet{IsAudio: true, TimeStamp: timeStamp, Data: data})
+		}
+
+		data := append([]byte{aacTagHeader, av.AAC_RAW}, frame[hdrSize:frameLen]...)
+		d.emit(&av.Packet{IsAudio: true, TimeStamp: timeStamp, Data: data})
+
+		frame = frame[frameLen:]
+		pts += uint64(aac.SamplesPerFrame * 1000 * timeScale / cfg.SampleRate)
+	}
+	return nil
+}
+
+func (d *Demuxer) emit(pkt *av.Packet) {
+	_ = d.hdrDemuxer.DemuxHdr(pkt)
+	d.pending = append(d.pending, pkt)
+}
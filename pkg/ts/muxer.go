@@ -0,0 +1,320 @@
+package ts
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"playground/pkg/av"
+	"playground/pkg/av/aac"
+	"playground/pkg/av/h264"
+)
+
+// Muxer writes flv framed H.264 and AAC packets as MPEG-TS. AVCC nalus are converted to
+// Annex-B with SPS/PPS inserted before IDR frames, raw AAC frames get ADTS headers.
+// PAT/PMT are written before the first frame, every key frame and after SetWriter.
+// Packets of other codecs, and frames before their sequence header, are skipped.
+type Muxer struct {
+	w   io.Writer
+	buf [PacketSize]byte
+
+	avc *h264.AVCConfig
+	aac *aac.Config
+
+	cc           map[uint16]uint8 // continuity counter of every pid
+	pmtVersion   uint8
+	tablesNeeded bool
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		w:            w,
+		cc:           make(map[uint16]uint8),
+		tablesNeeded: true,
+	}
+}
+
+// SetWriter switches output to w, e.g. for a new segment, which starts with PAT/PMT.
+// Codec configs and continuity counters are kept.
+func (m *Muxer) SetWriter(w io.Writer) {
+	m.w = w
+	m.tablesNeeded = true
+}
+
+// WritePacket writes one audio or video packet, metadata is ignored
+func (m *Muxer) WritePacket(pkt *av.Packet) error {
+	switch {
+	case pkt.IsVideo:
+		return m.writeVideo(pkt)
+	case pkt.IsAudio:
+		return m.writeAudio(pkt)
+	}
+	return nil
+}
+
+func (m *Muxer) writeVideo(pkt *av.Packet) error {
+	vh, ok := pkt.Header.(av.VideoPacketHeader)
+	if !ok {
+		return errors.New("ts: video packet without header")
+	}
+	if vh.CodecID() != av.VIDEO_H264 || len(pkt.Data) < 5 {
+		return nil
+	}
+
+	if vh.IsSeq() {
+		cfg, err := h264.ParseAVCConfig(pkt.Data[5:])
+		if err != nil {
+			return err
+		}
+		if m.avc == nil {
+			m.tablesNeeded = true // new stream in pmt
+			m.pmtVersion++
+		}
+		m.avc = cfg
+		return nil
+	}
+	if m.avc == nil || pkt.Data[1] != av.AVC_NALU {
+		return nil
+	}
+
+	nalus, err := h264.SplitAVCC(pkt.Data[5:], m.avc.LengthSize)
+	if err != nil {
+		return err
+	}
+
+	// aud, then sps/pps before the first idr if the frame has none
+	frame := make([]byte, 0, len(pkt.Data)+64)
+	frame = h264.AppendAnnexB(frame, audNALU)
+	hasSPS := false
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch h264.NALUType(nalu) {
+		case h264.NALUAUD:
+			continue
+		case h264.NALUSPS:
+			hasSPS = true
+		case h264.NALUIDR:
+			if !hasSPS {
+				frame = h264.AppendAnnexB(frame, m.avc.SPS...)
+				frame = h264.AppendAnnexB(frame, m.avc.PPS...)
+				hasSPS = true
+			}
+		}
+		frame = h264.AppendAnnexB(frame, nalu)
+	}
+
+	keyFrame := vh.IsKeyFrame()
+	if keyFrame || m.tablesNeeded {
+		if err := m.writeTables(); err != nil {
+			return err
+		}
+	}
+
+	dts := uint64(pkt.TimeStamp) * timeScale
+	pts := uint64(int64(dts) + int64(vh.CompositionTime())*timeScale)
+	return m.writePES(pidVideo, streamIDVideo, pts, dts, true, keyFrame, frame)
+}
+
+func (m *Muxer) writeAudio(pkt *av.Packet) error {
+	ah, ok := pkt.Header.(av.AudioPacketHeader)
+	if !ok {
+		return errors.New("ts: audio packet without header")
+	}
+	if ah.SoundFormat() != av.SOUND_AAC || len(pkt.Data) < 2 {
+		return nil
+	}
+
+	if ah.AACPacketType() == av.AAC_SEQHDR {
+		cfg, err := aac.ParseConfig(pkt.Data[2:])
+		if err != nil {
+			return err
+		}
+		if m.aac == nil {
+			m.tablesNeeded = true
+			m.pmtVersion++
+		}
+		m.aac = cfg
+		return nil
+	}
+	if m.aac == nil {
+		return nil
+	}
+
+	raw := pkt.Data[2:]
+	frame, err := m.aac.AppendADTSHeader(make([]byte, 0, aac.ADTSHeaderSize+len(raw)), len(raw))
+	if err != nil {
+		return err
+	}
+	frame = append(frame, raw...)
+
+	if m.tablesNeeded {
+		if err := m.writeTables(); err != nil {
+			return err
+		}
+	}
+
+	pts := uint64(pkt.TimeStamp) * timeScale
+	return m.writePES(pidAudio, streamIDAudio, pts, pts, false, m.avc == nil, frame)
+}
+
+// pcrPID carries pcr, video if there is
+func (m *Muxer) pcrPID() uint16 {
+	if m.avc != nil {
+		return pidVideo
+	}
+	return pidAudio
+}
+
+func (m *Muxer) writeTables() error {
+	// PAT: one program
+	pat := []byte{
+		tableIDPAT, 0, 0, // section length filled later
+		0, 1, // transport stream id
+		0xc1, 0, 0, // version 0, current, section 0 of 0
+		0, programNumber, 0xe0 | pidPMT>>8, pidPMT & 0xff,
+	}
+	if err := m.writeSection(pidPAT, pat); err != nil {
+		return err
+	}
+
+	// PMT: the streams with config
+	pcr := m.pcrPID()
+	pmt := []byte{
+		tableIDPMT, 0, 0,
+		0, programNumber,
+		0xc1 | (m.pmtVersion&0x1f)<<1, 0, 0,
+		0xe0 | byte(pcr>>8), byte(pcr),
+		0xf0, 0, // no program info
+	}
+	if m.avc != nil {
+		pmt = append(pmt, StreamTypeH264, 0xe0|pidVideo>>8, pidVideo&0xff, 0xf0, 0)
+	}
+	if m.aac != nil {
+		pmt = append(pmt, StreamTypeAAC, 0xe0|pidAudio>>8, pidAudio&0xff, 0xf0, 0)
+	}
+	if err := m.writeSection(pidPMT, pmt); err != nil {
+		return err
+	}
+
+	m.tablesNeeded = false
+	return nil
+}
+
+// writeSection fills section length and crc of a psi section, then writes it in one packet
+func (m *Muxer) writeSection(pid uint16, section []byte) error {
+	n := len(section) - 3 + 4 // after length field, crc included
+	section[1] = 0xb0 | byte(n>>8)
+	section[2] = byte(n)
+	section = append(section, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(section[len(section)-4:], crc32(section[:len(section)-4]))
+
+	b := m.buf[:]
+	b[0] = syncByte
+	b[1] = 0x40 | byte(pid>>8) // payload unit start
+	b[2] = byte(pid)
+	b[3] = 0x10 | m.nextCC(pid)
+	b[4] = 0 // pointer field
+	n = copy(b[5:], section)
+	for i := 5 + n; i < PacketSize; i++ {
+		b[i] = 0xff
+	}
+
+	_, err := m.w.Write(b)
+	return err
+}
+
+func (m *Muxer) nextCC(pid uint16) byte {
+	cc := m.cc[pid]
+	m.cc[pid] = (cc + 1) & 0x0f
+	return cc
+}
+
+// writePES writes one frame as a pes packet split into ts packets, the first one carries pcr
+// on the pcr pid and random access indicator on key frames.
+func (m *Muxer) writePES(pid uint16, streamID byte, pts, dts uint64, hasDTS, randomAccess bool, frame []byte) error {
+	pts &= 1<<33 - 1
+	dts &= 1<<33 - 1
+
+	hdr := make([]byte, 9, 19)
+	hdr[0], hdr[1], hdr[2], hdr[3] = 0, 0, 1, streamID
+	hdr[6] = 0x80 // marker bits
+	if hasDTS && pts != dts {
+		hdr[7], hdr[8] = 0xc0, 10
+		hdr = hdr[:19]
+		putTimestamp(hdr[9:], 3, pts)
+		putTimestamp(hdr[14:], 1, dts)
+	} else {
+		hdr[7], hdr[8] = 0x80, 5
+		hdr = hdr[:14]
+		putTimestamp(hdr[9:], 2, pts)
+	}
+	if size := len(hdr) - 6 + len(frame); size <= 0xffff {
+		binary.BigEndian.PutUint16(hdr[4:], uint16(size))
+	} // else 0, unbounded video pes
+
+	payload := append(hdr, frame...)
+	first := true
+	for len(payload) > 0 {
+		b := m.buf[:]
+		b[0] = syncByte
+		b[1] = byte(pid >> 8)
+		if first {
+			b[1] |= 0x40
+		}
+		b[2] = byte(pid)
+
+		// adaptation field body after its length byte
+		var af []byte
+		if first && (randomAccess || pid == m.pcrPID()) {
+			af = make([]byte, 1, 7)
+			if randomAccess {
+				af[0] |= 0x40
+			}
+			if pid == m.pcrPID() {
+				af[0] |= 0x10
+				af = af[:7]
+				putPCR(af[1:], dts)
+			}
+		}
+
+		space := PacketSize - 4
+		if af != nil {
+			space -= 1 + len(af)
+		}
+		if len(payload) < space { // stuffing in adaptation field
+			stuff := space - len(payload)
+			if af == nil {
+				stuff-- // the length byte
+				if stuff > 0 {
+					af = []byte{0}
+					stuff--
+				} else {
+					af = []byte{}
+				}
+			}
+			for i := 0; i < stuff; i++ {
+				af = append(af, 0xff)
+			}
+		}
+
+		i := 4
+		if af != nil {
+			b[3] = 0x30 | m.nextCC(pid)
+			b[4] = byte(len(af))
+			i += 1 + copy(b[5:], af)
+		} else {
+			b[3] = 0x10 | m.nextCC(pid)
+		}
+		n := copy(b[i:], payload)
+		payload = payload[n:]
+
+		if _, err := m.w.Write(b); err != nil {
+			return err
+		}
+		first = false
+	}
+
+	return nil
+}
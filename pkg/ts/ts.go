@@ -0,0 +1,76 @@
+// Package ts muxes flv framed H.264/AAC av packets into MPEG-TS and demuxes them back.
+package ts
+
+import "errors"
+
+const (
+	PacketSize = 188
+	syncByte   = 0x47
+
+	pidPAT   = 0x0000
+	pidPMT   = 0x1000
+	pidVideo = 0x0100
+	pidAudio = 0x0101
+
+	StreamTypeH264 = 0x1b
+	StreamTypeAAC  = 0x0f // ADTS
+
+	streamIDVideo = 0xe0
+	streamIDAudio = 0xc0
+
+	tableIDPAT    = 0x00
+	tableIDPMT    = 0x02
+	programNumber = 1
+
+	timeScale = 90 // 90kHz clock ticks per millisecond
+)
+
+var ErrSync = errors.New("ts: sync byte not found")
+
+var crcTable = func() (t [256]uint32) {
+	for i := range t {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+	return
+}()
+
+// crc32 of MPEG-2 psi sections
+func crc32(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// putTimestamp writes a 33 bits PTS/DTS of PES header, prefix is 2 for PTS only,
+// 3 for PTS followed by DTS and 1 for DTS
+func putTimestamp(b []byte, prefix byte, ts uint64) {
+	b[0] = prefix<<4 | byte(ts>>29)&0x0e | 1
+	b[1] = byte(ts >> 22)
+	b[2] = byte(ts>>14)&0xfe | 1
+	b[3] = byte(ts >> 7)
+	b[4] = byte(ts<<1) | 1
+}
+
+func readTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// putPCR writes a PCR with 90kHz base and zero extension
+func putPCR(b []byte, base uint64) {
+	b[0] = byte(base >> 25)
+	b[1] = byte(base >> 17)
+	b[2] = byte(base >> 9)
+	b[3] = byte(base >> 1)
+	b[4] = byte(base<<7) | 0x7e
+	b[5] = 0
+}
@@ -0,0 +1,160 @@
+package ts
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"playground/pkg/av"
+	"playground/pkg/av/h264"
+	"playground/pkg/flv"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10}
+	testPPS = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+func avcPacket(ts uint32, frameType, pktType byte, cts int32, body []byte) *av.Packet {
+	data := []byte{frameType<<4 | av.VIDEO_H264, pktType, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	return &av.Packet{IsVideo: true, TimeStamp: ts, Data: append(data, body...)}
+}
+
+func aacPacket(ts uint32, pktType byte, body []byte) *av.Packet {
+	return &av.Packet{IsAudio: true, TimeStamp: ts, Data: append([]byte{aacTagHeader, pktType}, body...)}
+}
+
+func nalu(typ byte, size int) []byte {
+	b := bytes.Repeat([]byte{0xab}, size)
+	b[0] = 0x60 | typ
+	return b
+}
+
+func testPackets() []*av.Packet {
+	cfg := &h264.AVCConfig{SPS: [][]byte{testSPS}, PPS: [][]byte{testPPS}}
+	pkts := []*av.Packet{
+		avcPacket(0, av.KEY_FRAME, av.AVC_SEQHDR, 0, cfg.Marshal()),
+		// AAC LC, 44.1kHz, stereo. demuxed sequence headers take the time of the next frame
+		aacPacket(3, av.AAC_SEQHDR, []byte{0x12, 0x10}),
+	}
+
+	for i := uint32(0); i < 30; i++ {
+		ts := i * 40
+		switch {
+		case i%10 == 0: // big idr over 64KB, an unbounded pes
+			pkts = append(pkts, avcPacket(ts, av.KEY_FRAME, av.AVC_NALU, 80, h264.AppendAVCC(nil, nalu(6, 20), nalu(h264.NALUIDR, 70000))))
+		default: // b frames reordered
+			pkts = append(pkts, avcPacket(ts, av.INTER_FRAME, av.AVC_NALU, int32(i%3)*40, h264.AppendAVCC(nil, nalu(1, 500+int(i)))))
+		}
+		pkts = append(pkts, aacPacket(ts+3, av.AAC_RAW, bytes.Repeat([]byte{byte(i)}, 300)))
+	}
+
+	dm := flv.NewDemuxer()
+	for _, pkt := range pkts {
+		_ = dm.DemuxHdr(pkt)
+	}
+	return pkts
+}
+
+func TestMuxDemux(t *testing.T) {
+	pkts := testPackets()
+
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	for _, pkt := range pkts {
+		if err := m.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len()%PacketSize != 0 {
+		t.Fatalf("output size %d is not multiple of %d", buf.Len(), PacketSize)
+	}
+
+	var video, audio []*av.Packet
+	d := NewDemuxer(&buf)
+	for {
+		pkt, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.IsVideo {
+			video = append(video, pkt)
+		} else {
+			audio = append(audio, pkt)
+		}
+	}
+
+	var wantVideo, wantAudio []*av.Packet
+	for _, pkt := range pkts {
+		if pkt.IsVideo {
+			wantVideo = append(wantVideo, pkt)
+		} else {
+			wantAudio = append(wantAudio, pkt)
+		}
+	}
+
+	comparePackets(t, "video", video, wantVideo)
+	comparePackets(t, "audio", audio, wantAudio)
+}
+
+func comparePackets(t *testing.T, track string, got, want []*av.Packet) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d packets, want %d", track, len(got), len(want))
+	}
+	for i := range want {
+		if got[i].TimeStamp != want[i].TimeStamp {
+			t.Errorf("%s %d: timestamp %d, want %d", track, i, got[i].TimeStamp, want[i].TimeStamp)
+		}
+		if !bytes.Equal(got[i].Data, want[i].Data) {
+			t.Errorf("%s %d: data differs, got % x..., want % x...", track, i, head(got[i].Data), head(want[i].Data))
+		}
+	}
+}
+
+func head(b []byte) []byte {
+	if len(b) > 16 {
+		return b[:16]
+	}
+	return b
+}
+
+func TestMuxerTables(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	for _, pkt := range testPackets()[:3] { // sequence headers and the first idr
+		if err := m.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := buf.Bytes()
+	if pid := uint16(b[1]&0x1f)<<8 | uint16(b[2]); pid != pidPAT {
+		t.Fatalf("first packet pid 0x%x, want PAT", pid)
+	}
+	pmt := b[PacketSize:]
+	if pid := uint16(pmt[1]&0x1f)<<8 | uint16(pmt[2]); pid != pidPMT {
+		t.Fatalf("second packet pid 0x%x, want PMT", pid)
+	}
+
+	section, err := psiSection(pmt[4:], true, tableIDPMT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pcr := uint16(section[8]&0x1f)<<8 | uint16(section[9]); pcr != pidVideo {
+		t.Errorf("pcr pid 0x%x, want video", pcr)
+	}
+
+	// the idr starts with pcr and random access indicator, continuity counter 0
+	pes := b[2*PacketSize:]
+	if pes[3]&0x0f != 0 || pes[3]&0x20 == 0 || pes[5]&0x50 != 0x50 {
+		t.Errorf("bad idr ts header % x", pes[:6])
+	}
+	if next := b[3*PacketSize:]; next[3]&0x0f != 1 {
+		t.Errorf("continuity counter %d, want 1", next[3]&0x0f)
+	}
+}